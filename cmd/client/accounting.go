@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/accounting"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var accountingLog = logging.For("accounting")
+
+// The traffic counters of the device are sampled this often
+const accountingInterval = time.Minute
+
+// quotas account the traffic with the peers. If remove is set, peers over
+// their quota are removed and left out of the peer lists until the period
+// ends; the server never is.
+type quotas struct {
+	*accounting.Accounting
+	wgState *wg.State
+	server  wgtypes.Key
+	remove  bool
+}
+
+// filter leaves out the peers over their quota, if they are removed
+func (q *quotas) filter(peers []wg.Peer) []wg.Peer {
+	if q == nil || !q.remove {
+		return peers
+	}
+	kept := peers[:0]
+	for _, p := range peers {
+		if p.PublicKey != q.server && q.Exceeded(p.PublicKey) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// run samples the counters, removing the peers that exceed their quota if so
+// configured. Those whose quota is lifted are added back by the next refresh.
+func (q *quotas) run() {
+	ticker := time.NewTicker(accountingInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		stats, err := q.wgState.GetPeerStats()
+		if err != nil {
+			accountingLog.WithError(err).Error("Could not read traffic counters")
+			continue
+		}
+		exceeded, lifted, err := q.Sample(stats, now)
+		if err != nil {
+			accountingLog.WithError(err).Warn("Could not save traffic usage")
+		}
+		var remove []wgtypes.Key
+		for _, k := range exceeded {
+			accountingLog.WithField("peer", k.String()).Warn("Peer exceeded its traffic quota")
+			if q.remove && k != q.server {
+				remove = append(remove, k)
+			}
+		}
+		if err := q.wgState.RemovePeers(remove); err != nil {
+			accountingLog.WithError(err).Error("Could not remove peers over their traffic quota")
+		}
+		for _, k := range lifted {
+			accountingLog.WithField("peer", k.String()).Info("Traffic quota of peer lifted for the new period")
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/jimzhong/wireguard-overlay/internal/cleanup"
+	"github.com/jimzhong/wireguard-overlay/internal/firewall"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+)
+
+var aclLog = logging.For("acl")
+
+// aclEnforcer applies the ACL the server distributes whenever it changes
+type aclEnforcer struct {
+	iface   string
+	applied []firewall.ACLRule
+	active  bool
+}
+
+func (a *aclEnforcer) update(t transport.Transport) {
+	acl, err := t.FetchACL()
+	if err != nil {
+		aclLog.WithError(err).Warn("Could not fetch ACL")
+		return
+	}
+	if a.active && reflect.DeepEqual(acl.Rules, a.applied) {
+		return
+	}
+	if err := firewall.ApplyACL(a.iface, acl.Rules); err != nil {
+		aclLog.WithError(err).Error("Could not apply ACL")
+		return
+	}
+	aclLog.Infof("Applied ACL with %d rules", len(acl.Rules))
+	if !a.active {
+		cleanup.Register("remove ACL", firewall.CleanupACL)
+	}
+	a.applied, a.active = acl.Rules, true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/tracing"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// peerApplier applies the peers of each refresh in the background, so that
+// applying thousands of them holds up neither the refreshes nor the main
+// loop. Only the latest peers are applied; those superseded while an
+// application runs are dropped.
+type peerApplier struct {
+	s       *syncer
+	mu      sync.Mutex
+	pending []wg.Peer
+	queued  bool
+	wake    chan struct{}
+}
+
+func newPeerApplier(s *syncer) *peerApplier {
+	return &peerApplier{s: s, wake: make(chan struct{}, 1)}
+}
+
+// submit hands the peers to the worker, replacing any not yet applied
+func (a *peerApplier) submit(peers []wg.Peer) {
+	a.mu.Lock()
+	a.pending, a.queued = peers, true
+	a.mu.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *peerApplier) take() ([]wg.Peer, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	peers, ok := a.pending, a.queued
+	a.pending, a.queued = nil, false
+	return peers, ok
+}
+
+// run applies the submitted peers until the device is stopped. Peers that
+// could not be configured are applied again after failedPeerRetry, unless
+// newer peers arrive first.
+func (a *peerApplier) run() {
+	var retry <-chan time.Time
+	var last []wg.Peer
+	for {
+		select {
+		case <-a.wake:
+		case <-retry:
+			a.mu.Lock()
+			if !a.queued {
+				a.pending, a.queued = last, true
+			}
+			a.mu.Unlock()
+		}
+		peers, ok := a.take()
+		if !ok {
+			continue
+		}
+		retry = nil
+		err := a.apply(peers)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if err != nil {
+			last = peers
+			retry = time.After(failedPeerRetry)
+		}
+	}
+}
+
+// apply configures the peers and removes the others, and records the peers
+// that failed
+func (a *peerApplier) apply(peers []wg.Peer) (err error) {
+	s := a.s
+	ctx, span := tracing.Start(context.Background(), "apply", attribute.Int("peers", len(peers)))
+	defer func() { tracing.End(span, err) }()
+	var failed wg.PeerErrors
+	err = s.wgState.AddPeersContext(ctx, peers)
+	if errors.As(err, &failed) {
+		// The others were configured; the failed ones are retried soon
+		for k, err := range failed {
+			syncLog.WithField("peer", k.String()).WithError(err).Warn("Could not add peer")
+			s.errs.set(k, errRejected, "%s", err)
+		}
+	} else if errors.Is(err, context.Canceled) {
+		return err
+	} else if err != nil {
+		syncLog.WithError(err).Error("Could not add peers")
+	}
+	for _, p := range peers {
+		if _, ok := failed[p.PublicKey]; !ok {
+			s.errs.resolve(p.PublicKey, errRejected)
+		}
+	}
+	syncLog.Debug("Added peers: ", peers)
+	if s.peerCache != nil && err == nil {
+		if err := s.peerCache.save(peers); err != nil {
+			syncLog.WithError(err).Warn("Could not cache peers")
+		}
+	}
+	if err := s.removeStalePeers(peers); err != nil {
+		syncLog.WithError(err).Error("Could not remove peers")
+	}
+	return err
+}
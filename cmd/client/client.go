@@ -1,83 +1,751 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"github.com/jimzhong/wireguard-overlay/internal/accounting"
+	"github.com/jimzhong/wireguard-overlay/internal/cleanup"
 	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/docker"
+	"github.com/jimzhong/wireguard-overlay/internal/firewall"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/noise"
+	"github.com/jimzhong/wireguard-overlay/internal/portmap"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/support"
+	"github.com/jimzhong/wireguard-overlay/internal/tcprelay"
+	"github.com/jimzhong/wireguard-overlay/internal/tracing"
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+	"github.com/jimzhong/wireguard-overlay/internal/underlay"
 	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func fetchPeers(server net.TCPAddr) ([]wg.Peer, error) {
+// syncLog logs the peer sync with the server
+var syncLog = logging.For("sync")
+
+// enroll presents the token to the server's enrollment listener to get the
+// public key added to the overlay, and decodes how to reach the server over
+// the overlay into bootstrap. Servers predating bootstrapping leave it empty.
+// With tlsConfig, the token is sent over TLS.
+func enroll(server net.TCPAddr, tlsConfig *tls.Config, enrollment protocol.Enrollment, bootstrap *protocol.Bootstrap) error {
 	client := &http.Client{
 		Timeout: 11 * time.Second,
 	}
+	scheme := "http"
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		scheme = "https"
+	}
 	url := url.URL{
-		Scheme: "http",
+		Scheme: scheme,
 		Host:   server.String(),
-		Path:   "/",
+		Path:   protocol.EnrollPath,
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(enrollment); err != nil {
+		return backoff.Permanent(err)
 	}
-	logrus.Debug("Fetching peers from ", url.String())
-	res, err := client.Get(url.String())
+	syncLog.Debug("Enrolling with ", url.String())
+	res, err := client.Post(url.String(), "application/octet-stream", &buf)
 	if err != nil {
-		logrus.WithError(err).Error("Could not connect to server")
-		return nil, err
+		return err
 	}
 	defer res.Body.Close()
-	var peers []wg.Peer
-	if err := gob.NewDecoder(res.Body).Decode(&peers); err != nil {
-		logrus.WithError(err).Error("Could not decode peer list")
-		return nil, err
+	if res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return backoff.Permanent(fmt.Errorf("server rejected enrollment: %s", strings.TrimSpace(string(msg))))
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded %s", res.Status)
+	}
+	if err := gob.NewDecoder(res.Body).Decode(bootstrap); err != nil && err != io.EOF {
+		return errors.Wrap(err, "Could not decode bootstrap")
+	}
+	return nil
+}
+
+// applyBootstrap takes the server key and port from the bootstrap if no
+// server key is configured, and checks them against the configuration otherwise
+func applyBootstrap(bootstrap protocol.Bootstrap, serverPubkey *wgtypes.Key, port *int, network net.IPNet, saltDigest []byte) error {
+	if bootstrap.PublicKey == (wgtypes.Key{}) {
+		if *serverPubkey == (wgtypes.Key{}) {
+			return errors.New("Server does not support bootstrapping; set server-pubkey")
+		}
+		return nil
+	}
+	if *serverPubkey != (wgtypes.Key{}) && *serverPubkey != bootstrap.PublicKey {
+		return errors.Errorf("Server announced key %s instead of server-pubkey", bootstrap.PublicKey)
+	}
+	if bootstrap.Network.String() != network.String() {
+		return errors.Errorf("Server uses overlay network %s instead of overlay-net %s", &bootstrap.Network, &network)
+	}
+	if !bytes.Equal(bootstrap.SaltDigest, saltDigest) {
+		return errors.New("Server uses another address-salt")
+	}
+	if *serverPubkey == (wgtypes.Key{}) {
+		logrus.Infof("Bootstrapped server key %s and port %d", bootstrap.PublicKey, bootstrap.Port)
+		*serverPubkey, *port = bootstrap.PublicKey, bootstrap.Port
 	}
-	logrus.Debug("Fetched peers: ", peers)
-	return peers, nil
+	return nil
 }
 
-func refreshPeers(wg *wg.State, serverAddr net.TCPAddr, preshardKey wgtypes.Key, bf backoff.BackOff, delay chan<- time.Duration) {
-	peers, err := fetchPeers(serverAddr)
+// watchPeers triggers a refresh whenever the transport reports a change
+func watchPeers(t transport.Transport, retry time.Duration, trigger chan<- struct{}) {
+	var since uint64
+	for {
+		gen, err := t.Watch(since)
+		if err != nil {
+			syncLog.WithError(err).Debug("Could not watch for peer changes")
+			time.Sleep(retry)
+			continue
+		}
+		if since != 0 && gen != since {
+			syncLog.Debug("Peers changed on server")
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+		since = gen
+	}
+}
+
+type syncer struct {
+	wgState      *wg.State
+	transport    transport.Transport
+	serverKey    wgtypes.Key
+	presharedKey wgtypes.Key
+	registration func() protocol.Registration
+	// nat64 is set when IPv4 endpoints have to be reached through NAT64
+	nat64 *net.IPNet
+	// rotation is set when the client rotates its key
+	rotation *rotator
+	// standby are the next keys of rotating peers currently configured
+	standby []wgtypes.Key
+	health  *healthTracker
+	paths   *pathSelector
+	errs    *peerErrors
+	// relay is set when peers that cannot be reached directly are relayed
+	// through the server
+	relay *relayer
+	punch *puncher
+	// tcp is set when the session with the server may be tunnelled over TCP
+	tcp *tcpFallback
+	// acl is set when the ACL of the server is enforced
+	acl    *aclEnforcer
+	server wg.Peer
+	// replicas are those of the server, between which the server peer moves
+	replicas replicaFailover
+	// applier applies the fetched peers in the background
+	applier *peerApplier
+	// peerCache is set when the peers applied are kept for the next start
+	peerCache *peerCache
+	// routed is set while the topology routes peers through the server
+	routed bool
+	// revoked are the keys never to configure
+	revoked *revocations
+	// expiry removes the peers whose records lapse
+	expiry *expirations
+	// hubs are the region hubs, through which peers may be reached
+	hubs *regionHubs
+	// quotas is set when the traffic with the peers is accounted
+	quotas *quotas
+	// split is set when networks are included in or excluded from the overlay
+	split *splitTunnel
+	// restart is signalled when the server tells the client to restart
+	restart chan struct{}
+	// portal is set when captive portals are detected. Behind one, the
+	// keepalives are stopped and quieted is set.
+	portal  *portalDetector
+	quieted bool
+	// serverHost is resolved again every resolveInterval, when fetching the
+	// peers fails and when the underlay network changed, which sets moved
+	serverHost      string
+	resolveInterval time.Duration
+	resolved        time.Time
+	moved           int32
+	// state is reported on the control socket
+	state    *syncState
+	metadata *peerMetadata
+}
+
+// shutdown keeps the tunnels up for drain, or until another signal, so that
+// open connections can finish, and then deregisters from the server
+func (s *syncer) shutdown(drain time.Duration, signals <-chan os.Signal) {
+	if drain > 0 {
+		syncLog.Infof("Draining for %s; signal again to exit at once", drain)
+		select {
+		case <-time.After(drain):
+		case <-signals:
+		}
+	}
+	if err := s.transport.Deregister(); err != nil {
+		syncLog.WithError(err).Warn("Could not deregister from server")
+		return
+	}
+	syncLog.Info("Deregistered from server")
+}
+
+func (s *syncer) refreshPeers(retry *retryPolicy, delay chan<- time.Duration) {
+	if s.portal != nil && s.portal.behind() {
+		// The detector triggers a refresh once the portal is passed
+		s.quiet()
+		s.state.record(errors.New("Paused behind a captive portal"), 0, s.portal.interval, true, false)
+		delay <- s.portal.interval
+		return
+	}
+	ctx, span := tracing.Start(context.Background(), "sync", attribute.String("interface", s.wgState.Interface()))
+	if atomic.SwapInt32(&s.moved, 0) == 1 {
+		s.reconnect()
+	}
+	if s.quieted {
+		s.quieted = false
+		if err := s.wgState.AddPeers([]wg.Peer{s.server}); err != nil {
+			syncLog.WithError(err).Error("Could not restore keepalive to server")
+		}
+	}
+	if s.rotation != nil {
+		s.rotation.complete(time.Now())
+	}
+	if s.tcp != nil && s.tcp.update(time.Now()) {
+		s.server = s.tcp.server()
+		if err := s.wgState.AddPeers([]wg.Peer{s.server}); err != nil {
+			syncLog.WithError(err).Error("Could not switch transport to server")
+		}
+	}
+	if err := s.health.update(time.Now()); err != nil {
+		syncLog.WithError(err).Error("Could not check direct connectivity")
+	}
+	for k, since := range s.health.failures() {
+		s.errs.set(k, errHandshakeTimeout, "No handshake for %s while sending traffic", time.Since(since).Round(time.Second))
+	}
+	for _, k := range s.health.keys() {
+		if s.health.reachable(k) {
+			s.errs.resolve(k, errHandshakeTimeout, errEndpointUnreachable)
+		}
+	}
+	registration := s.registration()
+	registration.Standby = s.standby
+	registration.Unreachable = s.health.unreachable(time.Now())
+	_, registering := tracing.Start(ctx, "register")
+	err := s.transport.Register(registration)
+	tracing.End(registering, err)
+	if err != nil {
+		syncLog.WithError(err).Error("Could not register with server")
+	}
+	peers, err := s.transport.FetchPeers(ctx)
+	if err != nil {
+		syncLog.WithError(err).Error("Could not fetch peers")
+	} else {
+		syncLog.Debug("Fetched peers: ", peers)
+	}
+	next := retry.next(err == nil, time.Now())
+	if err != nil && s.portal != nil && s.portal.check() && s.portal.behind() {
+		s.quiet()
+	}
+	if s.resolveDue(err != nil) && s.resolveServer() && !s.quieted {
+		if err := s.wgState.AddPeers([]wg.Peer{s.server}); err != nil {
+			syncLog.WithError(err).Error("Could not update server endpoint")
+		}
+	}
+	if err != nil {
+		if s.failOver() && !s.quieted {
+			if err := s.wgState.AddPeers([]wg.Peer{s.server}); err != nil {
+				syncLog.WithError(err).Error("Could not move to server replica")
+			}
+		}
+	} else {
+		s.replicas.observe(s.transport.Replicas())
+	}
 	if err == nil {
-		bf.Reset()
+		// Before anything else, so that no revoked peer is configured again
+		s.revoked.update(s.transport)
+		peers = s.revoked.filter(peers)
+		peers = s.expiry.filter(peers, time.Now())
+		peers = s.quotas.filter(peers)
+		// Renewed well before the first record lapses
+		if e := s.expiry.earliest(); !e.IsZero() && time.Until(e)/2 < next {
+			next = time.Until(e) / 2
+		}
+		s.metadata.update(peers)
+		var own *wg.Peer
+		known := make(map[wgtypes.Key]bool, len(peers))
 		for i := range peers {
-			peers[i].PresharedKey = preshardKey
+			known[peers[i].PublicKey] = true
+			if peers[i].PublicKey == s.wgState.PublicKey() {
+				own = &peers[i]
+				if len(peers[i].Addresses) != 0 {
+					if err := s.wgState.AssignAddresses(peers[i].Addresses); err != nil {
+						syncLog.WithError(err).Error("Could not configure assigned address")
+					}
+				} else if err := s.deriveOwnAddress(peers[i].AddressVersion); err != nil {
+					syncLog.WithError(err).Error("Could not configure derived address")
+				}
+			}
+			peers[i].PresharedKey = s.presharedKey
 			if strings.Count(peers[i].IP, ".") == 3 {
 				// If the peer is on IPv4
 				// TODO: make this confirgurable?
 				peers[i].KeepaliveInterval = 20 * time.Second
 			}
+			if s.nat64 != nil && peers[i].IP != "" {
+				peers[i].IP = underlay.Synthesize(s.nat64, net.ParseIP(peers[i].IP)).String()
+			}
+		}
+		s.errs.prune(known)
+		s.hubs.observe(peers, own)
+		if s.rotation != nil {
+			s.rotation.observe(s.transport, own)
+			if c := s.rotation.cutover; !c.IsZero() && time.Until(c) < next {
+				next = time.Until(c)
+			}
+		}
+		var cutover time.Time
+		peers, s.standby, cutover = applyRotations(s.wgState, peers, time.Now())
+		if !cutover.IsZero() && time.Until(cutover) < next {
+			next = time.Until(cutover)
+		}
+		server := s.server
+		var routed bool
+		peers = routeThroughHubs(s.wgState, peers)
+		peers, server, routed = routeThroughServer(s.wgState, peers, server)
+		peers, server = s.split.apply(peers, server, s.serverIP())
+		s.paths.apply(peers, s.health, time.Now())
+		if s.relay != nil {
+			s.relay.update(s.health, time.Now())
+			peers = s.relay.apply(peers, server)
+		} else if routed || s.routed || len(server.AllowedIPs) != 0 {
+			// Also drops the addresses of peers no longer routed
+			peers = append(peers, server)
+		}
+		s.routed = routed
+		s.applier.submit(peers)
+		if punches, err := s.transport.FetchPunches(); err != nil {
+			syncLog.WithError(err).Debug("Could not fetch hole punches")
+		} else {
+			s.punch.start(punches, peers)
+		}
+		if s.acl != nil {
+			s.acl.update(s.transport)
+		}
+		if restart, err := s.transport.FetchRestart(); err != nil {
+			syncLog.WithError(err).Debug("Could not check for restart")
+		} else if restart {
+			select {
+			case s.restart <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if s.tcp != nil && !s.tcp.tunnelled && next > serverHandshakeTimeout {
+		// Notice soon if UDP does not get through
+		next = serverHandshakeTimeout
+	}
+	if next < 0 {
+		next = 0
+	}
+	span.SetAttributes(attribute.Int("peers", len(peers)))
+	tracing.End(span, err)
+	s.state.record(err, len(peers), next, s.quieted, s.tcp != nil && s.tcp.tunnelled)
+	delay <- next
+}
+
+// reconnect resolves the server again and has wireguard send keepalives right
+// away, so that sessions move to the new underlay network without waiting for
+// the next handshake
+func (s *syncer) reconnect() {
+	s.resolveServer()
+	if s.quieted {
+		// The server is added back once the portal is passed
+		return
+	}
+	if err := s.wgState.AddPeers([]wg.Peer{s.server}); err != nil {
+		syncLog.WithError(err).Error("Could not update server endpoint")
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		syncLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	for _, p := range peers {
+		if p.KeepaliveInterval == 0 {
+			continue
+		}
+		if err := s.wgState.SetPeerEndpoint(p.PublicKey, nil, p.KeepaliveInterval); err != nil {
+			syncLog.WithError(err).Error("Could not nudge peer")
+		}
+	}
+}
+
+// While the server cannot be reached, its hostname is resolved again at most
+// this often
+const serverResolveMinInterval = 10 * time.Second
+
+// resolveDue reports whether to resolve the server hostname again
+func (s *syncer) resolveDue(failed bool) bool {
+	if s.resolveInterval <= 0 {
+		return false
+	}
+	since := time.Since(s.resolved)
+	return since >= s.resolveInterval || (failed && since >= serverResolveMinInterval)
+}
+
+// resolveServer resolves the server hostname again, if it is one, and points
+// the server peer at the new address if the current one is gone. It reports
+// whether the address changed.
+func (s *syncer) resolveServer() bool {
+	s.resolved = time.Now()
+	if net.ParseIP(s.serverHost) != nil {
+		return false
+	}
+	// A replica the client moved to is kept until it fails as well
+	if s.replicas.isReplica(s.serverIP(), s.serverPort()) {
+		return false
+	}
+	hasIPv4, err := underlay.HasIPv4()
+	if err != nil {
+		hasIPv4 = true
+	}
+	ips, err := underlay.ResolveHostAll(s.serverHost, hasIPv4)
+	if err != nil {
+		syncLog.WithError(err).Warn("Could not resolve server address")
+		return false
+	}
+	current := s.serverIP()
+	for _, ip := range ips {
+		if underlay.Synthesize(s.nat64, ip).String() == current {
+			return false
 		}
-		err = wg.AddPeers(peers)
+	}
+	ip := underlay.Synthesize(s.nat64, ips[0]).String()
+	syncLog.Infof("Server address of %s changed from %s to %s", s.serverHost, current, ip)
+	if s.tcp != nil {
+		s.tcp.direct.IP = ip
+		s.server = s.tcp.server()
+	} else {
+		s.server.IP = ip
+	}
+	return true
+}
+
+// deriveOwnAddress moves the source address of overlay traffic to the address
+// of the derivation version the server announced. The address of the first
+// version stays configured, since the server is reached with it.
+func (s *syncer) deriveOwnAddress(v derive.Version) error {
+	if v.Normalize() == derive.Current && s.wgState.AssignedAddress().IP == nil {
+		return nil
+	}
+	addr, err := s.wgState.DeriveAddress(v, s.wgState.PublicKey())
+	if err != nil {
+		return err
+	}
+	return s.wgState.AssignAddresses([]net.IP{addr.IP})
+}
+
+// serverIP is the underlay address of the server, even while tunnelled
+func (s *syncer) serverIP() string {
+	if s.tcp != nil {
+		return s.tcp.direct.IP
+	}
+	return s.server.IP
+}
+
+// quiet stops the keepalives to all peers, so that wireguard only initiates
+// handshakes when there is traffic. The NATs of guest networks tend to block
+// clients that keep sending while the portal drops their packets.
+func (s *syncer) quiet() {
+	if s.quieted {
+		return
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		syncLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	for _, p := range peers {
+		if p.KeepaliveInterval == 0 {
+			continue
+		}
+		if err := s.wgState.SetPeerEndpoint(p.PublicKey, nil, 0); err != nil {
+			syncLog.WithError(err).Error("Could not stop keepalive")
+		}
+	}
+	s.quieted = true
+}
+
+// removeStalePeers removes the peers the server no longer distributes
+func (s *syncer) removeStalePeers(peers []wg.Peer) error {
+	current, err := s.wgState.GetPeers()
+	if err != nil {
+		return err
+	}
+	wanted := make(map[wgtypes.Key]bool, len(peers))
+	for _, p := range peers {
+		wanted[p.PublicKey] = true
+	}
+	var stale []wgtypes.Key
+	for _, p := range current {
+		if p.PublicKey != s.serverKey && !wanted[p.PublicKey] {
+			stale = append(stale, p.PublicKey)
+		}
+	}
+	if len(stale) != 0 {
+		syncLog.Debug("Removing peers: ", stale)
+	}
+	return s.wgState.RemovePeers(stale)
+}
+
+// nat64Prefix returns the prefix through which IPv4 endpoints are reached, or
+// nil if they are reached directly
+func nat64Prefix(setting string, hasIPv4 bool) (*net.IPNet, error) {
+	switch setting {
+	case "none":
+		return nil, nil
+	case "auto":
+		if hasIPv4 {
+			return nil, nil
+		}
+		prefix, err := underlay.DiscoverNAT64Prefix()
 		if err != nil {
-			logrus.WithError(err).Error("Could not add peers")
+			logrus.WithError(err).Warn("No IPv4 connectivity and no NAT64; IPv4 peers will be unreachable")
+			return nil, nil
 		}
-		logrus.Debug("Added peers: ", peers)
+		return prefix, nil
 	}
-	delay <- bf.NextBackOff()
+	return underlay.ParseNAT64Prefix(setting)
+}
+
+func setUpFirewall(wgState *wg.State, iface string, backend string, overlayPorts []string) (firewall.Firewall, error) {
+	ports, err := firewall.ParsePorts(overlayPorts)
+	if err != nil {
+		return nil, err
+	}
+	listenPort, err := wgState.ListenPort()
+	if err != nil {
+		return nil, err
+	}
+	fw, err := firewall.New(backend)
+	if err != nil {
+		return nil, err
+	}
+	return fw, fw.Apply(firewall.Rules{
+		Interface:    iface,
+		ListenPort:   listenPort,
+		OverlayPorts: ports,
+	})
 }
 
 func main() {
+	defer cleanup.Run()
+	defer cleanup.Recover()
+	subcommand := config.Subcommand()
+	if subcommand == "config" {
+		if err := config.RunCommand("client"); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
 	config, err := config.LoadClientConfig()
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	logLevel, err := logrus.ParseLevel(config.LogLevel)
-	if err != nil {
-		logrus.WithError(err).Fatal("Could not parse loglevel")
+	if err := logging.Setup(config.LogFormat, config.LogLevel, config.LogLevels); err != nil {
+		logrus.Fatal(err)
+	}
+
+	switch subcommand {
+	case "":
+	case "support-bundle":
+		path, err := support.WriteBundle(config.Interface, config)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not create support bundle")
+		}
+		fmt.Println(path)
+		return
+	case "log-levels":
+		if err := logging.RunCommand(config.ControlSocket, config.LogLevels); err != nil {
+			logrus.WithError(err).Fatal("Could not set log levels")
+		}
+		return
+	case "debug-peer":
+		if err := logging.RunDebugCommand(config.ControlSocket, config.DebugPeer, config.DebugMinutes); err != nil {
+			logrus.WithError(err).Fatal("Could not debug peer")
+		}
+		return
+	case "peers":
+		if err := status.RunCommand(config.ControlSocket); err != nil {
+			logrus.WithError(err).Fatal("Could not list peers")
+		}
+		return
+	case "top":
+		device := func() (h *status.Handler, err error) {
+			err = wg.InNetns(config.Netns, func() (err error) {
+				h, err = status.NewHandler(config.Interface)
+				return
+			})
+			return
+		}
+		if err := status.RunTop(config.ControlSocket, device); err != nil {
+			logrus.WithError(err).Fatal("Could not show peers")
+		}
+		return
+	case "export-config":
+		if err := exportWgQuick(config); err != nil {
+			logrus.WithError(err).Fatal("Could not export configuration")
+		}
+		return
+	case "self-test":
+		if err := wg.SelfTest(); err != nil {
+			logrus.WithError(err).Fatal("Self-test failed")
+		}
+		fmt.Println("Self-test passed")
+		return
+	case "connectivity-test":
+		if err := testConnectivity(config, time.Duration(config.TestTimeoutSecs)*time.Second); err != nil {
+			logrus.WithError(err).Fatal("Connectivity test failed")
+		}
+		return
+	default:
+		logrus.Fatal("Unknown command: ", subcommand)
+	}
+	if config.SelfTest {
+		if err := wg.SelfTest(); err != nil {
+			logrus.WithError(err).Fatal("Self-test failed")
+		}
+		logrus.Info("Self-test passed")
 	}
-	logrus.SetLevel(logLevel)
 
-	serverPubkey, err := wgtypes.ParseKey(config.ServerPubkey)
+	overlays, err := loadOverlays(config)
 	if err != nil {
-		logrus.WithError(err).Fatal("Could not parse server key")
+		logrus.Fatal(err)
+	}
+	if config.DryRun {
+		for i, o := range overlays {
+			runOverlay(o, i == 0)
+		}
+		return
+	}
+	if config.OTLPURL != "" {
+		flush, err := tracing.Setup(config.OTLPURL, "wireguard-overlay-client")
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up tracing")
+		}
+		defer flush()
+	}
+	var running sync.WaitGroup
+	for _, o := range overlays[1:] {
+		o := o
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer cleanup.Recover()
+			runOverlay(o, false)
+		}()
+	}
+	runOverlay(config, true)
+	running.Wait()
+}
+
+// loadOverlays returns the main overlay followed by the further overlays it
+// lists. Each needs its own interface; a further overlay that keeps the
+// default control socket or peer cache gets one named after its interface.
+func loadOverlays(primary *config.ClientConfig) ([]*config.ClientConfig, error) {
+	overlays := []*config.ClientConfig{primary}
+	for _, path := range primary.Overlays {
+		o, err := config.LoadClientOverlay(path)
+		if err != nil {
+			return nil, err
+		}
+		if o.ControlSocket == primary.ControlSocket && o.ControlSocket != "" {
+			o.ControlSocket = filepath.Join(filepath.Dir(primary.ControlSocket), "client-"+o.Interface+".sock")
+		}
+		if o.PeerCache == primary.PeerCache && o.PeerCache != "" {
+			o.PeerCache = filepath.Join(filepath.Dir(primary.PeerCache), "client-"+o.Interface+"-peers.cache")
+		}
+		overlays = append(overlays, o)
+	}
+	interfaces := make(map[string]bool)
+	sockets := make(map[string]bool)
+	caches := make(map[string]bool)
+	statusAddrs := make(map[string]bool)
+	keyFiles := make(map[string]bool)
+	docker := 0
+	for _, o := range overlays {
+		// The Docker driver has a fixed socket
+		if len(o.DockerSubnets) != 0 {
+			if docker++; docker > 1 {
+				return nil, errors.New("Only one overlay can serve the Docker driver")
+			}
+		}
+		if interfaces[o.Interface] {
+			return nil, errors.Errorf("Interface %s is used by several overlays", o.Interface)
+		}
+		for _, v := range []struct {
+			value string
+			seen  map[string]bool
+			what  string
+		}{
+			{o.ControlSocket, sockets, "Control socket"},
+			{o.PeerCache, caches, "Peer cache"},
+			{o.StatusAddr, statusAddrs, "Status address"},
+			{o.KeyFile, keyFiles, "Key file"},
+		} {
+			if v.value != "" && v.seen[v.value] {
+				return nil, errors.Errorf("%s %s is used by several overlays", v.what, v.value)
+			}
+			v.seen[v.value] = true
+		}
+		interfaces[o.Interface] = true
+	}
+	return overlays, nil
+}
+
+// discoveredBy names how peers are discovered without a server, if they are
+func discoveredBy(config *config.ClientConfig) string {
+	switch {
+	case config.ClusterKey != "":
+		return "gossip"
+	case config.Kubernetes:
+		return "Kubernetes"
+	}
+	return ""
+}
+
+// runOverlay sets up the interface of one overlay and keeps its peers in sync
+// until told to exit. Only the main overlay names the node in the logs.
+func runOverlay(config *config.ClientConfig, primary bool) {
+	var err error
+	if config.WesherState != "" {
+		if err := importWesherState(config); err != nil {
+			logrus.WithError(err).Fatal("Could not import wesher state")
+		}
+	}
+	if config.Wesher && config.ClusterKey == "" {
+		logrus.Fatal("wesher requires cluster-key or wesher-state")
 	}
 	presharedKey := func() wgtypes.Key {
 		if config.PresharedKey != "" {
@@ -90,55 +758,514 @@ func main() {
 		return wgtypes.Key{}
 	}()
 
-	wgState, err := wg.New(config.Interface, 0, (net.IPNet)(*config.OverlayNet), config.PrivateKey)
+	var imported []wg.Peer
+	listenPort := 0
+	if config.ImportWgQuick != "" {
+		if imported, listenPort, err = importWgQuick(config); err != nil {
+			logrus.WithError(err).Fatal("Could not import wg-quick configuration")
+		}
+	}
+	privateKey := config.PrivateKey
+	if config.KeyFile != "" {
+		privateKey, err = loadKeyFile(config.KeyFile, config.PrivateKey)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not load private key")
+		}
+	}
+	if config.Wesher {
+		// Wesher nodes expect every node on their port
+		listenPort = config.WesherPort
+	} else if listenPort == 0 && config.ListenPortRange != "" {
+		if listenPort, err = pickListenPort(config.ListenPortRange); err != nil {
+			logrus.WithError(err).Fatal("Could not pick wireguard port")
+		}
+	}
+	wgState, err := wg.New(config.Interface, listenPort, (net.IPNet)(*config.OverlayNet), []byte(config.AddressSalt), privateKey)
 	if err != nil {
 		logrus.WithError(err).Fatal("Could not instantiate wireguard controller")
 	}
+	if config.Netns != "" {
+		if config.Firewall != "none" || config.ACL {
+			logrus.Fatal("Firewall rules and ACLs are not supported with netns")
+		}
+		if err := wgState.SetNetns(config.Netns); err != nil {
+			logrus.WithError(err).Fatal("Could not use network namespace")
+		}
+	}
+	if primary {
+		logging.SetNode(wgState.PublicKey().String())
+	}
+	extraNets, err := config.ExtraNetworks()
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse extra overlay networks")
+	}
+	wgState.SetExtraNetworks(extraNets)
+	if config.DryRun {
+		wgState.DryRun(os.Stdout)
+	}
+	wgState.SetUpdateRate(config.PeerUpdateRate, config.PeerUpdateBurst)
+	wgState.SetBatchSize(config.PeerApplyBatch)
+	wgState.SetPolicyRouting(config.FirewallMark, config.RoutingTable)
+	if err := wgState.SetRouteAttributes(config.RouteMetric, config.RouteMarker); err != nil {
+		logrus.WithError(err).Fatal("Could not set route attributes")
+	}
+	speaker, err := setUpRouteExport(wgState, config)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up route export")
+	}
 	if err := wgState.SetUpInterface(); err != nil {
 		logrus.WithError(err).Fatal("Could not up interface")
 	}
-	defer func() {
+	listenPort, err = wgState.ListenPort()
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not read wireguard port")
+	}
+	if !config.DryRun {
+		logrus.Infof("Listening on wireguard port %d", listenPort)
+	}
+	cleanup.Register("down interface", func() error {
 		logrus.Info("Exiting...")
-		if err := wgState.DownInterface(); err != nil {
-			logrus.WithError(err).Error("Could not down interface")
+		wgState.Stop()
+		return wgState.DownInterface()
+	})
+	if len(imported) != 0 {
+		if err := wgState.AddPeers(imported); err != nil {
+			logrus.WithError(err).Fatal("Could not add imported peers")
 		}
-	}()
-
-	if err := wgState.AddPeers([]wg.Peer{
-		{
-			PublicKey: serverPubkey,
-			IP:        config.ServerAddr.String(),
-			Port:      config.ServerPort,
-		},
+	}
+	revoked := newRevocations(wgState)
+	expiry := newExpirations(wgState)
+	var peerCache *peerCache
+	if config.PeerCache != "" && !config.DryRun {
+		peerCache = newPeerCache(config.PeerCache, wgState, config.ServerPubkey, revoked, expiry)
+		peerCache.restore()
+	}
+	if config.DryRun {
+		if err := planServerPeer(wgState, config.ServerAddr, config.ServerPubkey, config.ServerPort, config.NAT64Prefix, discoveredBy(config)); err != nil {
+			logrus.WithError(err).Fatal("Could not plan server peer")
+		}
+		return
+	}
+	if speaker != nil {
+		speaker.Run()
+		cleanup.Register("close BGP sessions", func() error {
+			speaker.Close()
+			return nil
+		})
+	}
+	if config.ReconcileIntervalSecs > 0 {
+		go wgState.RunReconcile(time.Duration(config.ReconcileIntervalSecs) * time.Second)
+	}
+	peerErrs := newPeerErrors()
+	state := &syncState{}
+	var statusHandler *status.Handler
+	if err := wg.InNetns(config.Netns, func() (err error) {
+		statusHandler, err = status.NewHandler(config.Interface)
+		return err
 	}); err != nil {
+		logrus.WithError(err).Fatal("Could not instantiate status handler")
+	}
+	statusHandler.SetPeerErrors(peerErrs.byKey)
+	metadata := &peerMetadata{}
+	statusHandler.SetPeerMetadata(metadata.get)
+	statusHandler.AddCollector(peerErrs.collect)
+	var probes *prober
+	if config.ProbePort != 0 && config.ProbeIntervalSecs > 0 {
+		if probes, err = newProber(wgState, config.Netns, config.ProbePort); err != nil {
+			logrus.WithError(err).Error("Could not listen for probes")
+		} else {
+			defer probes.Close()
+			statusHandler.SetPeerLatency(probes.latency)
+			go probes.run(time.Duration(config.ProbeIntervalSecs) * time.Second)
+		}
+	}
+	if config.ControlSocket != "" {
+		ctl, err := control.Listen(config.ControlSocket)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not open control socket")
+		} else {
+			defer ctl.Close()
+			ctl.Handle(control.LogPath, logging.Handler())
+			ctl.Handle(control.DebugPath, logging.DebugHandler())
+			ctl.Handle(control.PeersPath, http.HandlerFunc(statusHandler.ServeStatus))
+			ctl.Handle(control.SyncPath, state)
+		}
+	}
+	go wgState.TraceDebuggedPeer()
+	if primary && config.DebugPeer != "" && config.DebugMinutes > 0 {
+		if _, err := wgtypes.ParseKey(config.DebugPeer); err != nil {
+			logrus.WithError(err).Fatal("Could not parse debug-peer")
+		}
+		logging.DebugPeer(config.DebugPeer, time.Duration(config.DebugMinutes)*time.Minute)
+	}
+
+	if config.Firewall != "none" {
+		fw, err := setUpFirewall(wgState, config.Interface, config.Firewall, config.FirewallOverlayPorts)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up firewall")
+		}
+		cleanup.Register("clean up firewall rules", fw.Cleanup)
+	}
+
+	if len(config.DockerSubnets) != 0 {
+		var subnets []net.IPNet
+		for _, s := range config.DockerSubnets {
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				logrus.WithError(err).Fatal("Could not parse docker subnet")
+			}
+			subnets = append(subnets, *subnet)
+		}
+		// Containers are reached through the overlay
+		if err := wgState.EnableForwarding(); err != nil {
+			logrus.WithError(err).Fatal("Could not enable forwarding for containers")
+		}
+		plugin, err := docker.Listen(subnets)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start Docker driver")
+		}
+		defer plugin.Close()
+	}
+
+	if config.StatusAddr != "" {
+		statusServer, err := status.ListenAndServe(config.StatusAddr, statusHandler)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start status server")
+		}
+		defer statusServer.Close()
+	}
+
+	if (len(config.IncludeRoutes) != 0 || len(config.ExcludeRoutes) != 0) && (config.ClusterKey != "" || config.Kubernetes) {
+		logrus.Fatal("include-routes and exclude-routes require a server")
+	}
+	if config.ClusterKey != "" {
+		var wesherName string
+		if config.Wesher {
+			if wesherName = config.WesherName; wesherName == "" {
+				if wesherName, err = os.Hostname(); err != nil {
+					logrus.WithError(err).Fatal("Could not get hostname for wesher")
+				}
+			}
+		}
+		g, err := newGossip(wgState, presharedKey, config.ClusterKey, config.GossipPort, config.GossipAdvertiseAddr, config.GossipJoin, wesherName)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up gossip discovery")
+		}
+		logrus.Infof("Client is running without a server. Pubkey: %s IP: %s", wgState.PublicKey(), &wgState.OverlayAddr)
+		g.run(time.Duration(config.PeerRefreshIntervalSecs) * time.Second)
+		return
+	}
+	if config.Kubernetes {
+		k, err := newKubeDiscovery(wgState, presharedKey, config.KubeNode, config.KubeAdvertiseAddr, config.KubePodRoutes)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up Kubernetes discovery")
+		}
+		logrus.Infof("Client is running on Kubernetes node %s without a server. Pubkey: %s IP: %s", k.node, wgState.PublicKey(), &wgState.OverlayAddr)
+		k.run(time.Duration(config.PeerRefreshIntervalSecs) * time.Second)
+		return
+	}
+
+	// Without a server key the client bootstraps through enrollment
+	var serverPubkey wgtypes.Key
+	if config.ServerPubkey != "" || config.EnrollToken == "" {
+		if serverPubkey, err = wgtypes.ParseKey(config.ServerPubkey); err != nil {
+			logrus.WithError(err).Fatal("Could not parse server key")
+		}
+	}
+	var mapping *portmap.PortMapping
+	if config.PortMapping != "none" {
+		if mapping, err = portmap.Keep(config.PortMapping, listenPort); err != nil {
+			logrus.WithError(err).Fatal("Could not set up port mapping")
+		}
+		cleanup.Register("remove port mapping", mapping.Close)
+	}
+
+	var discovery *endpointDiscovery
+	if len(config.STUNServers) != 0 {
+		discovery = &endpointDiscovery{
+			wgState:  wgState,
+			servers:  config.STUNServers,
+			interval: time.Duration(config.STUNIntervalSecs) * time.Second,
+		}
+	}
+	ownMetadata, err := protocol.ParseMetadata(config.Metadata)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid metadata")
+	}
+	hubs := newRegionHubs(wgState, probes, config.ProbePort)
+	if config.ProbePort != 0 {
+		go hubs.run()
+	}
+	registration := func() protocol.Registration {
+		r := protocol.Registration{Started: started, AddressVersions: derive.Versions(), Metadata: ownMetadata, ListenPort: listenPort}
+		r.NearestHub = hubs.nearest()
+		if mapping != nil {
+			r.Endpoint = mapping.External()
+		}
+		if discovery != nil {
+			r.Reflexive, r.NAT = discovery.reflexive()
+		}
+		if len(*config.RequestedAddr) != 0 {
+			r.RequestedAddr = *config.RequestedAddr
+		}
+		if config.LANEndpoints {
+			r.LocalEndpoints = localEndpoints(config.Interface, listenPort)
+		}
+		return r
+	}
+
+	hasIPv4, err := underlay.HasIPv4()
+	if err != nil {
+		logrus.WithError(err).Warn("Could not check for IPv4 connectivity")
+		hasIPv4 = true
+	}
+	nat64, err := nat64Prefix(config.NAT64Prefix, hasIPv4)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up NAT64")
+	}
+	if nat64 != nil {
+		logrus.Info("Reaching IPv4 peers through NAT64 prefix ", nat64)
+	}
+	serverIP, err := underlay.ResolveHost(config.ServerAddr, hasIPv4)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not resolve server address")
+	}
+	serverIP = underlay.Synthesize(nat64, serverIP)
+	if config.EnrollToken != "" {
+		enrollAddr := net.TCPAddr{IP: serverIP, Port: config.EnrollPort}
+		tlsConfig, err := enrollTLS(config)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up TLS for enrolling")
+		}
+		bf := backoff.NewExponentialBackOff()
+		bf.MaxElapsedTime = 2 * time.Minute
+		var bootstrap protocol.Bootstrap
+		if err := backoff.Retry(func() error {
+			return enroll(enrollAddr, tlsConfig, protocol.Enrollment{PublicKey: wgState.PublicKey(), Token: config.EnrollToken}, &bootstrap)
+		}, bf); err != nil {
+			logrus.WithError(err).Fatal("Could not enroll with server")
+		}
+		logrus.Info("Enrolled with server")
+		if err := applyBootstrap(bootstrap, &serverPubkey, &config.ServerPort, wgState.OverlayNetwork, wgState.SaltDigest()); err != nil {
+			logrus.WithError(err).Fatal("Could not bootstrap from server")
+		}
+	}
+	split, err := newSplitTunnel(config.IncludeRoutes, config.ExcludeRoutes, serverIP)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up split tunneling")
+	}
+	serverPeer := wg.Peer{
+		PublicKey: serverPubkey,
+		IP:        serverIP.String(),
+		Port:      config.ServerPort,
+	}
+	if err := wgState.AddPeers([]wg.Peer{serverPeer}); err != nil {
 		logrus.WithError(err).Fatal("Could not add server as wireguard peer")
 	}
+	state.setServer(serverPubkey)
+	if config.TrafficQuotaMB > 0 && config.AccountingPeriod == "" {
+		logrus.Fatal("traffic-quota requires accounting-period")
+	}
+	var quota *quotas
+	if config.AccountingPeriod != "" {
+		a, err := accounting.New(config.AccountingFile, config.AccountingPeriod, int64(config.TrafficQuotaMB)<<20)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up traffic accounting")
+		}
+		if config.QuotaAction != "alert" && config.QuotaAction != "remove" {
+			logrus.Fatalf("Unknown quota action %q (alert/remove)", config.QuotaAction)
+		}
+		quota = &quotas{Accounting: a, wgState: wgState, server: serverPubkey, remove: config.QuotaAction == "remove"}
+		statusHandler.AddCollector(a.Collect)
+		statusHandler.SetPeerUsage(a.Usage)
+		go quota.run()
+	}
 
-	logrus.Infof("Client is running. Pubkey: %s IP: %s", wgState.PublicKey, &wgState.OverlayAddr)
+	logrus.Infof("Client is running. Pubkey: %s IP: %s", wgState.PublicKey(), &wgState.OverlayAddr)
 	incomingSignals := make(chan os.Signal, 1)
 	signal.Notify(incomingSignals, syscall.SIGTERM, os.Interrupt)
+	debug := debugSignals()
 	delayCh := make(chan time.Duration)
-	bf := &backoff.ExponentialBackOff{
-		InitialInterval:     time.Duration(config.PeerRefreshIntervalSecs) * time.Second,
-		MaxInterval:         60 * time.Second,
-		MaxElapsedTime:      0,
-		RandomizationFactor: backoff.DefaultRandomizationFactor,
-		Multiplier:          backoff.DefaultMultiplier,
-		Stop:                backoff.Stop,
-		Clock:               backoff.SystemClock,
-	}
-	bf.Reset()
+	refreshInterval := time.Duration(config.PeerRefreshIntervalSecs) * time.Second
+	retry := newRetryPolicy(refreshInterval, time.Duration(config.PeerRefreshMaxBackoffSecs)*time.Second)
 	httpServerAddr := net.TCPAddr{IP: wgState.GetOverlayAddress(serverPubkey).IP, Port: config.ServerPort}
+	tlsConfig, err := peerAPITLS(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up TLS for the peer API")
+	}
+	options := transport.Options{
+		Server: httpServerAddr,
+		Path:   config.TransportFile,
+		HTTP: transport.HTTPOptions{
+			Netns:      config.Netns,
+			TLS:        tlsConfig,
+			PrivateKey: wgState.PrivateKey,
+			ServerKey:  serverPubkey,
+			PageSize:   config.PeerPageSize,
+		},
+	}
+	if config.Noise {
+		options.HTTP.Wrap = func(conn net.Conn) net.Conn { return noise.Client(conn, wgState.PrivateKey(), serverPubkey) }
+	}
+	t, err := transport.New(config.Transport, options)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up transport")
+	}
+	if probes != nil {
+		returnCookies(probes, t)
+	}
+	s := &syncer{
+		wgState:         wgState,
+		transport:       t,
+		serverKey:       serverPubkey,
+		presharedKey:    presharedKey,
+		registration:    registration,
+		nat64:           nat64,
+		server:          serverPeer,
+		health:          newHealthTracker(wgState, serverPubkey),
+		punch:           newPuncher(wgState, nat64, peerErrs),
+		paths:           newPathSelector(wgState, config.Interface, nat64, peerErrs, probes),
+		errs:            peerErrs,
+		restart:         make(chan struct{}, 1),
+		serverHost:      config.ServerAddr,
+		resolveInterval: time.Duration(config.ServerResolveIntervalSecs) * time.Second,
+		resolved:        time.Now(),
+		state:           state,
+		metadata:        metadata,
+		peerCache:       peerCache,
+		revoked:         revoked,
+		expiry:          expiry,
+		hubs:            hubs,
+		quotas:          quota,
+		split:           split,
+	}
+	s.applier = newPeerApplier(s)
+	if config.ACL {
+		s.acl = &aclEnforcer{iface: config.Interface}
+	}
+	if config.RelayFallback {
+		s.relay = newRelayer(wgState)
+	}
+	if config.TCPRelay != "" {
+		var tlsConfig *tls.Config
+		if config.TCPRelayTLS {
+			host, _, err := net.SplitHostPort(config.TCPRelay)
+			if err != nil {
+				logrus.WithError(err).Fatal("Invalid TCP relay address")
+			}
+			tlsConfig = &tls.Config{ServerName: host}
+		}
+		proxy, err := tcprelay.NewProxy(config.TCPRelay, tlsConfig)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up TCP relay")
+		}
+		defer proxy.Close()
+		s.tcp = newTCPFallback(wgState, serverPeer, proxy)
+		s.server = s.tcp.server()
+		if err := wgState.AddPeers([]wg.Peer{s.server}); err != nil {
+			logrus.WithError(err).Error("Could not configure keepalive to server")
+		}
+	}
+	if config.KeyRotationHours > 0 {
+		if config.KeyFile == "" {
+			logrus.Fatal("Key rotation requires a key file")
+		}
+		s.rotation, err = newRotator(wgState, config.KeyFile, time.Duration(config.KeyRotationHours)*time.Hour)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up key rotation")
+		}
+	}
+	clock, _ := t.(interface{ ClockOffset() (time.Duration, bool) })
+	var clockOffset func() (time.Duration, bool)
+	if clock != nil {
+		clockOffset = clock.ClockOffset
+	}
+	if config.ReportFailures {
+		go (&failureMonitor{
+			wgState:   wgState,
+			transport: t,
+			serverKey: serverPubkey,
+			mapping:   mapping,
+			clock:     clockOffset,
+		}).run()
+	}
+	if config.HandshakeDiagnosis > 0 {
+		watcher := newHandshakeWatcher(wgState, serverPubkey, config.HandshakeDiagnosis, clockOffset)
+		statusHandler.AddCollector(watcher.collect)
+		go watcher.run()
+	}
+	changed := make(chan struct{}, 1)
+	go watchPeers(t, refreshInterval, changed)
+	if discovery != nil {
+		go discovery.run(changed)
+	}
+	go s.expiry.run()
+	go s.applier.run()
+	moved := make(chan struct{}, 1)
+	go watchNetwork(config.Interface, moved)
+	if config.CaptivePortalURL != "" {
+		s.portal = newPortalDetector(config.CaptivePortalURL, time.Duration(config.CaptivePortalIntervalSecs)*time.Second)
+		go s.portal.run(changed)
+	}
 	timer := time.NewTimer(0)
+	// Refreshes run one at a time; a change seen meanwhile triggers another
+	refreshing, pending := false, false
+	refresh := func() {
+		if refreshing {
+			pending = true
+			return
+		}
+		refreshing = true
+		timer.Stop()
+		go s.refreshPeers(retry, delayCh)
+	}
 mainLoop:
 	for {
 		select {
 		case <-incomingSignals:
+			s.shutdown(time.Duration(config.DrainSecs)*time.Second, incomingSignals)
 			break mainLoop
+		case <-s.restart:
+			syncLog.Info("Restarting as told by the server")
+			if err := reexec(); err != nil {
+				logrus.WithError(err).Fatal("Could not restart")
+			}
+		case sig := <-debug:
+			if sig == syscall.SIGUSR2 {
+				s.dumpState()
+				continue
+			}
+			syncLog.Info("Refreshing peers as signalled")
+			retry.reset()
+			refresh()
 		case <-timer.C:
-			go refreshPeers(wgState, httpServerAddr, presharedKey, bf, delayCh)
+			refresh()
+		case <-changed:
+			// The server or the network changed, so failures are stale
+			retry.reset()
+			refresh()
+		case <-moved:
+			atomic.StoreInt32(&s.moved, 1)
+			retry.reset()
+			refresh()
+			if discovery != nil {
+				go func() {
+					if discovery.check() {
+						select {
+						case changed <- struct{}{}:
+						default:
+						}
+					}
+				}()
+			}
 		case delay := <-delayCh:
-			logrus.Debug("Next fetch in ", delay)
+			refreshing = false
+			if pending {
+				pending = false
+				refresh()
+				continue
+			}
+			syncLog.Debug("Next fetch in ", delay)
 			timer.Reset(delay)
 		}
 	}
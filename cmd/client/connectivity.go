@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The connectivity test echoes this many peers besides the server
+	testPeers    = 2
+	testInterval = 2 * time.Second
+	testTimeout  = 5 * time.Second
+)
+
+// check is the outcome of one step of the connectivity test
+type check struct {
+	name string
+	err  error
+}
+
+// testConnectivity checks the running client behind the control socket end
+// to end: it joined, the server answers on its overlay address, a couple of
+// peers answer echo probes, and the handshakes with all of them are recent.
+// The checks are repeated until they pass or the timeout elapses, so that it
+// can run right after the client is started. It prints a report and returns
+// an error if a check still fails.
+func testConnectivity(config *config.ClientConfig, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		checks := runChecks(config)
+		failed := 0
+		for _, c := range checks {
+			if c.err != nil {
+				failed++
+			}
+		}
+		if failed == 0 || time.Now().After(deadline) {
+			for _, c := range checks {
+				if c.err != nil {
+					fmt.Printf("FAIL %s: %s\n", c.name, c.err)
+				} else {
+					fmt.Printf("ok   %s\n", c.name)
+				}
+			}
+			if failed != 0 {
+				return errors.Errorf("%d of %d checks failed", failed, len(checks))
+			}
+			return nil
+		}
+		time.Sleep(testInterval)
+	}
+}
+
+func runChecks(config *config.ClientConfig) []check {
+	var sync status.Sync
+	if err := control.Call(config.ControlSocket, http.MethodGet, control.SyncPath, nil, &sync); err != nil {
+		return []check{{name: "control socket", err: err}}
+	}
+	if sync.LastSuccess.IsZero() {
+		err := errors.New("No peers fetched from the server yet")
+		if sync.LastError != "" {
+			err = errors.Errorf("No peers fetched from the server yet: %s", sync.LastError)
+		}
+		return []check{{name: "join", err: err}}
+	}
+	checks := []check{{name: "join"}}
+	if sync.Server == "" {
+		return append(checks, check{name: "server", err: errors.New("The client runs without a server")})
+	}
+	var st status.Status
+	if err := control.Call(config.ControlSocket, http.MethodGet, control.PeersPath, nil, &st); err != nil {
+		return append(checks, check{name: "peers", err: err})
+	}
+	nets, err := config.ExtraNetworks()
+	if err != nil {
+		return append(checks, check{name: "overlay networks", err: err})
+	}
+	nets = append([]net.IPNet{(net.IPNet)(*config.OverlayNet)}, nets...)
+
+	// The server answers on the overlay with its peer API
+	var server *status.PeerStatus
+	peers := make([]status.PeerStatus, 0, len(st.Peers))
+	for i := range st.Peers {
+		if st.Peers[i].PublicKey == sync.Server {
+			server = &st.Peers[i]
+		} else if overlayIP(st.Peers[i], nets) != nil {
+			peers = append(peers, st.Peers[i])
+		}
+	}
+	if server == nil {
+		return append(checks, check{name: "server", err: errors.New("The server is not a peer of the interface")})
+	}
+	name := "server " + server.PublicKey
+	ip := overlayIP(*server, nets)
+	if ip == nil {
+		return append(checks, check{name: name, err: errors.New("The server has no overlay address")})
+	}
+	err = wg.InNetns(config.Netns, func() error {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(config.ServerPort)), testTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	checks = append(checks, check{name: name + " at " + ip.String(), err: err})
+	tested := []string{server.PublicKey}
+
+	// Peers that handshook most recently are the most likely to answer
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastHandshakeTime.After(peers[j].LastHandshakeTime) })
+	if len(peers) > testPeers {
+		peers = peers[:testPeers]
+	}
+	for _, p := range peers {
+		ip := overlayIP(p, nets)
+		name := "peer " + p.PublicKey + " at " + ip.String()
+		if config.ProbePort == 0 {
+			checks = append(checks, check{name: name, err: errors.New("probe-port is not set, so peers do not answer echoes")})
+			continue
+		}
+		var rtt time.Duration
+		err := wg.InNetns(config.Netns, func() (err error) {
+			rtt, err = echo(ip, config.ProbePort)
+			return err
+		})
+		if err == nil {
+			name += fmt.Sprintf(" (%s)", rtt.Round(time.Microsecond))
+		}
+		checks = append(checks, check{name: name, err: err})
+		tested = append(tested, p.PublicKey)
+	}
+
+	// The traffic above handshakes if the sessions were idle, so read the
+	// handshakes again
+	if err := control.Call(config.ControlSocket, http.MethodGet, control.PeersPath, nil, &st); err != nil {
+		return append(checks, check{name: "peers", err: err})
+	}
+	handshakes := make(map[string]time.Time, len(st.Peers))
+	for _, p := range st.Peers {
+		handshakes[p.PublicKey] = p.LastHandshakeTime
+	}
+	now := time.Now()
+	for _, k := range tested {
+		c := check{name: "handshake with " + k}
+		if t := handshakes[k]; t.IsZero() {
+			c.err = errors.New("Never")
+		} else if now.Sub(t) > staleHandshake {
+			c.err = errors.Errorf("Last %s", ago(now, t))
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+func ago(now, t time.Time) string {
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
+
+// overlayIP returns the first overlay address among the allowed IPs of the
+// peer, if any
+func overlayIP(p status.PeerStatus, nets []net.IPNet) net.IP {
+	for _, a := range p.AllowedIPs {
+		ip, n, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		if ones, bits := n.Mask.Size(); ones == bits {
+			for _, o := range nets {
+				if o.Contains(ip) {
+					return ip
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// echo sends a probe to the prober of the peer and waits for the answer
+func echo(ip net.IP, port int) (time.Duration, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	seq := uint64(time.Now().UnixNano())
+	buf := make([]byte, probeSize)
+	copy(buf, probeMagic[:])
+	buf[4] = probeRequest
+	binary.BigEndian.PutUint64(buf[5:], seq)
+	sent := time.Now()
+	conn.SetDeadline(sent.Add(testTimeout))
+	if _, err := conn.Write(buf); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, probeSize)
+	for {
+		n, err := conn.Read(reply)
+		if err != nil {
+			return 0, errors.Wrap(err, "No answer to echo")
+		}
+		if n == probeSize && [4]byte{reply[0], reply[1], reply[2], reply[3]} == probeMagic &&
+			reply[4] == probeReply && binary.BigEndian.Uint64(reply[5:]) == seq {
+			return time.Since(sent), nil
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/portmap"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var diagnosticsLog = logging.For("diagnostics")
+
+const (
+	failureCheckInterval = time.Minute
+	// Wireguard rekeys every two minutes while there is traffic
+	staleHandshake = 3 * time.Minute
+	// Consecutive failed checks before a peer is reported
+	failureThreshold = 3
+	maxEndpoints     = 8
+)
+
+type peerHealth struct {
+	tx, rx int64
+	// recent is set when a handshake succeeded lately
+	recent    bool
+	failures  int
+	since     time.Time
+	endpoints []string
+	reported  bool
+}
+
+// failureMonitor reports peers that are sent traffic but never answer
+type failureMonitor struct {
+	wgState   *wg.State
+	transport transport.Transport
+	serverKey wgtypes.Key
+	mapping   *portmap.PortMapping
+	// clock returns the offset of the clock of the server, if known
+	clock  func() (time.Duration, bool)
+	health map[wgtypes.Key]*peerHealth
+}
+
+func (m *failureMonitor) run() {
+	m.health = make(map[wgtypes.Key]*peerHealth)
+	ticker := time.NewTicker(failureCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := m.check(time.Now()); err != nil {
+			diagnosticsLog.WithError(err).Debug("Could not check peers for failures")
+		}
+	}
+}
+
+func (m *failureMonitor) check(now time.Time) error {
+	stats, err := m.wgState.GetPeerStats()
+	if err != nil {
+		return err
+	}
+	serverReachable := false
+	for _, p := range stats {
+		if p.PublicKey == m.serverKey {
+			serverReachable = !p.LastHandshake.IsZero() && now.Sub(p.LastHandshake) <= staleHandshake
+		}
+	}
+	var offset time.Duration
+	var clocked bool
+	if m.clock != nil {
+		offset, clocked = m.clock()
+	}
+	seen := make(map[wgtypes.Key]bool, len(stats))
+	for _, p := range stats {
+		// Reports go through the server, so its failures cannot be reported
+		if p.PublicKey == m.serverKey {
+			continue
+		}
+		seen[p.PublicKey] = true
+		h, ok := m.health[p.PublicKey]
+		if !ok {
+			m.health[p.PublicKey] = &peerHealth{tx: p.TxBytes, rx: p.RxBytes}
+			continue
+		}
+		stale := p.LastHandshake.IsZero() || now.Sub(p.LastHandshake) > staleHandshake
+		failing := stale && p.TxBytes > h.tx && p.RxBytes == h.rx
+		h.tx, h.rx = p.TxBytes, p.RxBytes
+		if !failing {
+			if h.reported {
+				diagnosticsLog.WithField("peer", p.PublicKey.String()).Info("Peer is reachable again")
+			}
+			*h = peerHealth{tx: p.TxBytes, rx: p.RxBytes}
+			continue
+		}
+		if h.since.IsZero() {
+			h.since = now
+		}
+		h.failures++
+		if p.Endpoint != nil && len(h.endpoints) < maxEndpoints && !contains(h.endpoints, p.Endpoint.String()) {
+			h.endpoints = append(h.endpoints, p.Endpoint.String())
+		}
+		if h.failures < failureThreshold || h.reported {
+			continue
+		}
+		diag := protocol.Diagnostic{
+			Peer:          p.PublicKey,
+			Endpoints:     h.endpoints,
+			FailingSince:  h.since.UTC(),
+			LastHandshake: p.LastHandshake,
+			TxBytes:       p.TxBytes,
+			RxBytes:       p.RxBytes,
+			Error:         "no handshake completed",
+			NAT:           m.natType(p.Endpoint),
+		}
+		if !p.LastHandshake.IsZero() {
+			diag.Error = fmt.Sprintf("no handshake for %s", now.Sub(p.LastHandshake).Round(time.Second))
+		}
+		diag.Cause, _ = diagnoseHandshake(handshakeObservation{
+			endpoint:        p.Endpoint,
+			lastHandshake:   p.LastHandshake,
+			rxBytes:         p.RxBytes,
+			serverReachable: serverReachable,
+			clockOffset:     offset,
+			clocked:         clocked,
+		})
+		if err := m.transport.ReportFailure(diag); err != nil {
+			diagnosticsLog.WithError(err).WithField("peer", p.PublicKey.String()).Warn("Could not report failure to reach peer")
+			continue
+		}
+		diagnosticsLog.WithField("peer", p.PublicKey.String()).Warn("Cannot reach peer; reported to server")
+		h.reported = true
+	}
+	for k := range m.health {
+		if !seen[k] {
+			delete(m.health, k)
+		}
+	}
+	return nil
+}
+
+// natType guesses how this client is reachable from the peer's address family
+func (m *failureMonitor) natType(endpoint *net.UDPAddr) string {
+	// The port counts as mapped only once the router has mapped it
+	if m.mapping != nil && m.mapping.External() != nil {
+		return "port-mapped"
+	}
+	v4 := endpoint == nil || endpoint.IP.To4() != nil
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "unknown"
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() || (ipnet.IP.To4() != nil) != v4 {
+			continue
+		}
+		if v4 && isPrivateIPv4(ipnet.IP) {
+			continue
+		}
+		return "public"
+	}
+	return "nat"
+}
+
+func isPrivateIPv4(ip net.IP) bool {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
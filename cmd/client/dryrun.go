@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jimzhong/wireguard-overlay/internal/underlay"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// planServerPeer prints how the server would be configured as a peer during a
+// dry run. The other peers are fetched from the server through the tunnel, so
+// they cannot be shown.
+func planServerPeer(wgState *wg.State, serverAddr, serverPubkey string, serverPort int, nat64Config, discovery string) error {
+	if discovery != "" {
+		fmt.Printf("Peers are discovered through %s and are not shown\n", discovery)
+		return nil
+	}
+	key, err := wgtypes.ParseKey(serverPubkey)
+	if err != nil {
+		return errors.Wrap(err, "Could not parse server key")
+	}
+	hasIPv4, err := underlay.HasIPv4()
+	if err != nil {
+		hasIPv4 = true
+	}
+	nat64, err := nat64Prefix(nat64Config, hasIPv4)
+	if err != nil {
+		return err
+	}
+	serverIP, err := underlay.ResolveHost(serverAddr, hasIPv4)
+	if err != nil {
+		return errors.Wrap(err, "Could not resolve server address")
+	}
+	if err := wgState.AddPeers([]wg.Peer{{
+		PublicKey: key,
+		IP:        underlay.Synthesize(nat64, serverIP).String(),
+		Port:      serverPort,
+	}}); err != nil {
+		return err
+	}
+	fmt.Println("Peers are fetched from the server through the tunnel and are not shown")
+	return nil
+}
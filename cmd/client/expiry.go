@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Lapsed records are looked for this often
+const expiryCheckInterval = 5 * time.Second
+
+// expirations are when the records of the peers applied last lapse. A peer
+// whose record lapsed is removed from the device, whether or not the server
+// can still be reached to renew it.
+type expirations struct {
+	wgState *wg.State
+	mu      sync.Mutex
+	expires map[wgtypes.Key]time.Time
+}
+
+func newExpirations(wgState *wg.State) *expirations {
+	return &expirations{wgState: wgState, expires: make(map[wgtypes.Key]time.Time)}
+}
+
+// filter leaves out the peers whose records lapsed and keeps the expiry of
+// the others, replacing those of the previous list
+func (e *expirations) filter(peers []wg.Peer, now time.Time) []wg.Peer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expires = make(map[wgtypes.Key]time.Time)
+	kept := peers[:0]
+	for _, p := range peers {
+		// The client never removes itself
+		if p.Expires.IsZero() || p.PublicKey == e.wgState.PublicKey() {
+			kept = append(kept, p)
+			continue
+		}
+		if !now.Before(p.Expires) {
+			syncLog.WithField("peer", p.PublicKey.String()).Debug("Left out peer whose record lapsed")
+			continue
+		}
+		e.expires[p.PublicKey] = p.Expires
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// earliest returns when the first record lapses, or the zero time if none
+// does
+func (e *expirations) earliest() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var earliest time.Time
+	for _, t := range e.expires {
+		if earliest.IsZero() || t.Before(earliest) {
+			earliest = t
+		}
+	}
+	return earliest
+}
+
+// run removes the peers whose records lapsed from the device
+func (e *expirations) run() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		var lapsed []wgtypes.Key
+		e.mu.Lock()
+		for k, t := range e.expires {
+			if !now.Before(t) {
+				lapsed = append(lapsed, k)
+				delete(e.expires, k)
+			}
+		}
+		e.mu.Unlock()
+		if len(lapsed) == 0 {
+			continue
+		}
+		if err := e.wgState.RemovePeers(lapsed); err != nil {
+			syncLog.WithError(err).Error("Could not remove peers whose records lapsed")
+			continue
+		}
+		for _, k := range lapsed {
+			syncLog.WithField("peer", k.String()).Warn("Removed peer whose record lapsed")
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var gossipLog = logging.For("gossip")
+
+// gossipMeta is the peer record a node gossips about itself
+type gossipMeta struct {
+	PublicKey wgtypes.Key    `json:"public_key"`
+	Port      int            `json:"port"`
+	Version   derive.Version `json:"version"`
+}
+
+// gossipDelegate hands the record of the node to memberlist
+type gossipDelegate struct {
+	meta []byte
+}
+
+func (d *gossipDelegate) NodeMeta(limit int) []byte {
+	return d.meta
+}
+
+func (d *gossipDelegate) NotifyMsg([]byte)                           {}
+func (d *gossipDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *gossipDelegate) LocalState(join bool) []byte                { return nil }
+func (d *gossipDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// gossipEvents triggers a refresh when members join, leave or change
+type gossipEvents struct {
+	changed chan struct{}
+}
+
+func (e *gossipEvents) notify() {
+	select {
+	case e.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (e *gossipEvents) NotifyJoin(*memberlist.Node)   { e.notify() }
+func (e *gossipEvents) NotifyLeave(*memberlist.Node)  { e.notify() }
+func (e *gossipEvents) NotifyUpdate(*memberlist.Node) { e.notify() }
+
+// gossip discovers peers without a server: nodes sharing the cluster key
+// gossip their records over the underlay and configure each other as peers.
+// Records of wesher nodes are understood as well.
+type gossip struct {
+	wgState      *wg.State
+	presharedKey wgtypes.Key
+	members      *memberlist.Memberlist
+	events       *gossipEvents
+	join         []string
+	// wgPort is the port of wesher nodes, which all use the same one
+	wgPort int
+}
+
+// newGossip starts gossiping. With wesherName set, the node gossips as the
+// wesher node of that name, with the address wesher derives from it.
+func newGossip(wgState *wg.State, presharedKey wgtypes.Key, clusterKey string, port int, advertise string, join []string, wesherName string) (*gossip, error) {
+	key, err := base64.StdEncoding.DecodeString(clusterKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not decode cluster key")
+	}
+	wgPort, err := wgState.ListenPort()
+	if err != nil {
+		return nil, err
+	}
+	name := wgState.PublicKey().String()
+	var meta []byte
+	if wesherName != "" {
+		name = wesherName
+		addr := wesherAddress(wgState.OverlayNetwork, name)
+		if err := wgState.AssignAddresses([]net.IP{addr.IP}); err != nil {
+			return nil, errors.Wrap(err, "Could not configure wesher address")
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(wesherMeta{OverlayAddr: addr, PubKey: wgState.PublicKey().String()}); err != nil {
+			return nil, err
+		}
+		meta = buf.Bytes()
+	} else if meta, err = json.Marshal(gossipMeta{PublicKey: wgState.PublicKey(), Port: wgPort, Version: derive.Current}); err != nil {
+		return nil, err
+	}
+	conf := memberlist.DefaultWANConfig()
+	conf.Name = name
+	conf.BindPort = port
+	conf.AdvertisePort = port
+	conf.AdvertiseAddr = advertise
+	conf.SecretKey = key
+	conf.Delegate = &gossipDelegate{meta: meta}
+	events := &gossipEvents{changed: make(chan struct{}, 1)}
+	conf.Events = events
+	conf.Logger = log.New(gossipLog.WriterLevel(logrus.DebugLevel), "", 0)
+	if !gossipLog.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		conf.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	members, err := memberlist.Create(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not start gossip")
+	}
+	return &gossip{wgState: wgState, presharedKey: presharedKey, members: members, events: events, join: join, wgPort: wgPort}, nil
+}
+
+// peers returns the other members as wireguard peers
+func (g *gossip) peers() []wg.Peer {
+	var peers []wg.Peer
+	for _, m := range g.members.Members() {
+		p, err := g.peer(m)
+		if err != nil {
+			gossipLog.WithError(err).Warn("Ignored gossip member with invalid record ", m.Name)
+			continue
+		}
+		if p.PublicKey == g.wgState.PublicKey() {
+			continue
+		}
+		p.IP = m.Addr.String()
+		p.PresharedKey = g.presharedKey
+		if strings.Count(p.IP, ".") == 3 {
+			p.KeepaliveInterval = 20 * time.Second
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// peer decodes the record of a member, which is either ours or that of a
+// wesher node
+func (g *gossip) peer(m *memberlist.Node) (wg.Peer, error) {
+	var meta gossipMeta
+	if err := json.Unmarshal(m.Meta, &meta); err == nil {
+		return wg.Peer{Port: meta.Port, PublicKey: meta.PublicKey, AddressVersion: meta.Version}, nil
+	}
+	var wesher wesherMeta
+	if err := gob.NewDecoder(bytes.NewReader(m.Meta)).Decode(&wesher); err != nil {
+		return wg.Peer{}, errors.New("Neither our record nor that of wesher")
+	}
+	key, err := wgtypes.ParseKey(wesher.PubKey)
+	if err != nil {
+		return wg.Peer{}, errors.Wrap(err, "Invalid key in wesher record")
+	}
+	return wg.Peer{
+		Port:       g.wgPort,
+		PublicKey:  key,
+		Addresses:  []net.IP{wesher.OverlayAddr.IP},
+		AllowedIPs: wesher.Routes,
+	}, nil
+}
+
+// refresh joins the cluster if the node is alone and configures the members
+func (g *gossip) refresh() {
+	if g.members.NumMembers() <= 1 && len(g.join) != 0 {
+		if n, err := g.members.Join(g.join); err != nil {
+			gossipLog.WithError(err).Warn("Could not join gossip cluster")
+		} else {
+			gossipLog.Infof("Joined gossip cluster through %d nodes", n)
+		}
+	}
+	peers := g.peers()
+	if err := g.wgState.AddPeers(peers); err != nil {
+		gossipLog.WithError(err).Error("Could not add peers")
+	}
+	if err := (&syncer{wgState: g.wgState}).removeStalePeers(peers); err != nil {
+		gossipLog.WithError(err).Error("Could not remove peers")
+	}
+}
+
+// run keeps the peers in sync with the cluster until the process is told to
+// exit
+func (g *gossip) run(interval time.Duration) {
+	incomingSignals := make(chan os.Signal, 1)
+	signal.Notify(incomingSignals, syscall.SIGTERM, os.Interrupt)
+	debug := debugSignals()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	g.refresh()
+	for {
+		select {
+		case <-incomingSignals:
+			if err := g.members.Leave(time.Second); err != nil {
+				gossipLog.WithError(err).Warn("Could not leave gossip cluster")
+			}
+			if err := g.members.Shutdown(); err != nil {
+				gossipLog.WithError(err).Warn("Could not stop gossip")
+			}
+			return
+		case sig := <-debug:
+			if sig == syscall.SIGUSR2 {
+				dumpPeers(gossipLog, g.wgState, wgtypes.Key{}, nil)
+				continue
+			}
+			gossipLog.Info("Refreshing peers as signalled")
+			g.refresh()
+		case <-ticker.C:
+			g.refresh()
+		case <-g.events.changed:
+			g.refresh()
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// Wireguard handshakes this often with a peer it sends traffic to
+	handshakeInterval = 2 * time.Minute
+	// Clocks further apart than this are diagnosed as skewed
+	maxClockSkew = time.Minute
+)
+
+// Likely causes of failing handshakes
+const (
+	causeNoEndpoint  = "no_endpoint"
+	causeUDPBlocked  = "udp_blocked"
+	causeKeyMismatch = "key_mismatch"
+	causeClockSkew   = "clock_skew"
+)
+
+var handshakeCauses = []string{causeNoEndpoint, causeUDPBlocked, causeKeyMismatch, causeClockSkew}
+
+// handshakeObservation is what is known about a peer whose handshakes fail
+type handshakeObservation struct {
+	endpoint      *net.UDPAddr
+	lastHandshake time.Time
+	rxBytes       int64
+	// server is set if the peer is the server, and serverReachable if a
+	// handshake with the server succeeded lately
+	server          bool
+	serverReachable bool
+	// clockOffset is how far the clock of the server is ahead, if known
+	clockOffset time.Duration
+	clocked     bool
+}
+
+// diagnoseHandshake returns the likely cause of the failing handshakes with a
+// peer and an explanation for the operator
+func diagnoseHandshake(o handshakeObservation) (string, string) {
+	if o.endpoint == nil {
+		return causeNoEndpoint, "The peer has no endpoint; it may not have registered, or only be reachable through the server"
+	}
+	if !o.server && !o.serverReachable {
+		return causeUDPBlocked, fmt.Sprintf("No handshake with the server either; UDP from this node is likely blocked, e.g. to %s", o.endpoint)
+	}
+	if skew := o.clockOffset; o.clocked && (skew > maxClockSkew || skew < -maxClockSkew) {
+		return causeClockSkew, fmt.Sprintf("The clock is %s off the server's; handshakes timestamped before earlier ones and signed registrations are rejected", skew.Round(time.Second))
+	}
+	if o.rxBytes > 0 || !o.lastHandshake.IsZero() {
+		return causeKeyMismatch, "The peer answered before but no handshake completes; one side likely has an outdated key of the other, e.g. after a rotation or reinstall"
+	}
+	return causeUDPBlocked, fmt.Sprintf("Nothing ever arrived from %s; UDP is likely blocked or filtered on the path or at the peer", o.endpoint)
+}
+
+type handshakeState struct {
+	tx int64
+	// since is when the handshakes started failing while sending, and cause
+	// is set once they are diagnosed
+	since time.Time
+	cause string
+}
+
+// handshakeWatcher diagnoses the peers that are sent traffic but do not
+// handshake within the given number of intervals, so that they are logged
+// and counted instead of silently dropping traffic
+type handshakeWatcher struct {
+	wgState   *wg.State
+	serverKey wgtypes.Key
+	after     time.Duration
+	// clock returns the offset of the clock of the server, if the transport
+	// knows it
+	clock func() (time.Duration, bool)
+	mu    sync.Mutex
+	peers map[wgtypes.Key]*handshakeState
+}
+
+func newHandshakeWatcher(wgState *wg.State, serverKey wgtypes.Key, intervals int, clock func() (time.Duration, bool)) *handshakeWatcher {
+	return &handshakeWatcher{
+		wgState:   wgState,
+		serverKey: serverKey,
+		after:     time.Duration(intervals) * handshakeInterval,
+		clock:     clock,
+		peers:     make(map[wgtypes.Key]*handshakeState),
+	}
+}
+
+func (w *handshakeWatcher) run() {
+	ticker := time.NewTicker(failureCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := w.check(time.Now()); err != nil {
+			diagnosticsLog.WithError(err).Debug("Could not check handshakes")
+		}
+	}
+}
+
+func (w *handshakeWatcher) check(now time.Time) error {
+	stats, err := w.wgState.GetPeerStats()
+	if err != nil {
+		return err
+	}
+	recent := func(p wg.PeerStats) bool {
+		return !p.LastHandshake.IsZero() && now.Sub(p.LastHandshake) <= staleHandshake
+	}
+	serverReachable := false
+	for _, p := range stats {
+		if p.PublicKey == w.serverKey {
+			serverReachable = recent(p)
+		}
+	}
+	var offset time.Duration
+	var clocked bool
+	if w.clock != nil {
+		offset, clocked = w.clock()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seen := make(map[wgtypes.Key]bool, len(stats))
+	for _, p := range stats {
+		seen[p.PublicKey] = true
+		st, ok := w.peers[p.PublicKey]
+		if !ok {
+			w.peers[p.PublicKey] = &handshakeState{tx: p.TxBytes}
+			continue
+		}
+		sending := p.TxBytes > st.tx
+		st.tx = p.TxBytes
+		log := diagnosticsLog.WithField("peer", p.PublicKey.String())
+		switch {
+		case recent(p):
+			if st.cause != "" {
+				log.Info("Handshakes with peer work again")
+			}
+			*st = handshakeState{tx: p.TxBytes}
+			continue
+		case !sending:
+			// Idle peers do not handshake
+			*st = handshakeState{tx: p.TxBytes}
+			continue
+		case st.since.IsZero():
+			st.since = now
+		}
+		if st.cause != "" || now.Sub(st.since) < w.after {
+			continue
+		}
+		cause, explanation := diagnoseHandshake(handshakeObservation{
+			endpoint:        p.Endpoint,
+			lastHandshake:   p.LastHandshake,
+			rxBytes:         p.RxBytes,
+			server:          p.PublicKey == w.serverKey,
+			serverReachable: serverReachable,
+			clockOffset:     offset,
+			clocked:         clocked,
+		})
+		st.cause = cause
+		fields := map[string]interface{}{
+			"cause":       cause,
+			"failing_for": now.Sub(st.since).Round(time.Second).String(),
+		}
+		if p.Endpoint != nil {
+			fields["endpoint"] = p.Endpoint.String()
+		}
+		if !p.LastHandshake.IsZero() {
+			fields["last_handshake"] = p.LastHandshake.UTC().Format(time.RFC3339)
+		}
+		log.WithFields(fields).Warn(explanation)
+	}
+	for k := range w.peers {
+		if !seen[k] {
+			delete(w.peers, k)
+		}
+	}
+	return nil
+}
+
+// collect exports the number of peers with failing handshakes by likely cause
+func (w *handshakeWatcher) collect(m *status.Metrics) {
+	w.mu.Lock()
+	counts := make(map[string]int, len(handshakeCauses))
+	for _, st := range w.peers {
+		if st.cause != "" {
+			counts[st.cause]++
+		}
+	}
+	w.mu.Unlock()
+	causes := append([]string(nil), handshakeCauses...)
+	sort.Strings(causes)
+	samples := make([]status.Sample, 0, len(causes))
+	for _, cause := range causes {
+		samples = append(samples, status.Sample{Labels: status.Label("cause", cause), Value: float64(counts[cause])})
+	}
+	m.Write("wireguard_overlay_handshake_failures", "gauge", "Number of peers sent traffic without a handshake for handshake-diagnosis intervals, by likely cause.", samples...)
+}
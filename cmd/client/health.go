@@ -0,0 +1,105 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How long direct connectivity must fail before a peer counts as unreachable
+const unreachableAfter = time.Minute
+
+// healthTracker follows the handshakes and traffic of the peers to tell
+// which ones cannot be reached directly
+type healthTracker struct {
+	wgState   *wg.State
+	serverKey wgtypes.Key
+	health    map[wgtypes.Key]*peerHealth
+}
+
+func newHealthTracker(wgState *wg.State, serverKey wgtypes.Key) *healthTracker {
+	return &healthTracker{
+		wgState:   wgState,
+		serverKey: serverKey,
+		health:    make(map[wgtypes.Key]*peerHealth),
+	}
+}
+
+func (t *healthTracker) update(now time.Time) error {
+	stats, err := t.wgState.GetPeerStats()
+	if err != nil {
+		return err
+	}
+	seen := make(map[wgtypes.Key]bool, len(stats))
+	for _, p := range stats {
+		if p.PublicKey == t.serverKey {
+			continue
+		}
+		seen[p.PublicKey] = true
+		h, ok := t.health[p.PublicKey]
+		if !ok {
+			t.health[p.PublicKey] = &peerHealth{tx: p.TxBytes, rx: p.RxBytes}
+			continue
+		}
+		h.recent = !p.LastHandshake.IsZero() && now.Sub(p.LastHandshake) <= staleHandshake
+		// Idle peers neither fail nor recover
+		failing := !h.recent && p.TxBytes > h.tx && p.RxBytes == h.rx
+		h.tx, h.rx = p.TxBytes, p.RxBytes
+		if failing && h.since.IsZero() {
+			h.since = now
+		} else if h.recent {
+			h.since = time.Time{}
+		}
+	}
+	for k := range t.health {
+		if !seen[k] {
+			delete(t.health, k)
+		}
+	}
+	return nil
+}
+
+// reachable reports whether a direct handshake with the peer succeeded lately
+func (t *healthTracker) reachable(key wgtypes.Key) bool {
+	h, ok := t.health[key]
+	return ok && h.recent
+}
+
+// failing reports whether the handshakes with the peer fail while there is
+// traffic to it
+func (t *healthTracker) failing(key wgtypes.Key) bool {
+	h, ok := t.health[key]
+	return ok && !h.since.IsZero()
+}
+
+// keys returns the tracked peers
+func (t *healthTracker) keys() []wgtypes.Key {
+	keys := make([]wgtypes.Key, 0, len(t.health))
+	for k := range t.health {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// failures returns since when the failing peers fail
+func (t *healthTracker) failures() map[wgtypes.Key]time.Time {
+	failures := make(map[wgtypes.Key]time.Time)
+	for k, h := range t.health {
+		if !h.since.IsZero() {
+			failures[k] = h.since
+		}
+	}
+	return failures
+}
+
+// unreachable returns the peers that failed to handshake for a while
+func (t *healthTracker) unreachable(now time.Time) []wgtypes.Key {
+	var keys []wgtypes.Key
+	for k, h := range t.health {
+		if !h.since.IsZero() && now.Sub(h.since) >= unreachableAfter {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The round trip times to the hubs are measured this often
+const hubProbeInterval = time.Minute
+
+// regionHubs tracks the region hubs of the overlay. It measures the round trip time
+// to their endpoints, so that the client reports the nearest one, and turns
+// the client into a forwarding hub when the server made it one.
+type regionHubs struct {
+	wgState *wg.State
+	probes  *prober
+	// port is the probe port of the hubs, 0 if round trip times are not
+	// measured
+	port      int
+	mu        sync.Mutex
+	endpoints map[wgtypes.Key]net.IP
+	rtts      map[wgtypes.Key]time.Duration
+	region    string
+}
+
+func newRegionHubs(wgState *wg.State, probes *prober, port int) *regionHubs {
+	return &regionHubs{wgState: wgState, probes: probes, port: port, rtts: make(map[wgtypes.Key]time.Duration)}
+}
+
+// observe learns the hubs from the peer list. If the own record makes the
+// client a hub, it forwards between its peers and answers probes from the
+// underlay from then on.
+func (h *regionHubs) observe(peers []wg.Peer, own *wg.Peer) {
+	endpoints := make(map[wgtypes.Key]net.IP)
+	for _, p := range peers {
+		if ip := net.ParseIP(p.IP); p.Hub != "" && ip != nil && p.PublicKey != h.wgState.PublicKey() {
+			endpoints[p.PublicKey] = ip
+		}
+	}
+	h.mu.Lock()
+	h.endpoints = endpoints
+	becomes := own != nil && own.Hub != "" && h.region == ""
+	if becomes {
+		h.region = own.Hub
+	}
+	h.mu.Unlock()
+	if !becomes {
+		return
+	}
+	syncLog.Info("Forwarding as hub of region ", own.Hub)
+	if err := h.wgState.EnableForwarding(); err != nil {
+		syncLog.WithError(err).Error("Could not enable forwarding as hub")
+	}
+	if h.probes != nil {
+		h.probes.answerUnderlay()
+	}
+}
+
+// run measures the round trip times to the hubs
+func (h *regionHubs) run() {
+	for {
+		h.mu.Lock()
+		endpoints := h.endpoints
+		h.mu.Unlock()
+		rtts := make(map[wgtypes.Key]time.Duration, len(endpoints))
+		for k, ip := range endpoints {
+			rtt, err := echo(ip, h.port)
+			if err != nil {
+				syncLog.WithField("peer", k.String()).WithError(err).Debug("Could not measure round trip time to hub")
+				continue
+			}
+			rtts[k] = rtt
+		}
+		h.mu.Lock()
+		h.rtts = rtts
+		h.mu.Unlock()
+		time.Sleep(hubProbeInterval)
+	}
+}
+
+// nearest returns the hub with the lowest round trip time, or the zero key if
+// none answered
+func (h *regionHubs) nearest() wgtypes.Key {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var nearest wgtypes.Key
+	var lowest time.Duration
+	for k, rtt := range h.rtts {
+		if lowest == 0 || rtt < lowest {
+			nearest, lowest = k, rtt
+		}
+	}
+	return nearest
+}
+
+// routeThroughHubs leaves out the peers reached through a hub and moves their
+// addresses and routes to the hub. Peers whose hub is not among the peers are
+// configured directly.
+func routeThroughHubs(wgState *wg.State, peers []wg.Peer) []wg.Peer {
+	direct := make([]wg.Peer, 0, len(peers))
+	position := make(map[wgtypes.Key]int, len(peers))
+	for _, p := range peers {
+		if p.Via == (wgtypes.Key{}) {
+			position[p.PublicKey] = len(direct)
+			direct = append(direct, p)
+		}
+	}
+	moved := make(map[wgtypes.Key]bool)
+	for _, p := range peers {
+		if p.Via == (wgtypes.Key{}) {
+			continue
+		}
+		i, ok := position[p.Via]
+		if !ok {
+			direct = append(direct, p)
+			continue
+		}
+		hub := &direct[i]
+		if !moved[hub.PublicKey] {
+			hub.Addresses = wgState.PeerAddresses(*hub)
+			hub.AllowedIPs = append([]net.IPNet(nil), hub.AllowedIPs...)
+			moved[hub.PublicKey] = true
+		}
+		hub.Addresses = append(hub.Addresses, wgState.PeerAddresses(p)...)
+		hub.AllowedIPs = append(hub.AllowedIPs, p.AllowedIPs...)
+	}
+	return direct
+}
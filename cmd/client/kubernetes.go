@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/kube"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var kubeLog = logging.For("kube")
+
+// The record of a node is kept in these annotations of its node object
+const (
+	kubeKeyAnnotation      = "wireguard-overlay/public-key"
+	kubeEndpointAnnotation = "wireguard-overlay/endpoint"
+	kubeVersionAnnotation  = "wireguard-overlay/address-version"
+)
+
+// kubeDiscovery discovers peers without a server: each node publishes its
+// record as annotations of its Kubernetes node and configures the other
+// annotated nodes as peers
+type kubeDiscovery struct {
+	wgState      *wg.State
+	presharedKey wgtypes.Key
+	client       *kube.Client
+	node         string
+	advertise    string
+	podRoutes    bool
+}
+
+func newKubeDiscovery(wgState *wg.State, presharedKey wgtypes.Key, node, advertise string, podRoutes bool) (*kubeDiscovery, error) {
+	client, err := kube.InCluster()
+	if err != nil {
+		return nil, err
+	}
+	if node == "" {
+		if node, err = os.Hostname(); err != nil {
+			return nil, errors.Wrap(err, "Could not get node name")
+		}
+	}
+	return &kubeDiscovery{
+		wgState:      wgState,
+		presharedKey: presharedKey,
+		client:       client,
+		node:         node,
+		advertise:    advertise,
+		podRoutes:    podRoutes,
+	}, nil
+}
+
+// publish annotates the node with its record, unless it is unchanged. The
+// endpoint is the advertised address or the InternalIP of the node.
+func (k *kubeDiscovery) publish(self *kube.Node) error {
+	port, err := k.wgState.ListenPort()
+	if err != nil {
+		return err
+	}
+	host := k.advertise
+	if host == "" {
+		ip := self.InternalIP()
+		if ip == nil {
+			return errors.Errorf("Node %s has no InternalIP to advertise", k.node)
+		}
+		host = ip.String()
+	}
+	endpoint := net.JoinHostPort(host, strconv.Itoa(port))
+	key := k.wgState.PublicKey().String()
+	version := strconv.Itoa(int(derive.Current))
+	a := self.Metadata.Annotations
+	if a[kubeKeyAnnotation] == key && a[kubeEndpointAnnotation] == endpoint && a[kubeVersionAnnotation] == version {
+		return nil
+	}
+	if err := k.client.Annotate(k.node, map[string]*string{
+		kubeKeyAnnotation:      &key,
+		kubeEndpointAnnotation: &endpoint,
+		kubeVersionAnnotation:  &version,
+	}); err != nil {
+		return err
+	}
+	kubeLog.Infof("Published endpoint %s on node %s", endpoint, k.node)
+	return nil
+}
+
+// unpublish removes the record, so that the other nodes drop the node
+func (k *kubeDiscovery) unpublish() error {
+	return k.client.Annotate(k.node, map[string]*string{
+		kubeKeyAnnotation:      nil,
+		kubeEndpointAnnotation: nil,
+		kubeVersionAnnotation:  nil,
+	})
+}
+
+// peers returns the other annotated nodes as wireguard peers, with their pod
+// networks as allowed IPs if pod routes are enabled
+func (k *kubeDiscovery) peers(nodes []kube.Node) []wg.Peer {
+	var peers []wg.Peer
+	for i := range nodes {
+		n := &nodes[i]
+		a := n.Metadata.Annotations
+		if n.Metadata.Name == k.node || a[kubeKeyAnnotation] == "" {
+			continue
+		}
+		log := kubeLog.WithField("node", n.Metadata.Name)
+		key, err := wgtypes.ParseKey(a[kubeKeyAnnotation])
+		if err != nil {
+			log.WithError(err).Warn("Ignored node with invalid public key")
+			continue
+		}
+		host, port, err := net.SplitHostPort(a[kubeEndpointAnnotation])
+		if err != nil {
+			log.WithError(err).Warn("Ignored node with invalid endpoint")
+			continue
+		}
+		p := wg.Peer{
+			IP:             host,
+			PublicKey:      key,
+			PresharedKey:   k.presharedKey,
+			AddressVersion: derive.Current,
+		}
+		if p.Port, err = strconv.Atoi(port); err != nil {
+			log.WithError(err).Warn("Ignored node with invalid endpoint")
+			continue
+		}
+		if v, err := strconv.Atoi(a[kubeVersionAnnotation]); err == nil {
+			p.AddressVersion = derive.Version(v)
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			p.KeepaliveInterval = 20 * time.Second
+		}
+		if k.podRoutes {
+			p.AllowedIPs = n.PodCIDRs()
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// refresh publishes the record of the node and configures the other nodes
+func (k *kubeDiscovery) refresh() {
+	nodes, err := k.client.Nodes()
+	if err != nil {
+		kubeLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	found := false
+	for i := range nodes {
+		if nodes[i].Metadata.Name == k.node {
+			found = true
+			if err := k.publish(&nodes[i]); err != nil {
+				kubeLog.WithError(err).Warn("Could not publish node record")
+			}
+		}
+	}
+	if !found {
+		kubeLog.Warnf("Node %s does not exist, so its record is not published", k.node)
+	}
+	peers := k.peers(nodes)
+	if err := k.wgState.AddPeers(peers); err != nil {
+		kubeLog.WithError(err).Error("Could not add peers")
+	}
+	if err := (&syncer{wgState: k.wgState}).removeStalePeers(peers); err != nil {
+		kubeLog.WithError(err).Error("Could not remove peers")
+	}
+}
+
+// run keeps the peers in sync with the annotated nodes until the process is
+// told to exit
+func (k *kubeDiscovery) run(interval time.Duration) {
+	incomingSignals := make(chan os.Signal, 1)
+	signal.Notify(incomingSignals, syscall.SIGTERM, os.Interrupt)
+	debug := debugSignals()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	k.refresh()
+	for {
+		select {
+		case <-incomingSignals:
+			if err := k.unpublish(); err != nil {
+				kubeLog.WithError(err).Warn("Could not remove node record")
+			}
+			return
+		case sig := <-debug:
+			if sig == syscall.SIGUSR2 {
+				dumpPeers(kubeLog, k.wgState, wgtypes.Key{}, nil)
+				continue
+			}
+			kubeLog.Info("Refreshing peers as signalled")
+			k.refresh()
+		case <-ticker.C:
+			k.refresh()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parsePortRange parses first-last, or a single port
+func parsePortRange(s string) (int, int, error) {
+	first, last := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	a, errA := strconv.Atoi(strings.TrimSpace(first))
+	b, errB := strconv.Atoi(strings.TrimSpace(last))
+	if errA != nil || errB != nil || a < 1 || b > 65535 || a > b {
+		return 0, 0, errors.Errorf("Invalid port range %q", s)
+	}
+	return a, b, nil
+}
+
+// pickListenPort returns the first port of the range on which no UDP socket
+// is bound yet. Wireguard keeps its socket in the namespace of the daemon, so
+// that is where the ports are tried.
+func pickListenPort(portRange string) (int, error) {
+	first, last, err := parsePortRange(portRange)
+	if err != nil {
+		return 0, err
+	}
+	for port := first; port <= last; port++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		return port, nil
+	}
+	return 0, errors.Errorf("No free UDP port in %s", portRange)
+}
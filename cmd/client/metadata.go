@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+)
+
+// peerMetadata holds the metadata of the peers as last fetched, for the
+// status and metrics
+type peerMetadata struct {
+	mu    sync.Mutex
+	byKey map[string]map[string]string
+}
+
+func (m *peerMetadata) update(peers []wg.Peer) {
+	byKey := make(map[string]map[string]string)
+	for _, p := range peers {
+		if len(p.Metadata) != 0 {
+			byKey[p.PublicKey.String()] = p.Metadata
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byKey = byKey
+}
+
+// get returns the metadata by key, which must not be modified
+func (m *peerMetadata) get() map[string]map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.byKey
+}
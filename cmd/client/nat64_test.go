@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestNAT64Prefix(t *testing.T) {
+	tests := []struct {
+		setting string
+		hasIPv4 bool
+		want    string
+		ok      bool
+	}{
+		{"none", false, "", true},
+		{"none", true, "", true},
+		{"auto", true, "", true},
+		{"64:ff9b::/96", true, "64:ff9b::/96", true},
+		{"2001:db8:64::/96", false, "2001:db8:64::/96", true},
+		{"2001:db8:64::/64", false, "", false},
+		{"bogus", false, "", false},
+	}
+	for _, tt := range tests {
+		prefix, err := nat64Prefix(tt.setting, tt.hasIPv4)
+		if (err == nil) != tt.ok {
+			t.Errorf("nat64Prefix(%q, %v) error = %v, want ok %v", tt.setting, tt.hasIPv4, err, tt.ok)
+			continue
+		}
+		got := ""
+		if prefix != nil {
+			got = prefix.String()
+		}
+		if got != tt.want {
+			t.Errorf("nat64Prefix(%q, %v) = %q, want %q", tt.setting, tt.hasIPv4, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/vishvananda/netlink"
+)
+
+var networkLog = logging.For("network")
+
+const (
+	// Changes come in bursts, e.g. a new link, its address and its routes, so
+	// they are reported once things are quiet for this long
+	networkSettle = 2 * time.Second
+	// The wall clock is compared with the monotonic clock this often; the
+	// monotonic clock stops while the host sleeps
+	sleepCheckInterval = 5 * time.Second
+	sleepThreshold     = 10 * time.Second
+)
+
+// watchNetwork triggers when the underlay addresses, routes or links change,
+// or when the host wakes from sleep. Changes of the overlay interface itself
+// are ignored.
+func watchNetwork(iface string, trigger chan<- struct{}) {
+	overlay := -1
+	if link, err := netlink.LinkByName(iface); err == nil {
+		overlay = link.Attrs().Index
+	}
+	done := make(chan struct{})
+	defer close(done)
+	addrs := make(chan netlink.AddrUpdate, 16)
+	routes := make(chan netlink.RouteUpdate, 16)
+	links := make(chan netlink.LinkUpdate, 16)
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		networkLog.WithError(err).Warn("Could not watch addresses")
+	}
+	if err := netlink.RouteSubscribe(routes, done); err != nil {
+		networkLog.WithError(err).Warn("Could not watch routes")
+	}
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		networkLog.WithError(err).Warn("Could not watch links")
+	}
+	settle := time.NewTimer(0)
+	<-settle.C
+	changed := func(index int, what string) {
+		if index == overlay {
+			return
+		}
+		networkLog.Debugf("Network changed: %s", what)
+		settle.Reset(networkSettle)
+	}
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case u, ok := <-addrs:
+			if !ok {
+				addrs = nil
+				continue
+			}
+			changed(u.LinkIndex, "address "+u.LinkAddress.String())
+		case u, ok := <-routes:
+			if !ok {
+				routes = nil
+				continue
+			}
+			changed(u.LinkIndex, "route "+u.Route.String())
+		case u, ok := <-links:
+			if !ok {
+				links = nil
+				continue
+			}
+			changed(u.Attrs().Index, "link "+u.Attrs().Name)
+		case now := <-ticker.C:
+			// Round(0) drops the monotonic reading
+			if slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last); slept > sleepThreshold {
+				networkLog.Infof("Woke up after sleeping for %s", slept.Round(time.Second))
+				settle.Reset(0)
+			}
+			last = now
+		case <-settle.C:
+			networkLog.Info("Underlay network changed")
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/underlay"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var pathLog = logging.For("path")
+
+// A failing path is probed again at most this often
+const pathRecheck = 2 * time.Minute
+
+// Candidates are tried in this order: on a local network, over IPv6, others
+const (
+	rankLAN = iota
+	rankIPv6
+	rankOther
+)
+
+// pathSelector picks the endpoint of peers that have several candidates. It
+// starts with the most direct one and, when the connection fails, probes the
+// candidates in order and keeps the first that completes a handshake.
+type pathSelector struct {
+	wgState *wg.State
+	iface   string
+	nat64   *net.IPNet
+	errs    *peerErrors
+	probes  *prober
+	mu      sync.Mutex
+	paths   map[wgtypes.Key]*path
+}
+
+type path struct {
+	candidates []*net.UDPAddr
+	current    *net.UDPAddr
+	probing    bool
+	verify     bool
+	probed     time.Time
+}
+
+func newPathSelector(wgState *wg.State, iface string, nat64 *net.IPNet, errs *peerErrors, probes *prober) *pathSelector {
+	return &pathSelector{
+		wgState: wgState,
+		iface:   iface,
+		nat64:   nat64,
+		errs:    errs,
+		probes:  probes,
+		paths:   make(map[wgtypes.Key]*path),
+	}
+}
+
+// apply sets the endpoints of the peers to their selected paths and starts
+// probing the failing ones. Peers being probed are left without endpoint, so
+// that the probe is not disturbed.
+func (s *pathSelector) apply(peers []wg.Peer, health *healthTracker, now time.Time) {
+	local := localNetworks(s.iface)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[wgtypes.Key]bool, len(peers))
+	for i := range peers {
+		key := peers[i].PublicKey
+		if len(peers[i].Candidates) < 2 {
+			continue
+		}
+		seen[key] = true
+		ranked := s.rank(peers[i].Candidates, local)
+		p, ok := s.paths[key]
+		if !ok || !sameCandidates(p.candidates, ranked) {
+			p = &path{candidates: ranked, current: ranked[0]}
+			s.paths[key] = p
+			pathLog.WithField("peer", key.String()).Debug("Starting with path ", p.current)
+			// A private address on a local network may belong to another host
+			// when both LANs use the same range, so it is only kept once a
+			// handshake over it succeeds
+			if onNetworks(p.current.IP, local) {
+				p.verify = true
+			}
+		}
+		if !p.probing && (p.verify || (health.failing(key) || s.probes.degraded(key)) && now.Sub(p.probed) >= pathRecheck) {
+			p.verify = false
+			p.probing, p.probed = true, now
+			go s.probe(key, p, peers[i].KeepaliveInterval)
+		}
+		if p.probing {
+			peers[i].IP, peers[i].Port = "", 0
+		} else {
+			peers[i].IP, peers[i].Port = p.current.IP.String(), p.current.Port
+		}
+	}
+	for k := range s.paths {
+		if !seen[k] {
+			delete(s.paths, k)
+		}
+	}
+}
+
+// probe sends keepalives to each candidate in turn until a handshake succeeds
+func (s *pathSelector) probe(key wgtypes.Key, p *path, keepalive time.Duration) {
+	log := pathLog.WithField("peer", key.String())
+	s.mu.Lock()
+	candidates, selected := p.candidates, p.current
+	s.mu.Unlock()
+	reached := false
+	for _, c := range candidates {
+		start := time.Now()
+		log.Debug("Probing path ", c)
+		if err := s.wgState.SetPeerEndpoint(key, c, punchKeepalive); err != nil {
+			log.WithError(err).Error("Could not probe path")
+			break
+		}
+		if s.handshakeWithin(key, start, punchAttempt) {
+			if !c.IP.Equal(selected.IP) || c.Port != selected.Port {
+				log.Infof("Switched path to %s, handshake took %s", c, time.Since(start).Round(time.Millisecond))
+			}
+			selected, reached = c, true
+			break
+		}
+	}
+	if !reached {
+		s.errs.set(key, errEndpointUnreachable, "No handshake over any of %d candidate endpoints", len(candidates))
+	}
+	if err := s.wgState.SetPeerEndpoint(key, selected, keepalive); err != nil {
+		log.WithError(err).Error("Could not restore path")
+	}
+	s.mu.Lock()
+	p.current, p.probing = selected, false
+	s.mu.Unlock()
+}
+
+// handshakeWithin waits up to timeout for a handshake after start
+func (s *pathSelector) handshakeWithin(key wgtypes.Key, start time.Time, timeout time.Duration) bool {
+	for deadline := start.Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		stats, err := s.wgState.GetPeerStats()
+		if err != nil {
+			pathLog.WithError(err).Error("Could not get peer stats")
+			return false
+		}
+		for _, st := range stats {
+			if st.PublicKey == key && st.LastHandshake.After(start) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rank orders the candidates by how direct they are, keeping the order of the
+// server within a rank, and reaches IPv4 candidates through NAT64 if needed
+func (s *pathSelector) rank(candidates []*net.UDPAddr, local []*net.IPNet) []*net.UDPAddr {
+	ranks := make(map[*net.UDPAddr]int, len(candidates))
+	ranked := make([]*net.UDPAddr, 0, len(candidates))
+	for _, c := range candidates {
+		r := rankOther
+		if onNetworks(c.IP, local) {
+			r = rankLAN
+		}
+		if r != rankLAN && c.IP.To4() == nil {
+			r = rankIPv6
+		}
+		if r != rankLAN && s.nat64 != nil && c.IP.To4() != nil {
+			c = &net.UDPAddr{IP: underlay.Synthesize(s.nat64, c.IP), Port: c.Port}
+		}
+		ranks[c] = r
+		ranked = append(ranked, c)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranks[ranked[i]] < ranks[ranked[j]] })
+	return ranked
+}
+
+func sameCandidates(a, b []*net.UDPAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].IP.Equal(b[i].IP) || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+	return true
+}
+
+// onNetworks reports whether ip is a private address on one of the networks
+func onNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if !isPrivate(ip) {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate reports whether ip is a private IPv4 or a unique local IPv6 address
+func isPrivate(ip net.IP) bool {
+	if ip.To4() != nil {
+		return isPrivateIPv4(ip)
+	}
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// localNetworks returns the networks of the underlay interfaces
+func localNetworks(overlay string) []*net.IPNet {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		pathLog.WithError(err).Warn("Could not list local addresses")
+		return nil
+	}
+	skip := -1
+	if link, err := netlink.LinkByName(overlay); err == nil {
+		skip = link.Attrs().Index
+	}
+	var networks []*net.IPNet
+	for _, a := range addrs {
+		if a.LinkIndex == skip || a.IP.IsLoopback() || a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		networks = append(networks, a.IPNet)
+	}
+	return networks
+}
+
+// localEndpoints returns the private addresses of the underlay interfaces with
+// the port, for peers on the same networks to connect to. Public addresses are
+// already known to the server.
+func localEndpoints(overlay string, port int) []*net.UDPAddr {
+	var endpoints []*net.UDPAddr
+	for _, n := range localNetworks(overlay) {
+		if !isPrivate(n.IP) {
+			continue
+		}
+		endpoints = append(endpoints, &net.UDPAddr{IP: n.IP, Port: port})
+	}
+	return endpoints
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerCache keeps the last peer list applied on disk, so that a client that
+// starts while the server is unreachable brings its tunnels back. The file is
+// authenticated with a key derived from the private key of the client, and
+// only used for the same overlay and server. The revocations learnt from the
+// server are kept along, so that the cached list brings back no revoked peer,
+// and peers whose records lapsed meanwhile are left out.
+type peerCache struct {
+	path    string
+	wgState *wg.State
+	revoked *revocations
+	expiry  *expirations
+	network string
+	server  string
+	// last is what was last written, to skip writing the same list again
+	last []byte
+}
+
+func newPeerCache(path string, wgState *wg.State, server string, revoked *revocations, expiry *expirations) *peerCache {
+	network := wgState.OverlayNetwork
+	return &peerCache{path: path, wgState: wgState, revoked: revoked, expiry: expiry, network: network.String(), server: server}
+}
+
+// restore applies the cached peers, which the first successful refresh
+// replaces
+func (c *peerCache) restore() {
+	cached, saved, err := c.load()
+	if err != nil {
+		syncLog.WithError(err).Warn("Could not restore cached peers")
+		return
+	}
+	c.revoked.set(cached.Revoked)
+	peers := c.expiry.filter(c.revoked.filter(cached.Peers), time.Now())
+	if len(peers) == 0 {
+		return
+	}
+	syncLog.Infof("Restoring %d peers cached %s ago", len(peers), time.Since(saved).Round(time.Second))
+	if err := c.wgState.AddPeers(peers); err != nil {
+		syncLog.WithError(err).Warn("Could not restore cached peers")
+	}
+}
+
+type cachedPeers struct {
+	Network string
+	Server  string
+	Peers   []wg.Peer
+	Revoked []wgtypes.Key
+}
+
+func (c *peerCache) mac(data []byte) []byte {
+	key := c.wgState.PrivateKey()
+	h := hmac.New(sha256.New, append([]byte("wireguard-overlay peer cache"), key[:]...))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// load returns the cached peers and revocations and when they were saved, if
+// there are any
+func (c *peerCache) load() (cachedPeers, time.Time, error) {
+	var cached cachedPeers
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return cached, time.Time{}, nil
+	}
+	if err != nil {
+		return cached, time.Time{}, errors.Wrap(err, "Could not read peer cache")
+	}
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return cached, time.Time{}, errors.Wrap(err, "Could not read peer cache")
+	}
+	if len(data) < sha256.Size || !hmac.Equal(data[:sha256.Size], c.mac(data[sha256.Size:])) {
+		return cached, time.Time{}, errors.Errorf("Peer cache %s is corrupt or of another key", c.path)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data[sha256.Size:])).Decode(&cached); err != nil {
+		return cachedPeers{}, time.Time{}, errors.Wrapf(err, "Could not decode peer cache %s", c.path)
+	}
+	if cached.Network != c.network || cached.Server != c.server {
+		return cachedPeers{}, time.Time{}, errors.Errorf("Peer cache %s is of another overlay", c.path)
+	}
+	return cached, info.ModTime(), nil
+}
+
+// save writes the peers, unless they are those written last
+func (c *peerCache) save(peers []wg.Peer) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cachedPeers{Network: c.network, Server: c.server, Peers: peers, Revoked: c.revoked.list()}); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+	if bytes.Equal(body, c.last) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return errors.Wrap(err, "Could not create peer cache directory")
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(c.mac(body), body...), 0600); err != nil {
+		return errors.Wrap(err, "Could not write peer cache")
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return errors.Wrap(err, "Could not replace peer cache")
+	}
+	c.last = body
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The kinds of peer errors
+const (
+	errHandshakeTimeout    = "handshake timeout"
+	errEndpointUnreachable = "endpoint unreachable"
+	errRejected            = "rejected"
+)
+
+// A peer that could not be configured is tried again this soon
+const failedPeerRetry = 10 * time.Second
+
+// peerErrors keeps the most recent failure with each peer until it is
+// resolved, so that the status tells why a peer does not work instead of just
+// showing no handshake
+type peerErrors struct {
+	mu   sync.Mutex
+	errs map[wgtypes.Key]status.PeerError
+}
+
+func newPeerErrors() *peerErrors {
+	return &peerErrors{errs: make(map[wgtypes.Key]status.PeerError)}
+}
+
+func (e *peerErrors) set(key wgtypes.Key, kind string, format string, args ...interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errs[key] = status.PeerError{Kind: kind, Message: fmt.Sprintf(format, args...), Time: time.Now()}
+}
+
+// resolve forgets the error of the peer if it is of one of the kinds
+func (e *peerErrors) resolve(key wgtypes.Key, kinds ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err, ok := e.errs[key]
+	if !ok {
+		return
+	}
+	for _, kind := range kinds {
+		if err.Kind == kind {
+			delete(e.errs, key)
+			return
+		}
+	}
+}
+
+// collect exports the number of peers with errors by kind
+func (e *peerErrors) collect(m *status.Metrics) {
+	e.mu.Lock()
+	counts := map[string]int{errHandshakeTimeout: 0, errEndpointUnreachable: 0, errRejected: 0}
+	for _, err := range e.errs {
+		counts[err.Kind]++
+	}
+	e.mu.Unlock()
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	samples := make([]status.Sample, 0, len(kinds))
+	for _, kind := range kinds {
+		samples = append(samples, status.Sample{Labels: status.Label("kind", kind), Value: float64(counts[kind])})
+	}
+	m.Write("wireguard_overlay_peer_errors", "gauge", "Number of peers with an unresolved error, by kind.", samples...)
+}
+
+// prune forgets the errors of peers that are no longer in the overlay
+func (e *peerErrors) prune(peers map[wgtypes.Key]bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k := range e.errs {
+		if !peers[k] {
+			delete(e.errs, k)
+		}
+	}
+}
+
+// byKey returns the errors for the status API
+func (e *peerErrors) byKey() map[string]status.PeerError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	errs := make(map[string]status.PeerError, len(e.errs))
+	for k, err := range e.errs {
+		errs[k.String()] = err
+	}
+	return errs
+}
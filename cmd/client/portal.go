@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+)
+
+var portalLog = logging.For("portal")
+
+const (
+	portalTimeout = 5 * time.Second
+	// Behind a portal the probe runs this often, so that full operation
+	// resumes soon after the user logs in
+	portalCaptiveInterval = 5 * time.Second
+)
+
+// portalDetector tells whether the client sits behind a captive portal, as
+// on hotel and cafe networks, by fetching a URL that answers 204 No Content
+// when the internet is reachable. Portals answer with a redirect or a login
+// page instead.
+type portalDetector struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	mu       sync.Mutex
+	captive  bool
+}
+
+func newPortalDetector(url string, interval time.Duration) *portalDetector {
+	return &portalDetector{
+		url:      url,
+		interval: interval,
+		client: &http.Client{
+			Timeout: portalTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// run probes every interval, more often while captive, and triggers a refresh
+// once the portal lets traffic through
+func (d *portalDetector) run(trigger chan<- struct{}) {
+	for {
+		if d.check() && !d.behind() {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+		if d.behind() {
+			time.Sleep(portalCaptiveInterval)
+		} else {
+			time.Sleep(d.interval)
+		}
+	}
+}
+
+// check probes the URL and reports whether the portal state changed. Failed
+// probes leave it as it is, since there is no network to judge by.
+func (d *portalDetector) check() bool {
+	res, err := d.client.Get(d.url)
+	if err != nil {
+		portalLog.WithError(err).Debug("Could not probe for captive portal")
+		return false
+	}
+	res.Body.Close()
+	captive := res.StatusCode != http.StatusNoContent
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if captive == d.captive {
+		return false
+	}
+	d.captive = captive
+	if captive {
+		portalLog.Warnf("Behind a captive portal (probe answered %s); pausing until it lets traffic through", res.Status)
+	} else {
+		portalLog.Info("Captive portal passed; resuming")
+	}
+	return true
+}
+
+// behind reports whether the last probe found a captive portal
+func (d *portalDetector) behind() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.captive
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var probeLog = logging.For("probe")
+
+const (
+	// A probe not answered within this long is lost
+	probeTimeout = 2 * time.Second
+	// The statistics of a peer cover this many recent probes
+	probeWindow = 20
+	// A peer that lost this share of the probes in the window, with at least
+	// probeMinSamples of them, counts as degraded for path selection
+	probeDegradedLoss = 0.5
+	probeMinSamples   = 5
+)
+
+// Probes are the magic, the kind and a sequence number
+var probeMagic = [4]byte{'w', 'g', 'o', 'p'}
+
+const (
+	probeRequest = 1
+	probeReply   = 2
+	probeSize    = len(probeMagic) + 1 + 8
+)
+
+// prober measures the round trip time and loss to every peer with UDP echo
+// probes to its overlay address, and answers the probes of the others. Peers
+// that never answered, e.g. because they do not probe, are not reported.
+type prober struct {
+	wgState *wg.State
+	port    int
+	conn    *net.UDPConn
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]pendingProbe
+	peers   map[wgtypes.Key]*probeStats
+	// underlay is set on hubs, which answer probes from the underlay as well
+	// so that clients find the nearest one
+	underlay int32
+	// cookies, if set, are passed the cookies the server sends to verify the
+	// endpoints of the client
+	cookies func([]byte)
+}
+
+type pendingProbe struct {
+	key  wgtypes.Key
+	ip   net.IP
+	sent time.Time
+}
+
+type probeStats struct {
+	// rtts are those of the probes in the window, 0 for lost ones
+	rtts     []time.Duration
+	answered bool
+}
+
+// loss returns the share of lost probes in the window
+func (p *probeStats) loss() float64 {
+	lost := 0
+	for _, rtt := range p.rtts {
+		if rtt == 0 {
+			lost++
+		}
+	}
+	return float64(lost) / float64(len(p.rtts))
+}
+
+// rtt returns the average round trip time of the answered probes
+func (p *probeStats) rtt() time.Duration {
+	var sum time.Duration
+	answered := 0
+	for _, rtt := range p.rtts {
+		if rtt != 0 {
+			sum += rtt
+			answered++
+		}
+	}
+	if answered == 0 {
+		return 0
+	}
+	return sum / time.Duration(answered)
+}
+
+// newProber listens for probes on the port in the namespace of the interface
+func newProber(wgState *wg.State, netns string, port int) (*prober, error) {
+	var conn *net.UDPConn
+	if err := wg.InNetns(netns, func() (err error) {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	p := &prober{
+		wgState: wgState,
+		port:    port,
+		conn:    conn,
+		pending: make(map[uint64]pendingProbe),
+		peers:   make(map[wgtypes.Key]*probeStats),
+	}
+	go p.listen()
+	return p, nil
+}
+
+func (p *prober) listen() {
+	buf := make([]byte, protocol.VerifySize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			probeLog.WithError(err).Error("Could not read probe")
+			return
+		}
+		if cookie, ok := protocol.ParseCookiePacket(buf[:n]); ok {
+			p.mu.Lock()
+			cookies := p.cookies
+			p.mu.Unlock()
+			if cookies != nil {
+				cookies(cookie)
+			}
+			continue
+		}
+		if n != probeSize || [4]byte{buf[0], buf[1], buf[2], buf[3]} != probeMagic {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(buf[5:])
+		switch buf[4] {
+		case probeRequest:
+			// Only answer over the overlay, unless a hub
+			if !p.wgState.OnOverlay(addr.IP) && atomic.LoadInt32(&p.underlay) == 0 {
+				continue
+			}
+			buf[4] = probeReply
+			if _, err := p.conn.WriteToUDP(buf[:probeSize], addr); err != nil {
+				probeLog.WithError(err).Debug("Could not answer probe from ", addr)
+			}
+		case probeReply:
+			p.answered(seq, addr.IP, time.Now())
+		}
+	}
+}
+
+func (p *prober) answered(seq uint64, from net.IP, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent, ok := p.pending[seq]
+	if !ok || !sent.ip.Equal(from) || now.Sub(sent.sent) > probeTimeout {
+		return
+	}
+	delete(p.pending, seq)
+	st, ok := p.peers[sent.key]
+	if !ok {
+		return
+	}
+	rtt := now.Sub(sent.sent)
+	if rtt <= 0 {
+		rtt = time.Nanosecond
+	}
+	st.record(rtt)
+	st.answered = true
+}
+
+func (p *probeStats) record(rtt time.Duration) {
+	p.rtts = append(p.rtts, rtt)
+	if len(p.rtts) > probeWindow {
+		p.rtts = p.rtts[len(p.rtts)-probeWindow:]
+	}
+}
+
+// run probes every peer every interval
+func (p *prober) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.probe(time.Now()); err != nil {
+			probeLog.WithError(err).Warn("Could not probe peers")
+		}
+	}
+}
+
+// probe counts the unanswered probes as lost and sends the next ones
+func (p *prober) probe(now time.Time) error {
+	peers, err := p.wgState.GetPeers()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for seq, sent := range p.pending {
+		if now.Sub(sent.sent) > probeTimeout {
+			delete(p.pending, seq)
+			if st, ok := p.peers[sent.key]; ok {
+				st.record(0)
+			}
+		}
+	}
+	seen := make(map[wgtypes.Key]bool, len(peers))
+	buf := make([]byte, probeSize)
+	copy(buf, probeMagic[:])
+	buf[4] = probeRequest
+	for _, peer := range peers {
+		ips := p.wgState.PeerAddresses(peer)
+		if len(ips) == 0 {
+			continue
+		}
+		seen[peer.PublicKey] = true
+		if _, ok := p.peers[peer.PublicKey]; !ok {
+			p.peers[peer.PublicKey] = &probeStats{}
+		}
+		p.seq++
+		binary.BigEndian.PutUint64(buf[5:], p.seq)
+		p.pending[p.seq] = pendingProbe{key: peer.PublicKey, ip: ips[0], sent: time.Now()}
+		if _, err := p.conn.WriteToUDP(buf, &net.UDPAddr{IP: ips[0], Port: p.port}); err != nil {
+			probeLog.WithField("peer", peer.PublicKey.String()).WithError(err).Debug("Could not send probe")
+		}
+	}
+	for k := range p.peers {
+		if !seen[k] {
+			delete(p.peers, k)
+		}
+	}
+	return nil
+}
+
+// degraded reports whether the peer answered probes before but loses many
+// now
+func (p *prober) degraded(key wgtypes.Key) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.peers[key]
+	return ok && st.answered && len(st.rtts) >= probeMinSamples && st.loss() >= probeDegradedLoss
+}
+
+// latency returns the statistics of the peers that answered, by public key
+func (p *prober) latency() map[string]status.PeerLatency {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	latency := make(map[string]status.PeerLatency, len(p.peers))
+	for k, st := range p.peers {
+		if !st.answered || len(st.rtts) == 0 {
+			continue
+		}
+		latency[k.String()] = status.PeerLatency{
+			RTT:    st.rtt().Seconds() * 1000,
+			Loss:   st.loss(),
+			Probes: len(st.rtts),
+		}
+	}
+	return latency
+}
+
+// onCookie passes the cookies received to f
+func (p *prober) onCookie(f func([]byte)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cookies = f
+}
+
+func (p *prober) answerUnderlay() {
+	atomic.StoreInt32(&p.underlay, 1)
+}
+
+func (p *prober) Close() error {
+	return p.conn.Close()
+}
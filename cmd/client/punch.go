@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/underlay"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var punchLog = logging.For("punch")
+
+const (
+	// Keepalive interval while punching, so that packets keep flowing
+	punchKeepalive = time.Second
+	// How long to wait for a handshake on each candidate endpoint
+	punchAttempt = 3 * time.Second
+	// How many times to cycle through the candidates
+	punchRounds = 2
+)
+
+type punchID struct {
+	peer wgtypes.Key
+	at   time.Time
+}
+
+// puncher carries out the hole punches the server schedules
+type puncher struct {
+	wgState *wg.State
+	nat64   *net.IPNet
+	errs    *peerErrors
+	mu      sync.Mutex
+	started map[punchID]bool
+}
+
+func newPuncher(wgState *wg.State, nat64 *net.IPNet, errs *peerErrors) *puncher {
+	return &puncher{
+		wgState: wgState,
+		nat64:   nat64,
+		errs:    errs,
+		started: make(map[punchID]bool),
+	}
+}
+
+// start runs the punches that are not running yet against the configured peers
+func (p *puncher) start(punches []protocol.Punch, peers []wg.Peer) {
+	keepalive := make(map[wgtypes.Key]time.Duration, len(peers))
+	for _, peer := range peers {
+		keepalive[peer.PublicKey] = peer.KeepaliveInterval
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.started {
+		if time.Since(id.at) > punchAttempt*punchRounds*4 {
+			delete(p.started, id)
+		}
+	}
+	for _, punch := range punches {
+		id := punchID{peer: punch.Peer, at: punch.At}
+		k, ok := keepalive[punch.Peer]
+		if !ok || p.started[id] {
+			continue
+		}
+		p.started[id] = true
+		go p.run(punch, k)
+	}
+}
+
+// run sends keepalives to each candidate endpoint in turn, starting at the
+// scheduled time, until a handshake succeeds
+func (p *puncher) run(punch protocol.Punch, keepalive time.Duration) {
+	time.Sleep(time.Until(punch.At))
+	log := punchLog.WithField("peer", punch.Peer.String())
+	defer func() {
+		if err := p.wgState.SetPeerEndpoint(punch.Peer, nil, keepalive); err != nil {
+			log.WithError(err).Error("Could not restore keepalive")
+		}
+	}()
+	for round := 0; round < punchRounds; round++ {
+		for _, c := range punch.Candidates {
+			endpoint := c
+			if p.nat64 != nil && c.IP.To4() != nil {
+				endpoint = &net.UDPAddr{IP: underlay.Synthesize(p.nat64, c.IP), Port: c.Port}
+			}
+			log.Debug("Punching towards ", endpoint)
+			if err := p.wgState.SetPeerEndpoint(punch.Peer, endpoint, punchKeepalive); err != nil {
+				log.WithError(err).Error("Could not punch")
+				return
+			}
+			time.Sleep(punchAttempt)
+			if p.handshaked(punch.Peer, punch.At) {
+				log.Info("Punched through to ", endpoint)
+				return
+			}
+		}
+	}
+	log.Warn("Could not punch through to peer")
+	p.errs.set(punch.Peer, errEndpointUnreachable, "Hole punching over %d candidate endpoints failed", len(punch.Candidates))
+}
+
+// handshaked reports whether the peer completed a handshake after the time
+func (p *puncher) handshaked(key wgtypes.Key, since time.Time) bool {
+	stats, err := p.wgState.GetPeerStats()
+	if err != nil {
+		punchLog.WithError(err).Error("Could not get peer stats")
+		return false
+	}
+	for _, s := range stats {
+		if s.PublicKey == key {
+			return s.LastHandshake.After(since)
+		}
+	}
+	return false
+}
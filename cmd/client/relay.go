@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var relayLog = logging.For("relay")
+
+// Relayed peers keep being probed directly at this interval
+const probeInterval = 25 * time.Second
+
+// relayer routes the traffic of peers that cannot be reached directly through
+// the server, and switches back once a direct handshake succeeds again
+type relayer struct {
+	wgState *wg.State
+	relayed map[wgtypes.Key]bool
+}
+
+func newRelayer(wgState *wg.State) *relayer {
+	return &relayer{wgState: wgState, relayed: make(map[wgtypes.Key]bool)}
+}
+
+// update decides which peers to relay from their health
+func (r *relayer) update(health *healthTracker, now time.Time) {
+	for k := range r.relayed {
+		if health.reachable(k) {
+			relayLog.WithField("peer", k.String()).Info("Direct connection restored")
+			delete(r.relayed, k)
+		} else if _, ok := health.health[k]; !ok {
+			delete(r.relayed, k)
+		}
+	}
+	for _, k := range health.unreachable(now) {
+		if !r.relayed[k] {
+			relayLog.WithField("peer", k.String()).Warn("Cannot reach peer directly; relaying through the server")
+			r.relayed[k] = true
+		}
+	}
+}
+
+// apply moves the addresses of relayed peers to the server and returns the
+// peers along with the server
+func (r *relayer) apply(peers []wg.Peer, server wg.Peer) []wg.Peer {
+	server.Addresses = r.wgState.PeerAddresses(server)
+	server.AllowedIPs = append([]net.IPNet(nil), server.AllowedIPs...)
+	for i := range peers {
+		if !r.relayed[peers[i].PublicKey] {
+			continue
+		}
+		server.Addresses = append(server.Addresses, r.wgState.PeerAddresses(peers[i])...)
+		server.AllowedIPs = append(server.AllowedIPs, peers[i].AllowedIPs...)
+		// No addresses, but keep handshaking to notice when the direct path works
+		peers[i].Standby = true
+		peers[i].KeepaliveInterval = probeInterval
+	}
+	return append(peers, server)
+}
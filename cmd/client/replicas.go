@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/underlay"
+)
+
+// Fetching the peers fails this many times in a row before the client moves
+// to another replica of the server
+const replicaFailoverThreshold = 3
+
+// replicaFailover moves the server peer between the replicas the server
+// announces, which share its key and overlay address
+type replicaFailover struct {
+	replicas []protocol.Replica
+	failures int
+	// endpoints are the resolved endpoints of the replicas, to recognize the
+	// current one
+	endpoints map[string]bool
+}
+
+// observe records the replicas announced with a successful fetch
+func (f *replicaFailover) observe(replicas []protocol.Replica) {
+	f.failures = 0
+	if len(replicas) != 0 {
+		f.replicas = replicas
+	}
+}
+
+// failed counts a failed fetch and reports whether to move to another replica
+func (f *replicaFailover) failed() bool {
+	f.failures++
+	return len(f.replicas) > 1 && f.failures >= replicaFailoverThreshold
+}
+
+// next returns the endpoint of the healthy replica after the one at current,
+// which is not reached by the client if that is none of them
+func (f *replicaFailover) next(current *net.UDPAddr, nat64 *net.IPNet) (*net.UDPAddr, string) {
+	var candidates []*net.UDPAddr
+	var ids []string
+	start := 0
+	for _, r := range f.replicas {
+		if !r.Healthy || r.Endpoint == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", r.Endpoint)
+		if err != nil {
+			syncLog.WithError(err).Warnf("Could not resolve endpoint of replica %s", r.ID)
+			continue
+		}
+		addr.IP = underlay.Synthesize(nat64, addr.IP)
+		if f.endpoints == nil {
+			f.endpoints = make(map[string]bool)
+		}
+		f.endpoints[addr.String()] = true
+		if addr.String() == current.String() {
+			start = len(candidates) + 1
+		}
+		candidates = append(candidates, addr)
+		ids = append(ids, r.ID)
+	}
+	if len(candidates) == 0 {
+		return nil, ""
+	}
+	i := start % len(candidates)
+	if candidates[i].String() == current.String() {
+		return nil, ""
+	}
+	return candidates[i], ids[i]
+}
+
+// isReplica reports whether the server peer points at a replica the client
+// moved to
+func (f *replicaFailover) isReplica(ip string, port int) bool {
+	return f.endpoints[net.JoinHostPort(ip, strconv.Itoa(port))]
+}
+
+// failOver points the server peer at the next replica after repeated failures
+// to fetch the peers. It reports whether the endpoint changed.
+func (s *syncer) failOver() bool {
+	if !s.replicas.failed() {
+		return false
+	}
+	current := &net.UDPAddr{IP: net.ParseIP(s.serverIP()), Port: s.serverPort()}
+	addr, id := s.replicas.next(current, s.nat64)
+	if addr == nil {
+		return false
+	}
+	syncLog.Warnf("Moving from server replica at %s to %s at %s", current, id, addr)
+	s.replicas.failures = 0
+	if s.tcp != nil {
+		s.tcp.direct.IP, s.tcp.direct.Port = addr.IP.String(), addr.Port
+		s.server = s.tcp.server()
+	} else {
+		s.server.IP, s.server.Port = addr.IP.String(), addr.Port
+	}
+	return true
+}
+
+// serverPort is the underlay port of the server, even while tunnelled
+func (s *syncer) serverPort() int {
+	if s.tcp != nil {
+		return s.tcp.direct.Port
+	}
+	return s.server.Port
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/cleanup"
+	"github.com/pkg/errors"
+)
+
+// started is when the process started, registered so that the server can tell
+// that the client restarted
+var started = time.Now()
+
+// reexec cleans up and replaces the process with a new one of the same
+// executable, which picks up changes to the binary, config and keys
+func reexec() error {
+	path, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Could not find executable")
+	}
+	cleanup.Run()
+	return errors.Wrapf(syscall.Exec(path, os.Args, os.Environ()), "Could not execute %s", path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// Failed refreshes are retried after retryMin at first, doubling with
+	// every failure up to the maximum backoff
+	retryMin = time.Second
+	// Intervals vary by this fraction, so that clients do not synchronize
+	retryJitter = 0.3
+	// Right after startup peers are refreshed every startupInterval, so that
+	// nodes coming up together find each other quickly
+	startupInterval = 5 * time.Second
+	startupPeriod   = time.Minute
+)
+
+// retryPolicy decides when to refresh the peers next
+type retryPolicy struct {
+	mu       sync.Mutex
+	interval time.Duration
+	max      time.Duration
+	started  time.Time
+	failures int
+	rand     *rand.Rand
+}
+
+func newRetryPolicy(interval, max time.Duration) *retryPolicy {
+	if max < interval {
+		max = interval
+	}
+	return &retryPolicy{
+		interval: interval,
+		max:      max,
+		started:  time.Now(),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay until the next refresh after one succeeded or failed
+func (p *retryPolicy) next(ok bool, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d := p.interval
+	if ok {
+		p.failures = 0
+		if now.Sub(p.started) < startupPeriod && startupInterval < d {
+			d = startupInterval
+		}
+	} else {
+		d = retryMin << uint(p.failures)
+		if d > p.max || d <= 0 {
+			d = p.max
+		} else {
+			p.failures++
+		}
+	}
+	return time.Duration(float64(d) * (1 + retryJitter*(2*p.rand.Float64()-1)))
+}
+
+// reset makes the next failure retry quickly again, e.g. after the network
+// changed
+func (p *retryPolicy) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = 0
+}
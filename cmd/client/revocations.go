@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// revocations are the keys the server revoked. They are removed from the
+// device as soon as they are learnt, and left out of every peer list applied
+// afterwards, including a cached one.
+type revocations struct {
+	wgState *wg.State
+	mu      sync.Mutex
+	keys    map[wgtypes.Key]bool
+}
+
+func newRevocations(wgState *wg.State) *revocations {
+	return &revocations{wgState: wgState, keys: make(map[wgtypes.Key]bool)}
+}
+
+// update replaces the revoked keys with those of the server, keeping the
+// previous ones if they cannot be fetched
+func (r *revocations) update(t transport.Transport) {
+	revoked, err := t.FetchRevocations()
+	if err != nil {
+		syncLog.WithError(err).Warn("Could not fetch revocations")
+		return
+	}
+	r.set(revoked.Keys)
+}
+
+// set replaces the revoked keys and removes the newly revoked ones from the
+// device
+func (r *revocations) set(keys []wgtypes.Key) {
+	revoked := make(map[wgtypes.Key]bool, len(keys))
+	var removed []wgtypes.Key
+	r.mu.Lock()
+	for _, k := range keys {
+		// The client never removes itself
+		if k == r.wgState.PublicKey() {
+			continue
+		}
+		revoked[k] = true
+		if !r.keys[k] {
+			removed = append(removed, k)
+		}
+	}
+	r.keys = revoked
+	r.mu.Unlock()
+	if len(removed) == 0 {
+		return
+	}
+	configured, err := r.wgState.GetPeers()
+	if err != nil {
+		syncLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	var present []wgtypes.Key
+	for _, p := range configured {
+		if revoked[p.PublicKey] {
+			present = append(present, p.PublicKey)
+		}
+	}
+	if len(present) == 0 {
+		return
+	}
+	if err := r.wgState.RemovePeers(present); err != nil {
+		syncLog.WithError(err).Error("Could not remove revoked peers")
+		return
+	}
+	for _, k := range present {
+		syncLog.WithField("peer", k.String()).Info("Removed revoked peer")
+	}
+}
+
+// list returns the revoked keys in order
+func (r *revocations) list() []wgtypes.Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]wgtypes.Key, 0, len(r.keys))
+	for k := range r.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	return keys
+}
+
+// filter leaves the revoked peers out
+func (r *revocations) filter(peers []wg.Peer) []wg.Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.keys) == 0 {
+		return peers
+	}
+	kept := peers[:0]
+	for _, p := range peers {
+		if r.keys[p.PublicKey] {
+			syncLog.WithField("peer", p.PublicKey.String()).Debug("Left out revoked peer")
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
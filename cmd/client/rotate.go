@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var rotationLog = logging.For("rotation")
+
+// loadKeyFile returns the private key stored in path. A missing file is
+// created with the fallback key, or with a new key if there is none.
+func loadKeyFile(path string, fallback string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "Could not read key file")
+	}
+	key := fallback
+	if key == "" {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return "", err
+		}
+		key = k.String()
+	}
+	return key, writeKeyFile(path, key)
+}
+
+func writeKeyFile(path string, key string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "Could not create key directory")
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(key+"\n"), 0600); err != nil {
+		return errors.Wrap(err, "Could not write key file")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "Could not write key file")
+}
+
+// rotator periodically switches the client to a new key. The next key is
+// announced to the server and kept alongside the current one until the server
+// sets the cutover, by when all peers have configured it.
+type rotator struct {
+	wgState  *wg.State
+	keyFile  string
+	interval time.Duration
+	next     *wgtypes.Key
+	cutover  time.Time
+}
+
+func newRotator(wgState *wg.State, keyFile string, interval time.Duration) (*rotator, error) {
+	r := &rotator{wgState: wgState, keyFile: keyFile, interval: interval}
+	data, err := ioutil.ReadFile(r.nextFile())
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read next key")
+	}
+	// Resume the rotation that was in progress
+	next, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse next key")
+	}
+	r.next = &next
+	return r, nil
+}
+
+func (r *rotator) nextFile() string {
+	return r.keyFile + ".next"
+}
+
+func (r *rotator) due() bool {
+	info, err := os.Stat(r.keyFile)
+	return err == nil && time.Since(info.ModTime()) > r.interval
+}
+
+// observe starts a rotation when it is due and picks up the cutover from the
+// client's own entry in the peer list
+func (r *rotator) observe(t transport.Transport, own *wg.Peer) {
+	if r.next == nil {
+		if !r.due() {
+			return
+		}
+		next, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			rotationLog.WithError(err).Error("Could not generate next key")
+			return
+		}
+		if err := writeKeyFile(r.nextFile(), next.String()); err != nil {
+			rotationLog.WithError(err).Error("Could not store next key")
+			return
+		}
+		r.next = &next
+		rotationLog.Info("Starting rotation to ", next.PublicKey())
+	}
+	if own != nil && own.NextKey == r.next.PublicKey() {
+		r.cutover = own.Cutover
+		return
+	}
+	if err := t.AnnounceRotation(protocol.Rotation{NextKey: r.next.PublicKey()}); err != nil {
+		rotationLog.WithError(err).Error("Could not announce next key")
+	}
+}
+
+// complete switches to the next key once the cutover has passed
+func (r *rotator) complete(now time.Time) {
+	if r.next == nil || r.cutover.IsZero() || now.Before(r.cutover) {
+		return
+	}
+	if err := os.Rename(r.nextFile(), r.keyFile); err != nil {
+		rotationLog.WithError(err).Error("Could not store rotated key")
+		return
+	}
+	old := r.wgState.PublicKey()
+	if err := r.wgState.SetPrivateKey(*r.next); err != nil {
+		rotationLog.WithError(err).Error("Could not switch to next key")
+		return
+	}
+	rotationLog.Infof("Rotated key from %s to %s", old, r.wgState.PublicKey())
+	r.next = nil
+	r.cutover = time.Time{}
+}
+
+// applyRotations configures the next keys of rotating peers as standby until
+// their cutover and lets them take over the peers afterwards. It returns the
+// standby keys and the earliest upcoming cutover.
+func applyRotations(wgState *wg.State, peers []wg.Peer, now time.Time) ([]wg.Peer, []wgtypes.Key, time.Time) {
+	var standby []wgtypes.Key
+	var upcoming time.Time
+	applied := make([]wg.Peer, 0, len(peers))
+	for _, p := range peers {
+		if p.NextKey == (wgtypes.Key{}) || p.PublicKey == wgState.PublicKey() {
+			applied = append(applied, p)
+			continue
+		}
+		if p.Cutover.IsZero() || now.Before(p.Cutover) {
+			next := p
+			next.PublicKey = p.NextKey
+			next.Standby = true
+			applied = append(applied, p, next)
+			standby = append(standby, p.NextKey)
+			if !p.Cutover.IsZero() && (upcoming.IsZero() || p.Cutover.Before(upcoming)) {
+				upcoming = p.Cutover
+			}
+			continue
+		}
+		next := p
+		next.PublicKey = p.NextKey
+		next.Addresses = wgState.PeerAddresses(p)
+		applied = append(applied, next)
+	}
+	return applied, standby, upcoming
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+
+	"github.com/jimzhong/wireguard-overlay/internal/bgp"
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+)
+
+// setUpRouteExport routes the networks of peers the way route-export says. The
+// returned speaker, if any, still has to be run.
+func setUpRouteExport(wgState *wg.State, config *config.ClientConfig) (*bgp.Speaker, error) {
+	if config.RouteProtocol == config.RouteMarker {
+		// The routes of peer networks would be taken for those of the daemon
+		return nil, errors.Errorf("Route protocol %d is also the route marker", config.RouteProtocol)
+	}
+	switch config.RouteExport {
+	case "static":
+		return nil, nil
+	case "babel":
+		if config.RouteProtocol <= 0 || config.RouteProtocol > 255 {
+			return nil, errors.Errorf("Invalid route protocol %d", config.RouteProtocol)
+		}
+		wgState.SetRouteProtocol(config.RouteProtocol)
+		return nil, nil
+	case "bgp":
+	default:
+		return nil, errors.Errorf("Unknown route export %q", config.RouteExport)
+	}
+	if len(config.BGPNeighbors) == 0 {
+		return nil, errors.New("Route export bgp needs bgp-neighbors")
+	}
+	routerID := net.ParseIP(config.BGPRouterID)
+	if config.BGPRouterID == "" {
+		// Unique enough among the nodes of the overlay
+		key := wgState.PublicKey()
+		routerID = net.IP(key[:4])
+	}
+	peerASN := config.BGPPeerASN
+	if peerASN == 0 {
+		peerASN = config.BGPASN
+	}
+	speaker, err := bgp.New(uint32(config.BGPASN), uint32(peerASN), routerID, config.BGPNeighbors)
+	if err != nil {
+		return nil, err
+	}
+	wgState.ExportRoutes(func(routes []wg.Route) {
+		announced := make([]bgp.Route, 0, len(routes))
+		for _, r := range routes {
+			announced = append(announced, bgp.Route{Dst: r.Dst, NextHop: r.Via})
+		}
+		speaker.Announce(announced)
+	})
+	return speaker, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// debugSignals notifies of SIGUSR1, which refreshes the peers at once, and
+// SIGUSR2, which logs the state of the client
+func debugSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	return signals
+}
+
+// dumpPeers logs the peers on the device with their endpoints, handshake
+// ages, traffic and last errors, if errs is given
+func dumpPeers(log *logrus.Entry, wgState *wg.State, server wgtypes.Key, errs *peerErrors) {
+	peers, err := wgState.GetPeerStats()
+	if err != nil {
+		log.WithError(err).Error("Could not get peers")
+		return
+	}
+	var peerErrs map[string]status.PeerError
+	if errs != nil {
+		peerErrs = errs.byKey()
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey.String() < peers[j].PublicKey.String() })
+	log.Infof("%d peers on %s", len(peers), wgState.OverlayAddr.IP)
+	for _, p := range peers {
+		fields := logrus.Fields{
+			"peer":     p.PublicKey.String(),
+			"rx_bytes": p.RxBytes,
+			"tx_bytes": p.TxBytes,
+		}
+		if p.IP != "" {
+			fields["endpoint"] = net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+		}
+		if len(p.Addresses) != 0 {
+			addrs := make([]string, len(p.Addresses))
+			for i, a := range p.Addresses {
+				addrs[i] = a.String()
+			}
+			fields["addresses"] = strings.Join(addrs, ",")
+		}
+		handshake := "never"
+		if !p.LastHandshake.IsZero() {
+			handshake = time.Since(p.LastHandshake).Round(time.Second).String() + " ago"
+		}
+		fields["handshake"] = handshake
+		if p.PublicKey == server {
+			fields["server"] = true
+		}
+		if e, ok := peerErrs[p.PublicKey.String()]; ok {
+			fields["last_error"] = e.Kind + ": " + e.Message
+		}
+		log.WithFields(fields).Info("Peer")
+	}
+}
+
+// dumpState logs the state of the sync and the peers
+func (s *syncer) dumpState() {
+	st := s.state.get()
+	fields := logrus.Fields{"peers": st.Peers, "captive": st.Captive, "tunnelled": st.Tunnelled}
+	for name, t := range map[string]time.Time{"last_attempt": st.LastAttempt, "last_success": st.LastSuccess, "next_attempt": st.NextAttempt} {
+		if !t.IsZero() {
+			fields[name] = t.Format(time.RFC3339)
+		}
+	}
+	if st.LastError != "" {
+		fields["last_error"] = st.LastError
+	}
+	syncLog.WithFields(fields).Info("Sync state")
+	dumpPeers(syncLog, s.wgState, s.serverKey, s.errs)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// splitTunnel routes the included networks to the chosen peers, and keeps the
+// excluded ones and the address of the server out of the allowed IPs of all
+// peers, however they got there
+type splitTunnel struct {
+	include map[wgtypes.Key][]net.IPNet
+	exclude []net.IPNet
+}
+
+// newSplitTunnel parses the cidr=pubkey entries of include-routes and the
+// networks of exclude-routes. It returns nil if neither is configured, and an
+// error if an included network covers the server address.
+func newSplitTunnel(include, exclude []string, serverIP net.IP) (*splitTunnel, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	t := &splitTunnel{include: make(map[wgtypes.Key][]net.IPNet)}
+	for _, entry := range include {
+		// Base64 keys may end in =, CIDRs have none
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid include route %q, expected cidr=pubkey", entry)
+		}
+		_, n, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid include route %q", entry)
+		}
+		key, err := wgtypes.ParseKey(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key of include route %q", entry)
+		}
+		if n.Contains(serverIP) {
+			return nil, errors.Errorf("Include route %s covers the server address %s", n, serverIP)
+		}
+		t.include[key] = append(t.include[key], *n)
+	}
+	for _, s := range exclude {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid exclude route %q", s)
+		}
+		t.exclude = append(t.exclude, *n)
+	}
+	return t, nil
+}
+
+// apply adds the included networks to the peers and the server, and carves
+// the excluded ones and the server address out of their allowed IPs
+func (t *splitTunnel) apply(peers []wg.Peer, server wg.Peer, serverIP string) ([]wg.Peer, wg.Peer) {
+	if t == nil {
+		return peers, server
+	}
+	exclude := t.exclude
+	if ip := net.ParseIP(serverIP); ip != nil {
+		exclude = append(exclude[:len(exclude):len(exclude)], hostNetwork(ip))
+	}
+	tunnel := func(p *wg.Peer) {
+		nets := append(append([]net.IPNet(nil), p.AllowedIPs...), t.include[p.PublicKey]...)
+		for _, x := range exclude {
+			var kept []net.IPNet
+			for _, n := range nets {
+				kept = append(kept, subtract(n, x)...)
+			}
+			nets = kept
+		}
+		p.AllowedIPs = nets
+	}
+	for i := range peers {
+		tunnel(&peers[i])
+	}
+	tunnel(&server)
+	return peers, server
+}
+
+func hostNetwork(ip net.IP) net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// subtract returns the networks covering n but not x: nothing if x covers n,
+// and otherwise the sibling of every network on the way from n down to x
+func subtract(n, x net.IPNet) []net.IPNet {
+	n, x = canonical(n), canonical(x)
+	nOnes, bits := n.Mask.Size()
+	xOnes, xBits := x.Mask.Size()
+	if bits != xBits {
+		return []net.IPNet{n}
+	}
+	if xOnes <= nOnes && x.Contains(n.IP) {
+		return nil
+	}
+	if xOnes <= nOnes || !n.Contains(x.IP) {
+		return []net.IPNet{n}
+	}
+	rest := make([]net.IPNet, 0, xOnes-nOnes)
+	for ones := nOnes + 1; ones <= xOnes; ones++ {
+		mask := net.CIDRMask(ones, bits)
+		sibling := x.IP.Mask(mask)
+		sibling[(ones-1)/8] ^= 0x80 >> uint((ones-1)%8)
+		rest = append(rest, net.IPNet{IP: sibling, Mask: mask})
+	}
+	return rest
+}
+
+// canonical returns the network with an address of the length of its family
+// and the host bits cleared
+func canonical(n net.IPNet) net.IPNet {
+	ones, bits := n.Mask.Size()
+	if v4 := n.IP.To4(); v4 != nil {
+		if bits == 8*net.IPv6len {
+			ones -= 8 * (net.IPv6len - net.IPv4len)
+		}
+		mask := net.CIDRMask(ones, 8*net.IPv4len)
+		return net.IPNet{IP: v4.Mask(mask), Mask: mask}
+	}
+	return net.IPNet{IP: n.IP.To16().Mask(n.Mask), Mask: n.Mask}
+}
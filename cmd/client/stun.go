@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/stun"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+)
+
+var stunLog = logging.For("stun")
+
+// How long to wait for each STUN server
+const stunTimeout = 5 * time.Second
+
+// endpointDiscovery periodically discovers the public endpoint with STUN
+type endpointDiscovery struct {
+	wgState  *wg.State
+	servers  []string
+	interval time.Duration
+	mu       sync.Mutex
+	result   *stun.Result
+}
+
+// run checks the public endpoint every interval, or once if there is none, and
+// triggers a refresh, and with it a registration, when it changes
+func (d *endpointDiscovery) run(trigger chan<- struct{}) {
+	for {
+		if d.check() {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+		if d.interval <= 0 {
+			return
+		}
+		time.Sleep(d.interval)
+	}
+}
+
+// check reports whether the public endpoint or NAT behaviour changed
+func (d *endpointDiscovery) check() bool {
+	result, err := stun.Discover(d.servers, stunTimeout)
+	if err != nil {
+		stunLog.WithError(err).Warn("Could not discover public endpoint")
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.result != nil && d.result.Mapped.IP.Equal(result.Mapped.IP) && d.result.NAT == result.NAT &&
+		d.result.PortPreserved() == result.PortPreserved() {
+		return false
+	}
+	stunLog.Infof("Public address is %s (NAT: %s, port preserved: %t)", result.Mapped.IP, result.NAT, result.PortPreserved())
+	d.result = &result
+	return true
+}
+
+// reflexive returns the public endpoint of the wireguard port and the NAT
+// behaviour. The STUN socket is not the wireguard one, so the endpoint is
+// only known if the NAT maps independently of the destination and keeps
+// ports.
+func (d *endpointDiscovery) reflexive() (*net.UDPAddr, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.result == nil {
+		return nil, ""
+	}
+	if d.result.NAT == stun.NATDependent || (d.result.NAT != stun.NATNone && !d.result.PortPreserved()) {
+		return nil, d.result.NAT
+	}
+	port, err := d.wgState.ListenPort()
+	if err != nil {
+		stunLog.WithError(err).Warn("Could not get wireguard port")
+		return nil, d.result.NAT
+	}
+	return &net.UDPAddr{IP: d.result.Mapped.IP, Port: port}, d.result.NAT
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// syncState records the outcome of the refreshes for the control socket
+type syncState struct {
+	mu sync.Mutex
+	st status.Sync
+}
+
+func (s *syncState) record(err error, peers int, next time.Duration, captive, tunnelled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.st.LastAttempt = now
+	s.st.NextAttempt = now.Add(next)
+	s.st.Captive, s.st.Tunnelled = captive, tunnelled
+	if err != nil {
+		s.st.LastError = err.Error()
+		return
+	}
+	s.st.LastSuccess, s.st.LastError, s.st.Peers = now, "", peers
+}
+
+func (s *syncState) setServer(key wgtypes.Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.Server = key.String()
+}
+
+func (s *syncState) get() status.Sync {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st
+}
+
+func (s *syncState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := s.get()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		syncLog.WithError(err).Error("Could not write sync state")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/tcprelay"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+)
+
+const (
+	// How long UDP gets to handshake with the server before tunnelling
+	serverHandshakeTimeout = 30 * time.Second
+	// How often to try UDP again while tunnelling over TCP
+	directRetryInterval = 15 * time.Minute
+	// Keepalive to the server, so that a handshake is attempted right after
+	// switching and the tunnel is not closed as idle
+	serverKeepalive = 25 * time.Second
+)
+
+// tcpFallback tunnels the session with the server over TCP when UDP does not
+// get through, and tries UDP again from time to time
+type tcpFallback struct {
+	wgState *wg.State
+	direct  wg.Peer
+	proxy   *tcprelay.Proxy
+	// tunnelled is set while packets go through the proxy
+	tunnelled bool
+	// switched is when the transport changed last
+	switched time.Time
+}
+
+func newTCPFallback(wgState *wg.State, server wg.Peer, proxy *tcprelay.Proxy) *tcpFallback {
+	server.KeepaliveInterval = serverKeepalive
+	return &tcpFallback{wgState: wgState, direct: server, proxy: proxy, switched: time.Now()}
+}
+
+// server returns the server peer over the current transport
+func (f *tcpFallback) server() wg.Peer {
+	p := f.direct
+	if f.tunnelled {
+		local := f.proxy.LocalAddr()
+		p.IP, p.Port = local.IP.String(), local.Port
+	}
+	return p
+}
+
+// update switches the transport depending on the handshakes with the server
+// and reports whether it did
+func (f *tcpFallback) update(now time.Time) bool {
+	if f.tunnelled {
+		if now.Sub(f.switched) < directRetryInterval {
+			return false
+		}
+		relayLog.Info("Trying to reach the server over UDP again")
+		f.tunnelled = false
+		f.switched = now
+		return true
+	}
+	stats, err := f.wgState.GetPeerStats()
+	if err != nil {
+		relayLog.WithError(err).Error("Could not check connectivity with server")
+		return false
+	}
+	var last time.Time
+	for _, p := range stats {
+		if p.PublicKey == f.direct.PublicKey {
+			last = p.LastHandshake
+		}
+	}
+	if last.After(f.switched) {
+		if now.Sub(last) < staleHandshake {
+			return false
+		}
+	} else if now.Sub(f.switched) < serverHandshakeTimeout {
+		return false
+	}
+	relayLog.Warn("Cannot reach the server over UDP; tunnelling over TCP")
+	f.tunnelled = true
+	f.switched = now
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/pkg/errors"
+)
+
+// peerAPITLS returns the TLS config of the peer API, or nil without a CA. The
+// client certificate is read again for every handshake, so that it can be
+// renewed without a restart.
+func peerAPITLS(config *config.ClientConfig) (*tls.Config, error) {
+	if config.ServerTLSCA == "" {
+		return nil, nil
+	}
+	tlsConfig, err := serverTLS(config, config.ServerTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	if config.TLSCert != "" {
+		certFile, keyFile := config.TLSCert, config.TLSKey
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, errors.Wrap(err, "Could not load client certificate")
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// enrollTLS returns the TLS config of the enrollment listener, or nil without
+// a CA
+func enrollTLS(config *config.ClientConfig) (*tls.Config, error) {
+	if config.EnrollTLSCA == "" {
+		return nil, nil
+	}
+	return serverTLS(config, config.EnrollTLSCA)
+}
+
+// serverTLS returns a TLS config verifying the server against the CA bundle
+func serverTLS(config *config.ClientConfig, ca string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read server CA")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificates in %s", ca)
+	}
+	name := config.ServerTLSName
+	if name == "" {
+		name = config.ServerAddr
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots, ServerName: name}, nil
+}
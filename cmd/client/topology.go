@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+)
+
+// routeThroughServer leaves out the peers the topology of the overlay has
+// reached through the server and moves their addresses and routes to the
+// server. It returns the other peers, the server and whether any were moved.
+func routeThroughServer(wgState *wg.State, peers []wg.Peer, server wg.Peer) ([]wg.Peer, wg.Peer, bool) {
+	direct := make([]wg.Peer, 0, len(peers))
+	var routed bool
+	for _, p := range peers {
+		if !p.ThroughServer {
+			direct = append(direct, p)
+			continue
+		}
+		if !routed {
+			server.Addresses = wgState.PeerAddresses(server)
+			server.AllowedIPs = append([]net.IPNet(nil), server.AllowedIPs...)
+			routed = true
+		}
+		server.Addresses = append(server.Addresses, wgState.PeerAddresses(p)...)
+		server.AllowedIPs = append(server.AllowedIPs, p.AllowedIPs...)
+	}
+	return direct, server, routed
+}
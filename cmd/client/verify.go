@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+)
+
+// Cookies are returned one at a time, and dropped beyond this many waiting,
+// so that anyone sending cookies cannot have the client flood the server
+const cookieQueue = 8
+
+// returnCookies returns the cookies the server sends to the probe port to
+// verify the endpoints the client claims
+func returnCookies(probes *prober, t transport.Transport) {
+	queue := make(chan []byte, cookieQueue)
+	probes.onCookie(func(cookie []byte) {
+		select {
+		case queue <- cookie:
+		default:
+			probeLog.Debug("Dropped cookie")
+		}
+	})
+	go func() {
+		for cookie := range queue {
+			if err := t.VerifyEndpoint(protocol.Verification{Cookie: cookie}); err != nil {
+				probeLog.WithError(err).Debug("Could not return cookie")
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/pkg/errors"
+)
+
+// wesherState is the cluster state file of wesher
+type wesherState struct {
+	ClusterKey []byte
+	Nodes      []struct {
+		Name string
+		Addr net.IP
+	}
+}
+
+// wesherMeta is the gob encoded record wesher nodes gossip about themselves
+type wesherMeta struct {
+	OverlayAddr net.IPNet
+	PubKey      string
+	// Routes are only sent by more recent wesher versions
+	Routes []net.IPNet
+}
+
+// importWesherState takes the cluster key and the nodes to join from the
+// state file of wesher, unless they are configured
+func importWesherState(config *config.ClientConfig) error {
+	data, err := ioutil.ReadFile(config.WesherState)
+	if err != nil {
+		return errors.Wrap(err, "Could not read wesher state")
+	}
+	var state wesherState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Wrap(err, "Could not decode wesher state")
+	}
+	if config.ClusterKey == "" {
+		if len(state.ClusterKey) == 0 {
+			return errors.New("The wesher state has no cluster key")
+		}
+		config.ClusterKey = base64.StdEncoding.EncodeToString(state.ClusterKey)
+	}
+	if len(config.GossipJoin) == 0 {
+		for _, n := range state.Nodes {
+			config.GossipJoin = append(config.GossipJoin, net.JoinHostPort(n.Addr.String(), strconv.Itoa(config.GossipPort)))
+		}
+	}
+	return nil
+}
+
+// wesherAddress derives the overlay address of a node from its name as
+// wesher does, copying the trailing bytes of the FNV-128a of the name into the
+// host part of the network
+func wesherAddress(network net.IPNet, name string) net.IPNet {
+	bits, size := network.Mask.Size()
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	h := fnv.New128a()
+	h.Write([]byte(name))
+	hb := h.Sum(nil)
+	for i := 1; i <= (size-bits)/8; i++ {
+		ip[len(ip)-i] = hb[len(hb)-i]
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(size, size)}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/jimzhong/wireguard-overlay/internal/wgquick"
+	"github.com/pkg/errors"
+)
+
+// exportWgQuick writes the interface as a wg-quick configuration, which
+// brings it up the same way without the daemon
+func exportWgQuick(config *config.ClientConfig) error {
+	var c *wgquick.Config
+	if err := wg.InNetns(config.Netns, func() (err error) {
+		c, err = wgquick.Export(config.Interface)
+		return err
+	}); err != nil {
+		return err
+	}
+	return wgquick.Write(os.Stdout, c)
+}
+
+// importWgQuick reads a wg-quick configuration, taking its private key
+// unless one is configured. Its peers are returned with its listen port, to be
+// configured until the first sync replaces them; host entries on the overlay
+// network are their addresses.
+func importWgQuick(config *config.ClientConfig) ([]wg.Peer, int, error) {
+	f, err := os.Open(config.ImportWgQuick)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not open wg-quick configuration")
+	}
+	defer f.Close()
+	c, err := wgquick.Parse(f)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not parse wg-quick configuration")
+	}
+	if config.PrivateKey == "" {
+		config.PrivateKey = c.PrivateKey.String()
+	}
+	overlayNet := (*net.IPNet)(config.OverlayNet)
+	peers := make([]wg.Peer, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		peer := wg.Peer{
+			PublicKey:         p.PublicKey,
+			PresharedKey:      p.PresharedKey,
+			KeepaliveInterval: p.PersistentKeepalive,
+		}
+		if p.Endpoint != nil {
+			peer.IP, peer.Port = p.Endpoint.IP.String(), p.Endpoint.Port
+		}
+		for _, a := range p.AllowedIPs {
+			if ones, bits := a.Mask.Size(); ones == bits && overlayNet.Contains(a.IP) {
+				peer.Addresses = append(peer.Addresses, a.IP)
+			} else {
+				peer.AllowedIPs = append(peer.AllowedIPs, a)
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers, c.ListenPort, nil
+}
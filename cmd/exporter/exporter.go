@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+func main() {
+	switch subcommand := config.Subcommand(); subcommand {
+	case "":
+	case "config":
+		if err := config.RunCommand("exporter"); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	default:
+		logrus.Fatal("Unknown command: ", subcommand)
+	}
+	config, err := config.LoadExporterConfig()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logLevel, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse loglevel")
+	}
+	logrus.SetLevel(logLevel)
+
+	// The exporter never configures the device, it only needs it to exist
+	client, err := wgctrl.New()
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not instantiate wireguard client")
+	}
+	if _, err := client.Device(config.Interface); err != nil {
+		logrus.WithError(err).Fatal("Could not find wireguard interface ", config.Interface)
+	}
+	client.Close()
+
+	handler, err := status.NewHandler(config.Interface)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not instantiate status handler")
+	}
+	server, err := status.ListenAndServe(config.StatusAddr, handler)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not start status server")
+	}
+	defer server.Close()
+	logrus.Infof("Exporting %s on %s", config.Interface, config.StatusAddr)
+
+	incomingSigs := make(chan os.Signal, 1)
+	signal.Notify(incomingSigs, syscall.SIGTERM, os.Interrupt)
+	<-incomingSigs
+}
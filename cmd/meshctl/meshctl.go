@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type adminClient struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// call sends the body (if any) to the admin API and decodes the response into out
+func (c *adminClient) call(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("server responded %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func list(c *adminClient) error {
+	var peers []protocol.AdminPeer
+	if err := c.call(http.MethodGet, protocol.AdminPeersPath, nil, &peers); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBLIC KEY\tHOSTNAME\tSTATE\tADDRESSES\tENDPOINT\tHANDSHAKE\tNAT\tGROUPS\tROUTES\tMETADATA\tANNOTATIONS")
+	now := time.Now()
+	for _, p := range peers {
+		state := "pending"
+		switch {
+		case p.Revoked:
+			state = "revoked"
+		case p.Configured:
+			state = "configured"
+		case p.Approved:
+			state = "approved"
+		}
+		if p.Static {
+			state += " (static)"
+		}
+		if p.Offline {
+			state += " (offline)"
+		}
+		if p.Island != 0 {
+			state += fmt.Sprintf(" (island %d)", p.Island)
+		}
+		handshake := "never"
+		if p.LastHandshake != nil {
+			handshake = now.Sub(*p.LastHandshake).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.PublicKey, p.Hostname, state,
+			strings.Join(p.Addresses, ","), p.Endpoint, handshake, p.NAT, strings.Join(p.Groups, ","), strings.Join(p.Routes, ","),
+			annotations(p.Metadata), annotations(p.Annotations))
+	}
+	return w.Flush()
+}
+
+// annotations formats the annotations ordered by name
+func annotations(a map[string]string) string {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + a[name]
+	}
+	return strings.Join(names, "; ")
+}
+
+func diagnostics(c *adminClient) error {
+	var reports []protocol.AdminDiagnostic
+	if err := c.call(http.MethodGet, protocol.AdminDiagnosticsPath, nil, &reports); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPORTER\tPEER\tFAILING SINCE\tERROR\tCAUSE\tNAT\tENDPOINTS")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Reporter, r.Peer, r.FailingSince.Format(time.RFC3339),
+			r.Error, r.Cause, r.NAT, strings.Join(r.Endpoints, ","))
+	}
+	return w.Flush()
+}
+
+func partition(c *adminClient) error {
+	var status protocol.AdminPartition
+	if err := c.call(http.MethodGet, protocol.AdminPartitionPath, nil, &status); err != nil {
+		return err
+	}
+	if !status.Partitioned {
+		fmt.Println("Mesh is connected")
+		return nil
+	}
+	fmt.Printf("Mesh is partitioned since %s\n", status.Since.Format(time.RFC3339))
+	for i, island := range status.Islands {
+		fmt.Printf("Island %d:\n", i+1)
+		for _, k := range island {
+			fmt.Println("  " + k)
+		}
+	}
+	return nil
+}
+
+// view prints the peer list the peer would receive and the peers it would not
+func view(c *adminClient, key string) error {
+	var v protocol.AdminView
+	if err := c.call(http.MethodGet, protocol.AdminViewPath+"?key="+url.QueryEscape(key), nil, &v); err != nil {
+		return err
+	}
+	if !v.Registered {
+		fmt.Println("Peer has not registered since the server started")
+	}
+	if len(v.Groups) != 0 {
+		fmt.Println("Groups: " + strings.Join(v.Groups, ","))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBLIC KEY\tADDRESSES\tENDPOINT\tCANDIDATES\tNEXT KEY")
+	for _, p := range v.Peers {
+		endpoint := p.Endpoint
+		if p.ThroughServer {
+			endpoint = "through server"
+		} else if p.Via != "" {
+			endpoint = "via hub " + p.Via
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.PublicKey, strings.Join(p.Addresses, ","), endpoint,
+			strings.Join(p.Candidates, ","), p.NextKey)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(v.Hidden) == 0 {
+		return nil
+	}
+	fmt.Println("\nNot received:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, h := range v.Hidden {
+		fmt.Fprintf(w, "  %s\t%s\n", h.PublicKey, h.Reason)
+	}
+	return w.Flush()
+}
+
+func churn(c *adminClient) error {
+	var report []protocol.AdminChurn
+	if err := c.call(http.MethodGet, protocol.AdminChurnPath, nil, &report); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBLIC KEY\tSTATE\tJOINS\tLEAVES\tENDPOINT CHANGES\tLAST EVENT")
+	for _, r := range report {
+		state := "offline"
+		if r.Online {
+			state = "online"
+		}
+		if r.Flappy {
+			state += " (flappy)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", r.PublicKey, state, r.Joins, r.Leaves,
+			r.EndpointChanges, r.LastEvent.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// restart starts a rolling restart and follows it until it ends
+func restart(c *adminClient, group string, timeoutSecs int) error {
+	if group == "" {
+		return errors.New("A group is required")
+	}
+	var status protocol.AdminRestart
+	if err := c.call(http.MethodPost, protocol.AdminRestartPath, protocol.AdminRestartRequest{
+		Group:       group,
+		TimeoutSecs: timeoutSecs,
+	}, &status); err != nil {
+		return err
+	}
+	for _, k := range status.Skipped {
+		fmt.Printf("Skipping %s, which is offline\n", k)
+	}
+	current := ""
+	for {
+		if status.Current != current && status.Current != "" {
+			fmt.Printf("Restarting %s (%d left)\n", status.Current, len(status.Pending))
+		}
+		current = status.Current
+		switch status.State {
+		case "done":
+			fmt.Printf("Restarted %d peers\n", len(status.Restarted))
+			return nil
+		case "failed":
+			return errors.Errorf("Restart failed after %d peers: %s", len(status.Restarted), status.Error)
+		}
+		time.Sleep(2 * time.Second)
+		if err := c.call(http.MethodGet, protocol.AdminRestartPath, nil, &status); err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	command := config.Subcommand()
+	if command == "config" {
+		if err := config.RunCommand("meshctl"); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+	config, err := config.LoadMeshctlConfig()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	c := &adminClient{
+		url:   config.AdminURL,
+		token: config.AdminToken,
+		http:  &http.Client{Timeout: 11 * time.Second},
+	}
+	req := protocol.AdminRequest{PublicKey: config.Key}
+	switch command {
+	case "approve", "revoke", "kick", "set", "annotate", "renumber", "view":
+		if config.Key == "" {
+			logrus.Fatal("A peer key is required")
+		}
+	}
+
+	switch command {
+	case "", "list":
+		err = list(c)
+	case "approve":
+		err = c.call(http.MethodPost, protocol.AdminApprovePath, req, nil)
+	case "revoke":
+		err = c.call(http.MethodPost, protocol.AdminRevokePath, req, nil)
+	case "kick":
+		err = c.call(http.MethodPost, protocol.AdminKickPath, req, nil)
+	case "set":
+		// Only the given fields are changed
+		if config.Hostname != "" {
+			req.Hostname = &config.Hostname
+		}
+		if len(config.Routes) != 0 {
+			req.Routes = &config.Routes
+		}
+		if len(config.Groups) != 0 {
+			req.Groups = &config.Groups
+		}
+		err = c.call(http.MethodPost, protocol.AdminMetadataPath, req, nil)
+	case "annotate":
+		req.Annotations = make(map[string]string, len(config.Annotations))
+		for _, a := range config.Annotations {
+			parts := strings.SplitN(a, "=", 2)
+			if len(parts) != 2 {
+				logrus.Fatalf("Invalid annotation %q, expected name=value", a)
+			}
+			req.Annotations[parts[0]] = parts[1]
+		}
+		err = c.call(http.MethodPost, protocol.AdminAnnotatePath, req, nil)
+	case "renumber":
+		req.Address = config.Address
+		req.WindowSecs = config.WindowSecs
+		err = c.call(http.MethodPost, protocol.AdminRenumberPath, req, nil)
+	case "diagnostics":
+		err = diagnostics(c)
+	case "partition":
+		err = partition(c)
+	case "view":
+		err = view(c, config.Key)
+	case "churn":
+		err = churn(c)
+	case "restart":
+		err = restart(c, config.Group, config.RestartTimeoutSecs)
+	case "mint-token":
+		var token protocol.AdminToken
+		err = c.call(http.MethodPost, protocol.AdminTokensPath, protocol.AdminTokenRequest{
+			TTLSecs: config.TTLSecs,
+			Uses:    config.Uses,
+		}, &token)
+		if err == nil {
+			fmt.Println(token.Token)
+		}
+	default:
+		logrus.Fatal("Unknown command: ", command)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("Admin request failed")
+	}
+}
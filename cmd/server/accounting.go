@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/accounting"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var accountingLog = logging.For("accounting")
+
+// The traffic counters of the device are sampled this often
+const accountingInterval = time.Minute
+
+// quotas account the traffic of the clients with the server. If remove is
+// set, clients over their quota are left out of the peer lists until the
+// period ends.
+type quotas struct {
+	*accounting.Accounting
+	remove bool
+}
+
+// over reports whether the client is to be left out for exceeding its quota
+func (q *quotas) over(key wgtypes.Key) bool {
+	return q != nil && q.remove && q.Exceeded(key)
+}
+
+func (s *overlayServer) runAccounting() {
+	ticker := time.NewTicker(accountingInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		stats, err := s.wgState.GetPeerStats()
+		if err != nil {
+			accountingLog.WithError(err).Error("Could not read traffic counters")
+			continue
+		}
+		exceeded, lifted, err := s.quotas.Sample(stats, now)
+		if err != nil {
+			accountingLog.WithError(err).Warn("Could not save traffic usage")
+		}
+		for _, k := range exceeded {
+			accountingLog.WithField("peer", k.String()).Warn("Peer exceeded its traffic quota")
+			s.events.emit(protocol.Event{Event: eventQuotaExceeded, Peer: k.String()})
+			if s.quotas.remove {
+				s.events.emit(protocol.Event{Event: eventEvicted, Peer: k.String(), Reason: "over traffic quota"})
+			}
+		}
+		for _, k := range lifted {
+			accountingLog.WithField("peer", k.String()).Info("Traffic quota of peer lifted for the new period")
+		}
+		if s.quotas.remove && (len(exceeded) != 0 || len(lifted) != 0) {
+			s.changed()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/jimzhong/wireguard-overlay/internal/firewall"
+	"github.com/jimzhong/wireguard-overlay/internal/groups"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// aclFor resolves the rules whose destination group the receiver is in into
+// the addresses of the source peers it is sent, including their routed
+// networks. Rules without any such source are left out.
+func (s *overlayServer) aclFor(receiver wgtypes.Key) (protocol.ACL, error) {
+	var acl protocol.ACL
+	if len(s.acl) == 0 {
+		return acl, nil
+	}
+	peers, err := s.peersFor(receiver, nil)
+	if err != nil {
+		return acl, err
+	}
+	peerGroups := s.peerGroups()
+	for _, r := range s.acl {
+		if !peerGroups.Has(receiver, r.Dst) {
+			continue
+		}
+		rule := firewall.ACLRule{Allow: r.Allow, Any: r.Src == groups.Wildcard, Proto: r.Proto, Port: r.Port}
+		if !rule.Any {
+			for _, p := range peers {
+				if p.PublicKey == receiver || !peerGroups.Has(p.PublicKey, r.Src) {
+					continue
+				}
+				for _, ip := range s.wgState.PeerAddresses(p) {
+					rule.Sources = append(rule.Sources, net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+				}
+				rule.Sources = append(rule.Sources, p.AllowedIPs...)
+			}
+			if len(rule.Sources) == 0 {
+				continue
+			}
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return acl, nil
+}
+
+func (s *overlayServer) handleACL(w http.ResponseWriter, request *http.Request) {
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	acl, err := s.aclFor(key)
+	if err != nil {
+		http.Error(w, "Could not get peers", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(acl); err != nil {
+		http.Error(w, "Could not serialize ACL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		syncLog.WithError(err).Error("Could not write response")
+	}
+}
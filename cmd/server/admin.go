@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var adminLog = logging.For("admin")
+
+const (
+	maxAdminRequestSize = 64 << 10
+	maxAnnotationName   = 64
+	maxAnnotationValue  = 1024
+)
+
+func newAdminServer(s *overlayServer, token string, dashboard bool) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.AdminPeersPath, s.handleAdminPeers)
+	mux.HandleFunc(protocol.AdminApprovePath, s.adminAction(s.approve))
+	mux.HandleFunc(protocol.AdminRevokePath, s.adminAction(s.revoke))
+	mux.HandleFunc(protocol.AdminKickPath, s.adminAction(s.kick))
+	mux.HandleFunc(protocol.AdminMetadataPath, s.adminAction(s.setMetadata))
+	mux.HandleFunc(protocol.AdminAnnotatePath, s.adminAction(s.annotate))
+	mux.HandleFunc(protocol.AdminRenumberPath, s.adminAction(s.renumber))
+	mux.HandleFunc(protocol.AdminTokensPath, s.handleAdminTokens)
+	mux.HandleFunc(protocol.AdminDiagnosticsPath, s.handleAdminDiagnostics)
+	mux.HandleFunc(protocol.AdminPartitionPath, s.handleAdminPartition)
+	mux.HandleFunc(protocol.AdminChurnPath, s.handleAdminChurn)
+	mux.HandleFunc(protocol.AdminRestartPath, s.handleAdminRestart)
+	mux.HandleFunc(protocol.AdminViewPath, s.handleAdminView)
+	mux.HandleFunc(protocol.AdminTopologyPath, s.handleAdminTopology)
+	handler := requireToken(token, mux)
+	if dashboard {
+		handler = serveDashboard(handler)
+	}
+	return &http.Server{
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 6 * time.Second,
+		Handler:      handler,
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		adminLog.WithError(err).Error("Could not write response")
+	}
+}
+
+func (s *overlayServer) handleAdminPeers(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peers, err := s.wgState.GetPeerStats()
+	if err != nil {
+		http.Error(w, "Could not get peers", http.StatusInternalServerError)
+		return
+	}
+	active := make(map[wgtypes.Key]wg.PeerStats, len(peers))
+	for _, p := range peers {
+		active[p.PublicKey] = p
+	}
+	keys := make(map[wgtypes.Key]bool)
+	for _, k := range s.configured.list() {
+		keys[k] = true
+	}
+	for _, r := range s.store.List() {
+		keys[r.PublicKey] = true
+	}
+	for k := range active {
+		keys[k] = true
+	}
+	peerGroups := s.peerGroups()
+	list := make([]protocol.AdminPeer, 0, len(keys))
+	for k := range keys {
+		r, _ := s.store.Get(k)
+		ap := protocol.AdminPeer{
+			PublicKey:   k.String(),
+			Hostname:    r.Hostname,
+			Routes:      r.Routes,
+			Groups:      peerGroups[k],
+			Configured:  s.configured.has(k),
+			Approved:    r.Approved,
+			Revoked:     r.Revoked,
+			Static:      r.Static,
+			Island:      s.partition.islandOf(k),
+			Annotations: r.Annotations,
+		}
+		if reg, ok := s.reg.get(k); ok {
+			ap.NAT = reg.NAT
+			ap.Metadata = reg.Metadata
+		}
+		if seen, ok := s.reg.lastSeen(k); ok {
+			seen = seen.UTC()
+			ap.LastSeen = &seen
+		}
+		if s.liveness != nil {
+			ap.Offline = s.liveness.isOffline(k)
+		}
+		if p, ok := active[k]; ok {
+			for _, a := range p.Addresses {
+				ap.Addresses = append(ap.Addresses, a.String())
+			}
+			if p.IP != "" {
+				ap.Endpoint = net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+			}
+			if !p.LastHandshake.IsZero() {
+				handshake := p.LastHandshake.UTC()
+				ap.LastHandshake = &handshake
+			}
+			ap.ReceiveBytes, ap.TransmitBytes = p.RxBytes, p.TxBytes
+		}
+		list = append(list, ap)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PublicKey < list[j].PublicKey })
+	writeJSON(w, list)
+}
+
+// adminAction decodes the request and runs the action on the given key
+func (s *overlayServer) adminAction(action func(key wgtypes.Key, req *protocol.AdminRequest) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req protocol.AdminRequest
+		body := http.MaxBytesReader(w, request.Body, maxAdminRequestSize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, "Could not decode request", http.StatusBadRequest)
+			return
+		}
+		key, err := wgtypes.ParseKey(req.PublicKey)
+		if err != nil {
+			http.Error(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+		if err := action(key, &req); err != nil {
+			adminLog.WithError(err).WithField("peer", key.String()).Errorf("Admin %s failed", request.URL.Path)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		adminLog.WithField("peer", key.String()).Infof("Admin %s", request.URL.Path)
+		s.changed()
+		r, _ := s.store.Get(key)
+		writeJSON(w, r)
+	}
+}
+
+func (s *overlayServer) approve(key wgtypes.Key, req *protocol.AdminRequest) error {
+	if key == s.wgState.PublicKey() {
+		return errors.New("Cannot approve the server itself")
+	}
+	if _, err := s.store.Update(key, func(r *store.Record) {
+		r.Approved = true
+		r.Revoked = false
+	}); err != nil {
+		return err
+	}
+	s.events.emit(protocol.Event{Event: eventApproved, Peer: key.String(), Reason: "admin"})
+	peer, err := s.peerConfig(key)
+	if err != nil {
+		return err
+	}
+	return s.wgState.AddPeers([]wg.Peer{peer})
+}
+
+func (s *overlayServer) revoke(key wgtypes.Key, req *protocol.AdminRequest) error {
+	remove := []wgtypes.Key{key}
+	if r, ok := s.rotations()[key]; ok {
+		remove = append(remove, r.next)
+	}
+	old, _ := s.store.Get(key)
+	if _, err := s.store.Update(key, func(r *store.Record) {
+		r.Approved = false
+		r.Revoked = true
+		r.Rotation = nil
+		r.Renumbering = nil
+	}); err != nil {
+		return err
+	}
+	if s.alloc != nil && old.Renumbering != nil {
+		s.alloc.Unreserve(old.Renumbering.From)
+	}
+	s.events.emit(protocol.Event{Event: eventRevoked, Peer: key.String(), Reason: "admin"})
+	s.reg.delete(key)
+	if s.alloc != nil {
+		if err := s.alloc.Release(key); err != nil {
+			adminLog.WithError(err).Warn("Could not release address of ", key)
+		}
+	}
+	return s.wgState.RemovePeers(remove)
+}
+
+// kick drops the session and registration of the peer. The peer has to
+// handshake again and re-register.
+func (s *overlayServer) kick(key wgtypes.Key, req *protocol.AdminRequest) error {
+	if !s.allowed(key) {
+		return errors.New("Peer is not part of the overlay")
+	}
+	s.reg.delete(key)
+	s.events.emit(protocol.Event{Event: eventEvicted, Peer: key.String(), Reason: "kicked"})
+	if err := s.wgState.RemovePeers([]wgtypes.Key{key}); err != nil {
+		return err
+	}
+	peer, err := s.peerConfig(key)
+	if err != nil {
+		return err
+	}
+	return s.wgState.AddPeers([]wg.Peer{peer})
+}
+
+func (s *overlayServer) setMetadata(key wgtypes.Key, req *protocol.AdminRequest) error {
+	if req.Routes != nil {
+		for _, r := range *req.Routes {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return errors.Wrapf(err, "Invalid route %q", r)
+			}
+		}
+	}
+	if _, err := s.store.Update(key, func(r *store.Record) {
+		if req.Hostname != nil {
+			r.Hostname = *req.Hostname
+		}
+		if req.Routes != nil {
+			r.Routes = *req.Routes
+		}
+		if req.Groups != nil {
+			r.Groups = *req.Groups
+		}
+	}); err != nil {
+		return err
+	}
+	// The peer may have moved to a group with another prefix
+	moved := req.Groups != nil && s.alloc != nil && len(s.prefixes) != 0
+	if (moved || req.Routes != nil) && s.allowed(key) {
+		peer, err := s.peerConfig(key)
+		if err != nil {
+			return err
+		}
+		return s.wgState.AddPeers([]wg.Peer{peer})
+	}
+	return nil
+}
+
+// annotate sets the given annotations of the peer and removes those with an
+// empty value
+func (s *overlayServer) annotate(key wgtypes.Key, req *protocol.AdminRequest) error {
+	if len(req.Annotations) == 0 {
+		return errors.New("No annotations given")
+	}
+	for name, value := range req.Annotations {
+		if name == "" || len(name) > maxAnnotationName || strings.ContainsAny(name, "=\n") {
+			return errors.Errorf("Invalid annotation name %q", name)
+		}
+		if len(value) > maxAnnotationValue {
+			return errors.Errorf("Annotation %s is longer than %d bytes", name, maxAnnotationValue)
+		}
+	}
+	_, err := s.store.Update(key, func(r *store.Record) {
+		// The map is copied, so that the old record stays intact if saving fails
+		annotations := make(map[string]string, len(r.Annotations)+len(req.Annotations))
+		for name, value := range r.Annotations {
+			annotations[name] = value
+		}
+		for name, value := range req.Annotations {
+			if value == "" {
+				delete(annotations, name)
+			} else {
+				annotations[name] = value
+			}
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		r.Annotations = annotations
+	})
+	return err
+}
+
+func (s *overlayServer) handleAdminTokens(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.tokens == nil {
+		http.Error(w, "Enrollment is disabled", http.StatusNotFound)
+		return
+	}
+	var req protocol.AdminTokenRequest
+	body := http.MaxBytesReader(w, request.Body, maxAdminRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "Could not decode request", http.StatusBadRequest)
+		return
+	}
+	token, expires, err := s.tokens.Mint(time.Duration(req.TTLSecs)*time.Second, req.Uses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	adminLog.Infof("Minted enrollment token for %d uses expiring %s", req.Uses, expires)
+	writeJSON(w, protocol.AdminToken{Token: token, Expires: expires})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var allowlistLog = logging.For("allowlist")
+
+// The allowlist file is checked for changes this often
+const allowlistPoll = 10 * time.Second
+
+// allowlist holds the keys of the clients configured with client-pubkeys and
+// listed in client-pubkeys-file, which is read again when it changes
+type allowlist struct {
+	path    string
+	mu      sync.RWMutex
+	static  map[wgtypes.Key]bool
+	keys    map[wgtypes.Key]bool
+	modTime time.Time
+}
+
+func newAllowlist(pubkeys []string, path string) (*allowlist, error) {
+	a := &allowlist{path: path, static: make(map[wgtypes.Key]bool, len(pubkeys))}
+	for _, p := range pubkeys {
+		pubkey, err := wgtypes.ParseKey(p)
+		if err != nil {
+			allowlistLog.WithError(err).Warn("Skipped invalid key: ", p)
+			continue
+		}
+		a.static[pubkey] = true
+	}
+	a.keys = a.static
+	if path != "" {
+		if _, _, err := a.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *allowlist) has(key wgtypes.Key) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.keys[key]
+}
+
+func (a *allowlist) list() []wgtypes.Key {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	keys := make([]wgtypes.Key, 0, len(a.keys))
+	for k := range a.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// reload reads the file again if it changed and returns the keys added to and
+// removed from the list. If the file cannot be read, the list is kept.
+func (a *allowlist) reload() (added, removed []wgtypes.Key, err error) {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not read client-pubkeys-file")
+	}
+	a.mu.RLock()
+	unchanged := info.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil, nil, nil
+	}
+	listed, err := readKeyFile(a.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make(map[wgtypes.Key]bool, len(a.static)+len(listed))
+	for k := range a.static {
+		keys[k] = true
+	}
+	for k := range listed {
+		keys[k] = true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k := range keys {
+		if !a.keys[k] {
+			added = append(added, k)
+		}
+	}
+	for k := range a.keys {
+		if !keys[k] {
+			removed = append(removed, k)
+		}
+	}
+	a.keys, a.modTime = keys, info.ModTime()
+	return added, removed, nil
+}
+
+// readKeyFile reads a base64 encoded public key per line. Empty lines and
+// those starting with # are skipped.
+func readKeyFile(path string) (map[wgtypes.Key]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open client-pubkeys-file")
+	}
+	defer f.Close()
+	keys := make(map[wgtypes.Key]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := wgtypes.ParseKey(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key on line %d of %s", line, path)
+		}
+		keys[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not read client-pubkeys-file")
+	}
+	return keys, nil
+}
+
+// runAllowlist configures the clients added to the allowlist file and evicts
+// those removed from it, unless they are approved through the admin API
+func (s *overlayServer) runAllowlist() {
+	ticker := time.NewTicker(allowlistPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		added, removed, err := s.configured.reload()
+		if err != nil {
+			allowlistLog.WithError(err).Error("Could not reload allowlist; keeping the previous one")
+			continue
+		}
+		for _, k := range added {
+			if !s.allowed(k) {
+				continue
+			}
+			allowlistLog.WithField("peer", k.String()).Info("Peer added to allowlist")
+			s.events.emit(protocol.Event{Event: eventApproved, Peer: k.String(), Reason: "allowlist"})
+			peer, err := s.peerConfig(k)
+			if err == nil {
+				err = s.wgState.AddPeers([]wg.Peer{peer})
+			}
+			if err != nil {
+				allowlistLog.WithField("peer", k.String()).WithError(err).Error("Could not configure peer")
+			}
+		}
+		for _, k := range removed {
+			if s.allowed(k) {
+				continue
+			}
+			log := allowlistLog.WithField("peer", k.String())
+			log.Info("Peer removed from allowlist")
+			s.events.emit(protocol.Event{Event: eventEvicted, Peer: k.String(), Reason: "removed from allowlist"})
+			s.reg.delete(k)
+			if s.alloc != nil {
+				if err := s.alloc.Release(k); err != nil {
+					log.WithError(err).Warn("Could not release address")
+				}
+			}
+			remove := []wgtypes.Key{k}
+			if r, ok := s.rotations()[k]; ok {
+				remove = append(remove, r.next)
+			}
+			if err := s.wgState.RemovePeers(remove); err != nil {
+				log.WithError(err).Error("Could not remove peer")
+			}
+		}
+		if len(added) != 0 || len(removed) != 0 {
+			s.changed()
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var churnLog = logging.For("churn")
+
+const (
+	churnCheckInterval = 30 * time.Second
+	// Events are counted over this window
+	churnWindow = time.Hour
+	// Peers with at least this many events within the window are flappy
+	flappyEvents = 6
+)
+
+// peerChurn is what the server saw of a peer coming and going
+type peerChurn struct {
+	online   bool
+	endpoint string
+	// events within the window
+	joins, leaves, endpoints []time.Time
+}
+
+// churnTotals counts the events of a peer since the server started
+type churnTotals struct {
+	joins, leaves, endpoints int
+}
+
+func (p *peerChurn) events() int {
+	return len(p.joins) + len(p.leaves) + len(p.endpoints)
+}
+
+// churn tracks how often peers join, leave and change their endpoint, to find
+// nodes with broken NATs or unstable links. The peers without events in the
+// window are dropped, but their totals are kept, so that the counters exported
+// never go back.
+type churn struct {
+	mu     sync.Mutex
+	peers  map[wgtypes.Key]*peerChurn
+	totals map[wgtypes.Key]*churnTotals
+}
+
+func newChurn() *churn {
+	return &churn{peers: make(map[wgtypes.Key]*peerChurn), totals: make(map[wgtypes.Key]*churnTotals)}
+}
+
+func (c *churn) total(k wgtypes.Key) *churnTotals {
+	t, ok := c.totals[k]
+	if !ok {
+		t = &churnTotals{}
+		c.totals[k] = t
+	}
+	return t
+}
+
+func (s *overlayServer) runChurnTracking() {
+	ticker := time.NewTicker(churnCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkChurn(time.Now())
+	}
+}
+
+func (s *overlayServer) checkChurn(now time.Time) {
+	stats, err := s.wgState.GetPeerStats()
+	if err != nil {
+		churnLog.WithError(err).Warn("Could not get peer stats")
+		return
+	}
+	endpoints := make(map[wgtypes.Key]string, len(stats))
+	for _, st := range stats {
+		if st.Endpoint != nil {
+			endpoints[st.PublicKey] = st.Endpoint.String()
+		}
+	}
+	online := s.reg.heartbeats(now.Add(-heartbeatTimeout))
+	for _, event := range s.churn.update(online, endpoints, now) {
+		s.events.emit(event)
+	}
+}
+
+// update records the peers that came online, went offline or moved to another
+// endpoint since the last update, and returns the moves
+func (c *churn) update(online map[wgtypes.Key][]wgtypes.Key, endpoints map[wgtypes.Key]string, now time.Time) []protocol.Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var moves []protocol.Event
+	for k := range online {
+		p, ok := c.peers[k]
+		if !ok {
+			p = &peerChurn{}
+			c.peers[k] = p
+		}
+		if !p.online {
+			p.online = true
+			p.joins = append(p.joins, now)
+			c.total(k).joins++
+		}
+		if e := endpoints[k]; e != "" {
+			if p.endpoint != "" && p.endpoint != e {
+				churnLog.Debugf("Peer %s moved from %s to %s", k, p.endpoint, e)
+				p.endpoints = append(p.endpoints, now)
+				c.total(k).endpoints++
+				moves = append(moves, protocol.Event{Event: eventEndpointChanged, Peer: k.String(), Endpoint: e, PreviousEndpoint: p.endpoint})
+			}
+			p.endpoint = e
+		}
+	}
+	for k, p := range c.peers {
+		if _, ok := online[k]; !ok && p.online {
+			p.online = false
+			p.leaves = append(p.leaves, now)
+			c.total(k).leaves++
+		}
+		since := now.Add(-churnWindow)
+		p.joins, p.leaves, p.endpoints = recent(p.joins, since), recent(p.leaves, since), recent(p.endpoints, since)
+		if !p.online && p.events() == 0 {
+			delete(c.peers, k)
+		}
+	}
+	return moves
+}
+
+// recent drops the times before since, which are sorted
+func recent(times []time.Time, since time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(since) })
+	return times[i:]
+}
+
+// report lists the peers with events within the window, most events first
+func (c *churn) report() []protocol.AdminChurn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]protocol.AdminChurn, 0, len(c.peers))
+	for k, p := range c.peers {
+		if p.events() == 0 {
+			continue
+		}
+		r := protocol.AdminChurn{
+			PublicKey:       k.String(),
+			Online:          p.online,
+			Joins:           len(p.joins),
+			Leaves:          len(p.leaves),
+			EndpointChanges: len(p.endpoints),
+			Flappy:          p.events() >= flappyEvents,
+		}
+		for _, times := range [][]time.Time{p.joins, p.leaves, p.endpoints} {
+			if len(times) != 0 && times[len(times)-1].After(r.LastEvent) {
+				r.LastEvent = times[len(times)-1]
+			}
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Joins+list[i].Leaves+list[i].EndpointChanges, list[j].Joins+list[j].Leaves+list[j].EndpointChanges
+		if a != b {
+			return a > b
+		}
+		return list[i].PublicKey < list[j].PublicKey
+	})
+	return list
+}
+
+// collect writes the churn metrics
+func (c *churn) collect(m *status.Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var joins, leaves, endpoints []status.Sample
+	flappy := 0
+	for k, t := range c.totals {
+		labels := status.Label("public_key", k.String())
+		joins = append(joins, status.Sample{Labels: labels, Value: float64(t.joins)})
+		leaves = append(leaves, status.Sample{Labels: labels, Value: float64(t.leaves)})
+		endpoints = append(endpoints, status.Sample{Labels: labels, Value: float64(t.endpoints)})
+	}
+	for _, p := range c.peers {
+		if p.events() >= flappyEvents {
+			flappy++
+		}
+	}
+	m.Write("wireguard_overlay_peer_joins_total", "counter", "Times the peer came online.", joins...)
+	m.Write("wireguard_overlay_peer_leaves_total", "counter", "Times the peer went offline.", leaves...)
+	m.Write("wireguard_overlay_peer_endpoint_changes_total", "counter", "Times the peer moved to another endpoint.", endpoints...)
+	m.Write("wireguard_overlay_flappy_peers", "gauge", "Number of peers with at least "+strconv.Itoa(flappyEvents)+" events in the last hour.",
+		status.Sample{Labels: "", Value: float64(flappy)})
+}
+
+func (s *overlayServer) handleAdminChurn(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.churn.report())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// dashboard is a single page on top of the admin API. It holds no data
+// itself, and sends the token the user enters with every request.
+//
+//go:embed dashboard.html
+var dashboard []byte
+
+// serveDashboard serves the dashboard page without the token, and everything
+// else through next
+func serveDashboard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != protocol.DashboardPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+		// The page has buttons that revoke peers, so it must not be framed
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		w.Write(dashboard)
+	})
+}
+
+// handleAdminTopology lists the pairs of distributed peers the group policy
+// lets reach each other, with how and whether they do
+func (s *overlayServer) handleAdminTopology(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		http.Error(w, "Could not get peers", http.StatusInternalServerError)
+		return
+	}
+	standby := make(map[wgtypes.Key]bool)
+	for _, r := range s.rotations() {
+		standby[r.next] = true
+	}
+	keys := make([]wgtypes.Key, 0, len(peers))
+	for _, p := range peers {
+		if !standby[p.PublicKey] && !s.reg.hasDeparted(p.PublicKey) {
+			keys = append(keys, p.PublicKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	type link struct{ a, b wgtypes.Key }
+	broken := make(map[link]bool)
+	for k, unreachable := range s.reg.heartbeats(time.Now().Add(-heartbeatTimeout)) {
+		for _, u := range unreachable {
+			broken[link{k, u}] = true
+			broken[link{u, k}] = true
+		}
+	}
+	var homes map[wgtypes.Key]wgtypes.Key
+	if s.hubs != nil {
+		s.reg.apply(peers)
+		homes = s.homes(peers)
+	}
+	peerGroups := s.peerGroups()
+	topology := protocol.AdminTopology{Server: s.wgState.PublicKey().String(), Links: []protocol.AdminLink{}}
+	for i, a := range keys {
+		for _, b := range keys[i+1:] {
+			if s.policy != nil && !s.policy.Visible(peerGroups, a, b) && !s.policy.Visible(peerGroups, b, a) {
+				continue
+			}
+			l := protocol.AdminLink{
+				A:             a.String(),
+				B:             b.String(),
+				ThroughServer: !s.topology.Direct(peerGroups, a, b),
+				Broken:        broken[link{a, b}],
+			}
+			if via, ok := s.hubs.Via(a, homes[a], b, homes[b]); ok && !l.ThroughServer {
+				l.Via = via.String()
+			}
+			topology.Links = append(topology.Links, l)
+		}
+	}
+	writeJSON(w, topology)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/patrickmn/go-cache"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Every view keeps this many recent peer lists, against which deltas can be
+// sent. Clients further behind receive the full list.
+const maxPeerHistory = 4
+
+// Responses smaller than this are not worth compressing
+const minCompressed = 1024
+
+// peerList is a peer list as built for a view
+type peerList struct {
+	generation uint64
+	peers      []wg.Peer
+	serialized []byte
+	// gzipped is serialized compressed, once a client asked for it
+	gzipOnce sync.Once
+	gzipped  []byte
+}
+
+// compressed returns the serialized list compressed with gzip
+func (l *peerList) compressed() []byte {
+	l.gzipOnce.Do(func() { l.gzipped = compress(l.serialized) })
+	return l.gzipped
+}
+
+// page returns up to limit peers from offset on
+func (l *peerList) page(offset, limit int) []wg.Peer {
+	if offset < 0 || offset > len(l.peers) {
+		offset = len(l.peers)
+	}
+	if limit > len(l.peers)-offset {
+		limit = len(l.peers) - offset
+	}
+	return l.peers[offset : offset+limit]
+}
+
+// peerHistory keeps the recent peer lists of every view, so that clients
+// that have one of them are only sent what changed since. Views nobody
+// fetched for an hour are forgotten.
+type peerHistory struct {
+	mu    sync.Mutex
+	next  uint64
+	views *cache.Cache
+}
+
+func newPeerHistory() *peerHistory {
+	// Start from the clock so that generations of a restarted server are
+	// not mistaken for earlier ones
+	return &peerHistory{next: uint64(time.Now().UnixNano()), views: cache.New(time.Hour, 10*time.Minute)}
+}
+
+// record returns the current list of the view, which is the one built
+// unless the view already had the same list
+func (h *peerHistory) record(view string, peers []wg.Peer, serialized []byte) *peerList {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var lists []*peerList
+	if cached, found := h.views.Get(view); found {
+		lists = cached.([]*peerList)
+	}
+	if n := len(lists); n != 0 && bytes.Equal(lists[n-1].serialized, serialized) {
+		h.views.SetDefault(view, lists)
+		return lists[n-1]
+	}
+	h.next++
+	list := &peerList{generation: h.next, peers: peers, serialized: serialized}
+	if len(lists) == maxPeerHistory {
+		lists = lists[1:]
+	}
+	lists = append(append([]*peerList(nil), lists...), list)
+	h.views.SetDefault(view, lists)
+	return list
+}
+
+// find returns the list of the view with the generation, if still kept
+func (h *peerHistory) find(view string, generation uint64) *peerList {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cached, found := h.views.Get(view)
+	if !found {
+		return nil
+	}
+	for _, list := range cached.([]*peerList) {
+		if list.generation == generation {
+			return list
+		}
+	}
+	return nil
+}
+
+// delta returns what changed in the view from the list of the generation to
+// current. It fails once that list is no longer kept, and the client is to be
+// sent the full list.
+func (h *peerHistory) delta(view string, since uint64, current *peerList) (protocol.PeerDelta, bool) {
+	old := h.find(view, since)
+	if old == nil {
+		return protocol.PeerDelta{}, false
+	}
+	return peerDelta(old, current)
+}
+
+// peerDelta returns what changed from old to current. It fails if a key is
+// listed twice, which a delta cannot express.
+func peerDelta(old, current *peerList) (protocol.PeerDelta, bool) {
+	delta := protocol.PeerDelta{Since: old.generation, Generation: current.generation}
+	before := make(map[wgtypes.Key]*wg.Peer, len(old.peers))
+	for i := range old.peers {
+		if before[old.peers[i].PublicKey] != nil {
+			return delta, false
+		}
+		before[old.peers[i].PublicKey] = &old.peers[i]
+	}
+	seen := make(map[wgtypes.Key]bool, len(current.peers))
+	for _, p := range current.peers {
+		if seen[p.PublicKey] {
+			return delta, false
+		}
+		seen[p.PublicKey] = true
+		if o := before[p.PublicKey]; o == nil || !reflect.DeepEqual(*o, p) {
+			delta.Changed = append(delta.Changed, p)
+		}
+	}
+	for k := range before {
+		if !seen[k] {
+			delta.Removed = append(delta.Removed, k)
+		}
+	}
+	return delta, true
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// acceptsGzip reports whether the client asked for gzip encoded responses
+func acceptsGzip(request *http.Request) bool {
+	for _, coding := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(coding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
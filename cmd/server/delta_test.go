@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testPeers(t *testing.T, n int) []wg.Peer {
+	t.Helper()
+	peers := make([]wg.Peer, n)
+	for i := range peers {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[i] = wg.Peer{IP: "192.0.2." + strconv.Itoa(i+1), Port: 51820, PublicKey: k.PublicKey()}
+	}
+	return peers
+}
+
+// sorted orders peers by key, as deltas do not keep the order of the list
+func sorted(peers []wg.Peer) []wg.Peer {
+	peers = append([]wg.Peer(nil), peers...)
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey.String() < peers[j].PublicKey.String() })
+	return peers
+}
+
+func TestPeerDelta(t *testing.T) {
+	p := testPeers(t, 4)
+	moved := p[1]
+	moved.Port = 51821
+	tests := []struct {
+		name    string
+		old     []wg.Peer
+		current []wg.Peer
+		changed int
+		removed int
+	}{
+		{"unchanged", p[:3], p[:3], 0, 0},
+		{"add", p[:2], p[:3], 1, 0},
+		{"remove", p[:3], []wg.Peer{p[0], p[2]}, 0, 1},
+		{"change", p[:3], []wg.Peer{p[0], moved, p[2]}, 1, 0},
+		{"all at once", p[:3], []wg.Peer{moved, p[2], p[3]}, 2, 1},
+	}
+	for _, tt := range tests {
+		old := &peerList{generation: 1, peers: tt.old}
+		current := &peerList{generation: 2, peers: tt.current}
+		delta, ok := peerDelta(old, current)
+		if !ok {
+			t.Errorf("%s: no delta", tt.name)
+			continue
+		}
+		if delta.Since != 1 || delta.Generation != 2 {
+			t.Errorf("%s: delta from %d to %d, want 1 to 2", tt.name, delta.Since, delta.Generation)
+		}
+		if len(delta.Changed) != tt.changed || len(delta.Removed) != tt.removed {
+			t.Errorf("%s: %d changed and %d removed, want %d and %d", tt.name, len(delta.Changed), len(delta.Removed), tt.changed, tt.removed)
+		}
+		if got := delta.Apply(tt.old); !reflect.DeepEqual(sorted(got), sorted(tt.current)) {
+			t.Errorf("%s: applied delta gives %v, want %v", tt.name, got, tt.current)
+		}
+	}
+	duplicate := &peerList{generation: 2, peers: []wg.Peer{p[0], p[0]}}
+	if _, ok := peerDelta(&peerList{generation: 1, peers: p[:1]}, duplicate); ok {
+		t.Error("Delta to a list with a key listed twice")
+	}
+}
+
+func TestPeerHistoryExpires(t *testing.T) {
+	h := newPeerHistory()
+	p := testPeers(t, maxPeerHistory+2)
+	var lists []*peerList
+	for i := 1; i <= len(p); i++ {
+		serialized, err := encode(p[:i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		lists = append(lists, h.record("view", p[:i], serialized))
+	}
+	current := lists[len(lists)-1]
+	// The same list again is no new generation
+	serialized, _ := encode(p)
+	if again := h.record("view", p, serialized); again != current {
+		t.Errorf("Unchanged list got generation %d, want %d", again.generation, current.generation)
+	}
+	for i, list := range lists {
+		delta, ok := h.delta("view", list.generation, current)
+		kept := i >= len(lists)-maxPeerHistory
+		if ok != kept {
+			t.Errorf("Generation %d of %d: delta %v, want %v", i+1, len(lists), ok, kept)
+			continue
+		}
+		if ok && !reflect.DeepEqual(sorted(delta.Apply(list.peers)), sorted(current.peers)) {
+			t.Errorf("Generation %d of %d: applied delta does not give the current list", i+1, len(lists))
+		}
+	}
+	if _, ok := h.delta("other view", lists[len(lists)-1].generation, current); ok {
+		t.Error("Delta against the list of another view")
+	}
+}
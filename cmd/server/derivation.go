@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// derivation negotiates the algorithm of derived addresses. The configured
+// version is only announced once every registered peer supports it, so that
+// meshes move to a new algorithm without a flag day; until then the highest
+// version all of them support is used.
+type derivation struct {
+	mu      sync.Mutex
+	target  derive.Version
+	current derive.Version
+}
+
+func newDerivation(target derive.Version) *derivation {
+	return &derivation{target: target, current: derive.Current}
+}
+
+func (d *derivation) version() derive.Version {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// update picks the version from the versions each peer supports and reports
+// whether it changed
+func (d *derivation) update(supported map[wgtypes.Key][]derive.Version) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	best := derive.Current
+	for v := d.target; v > derive.Current; v-- {
+		all := true
+		for _, versions := range supported {
+			all = all && hasVersion(versions, v)
+		}
+		if all {
+			best = v
+			break
+		}
+	}
+	if best == d.current {
+		return false
+	}
+	d.current = best
+	return true
+}
+
+func hasVersion(versions []derive.Version, v derive.Version) bool {
+	for _, s := range versions {
+		if s.Normalize() == v {
+			return true
+		}
+	}
+	// Peers that predate negotiation only know the first version
+	return v == derive.V1
+}
+
+// negotiateAddressVersion updates the version after a registration and moves
+// the derived addresses of the peers on the device over when it changed
+func (s *overlayServer) negotiateAddressVersion() {
+	if s.alloc != nil || !s.derivation.update(s.reg.addressVersions()) {
+		return
+	}
+	syncLog.Infof("Deriving addresses with version %d", s.derivation.version())
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		syncLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	updated := make([]wg.Peer, 0, len(peers))
+	for _, p := range peers {
+		if len(p.Addresses) == 0 {
+			// Standby keys have no addresses yet
+			continue
+		}
+		peer := s.devicePeer(p.PublicKey)
+		if len(peer.Addresses) == 0 {
+			// Back to the first version, so drop the negotiated address
+			peer.Addresses = []net.IP{s.wgState.GetOverlayAddress(p.PublicKey).IP}
+		}
+		updated = append(updated, peer)
+	}
+	if err := s.wgState.AddPeers(updated); err != nil {
+		syncLog.WithError(err).Error("Could not update derived addresses")
+	}
+	s.changed()
+}
+
+// derivedAddresses returns the addresses derived for the peer. Clients keep
+// the address of the first version, through which they reach the server, next
+// to the negotiated one.
+func (s *overlayServer) derivedAddresses(key wgtypes.Key) []net.IP {
+	v := s.derivation.version()
+	if v == derive.Current {
+		return nil
+	}
+	addr, err := s.wgState.DeriveAddress(v, key)
+	if err != nil {
+		return nil
+	}
+	return []net.IP{addr.IP, s.wgState.GetOverlayAddress(key).IP}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var diagnosticsLog = logging.For("diagnostics")
+
+// Only the latest report per pair of peers is kept, up to this many pairs
+const maxDiagnostics = 1024
+
+type pair struct {
+	reporter, peer wgtypes.Key
+}
+
+// diagnostics keeps the failures reported by clients for operators
+type diagnostics struct {
+	mu      sync.Mutex
+	reports map[pair]protocol.AdminDiagnostic
+}
+
+func newDiagnostics() *diagnostics {
+	return &diagnostics{reports: make(map[pair]protocol.AdminDiagnostic)}
+}
+
+func (d *diagnostics) add(reporter wgtypes.Key, diag protocol.Diagnostic) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := pair{reporter: reporter, peer: diag.Peer}
+	if _, ok := d.reports[key]; !ok && len(d.reports) >= maxDiagnostics {
+		// Make room by dropping the oldest report
+		var oldest pair
+		var oldestTime time.Time
+		for k, r := range d.reports {
+			if oldestTime.IsZero() || r.Received.Before(oldestTime) {
+				oldest, oldestTime = k, r.Received
+			}
+		}
+		delete(d.reports, oldest)
+	}
+	d.reports[key] = protocol.AdminDiagnostic{
+		Reporter:   reporter.String(),
+		Peer:       diag.Peer.String(),
+		Received:   time.Now().UTC(),
+		Diagnostic: diag,
+	}
+}
+
+// list returns the reports, latest first
+func (d *diagnostics) list() []protocol.AdminDiagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]protocol.AdminDiagnostic, 0, len(d.reports))
+	for _, r := range d.reports {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Received.After(list[j].Received) })
+	return list
+}
+
+func (s *overlayServer) handleDiagnostics(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	var diag protocol.Diagnostic
+	body := http.MaxBytesReader(w, request.Body, maxRegistrationSize)
+	if err := gob.NewDecoder(body).Decode(&diag); err != nil {
+		http.Error(w, "Could not decode diagnostic", http.StatusBadRequest)
+		return
+	}
+	diagnosticsLog.Warnf("%s cannot reach %s (%s, likely cause %s, endpoints %v, nat %s)", key, diag.Peer, diag.Error, diag.Cause, diag.Endpoints, diag.NAT)
+	s.diagnostics.add(key, diag)
+	s.events.emit(protocol.Event{Event: eventHandshakeFailing, Peer: diag.Peer.String(), Reason: diag.Cause})
+}
+
+func (s *overlayServer) handleAdminDiagnostics(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.diagnostics.list())
+}
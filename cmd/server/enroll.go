@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/enroll"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+)
+
+var enrollLog = logging.For("enroll")
+
+const maxEnrollmentSize = 4096
+
+// newEnrollServer serves enrollments on the underlay, since new clients are
+// not part of the overlay yet
+func newEnrollServer(s *overlayServer) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.EnrollPath, s.handleEnroll)
+	return &http.Server{
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 6 * time.Second,
+		Handler:      mux,
+	}
+}
+
+func (s *overlayServer) handleEnroll(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var enrollment protocol.Enrollment
+	body := http.MaxBytesReader(w, request.Body, maxEnrollmentSize)
+	if err := gob.NewDecoder(body).Decode(&enrollment); err != nil {
+		http.Error(w, "Could not decode enrollment", http.StatusBadRequest)
+		return
+	}
+	key := enrollment.PublicKey
+	r, _ := s.store.Get(key)
+	if r.Revoked {
+		http.Error(w, "Public key is revoked", http.StatusForbidden)
+		return
+	}
+	// Clients present their token again when they restart. As anyone may
+	// claim a key, the bootstrap is only returned for the token it enrolled
+	// with, and other tokens are redeemed like for a new key.
+	if s.allowed(key) && enroll.Matches(r.Token, enrollment.Token) {
+		s.writeBootstrap(w)
+		return
+	}
+	if err := s.tokens.Redeem(enrollment.Token); err != nil {
+		enrollLog.WithError(err).Warnf("Rejected enrollment of %s from %s", key, request.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	known := s.allowed(key)
+	if _, err := s.store.Update(key, func(r *store.Record) {
+		r.Approved = true
+		r.Token = enroll.Hash(enrollment.Token)
+	}); err != nil {
+		enrollLog.WithError(err).Error("Could not record enrollment")
+		http.Error(w, "Could not record enrollment", http.StatusInternalServerError)
+		return
+	}
+	if known {
+		s.writeBootstrap(w)
+		return
+	}
+	peer, err := s.peerConfig(key)
+	if err == nil {
+		err = s.wgState.AddPeers([]wg.Peer{peer})
+	}
+	if err != nil {
+		enrollLog.WithError(err).Error("Could not add enrolled peer")
+		http.Error(w, "Could not add peer", http.StatusInternalServerError)
+		return
+	}
+	enrollLog.Infof("Enrolled %s from %s", key, request.RemoteAddr)
+	s.events.emit(protocol.Event{Event: eventApproved, Peer: key.String(), Reason: "enrollment"})
+	s.changed()
+	s.writeBootstrap(w)
+}
+
+// writeBootstrap tells the client how to reach the server over the overlay
+func (s *overlayServer) writeBootstrap(w http.ResponseWriter) {
+	port, err := s.wgState.ListenPort()
+	if err != nil {
+		enrollLog.WithError(err).Error("Could not get wireguard port")
+		http.Error(w, "Could not get wireguard port", http.StatusInternalServerError)
+		return
+	}
+	bootstrap := protocol.Bootstrap{
+		PublicKey:  s.wgState.PublicKey(),
+		Port:       port,
+		Network:    s.wgState.OverlayNetwork,
+		SaltDigest: s.wgState.SaltDigest(),
+	}
+	if err := gob.NewEncoder(w).Encode(bootstrap); err != nil {
+		enrollLog.WithError(err).Error("Could not write response")
+	}
+}
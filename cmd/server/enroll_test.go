@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/jimzhong/wireguard-overlay/internal/enroll"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// TestEnrollKnownKey checks that a key the server allows gets no bootstrap
+// without the token it enrolled with
+func TestEnrollKnownKey(t *testing.T) {
+	dir := t.TempDir()
+	records, err := store.Open(filepath.Join(dir, "peers.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := enroll.Load(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &overlayServer{store: records, configured: &allowlist{}, tokens: tokens}
+	client, _ := testKeys(t)
+	key := client.PublicKey()
+	if _, err := records.Update(key, func(r *store.Record) {
+		r.Approved = true
+		r.Token = enroll.Hash("enrolled with")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := testKeys(t)
+	if _, err := records.Update(revoked.PublicKey(), func(r *store.Record) {
+		r.Revoked = true
+		r.Token = enroll.Hash("enrolled with")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		key   wgtypes.Key
+		token string
+	}{
+		{"no token", key, ""},
+		{"other token", key, "guessed"},
+		{"revoked", revoked.PublicKey(), "enrolled with"},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		if err := gob.NewEncoder(&body).Encode(protocol.Enrollment{PublicKey: tt.key, Token: tt.token}); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.handleEnroll(w, httptest.NewRequest(http.MethodPost, protocol.EnrollPath, &body))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/pkg/errors"
+)
+
+var eventLog = logging.For("events")
+
+// Peer lifecycle events
+const (
+	eventRegistered       = "registered"
+	eventDeregistered     = "deregistered"
+	eventEndpointChanged  = "endpoint_changed"
+	eventEvicted          = "evicted"
+	eventApproved         = "approved"
+	eventRevoked          = "revoked"
+	eventKeyRotated       = "key_rotated"
+	eventQuotaExceeded    = "quota_exceeded"
+	eventHandshakeFailing = "handshake_failing"
+)
+
+const (
+	// Events wait for the webhook in a queue of this many
+	eventQueue          = 1024
+	eventWebhookTimeout = 5 * time.Second
+)
+
+// events appends peer lifecycle events to the audit log and posts them to the
+// webhook. The audit log is written before emit returns; webhook posts are
+// queued, and dropped if the webhook cannot keep up.
+type events struct {
+	webhook string
+	client  *http.Client
+	queue   chan []byte
+	mu      sync.Mutex
+	audit   *os.File
+}
+
+// newEvents returns nil if neither a webhook nor an audit log is configured
+func newEvents(webhook, auditLog string) (*events, error) {
+	if webhook == "" && auditLog == "" {
+		return nil, nil
+	}
+	e := &events{webhook: webhook}
+	if auditLog != "" {
+		if err := os.MkdirAll(filepath.Dir(auditLog), 0755); err != nil {
+			return nil, errors.Wrap(err, "Could not create audit log directory")
+		}
+		f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not open audit log")
+		}
+		e.audit = f
+	}
+	if webhook != "" {
+		e.client = &http.Client{Timeout: eventWebhookTimeout}
+		e.queue = make(chan []byte, eventQueue)
+		go e.post()
+	}
+	return e, nil
+}
+
+// emit records the event as of now
+func (e *events) emit(event protocol.Event) {
+	if e == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	log := eventLog.WithField("peer", event.Peer)
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Could not encode event")
+		return
+	}
+	if e.audit != nil {
+		e.mu.Lock()
+		_, err := e.audit.Write(append(data, '\n'))
+		if err == nil {
+			err = e.audit.Sync()
+		}
+		e.mu.Unlock()
+		if err != nil {
+			log.WithError(err).Errorf("Could not write %s event to audit log", event.Event)
+		}
+	}
+	if e.queue != nil {
+		select {
+		case e.queue <- data:
+		default:
+			log.Warnf("Dropped %s event, the webhook is not keeping up", event.Event)
+		}
+	}
+}
+
+func (e *events) post() {
+	for data := range e.queue {
+		res, err := e.client.Post(e.webhook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			eventLog.WithError(err).Error("Could not post event")
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			eventLog.Errorf("Event webhook responded %s", res.Status)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/jimzhong/wireguard-overlay/internal/groups"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// homes returns the home hub of every peer. Hubs that deregistered or went
+// offline are not picked, so that their clients move to another one.
+func (s *overlayServer) homes(all []wg.Peer) map[wgtypes.Key]wgtypes.Key {
+	configured := make(map[wgtypes.Key]bool, len(all))
+	for _, p := range all {
+		configured[p.PublicKey] = true
+	}
+	up := func(k wgtypes.Key) bool {
+		return configured[k] && !s.reg.hasDeparted(k) && (s.liveness == nil || !s.liveness.isOffline(k))
+	}
+	homes := make(map[wgtypes.Key]wgtypes.Key, len(all))
+	for _, p := range all {
+		var nearest wgtypes.Key
+		if reg, ok := s.reg.get(p.PublicKey); ok {
+			nearest = reg.NearestHub
+		}
+		if home, ok := s.hubs.Home(p.PublicKey, p.Metadata[groups.RegionLabel], nearest, up); ok {
+			homes[p.PublicKey] = home
+		}
+	}
+	return homes
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// listenAll listens on each of the comma separated host:port addresses. The
+// host may also name a network interface, standing for all of its addresses.
+// Unless wildcard is set, addresses must be explicit, so that a listener is
+// never exposed on every interface by accident.
+func listenAll(spec string, wildcard bool) ([]net.Listener, error) {
+	var addrs []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid listen address %q", entry)
+		}
+		if iface, err := net.InterfaceByName(host); err == nil {
+			ifaceAddrs, err := iface.Addrs()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Could not get addresses of %s", host)
+			}
+			for _, a := range ifaceAddrs {
+				ipnet, ok := a.(*net.IPNet)
+				if !ok {
+					continue
+				}
+				h := ipnet.IP.String()
+				if ipnet.IP.IsLinkLocalUnicast() {
+					h += "%" + host
+				}
+				addrs = append(addrs, net.JoinHostPort(h, port))
+			}
+			if len(ifaceAddrs) == 0 {
+				return nil, errors.Errorf("Interface %s has no addresses", host)
+			}
+			continue
+		}
+		if ip := net.ParseIP(host); !wildcard && (host == "" || (ip != nil && ip.IsUnspecified())) {
+			return nil, errors.Errorf("Listen address %q must name an address or interface", entry)
+		}
+		addrs = append(addrs, entry)
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "Could not listen on %s", addr)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenNamed uses the sockets passed under name by socket activation, and
+// listens on spec otherwise
+func listenNamed(activated map[string][]net.Listener, name, spec string, wildcard bool) ([]net.Listener, error) {
+	if listeners := activated[name]; len(listeners) > 0 {
+		return listeners, nil
+	}
+	return listenAll(spec, wildcard)
+}
+
+// serveAll serves the listeners until the server is closed
+func serveAll(server transport.Server, listeners []net.Listener, what string) {
+	for _, l := range listeners {
+		logrus.Infof("Serving %s on %s", what, l.Addr())
+		go func(l net.Listener) {
+			if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.WithError(err).Fatalf("Could not serve %s", what)
+			}
+		}(l)
+	}
+}
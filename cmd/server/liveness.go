@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const livenessCheckInterval = 10 * time.Second
+
+// liveness marks peers offline that did not register within the TTL, so that
+// they are no longer distributed and clients stop trying dead endpoints.
+// Peers count as seen when the server started, giving them one TTL to come
+// back after a server restart. Static peers never register and are left out.
+type liveness struct {
+	ttl     time.Duration
+	started time.Time
+	mu      sync.Mutex
+	offline map[wgtypes.Key]bool
+}
+
+func newLiveness(ttl time.Duration, now time.Time) *liveness {
+	return &liveness{ttl: ttl, started: now, offline: make(map[wgtypes.Key]bool)}
+}
+
+// update marks the peers that registered last before the TTL offline, and
+// returns those that went offline and whether any peer went offline or came
+// back
+func (l *liveness) update(keys []wgtypes.Key, reg *registry, now time.Time) ([]wgtypes.Key, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed := false
+	var evicted []wgtypes.Key
+	offline := make(map[wgtypes.Key]bool)
+	for _, k := range keys {
+		seen, ok := reg.lastSeen(k)
+		if !ok || seen.Before(l.started) {
+			seen = l.started
+		}
+		if now.Sub(seen) <= l.ttl {
+			continue
+		}
+		offline[k] = true
+		if !l.offline[k] {
+			syncLog.WithField("peer", k.String()).Infof("Peer went offline, no registration for %s", now.Sub(seen).Round(time.Second))
+			evicted = append(evicted, k)
+			changed = true
+		}
+	}
+	for k := range l.offline {
+		if !offline[k] {
+			changed = true
+		}
+	}
+	l.offline = offline
+	return evicted, changed
+}
+
+// online marks a peer that registered online again and reports whether it
+// was offline
+func (l *liveness) online(key wgtypes.Key) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.offline[key] {
+		return false
+	}
+	delete(l.offline, key)
+	syncLog.WithField("peer", key.String()).Info("Peer is back online")
+	return true
+}
+
+func (l *liveness) isOffline(key wgtypes.Key) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.offline[key]
+}
+
+func (s *overlayServer) runLiveness() {
+	ticker := time.NewTicker(livenessCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		peers, err := s.wgState.GetPeers()
+		if err != nil {
+			syncLog.WithError(err).Warn("Could not get peers")
+			continue
+		}
+		keys := make([]wgtypes.Key, 0, len(peers))
+		for _, p := range peers {
+			if r, _ := s.store.Get(p.PublicKey); !r.Static {
+				keys = append(keys, p.PublicKey)
+			}
+		}
+		evicted, changed := s.liveness.update(keys, s.reg, time.Now())
+		for _, k := range evicted {
+			s.events.emit(protocol.Event{Event: eventEvicted, Peer: k.String(), Reason: "offline"})
+		}
+		if changed {
+			s.changed()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/jimzhong/wireguard-overlay/internal/wgquick"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// mobileKeepalive keeps the NAT mapping of a phone open, as the apps suggest
+const mobileKeepalive = 25 * time.Second
+
+// mobileRequest is the body of the control request provisioning a mobile peer
+type mobileRequest struct {
+	Endpoint string   `json:"endpoint"`
+	Hostname string   `json:"hostname,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// mobilePeer is a provisioned mobile peer. Its wg-quick config holds the
+// private key, which the server does not keep.
+type mobilePeer struct {
+	PublicKey string `json:"public_key"`
+	Config    string `json:"config"`
+}
+
+// mobileHandler provisions static peers on the control socket. Their apps
+// only configure the server, so it has to relay their traffic.
+func (s *overlayServer) mobileHandler(relay bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !relay {
+			http.Error(w, "Mobile peers require relay, since they reach the other peers through the server", http.StatusBadRequest)
+			return
+		}
+		var req mobileRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize)).Decode(&req); err != nil {
+			http.Error(w, "Could not decode request", http.StatusBadRequest)
+			return
+		}
+		peer, err := s.provisionMobile(req)
+		if err != nil {
+			adminLog.WithError(err).Error("Could not provision mobile peer")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, peer)
+	})
+}
+
+// provisionMobile generates a key for a new static peer, approves it and
+// returns the wg-quick config with which the app joins through the server
+func (s *overlayServer) provisionMobile(req mobileRequest) (mobilePeer, error) {
+	if req.Endpoint == "" {
+		return mobilePeer{}, errors.New("No endpoint given; set mobile-endpoint")
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", req.Endpoint)
+	if err != nil {
+		return mobilePeer{}, errors.Wrap(err, "Could not resolve endpoint")
+	}
+	private, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return mobilePeer{}, errors.Wrap(err, "Could not generate key")
+	}
+	key := private.PublicKey()
+	if _, err := s.store.Update(key, func(r *store.Record) {
+		r.Approved = true
+		r.Static = true
+		r.Hostname = req.Hostname
+		r.Groups = req.Groups
+	}); err != nil {
+		return mobilePeer{}, err
+	}
+	s.events.emit(protocol.Event{Event: eventApproved, Peer: key.String(), Reason: "mobile"})
+	peer, err := s.peerConfig(key)
+	if err != nil {
+		return mobilePeer{}, err
+	}
+	if err := s.wgState.AddPeers([]wg.Peer{peer}); err != nil {
+		return mobilePeer{}, err
+	}
+	s.changed()
+	adminLog.WithField("peer", key.String()).Infof("Provisioned mobile peer %s", req.Hostname)
+
+	addr, ok := s.address(key)
+	if !ok {
+		addr = s.wgState.GetOverlayAddress(key).IP
+	}
+	bits := 8 * net.IPv6len
+	if addr.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	config := &wgquick.Config{
+		PrivateKey: private,
+		Addresses:  []net.IPNet{{IP: addr, Mask: net.CIDRMask(bits, bits)}},
+		Peers: []wgquick.Peer{{
+			PublicKey:           s.wgState.PublicKey(),
+			Endpoint:            endpoint,
+			AllowedIPs:          s.wgState.Networks(),
+			PersistentKeepalive: mobileKeepalive,
+		}},
+	}
+	b := &strings.Builder{}
+	if err := wgquick.Write(b, config); err != nil {
+		return mobilePeer{}, err
+	}
+	return mobilePeer{PublicKey: key.String(), Config: b.String()}, nil
+}
+
+// runMobileCommand provisions a mobile peer on the running server, writes its
+// config to path, or stdout if empty, and prints it as a QR code for the apps
+func runMobileCommand(socket, endpoint, hostname string, groups []string, path string) error {
+	var peer mobilePeer
+	req := mobileRequest{Endpoint: endpoint, Hostname: hostname, Groups: groups}
+	if err := control.Call(socket, http.MethodPost, control.MobilePath, req, &peer); err != nil {
+		return err
+	}
+	if path == "" {
+		fmt.Print(peer.Config)
+	} else if err := os.WriteFile(path, []byte(peer.Config), 0600); err != nil {
+		return errors.Wrap(err, "Could not write config")
+	}
+	code, err := qrcode.New(peer.Config, qrcode.Low)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode QR code")
+	}
+	fmt.Println()
+	fmt.Print(code.ToSmallString(false))
+	fmt.Println("Public key:", peer.PublicKey)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// notifier lets clients wait for changes of the distributed peers
+type notifier struct {
+	mu         sync.Mutex
+	generation uint64
+	changed    chan struct{}
+}
+
+func newNotifier() *notifier {
+	// Start from the clock so that clients notice a restarted server
+	return &notifier{
+		generation: uint64(time.Now().UnixNano()),
+		changed:    make(chan struct{}),
+	}
+}
+
+// bump advances the generation and wakes up all waiters
+func (n *notifier) bump() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.generation++
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *notifier) current() (uint64, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.generation, n.changed
+}
+
+// wait blocks until the generation differs from since, the timeout expires or
+// ctx is done, and returns the current generation
+func (n *notifier) wait(ctx context.Context, since uint64, timeout time.Duration) uint64 {
+	gen, changed := n.current()
+	if gen != since {
+		return gen
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	gen, _ = n.current()
+	return gen
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var partitionLog = logging.For("partition")
+
+const (
+	partitionCheckInterval = 30 * time.Second
+	// Peers that did not register for this long are considered offline
+	heartbeatTimeout = 2 * time.Minute
+	webhookTimeout   = 5 * time.Second
+)
+
+// partition tracks whether the online peers have split into islands that
+// cannot reach each other
+type partition struct {
+	mu      sync.Mutex
+	islands [][]wgtypes.Key
+	since   time.Time
+	// island maps the peers outside of the largest island to their island
+	island map[wgtypes.Key]int
+}
+
+func (p *partition) status() protocol.AdminPartition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := protocol.AdminPartition{Partitioned: len(p.island) != 0, Since: p.since}
+	for _, island := range p.islands {
+		keys := make([]string, 0, len(island))
+		for _, k := range island {
+			keys = append(keys, k.String())
+		}
+		status.Islands = append(status.Islands, keys)
+	}
+	return status
+}
+
+// islandOf returns the island of an affected peer, or 0
+func (p *partition) islandOf(key wgtypes.Key) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.island[key]
+}
+
+// components groups the keys into connected components of the graph given by
+// linked, largest first
+func components(keys []wgtypes.Key, linked func(a, b wgtypes.Key) bool) [][]wgtypes.Key {
+	parent := make([]int, len(keys))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			if linked(keys[i], keys[j]) {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+	byRoot := make(map[int][]wgtypes.Key)
+	for i, k := range keys {
+		byRoot[find(i)] = append(byRoot[find(i)], k)
+	}
+	comps := make([][]wgtypes.Key, 0, len(byRoot))
+	for _, c := range byRoot {
+		comps = append(comps, c)
+	}
+	sort.Slice(comps, func(i, j int) bool {
+		if len(comps[i]) != len(comps[j]) {
+			return len(comps[i]) > len(comps[j])
+		}
+		return comps[i][0].String() < comps[j][0].String()
+	})
+	return comps
+}
+
+func (s *overlayServer) runPartitionDetection(webhook string) {
+	ticker := time.NewTicker(partitionCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkPartition(time.Now(), webhook)
+	}
+}
+
+func (s *overlayServer) checkPartition(now time.Time, webhook string) {
+	online := s.reg.heartbeats(now.Add(-heartbeatTimeout))
+	keys := make([]wgtypes.Key, 0, len(online))
+	type link struct{ a, b wgtypes.Key }
+	broken := make(map[link]bool)
+	for k, unreachable := range online {
+		keys = append(keys, k)
+		for _, u := range unreachable {
+			broken[link{k, u}] = true
+			broken[link{u, k}] = true
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	peerGroups := s.peerGroups()
+	// Peers that are not supposed to see each other are not expected to connect
+	visible := func(a, b wgtypes.Key) bool {
+		return s.policy == nil || s.policy.Visible(peerGroups, a, b) || s.policy.Visible(peerGroups, b, a)
+	}
+	expected := components(keys, visible)
+	actual := components(keys, func(a, b wgtypes.Key) bool {
+		return visible(a, b) && !broken[link{a, b}]
+	})
+
+	s.partition.mu.Lock()
+	defer s.partition.mu.Unlock()
+	was := len(s.partition.island) != 0
+	partitioned := len(actual) > len(expected)
+	s.partition.island = make(map[wgtypes.Key]int)
+	if !partitioned {
+		s.partition.islands = nil
+		if was {
+			partitionLog.Info("Mesh partition resolved")
+			s.partition.since = time.Time{}
+			go sendAlert(webhook, "partition_resolved", nil)
+		}
+		return
+	}
+	s.partition.islands = actual
+	for i, island := range actual[1:] {
+		for _, k := range island {
+			s.partition.island[k] = i + 2
+		}
+	}
+	if !was {
+		s.partition.since = now.UTC()
+		partitionLog.Errorf("Mesh partitioned into %d islands (%d expected)", len(actual), len(expected))
+		go sendAlert(webhook, "partition", actual)
+	}
+}
+
+// sendAlert posts the event to the webhook, if one is configured
+func sendAlert(webhook string, event string, islands [][]wgtypes.Key) {
+	if webhook == "" {
+		return
+	}
+	alert := protocol.Alert{Event: event, Time: time.Now().UTC()}
+	for _, island := range islands {
+		keys := make([]string, 0, len(island))
+		for _, k := range island {
+			keys = append(keys, k.String())
+		}
+		alert.Islands = append(alert.Islands, keys)
+	}
+	data, err := json.Marshal(alert)
+	if err != nil {
+		partitionLog.WithError(err).Error("Could not encode alert")
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	res, err := client.Post(webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		partitionLog.WithError(err).Error("Could not send alert")
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		partitionLog.Errorf("Alert webhook responded %s", res.Status)
+	}
+}
+
+func (s *overlayServer) handleAdminPartition(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.partition.status())
+}
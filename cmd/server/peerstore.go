@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// openPeerStore opens the peer records in the file or in the etcd or Consul
+// cluster, verifying its servers with the certificates in ca if given
+func openPeerStore(kind, path string, options store.Options, ca string) (*store.Store, error) {
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read peer store CA")
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("No certificates in %s", ca)
+		}
+		options.TLS = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: roots}
+	}
+	var backend store.Backend
+	var err error
+	switch kind {
+	case "file":
+		return store.Open(path)
+	case "etcd":
+		backend, err = store.NewEtcd(options)
+	case "consul":
+		backend, err = store.NewConsul(options)
+	default:
+		return nil, errors.Errorf("Unknown peer store %s", kind)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not set up %s peer store", kind)
+	}
+	return store.OpenBackend(backend)
+}
+
+// recordChanged applies the change another server made to the record of a
+// peer, as the admin actions do on the server that made it
+func (s *overlayServer) recordChanged(old, r store.Record) {
+	key := r.PublicKey
+	log := adminLog.WithField("peer", key.String())
+	wasAllowed := !old.Revoked && (old.Approved || s.configured.has(key))
+	switch {
+	case !s.allowed(key):
+		if !wasAllowed {
+			break
+		}
+		log.Info("Peer revoked by another server")
+		s.events.emit(protocol.Event{Event: eventRevoked, Peer: key.String(), Reason: "another server"})
+		s.reg.delete(key)
+		if s.alloc != nil {
+			if err := s.alloc.Release(key); err != nil {
+				log.WithError(err).Warn("Could not release address")
+			}
+		}
+		if err := s.wgState.RemovePeers([]wgtypes.Key{key}); err != nil {
+			log.WithError(err).Error("Could not remove peer")
+		}
+	case !wasAllowed || !reflect.DeepEqual(old.Routes, r.Routes) || !reflect.DeepEqual(old.Groups, r.Groups):
+		if !wasAllowed {
+			log.Info("Peer approved by another server")
+			s.events.emit(protocol.Event{Event: eventApproved, Peer: key.String(), Reason: "another server"})
+		}
+		peer, err := s.peerConfig(key)
+		if err == nil {
+			err = s.wgState.AddPeers([]wg.Peer{peer})
+		}
+		if err != nil {
+			log.WithError(err).Error("Could not configure peer")
+		}
+	}
+	s.changed()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var punchLog = logging.For("punch")
+
+const (
+	// Lead time for both clients to fetch the punch
+	punchDelay = 5 * time.Second
+	// Punches are dropped this long after they started
+	punchExpiry = 30 * time.Second
+	// Minimum time between punches of the same pair
+	punchBackoff = 2 * time.Minute
+)
+
+// traversal coordinates hole punching between peers that cannot reach each
+// other
+type traversal struct {
+	mu      sync.Mutex
+	punches map[wgtypes.Key][]protocol.Punch
+	last    map[pair]time.Time
+}
+
+func newTraversal() *traversal {
+	return &traversal{
+		punches: make(map[wgtypes.Key][]protocol.Punch),
+		last:    make(map[pair]time.Time),
+	}
+}
+
+// candidates returns the endpoints under which the peer may be reachable: the
+// one the server observes, followed by the registered, reflexive and local ones
+func candidates(p wg.Peer, reg protocol.Registration) []*net.UDPAddr {
+	var c []*net.UDPAddr
+	if p.IP != "" && p.Port != 0 && !tunnelled(p) {
+		c = append(c, &net.UDPAddr{IP: net.ParseIP(p.IP), Port: p.Port})
+	}
+	advertised := []*net.UDPAddr{reg.Endpoint, reg.Reflexive}
+	if len(c) != 0 && reg.ListenPort != 0 {
+		// The NAT may have kept the port or forward it
+		advertised = append(advertised, &net.UDPAddr{IP: c[0].IP, Port: reg.ListenPort})
+	}
+	for _, e := range append(advertised, reg.LocalEndpoints...) {
+		if e == nil {
+			continue
+		}
+		known := false
+		for _, k := range c {
+			known = known || sameEndpoint(k, e)
+		}
+		if !known {
+			c = append(c, e)
+		}
+	}
+	return c
+}
+
+// schedule arranges a punch between the peers unless one happened lately. It
+// reports whether a punch was scheduled.
+func (t *traversal) schedule(a, b wgtypes.Key, candidatesA, candidatesB []*net.UDPAddr, now time.Time) bool {
+	if len(candidatesA) == 0 || len(candidatesB) == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := pair{reporter: a, peer: b}
+	if b.String() < a.String() {
+		key = pair{reporter: b, peer: a}
+	}
+	if now.Sub(t.last[key]) < punchBackoff {
+		return false
+	}
+	t.last[key] = now
+	at := now.Add(punchDelay)
+	t.punches[a] = append(t.punches[a], protocol.Punch{Peer: b, Candidates: candidatesB, At: at})
+	t.punches[b] = append(t.punches[b], protocol.Punch{Peer: a, Candidates: candidatesA, At: at})
+	return true
+}
+
+// pending returns the punches of the client that did not expire
+func (t *traversal) pending(key wgtypes.Key, now time.Time) []protocol.Punch {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pending []protocol.Punch
+	for _, p := range t.punches[key] {
+		if now.Sub(p.At) < punchExpiry {
+			pending = append(pending, p)
+		}
+	}
+	if len(pending) == 0 {
+		delete(t.punches, key)
+	} else {
+		t.punches[key] = pending
+	}
+	for k, last := range t.last {
+		if now.Sub(last) > punchBackoff {
+			delete(t.last, k)
+		}
+	}
+	return pending
+}
+
+// coordinatePunches schedules punches for the peers the client reported as
+// unreachable
+func (s *overlayServer) coordinatePunches(key wgtypes.Key, unreachable []wgtypes.Key) {
+	if len(unreachable) == 0 {
+		return
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		punchLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	byKey := make(map[wgtypes.Key]wg.Peer, len(peers))
+	for _, p := range peers {
+		byKey[p.PublicKey] = p
+	}
+	now := time.Now()
+	scheduled := false
+	for _, u := range unreachable {
+		peer, ok := byKey[u]
+		if !ok {
+			continue
+		}
+		own, _ := s.reg.get(key)
+		other, _ := s.reg.get(u)
+		if s.traversal.schedule(key, u, candidates(byKey[key], own), candidates(peer, other), now) {
+			punchLog.WithField("peer", key.String()).Debugf("Scheduled hole punching with %s", u)
+			scheduled = true
+		}
+	}
+	if scheduled {
+		// Wake up both sides so that they fetch the punch in time
+		s.notifier.bump()
+	}
+}
+
+func (s *overlayServer) handlePunch(w http.ResponseWriter, request *http.Request) {
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.traversal.pending(key, time.Now())); err != nil {
+		http.Error(w, "Could not serialize punches", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		punchLog.WithError(err).Error("Could not write response")
+	}
+}
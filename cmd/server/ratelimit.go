@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"golang.org/x/time/rate"
+)
+
+var limitLog = logging.For("limit")
+
+const (
+	// maxAPIRequestSize caps the body of any peer API request; handlers may
+	// impose tighter limits
+	maxAPIRequestSize = 1 << 20
+	maxAPIHeaderSize  = 16 << 10
+	// Limiters unused for this long are dropped
+	limiterIdle = 10 * time.Minute
+)
+
+// limiters keep a token bucket per IP address or public key
+type limiters struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// newLimiters returns nil, which allows everything, if perSecond is 0
+func newLimiters(perSecond float64, burst int) *limiters {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &limiters{limit: rate.Limit(perSecond), burst: burst, buckets: make(map[string]*bucket)}
+}
+
+func (l *limiters) allow(id string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) > limiterIdle {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > limiterIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[id] = b
+	}
+	b.seen = now
+	return b.limiter.AllowN(now, 1)
+}
+
+// apiLimits protect the peer API from clients that flood it, so that peer
+// distribution keeps working for everyone else
+type apiLimits struct {
+	byIP  *limiters
+	byKey *limiters
+	// Requests and connections turned away
+	rejectedIP, rejectedKey, rejectedConns int64
+}
+
+type requesterKey struct{}
+
+// limit rejects requests beyond the rate of their address and then of their
+// public key, caps the request body and passes the identified key on to the
+// handlers through the context
+func (s *overlayServer) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		now := time.Now()
+		host, _, _ := net.SplitHostPort(request.RemoteAddr)
+		if !s.limits.byIP.allow(host, now) {
+			atomic.AddInt64(&s.limits.rejectedIP, 1)
+			limitLog.WithField("addr", host).Debug("Request over the rate limit of the address")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		key, code := s.identify(request)
+		if code != http.StatusOK {
+			http.Error(w, "Could not identify peer", code)
+			return
+		}
+		if !s.limits.byKey.allow(key.String(), now) {
+			atomic.AddInt64(&s.limits.rejectedKey, 1)
+			limitLog.WithField("peer", key.String()).Debug("Request over the rate limit of the peer")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		request.Body = http.MaxBytesReader(w, request.Body, maxAPIRequestSize)
+		next.ServeHTTP(w, request.WithContext(context.WithValue(request.Context(), requesterKey{}, key)))
+	})
+}
+
+func (l *apiLimits) collect(m *status.Metrics) {
+	m.Write("wireguard_overlay_api_rejected_total", "counter", "Peer API requests and connections turned away by the limits.",
+		status.Sample{Labels: status.Label("reason", "address-rate"), Value: float64(atomic.LoadInt64(&l.rejectedIP))},
+		status.Sample{Labels: status.Label("reason", "peer-rate"), Value: float64(atomic.LoadInt64(&l.rejectedKey))},
+		status.Sample{Labels: status.Label("reason", "connections"), Value: float64(atomic.LoadInt64(&l.rejectedConns))},
+	)
+}
+
+// capListener closes connections beyond the total cap or the cap per address
+// right after accepting them
+type capListener struct {
+	net.Listener
+	limits       *apiLimits
+	total, perIP int
+	mu           sync.Mutex
+	open         int
+	byIP         map[string]int
+}
+
+func newCapListener(l net.Listener, limits *apiLimits, total, perIP int) net.Listener {
+	if total <= 0 && perIP <= 0 {
+		return l
+	}
+	return &capListener{Listener: l, limits: limits, total: total, perIP: perIP, byIP: make(map[string]int)}
+}
+
+func (l *capListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		l.mu.Lock()
+		if l.total > 0 && l.open >= l.total || l.perIP > 0 && l.byIP[host] >= l.perIP {
+			l.mu.Unlock()
+			atomic.AddInt64(&l.limits.rejectedConns, 1)
+			limitLog.WithField("addr", host).Debug("Connection over the cap")
+			conn.Close()
+			continue
+		}
+		l.open++
+		l.byIP[host]++
+		l.mu.Unlock()
+		return &cappedConn{Conn: conn, release: func() { l.release(host) }}, nil
+	}
+}
+
+func (l *capListener) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+	if l.byIP[host]--; l.byIP[host] <= 0 {
+		delete(l.byIP, host)
+	}
+}
+
+type cappedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *cappedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// registry holds what clients have registered about themselves
+type registry struct {
+	mu            sync.Mutex
+	registrations map[wgtypes.Key]protocol.Registration
+	// seen is when each peer registered last
+	seen map[wgtypes.Key]time.Time
+	// departed peers deregistered when shutting down and have not
+	// registered since
+	departed map[wgtypes.Key]bool
+	// origin is the replica a registration was learned from, if not this one
+	origin map[wgtypes.Key]string
+	// trusted, if set, reports whether a client may be handed out at an
+	// address it claimed
+	trusted func(wgtypes.Key, net.IP) bool
+}
+
+func newRegistry() *registry {
+	return &registry{
+		registrations: make(map[wgtypes.Key]protocol.Registration),
+		seen:          make(map[wgtypes.Key]time.Time),
+		departed:      make(map[wgtypes.Key]bool),
+		origin:        make(map[wgtypes.Key]string),
+	}
+}
+
+// set stores the registration and reports whether it differs from the
+// previous one
+func (r *registry) set(key wgtypes.Key, reg protocol.Registration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.store(key, reg, time.Now(), "")
+}
+
+// merge stores a registration another replica received at seen, unless the
+// peer registered here since, and reports whether it differs from the
+// previous one
+func (r *registry) merge(key wgtypes.Key, reg protocol.Registration, seen time.Time, replica string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !seen.After(r.seen[key]) {
+		return false
+	}
+	return r.store(key, reg, seen, replica)
+}
+
+func (r *registry) store(key wgtypes.Key, reg protocol.Registration, seen time.Time, replica string) bool {
+	old, ok := r.registrations[key]
+	r.registrations[key] = reg
+	r.seen[key] = seen
+	delete(r.departed, key)
+	if replica == "" {
+		delete(r.origin, key)
+	} else {
+		r.origin[key] = replica
+	}
+	return !ok || !sameEndpoint(old.Endpoint, reg.Endpoint) || !old.RequestedAddr.Equal(reg.RequestedAddr) ||
+		!sameMetadata(old.Metadata, reg.Metadata) || old.NearestHub != reg.NearestHub
+}
+
+// local returns the registrations received by this replica
+func (r *registry) local() []protocol.ReplicaRegistration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var local []protocol.ReplicaRegistration
+	for k, reg := range r.registrations {
+		if _, ok := r.origin[k]; !ok {
+			local = append(local, protocol.ReplicaRegistration{PublicKey: k, Registration: reg, Seen: r.seen[k]})
+		}
+	}
+	return local
+}
+
+func (r *registry) delete(key wgtypes.Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.registrations, key)
+	delete(r.seen, key)
+	delete(r.origin, key)
+}
+
+// depart forgets the registration of a peer that shut down and reports
+// whether it was not departed yet
+func (r *registry) depart(key wgtypes.Key) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.registrations, key)
+	delete(r.seen, key)
+	delete(r.origin, key)
+	if r.departed[key] {
+		return false
+	}
+	r.departed[key] = true
+	return true
+}
+
+// hasDeparted reports whether the peer shut down and did not come back yet
+func (r *registry) hasDeparted(key wgtypes.Key) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.departed[key]
+}
+
+// lastSeen returns when the peer registered last
+func (r *registry) lastSeen(key wgtypes.Key) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.seen[key]
+	return t, ok
+}
+
+// heartbeats returns the peers that registered after since, along with the
+// peers they reported as unreachable
+func (r *registry) heartbeats(since time.Time) map[wgtypes.Key][]wgtypes.Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	online := make(map[wgtypes.Key][]wgtypes.Key)
+	for k, t := range r.seen {
+		if t.After(since) {
+			online[k] = r.registrations[k].Unreachable
+		}
+	}
+	return online
+}
+
+// get returns the last registration of the peer
+func (r *registry) get(key wgtypes.Key) (protocol.Registration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.registrations[key]
+	return r.claimed(key, reg), ok
+}
+
+// claimed leaves out the endpoints the client claimed at untrusted addresses
+func (r *registry) claimed(key wgtypes.Key, reg protocol.Registration) protocol.Registration {
+	if r.trusted == nil {
+		return reg
+	}
+	if reg.Endpoint != nil && !r.trusted(key, reg.Endpoint.IP) {
+		reg.Endpoint = nil
+	}
+	if reg.Reflexive != nil && !r.trusted(key, reg.Reflexive.IP) {
+		reg.Reflexive = nil
+	}
+	var local []*net.UDPAddr
+	for _, e := range reg.LocalEndpoints {
+		if r.trusted(key, e.IP) {
+			local = append(local, e)
+		}
+	}
+	reg.LocalEndpoints = local
+	return reg
+}
+
+// addressVersions returns the derivation versions each peer supports
+func (r *registry) addressVersions() map[wgtypes.Key][]derive.Version {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := make(map[wgtypes.Key][]derive.Version, len(r.registrations))
+	for k, reg := range r.registrations {
+		versions[k] = reg.AddressVersions
+	}
+	return versions
+}
+
+// hasStandby reports whether the peer registered that it configured the key
+func (r *registry) hasStandby(peer, key wgtypes.Key) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.registrations[peer].Standby {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func sameMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if v, ok := b[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// metadata returns the metadata of the registered peers by key
+func (r *registry) metadata() map[string]map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	metadata := make(map[string]map[string]string)
+	for k, reg := range r.registrations {
+		if len(reg.Metadata) != 0 {
+			metadata[k.String()] = reg.Metadata
+		}
+	}
+	return metadata
+}
+
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// apply overrides what wireguard observed with what the peers registered
+func (r *registry) apply(peers []wg.Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range peers {
+		reg, ok := r.registrations[peers[i].PublicKey]
+		if !ok {
+			continue
+		}
+		reg = r.claimed(peers[i].PublicKey, reg)
+		if reg.Endpoint != nil {
+			peers[i].IP = reg.Endpoint.IP.String()
+			peers[i].Port = reg.Endpoint.Port
+		}
+		peers[i].Metadata = reg.Metadata
+	}
+}
+
+// peerByAddr finds the peer that owns the overlay address. Requests arriving
+// through the overlay are authenticated by wireguard, so the source address
+// identifies the client.
+func peerByAddr(peers []wg.Peer, ip net.IP) (wgtypes.Key, bool) {
+	for _, p := range peers {
+		for _, a := range p.Addresses {
+			if a.Equal(ip) {
+				return p.PublicKey, true
+			}
+		}
+	}
+	return wgtypes.Key{}, false
+}
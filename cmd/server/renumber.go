@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var renumberLog = logging.For("renumber")
+
+// How long the previous address stays valid unless the request says otherwise
+const defaultRenumberWindow = 10 * time.Minute
+
+// renumber moves the peer to the requested address. Both addresses are routed
+// to the peer until the window ends.
+func (s *overlayServer) renumber(key wgtypes.Key, req *protocol.AdminRequest) error {
+	if !s.allowed(key) {
+		return errors.New("Peer is not part of the overlay")
+	}
+	ip := net.ParseIP(req.Address)
+	if ip == nil || !s.wgState.OverlayNetwork.Contains(ip) {
+		return errors.Errorf("Invalid overlay address %q", req.Address)
+	}
+	r, _ := s.store.Get(key)
+	if r.Rotation != nil {
+		return errors.New("Peer is rotating its key")
+	}
+	if r.Renumbering != nil {
+		return errors.New("Peer is already being renumbered")
+	}
+	if prefix := s.prefixFor(key); prefix != nil && !prefix.Contains(ip) {
+		return errors.Errorf("Address is outside of the group prefix %s", prefix)
+	}
+	old, ok := s.address(key)
+	if !ok {
+		old = s.wgState.GetOverlayAddress(key).IP
+	}
+	if old.Equal(ip) {
+		return errors.New("Peer already has this address")
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		return err
+	}
+	if owner, taken := peerByAddr(peers, ip); (taken && owner != key) || ip.Equal(s.wgState.OverlayAddr.IP) {
+		return errors.Errorf("Address %s is in use", ip)
+	}
+	window := time.Duration(req.WindowSecs) * time.Second
+	if window <= 0 {
+		window = defaultRenumberWindow
+	}
+	if s.alloc != nil {
+		// Nobody else may lease the old address during the window
+		s.alloc.Reserve(old)
+		if _, err := s.alloc.Request(key, ip); err != nil {
+			s.alloc.Unreserve(old)
+			return err
+		}
+	}
+	if _, err := s.store.Update(key, func(rec *store.Record) {
+		if s.alloc == nil {
+			rec.Address = ip
+		}
+		rec.Renumbering = &store.Renumbering{From: old, Until: time.Now().Add(window).UTC()}
+	}); err != nil {
+		if s.alloc != nil {
+			s.restoreLease(key, old, ok)
+		}
+		return err
+	}
+	renumberLog.WithField("peer", key.String()).Infof("Renumbering from %s to %s", old, ip)
+	return s.wgState.AddPeers([]wg.Peer{s.devicePeer(key)})
+}
+
+// restoreLease moves the lease of a peer whose renumbering could not be
+// recorded back to its previous address, or releases it if it had none
+func (s *overlayServer) restoreLease(key wgtypes.Key, old net.IP, leased bool) {
+	s.alloc.Unreserve(old)
+	var err error
+	if leased {
+		_, err = s.alloc.Request(key, old)
+	} else {
+		err = s.alloc.Release(key)
+	}
+	if err != nil {
+		renumberLog.WithError(err).Error("Could not restore the lease of ", key)
+	}
+}
+
+// holdRenumbered reserves the previous addresses of renumbered peers after a
+// restart
+func (s *overlayServer) holdRenumbered() {
+	if s.alloc == nil {
+		return
+	}
+	for _, r := range s.store.List() {
+		if r.Renumbering != nil {
+			s.alloc.Reserve(r.Renumbering.From)
+		}
+	}
+}
+
+// runRenumberings withdraws previous addresses once their window ends
+func (s *overlayServer) runRenumberings() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkRenumberings(time.Now())
+	}
+}
+
+func (s *overlayServer) checkRenumberings(now time.Time) {
+	for _, r := range s.store.List() {
+		if r.Renumbering == nil || now.Before(r.Renumbering.Until) {
+			continue
+		}
+		from := r.Renumbering.From
+		if _, err := s.store.Update(r.PublicKey, func(rec *store.Record) {
+			rec.Renumbering = nil
+		}); err != nil {
+			renumberLog.WithError(err).Error("Could not finish renumbering of ", r.PublicKey)
+			continue
+		}
+		if s.alloc != nil {
+			s.alloc.Unreserve(from)
+		}
+		if err := s.wgState.AddPeers([]wg.Peer{s.devicePeer(r.PublicKey)}); err != nil {
+			renumberLog.WithError(err).Error("Could not withdraw address of ", r.PublicKey)
+		}
+		renumberLog.WithField("peer", r.PublicKey.String()).Infof("Withdrew address %s", from)
+		s.changed()
+	}
+}
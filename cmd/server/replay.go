@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// replayGuard rejects registrations that are not signed by the peer, that
+// are too far off the clock of the server, or that were seen before. Nonces
+// are kept until their timestamps leave the window.
+type replayGuard struct {
+	private wgtypes.Key
+	window  time.Duration
+	require bool
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	pruned  time.Time
+}
+
+func newReplayGuard(private wgtypes.Key, window time.Duration, require bool) *replayGuard {
+	return &replayGuard{private: private, window: window, require: require, seen: make(map[string]time.Time)}
+}
+
+// check verifies the registration body of the peer with the header
+func (g *replayGuard) check(key wgtypes.Key, header http.Header, body []byte, now time.Time) error {
+	if header.Get(protocol.MACHeader) == "" {
+		if g.require {
+			return errors.New("Registration is not signed")
+		}
+		return nil
+	}
+	timestamp, nonce, err := protocol.VerifyRegistration(g.private, key, header, body)
+	if err != nil {
+		return err
+	}
+	if skew := now.Sub(timestamp); skew > g.window || skew < -g.window {
+		return errors.Errorf("Registration timestamp is %s off the clock of the server", skew.Round(time.Second))
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.pruned) > g.window {
+		for id, expiry := range g.seen {
+			if now.After(expiry) {
+				delete(g.seen, id)
+			}
+		}
+		g.pruned = now
+	}
+	id := key.String() + nonce
+	if _, ok := g.seen[id]; ok {
+		return errors.New("Registration was replayed")
+	}
+	g.seen[id] = timestamp.Add(g.window)
+	return nil
+}
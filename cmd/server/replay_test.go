@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const testWindow = 2 * time.Minute
+
+func testKeys(t *testing.T) (wgtypes.Key, wgtypes.Key) {
+	t.Helper()
+	client, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// signedWithNonce signs the registration like protocol.SignRegistration, but
+// with the given nonce instead of a random one, so that a nonce can be
+// presented again with another timestamp
+func signedWithNonce(t *testing.T, client, server wgtypes.Key, body []byte, at time.Time, nonce []byte) http.Header {
+	t.Helper()
+	serverPub := server.PublicKey()
+	secret, err := curve25519.X25519(client[:], serverPub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte("wireguard-overlay registration"))
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(at.UnixNano()))
+	m.Write(ts[:])
+	m.Write(nonce)
+	m.Write(body)
+	header := make(http.Header)
+	header.Set(protocol.TimestampHeader, strconv.FormatInt(at.UnixNano(), 10))
+	header.Set(protocol.NonceHeader, base64.RawURLEncoding.EncodeToString(nonce))
+	header.Set(protocol.MACHeader, base64.RawURLEncoding.EncodeToString(m.Sum(nil)))
+	return header
+}
+
+func TestReplayGuardSkew(t *testing.T) {
+	client, server := testKeys(t)
+	body := []byte("registration")
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		skew time.Duration
+		ok   bool
+	}{
+		{"on time", 0, true},
+		{"just inside, behind", testWindow - time.Millisecond, true},
+		{"just inside, ahead", -testWindow + time.Millisecond, true},
+		{"just outside, behind", testWindow + time.Millisecond, false},
+		{"just outside, ahead", -testWindow - time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		g := newReplayGuard(server, testWindow, true)
+		header, err := protocol.SignRegistration(client, server.PublicKey(), body, now.Add(-tt.skew))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.check(client.PublicKey(), header, body, now); (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestReplayGuardSignature(t *testing.T) {
+	client, server := testKeys(t)
+	other, _ := testKeys(t)
+	body := []byte("registration")
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		signer wgtypes.Key
+		body   []byte
+		ok     bool
+	}{
+		{"valid", client, body, true},
+		{"other key", other, body, false},
+		{"modified body", client, []byte("registratioN"), false},
+	}
+	for _, tt := range tests {
+		g := newReplayGuard(server, testWindow, true)
+		header, err := protocol.SignRegistration(tt.signer, server.PublicKey(), body, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.check(client.PublicKey(), header, tt.body, now); (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestReplayGuardUnsigned(t *testing.T) {
+	client, server := testKeys(t)
+	for _, require := range []bool{false, true} {
+		g := newReplayGuard(server, testWindow, require)
+		err := g.check(client.PublicKey(), make(http.Header), []byte("registration"), time.Now())
+		if (err == nil) == require {
+			t.Errorf("require %v: error = %v", require, err)
+		}
+	}
+}
+
+func TestReplayGuardNonces(t *testing.T) {
+	client, server := testKeys(t)
+	body := []byte("registration")
+	nonce := []byte("0123456789abcdef")
+	start := time.Unix(1700000000, 0)
+	g := newReplayGuard(server, testWindow, true)
+	header := signedWithNonce(t, client, server, body, start, nonce)
+	if err := g.check(client.PublicKey(), header, body, start); err != nil {
+		t.Fatalf("First registration: %v", err)
+	}
+	if err := g.check(client.PublicKey(), header, body, start.Add(time.Second)); err == nil {
+		t.Error("Replayed registration was accepted")
+	}
+	// Within the window the nonce is remembered, even with a new timestamp
+	later := start.Add(testWindow / 2)
+	if err := g.check(client.PublicKey(), signedWithNonce(t, client, server, body, later, nonce), body, later); err == nil {
+		t.Error("Nonce was accepted again within the window")
+	}
+	// Once its expiry passed, it is pruned and may come again
+	after := start.Add(3 * testWindow)
+	if err := g.check(client.PublicKey(), signedWithNonce(t, client, server, body, after, nonce), body, after); err != nil {
+		t.Errorf("Nonce was not accepted again after it was pruned: %v", err)
+	}
+	if len(g.seen) != 1 {
+		t.Errorf("%d nonces remembered, want 1", len(g.seen))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var replicaLog = logging.For("replica")
+
+const (
+	replicaPollInterval = 5 * time.Second
+	// A replica that did not answer for this long is unhealthy
+	replicaTimeout = 3 * replicaPollInterval
+	// The registrations of a replica fit in this many bytes
+	maxReplicaState = 16 << 20
+)
+
+// replicas exchanges registrations with the other replicas of the server, so
+// that each distributes the clients registered with any of them
+type replicas struct {
+	self   protocol.Replica
+	token  string
+	client *http.Client
+	mu     sync.Mutex
+	// others are by URL of their replica API
+	others map[string]*otherReplica
+}
+
+type otherReplica struct {
+	replica  protocol.Replica
+	answered time.Time
+}
+
+func newReplicas(id, endpoint, token string, peers []string) (*replicas, error) {
+	if endpoint != "" {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, errors.Wrap(err, "Invalid replica endpoint")
+		}
+	}
+	r := &replicas{
+		self:   protocol.Replica{ID: id, Endpoint: endpoint, Healthy: true},
+		token:  token,
+		client: &http.Client{Timeout: replicaPollInterval},
+		others: make(map[string]*otherReplica),
+	}
+	for _, url := range peers {
+		r.others[strings.TrimSuffix(url, "/")] = &otherReplica{}
+	}
+	return r, nil
+}
+
+// poll fetches the state of the replica at url
+func (r *replicas) poll(url string) (protocol.ReplicaState, error) {
+	var state protocol.ReplicaState
+	req, err := http.NewRequest(http.MethodGet, url+protocol.ReplicaPath, nil)
+	if err != nil {
+		return state, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return state, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("replica responded %s", res.Status)
+	}
+	err = gob.NewDecoder(io.LimitReader(res.Body, maxReplicaState)).Decode(&state)
+	return state, err
+}
+
+// answered records the state of the replica at url as of now, and reports
+// whether the replica became healthy
+func (r *replicas) answered(url string, state protocol.ReplicaState, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o := r.others[url]
+	healthy := o.replica.Healthy
+	o.replica = protocol.Replica{ID: state.ID, Endpoint: state.Endpoint, Healthy: true}
+	o.answered = now
+	return !healthy
+}
+
+// check marks the replicas that stopped answering and reports them
+func (r *replicas) check(now time.Time) []protocol.Replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lost []protocol.Replica
+	for _, o := range r.others {
+		if o.replica.Healthy && now.Sub(o.answered) > replicaTimeout {
+			o.replica.Healthy = false
+			lost = append(lost, o.replica)
+		}
+	}
+	return lost
+}
+
+// list returns this replica and the others that answered once
+func (r *replicas) list() []protocol.Replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []protocol.Replica{r.self}
+	for _, o := range r.others {
+		if o.replica.ID != "" {
+			list = append(list, o.replica)
+		}
+	}
+	return list
+}
+
+func (r *replicas) collect(m *status.Metrics) {
+	var samples []status.Sample
+	for _, replica := range r.list() {
+		up := 0.0
+		if replica.Healthy {
+			up = 1
+		}
+		samples = append(samples, status.Sample{Labels: status.Label("replica", replica.ID), Value: up})
+	}
+	m.Write("wireguard_overlay_replica_up", "gauge", "Whether the replica answers the others.", samples...)
+}
+
+// runReplicas merges the registrations of the other replicas every poll
+// interval
+func (s *overlayServer) runReplicas() {
+	ticker := time.NewTicker(replicaPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed := false
+		for url := range s.replicas.others {
+			state, err := s.replicas.poll(url)
+			if err != nil {
+				replicaLog.WithError(err).Debug("Could not poll replica ", url)
+				continue
+			}
+			for _, r := range state.Registrations {
+				if s.allowed(r.PublicKey) && s.reg.merge(r.PublicKey, r.Registration, r.Seen, state.ID) {
+					changed = true
+				}
+			}
+			if s.replicas.answered(url, state, time.Now()) {
+				replicaLog.Infof("Replica %s is healthy", state.ID)
+				changed = true
+			}
+		}
+		for _, r := range s.replicas.check(time.Now()) {
+			replicaLog.Warnf("Replica %s stopped answering", r.ID)
+			changed = true
+		}
+		if changed {
+			s.changed()
+		}
+	}
+}
+
+// handleReplica tells another replica about the clients registered here, with
+// the endpoints observed for those that did not register one
+func (s *overlayServer) handleReplica(w http.ResponseWriter, request *http.Request) {
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		http.Error(w, "Could not get peers", http.StatusInternalServerError)
+		return
+	}
+	observed := make(map[wgtypes.Key]*net.UDPAddr, len(peers))
+	for _, p := range peers {
+		if p.IP != "" && p.Port != 0 && !tunnelled(p) {
+			observed[p.PublicKey] = &net.UDPAddr{IP: net.ParseIP(p.IP), Port: p.Port}
+		}
+	}
+	state := protocol.ReplicaState{
+		ID:            s.replicas.self.ID,
+		Endpoint:      s.replicas.self.Endpoint,
+		Registrations: s.reg.local(),
+	}
+	for i := range state.Registrations {
+		r := &state.Registrations[i]
+		if r.Registration.Endpoint == nil {
+			r.Registration.Endpoint = observed[r.PublicKey]
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		http.Error(w, "Could not serialize state", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		replicaLog.WithError(err).Error("Could not write response")
+	}
+}
+
+func newReplicaServer(s *overlayServer) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.ReplicaPath, s.handleReplica)
+	return &http.Server{
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 6 * time.Second,
+		Handler:      requireToken(s.replicas.token, mux),
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var restartLog = logging.For("restart")
+
+const (
+	restartCheckInterval = 5 * time.Second
+	// A restarted peer has to stay healthy this long before the next one is
+	// told to restart
+	restartSettle = 30 * time.Second
+)
+
+// restarts runs rolling restarts, telling the peers of a group to restart one
+// at a time and waiting for each to come back healthy
+type restarts struct {
+	mu     sync.Mutex
+	status protocol.AdminRestart
+	queue  []wgtypes.Key
+	// current was told to restart at ordered and registered again at back
+	current  wgtypes.Key
+	ordered  time.Time
+	back     time.Time
+	baseline int
+	timeout  time.Duration
+}
+
+// start begins restarting the peers in order, unless a restart is running
+func (r *restarts) start(group string, peers, skipped []wgtypes.Key, timeout time.Duration, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.State == "running" {
+		return errors.Errorf("A restart of group %s is running", r.status.Group)
+	}
+	r.status = protocol.AdminRestart{Group: group, State: "running", Started: now}
+	for _, k := range skipped {
+		r.status.Skipped = append(r.status.Skipped, k.String())
+	}
+	r.queue = peers
+	r.current = wgtypes.Key{}
+	r.timeout = timeout
+	return nil
+}
+
+// due reports whether the peer, which started at started, is to restart
+func (r *restarts) due(key wgtypes.Key, started time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status.State == "running" && key == r.current && !started.After(r.ordered)
+}
+
+// check advances the restart and reports whether a peer was told to restart
+func (r *restarts) check(reg *registry, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.State != "running" {
+		return false
+	}
+	if r.current == (wgtypes.Key{}) {
+		return r.next(reg, now)
+	}
+	if registration, ok := reg.get(r.current); ok && registration.Started.After(r.ordered) && r.back.IsZero() {
+		restartLog.WithField("peer", r.current.String()).Info("Peer restarted")
+		r.back = now
+	}
+	if !r.back.IsZero() && now.Sub(r.back) >= restartSettle {
+		// Healthy peers keep registering and reach as many peers as before
+		if unreachable, ok := reg.heartbeats(now.Add(-restartSettle))[r.current]; ok && len(unreachable) <= r.baseline {
+			r.status.Restarted = append(r.status.Restarted, r.current.String())
+			return r.next(reg, now)
+		}
+	}
+	if now.Sub(r.ordered) > r.timeout {
+		r.status.State = "failed"
+		r.status.Error = "peer " + r.current.String() + " did not come back healthy within " + r.timeout.String()
+		restartLog.WithField("peer", r.current.String()).Error("Rolling restart stopped: peer did not come back healthy")
+	}
+	return false
+}
+
+// next tells the next peer to restart, or ends the restart
+func (r *restarts) next(reg *registry, now time.Time) bool {
+	if len(r.queue) == 0 {
+		r.current = wgtypes.Key{}
+		r.status.State = "done"
+		restartLog.Infof("Rolling restart of group %s done", r.status.Group)
+		return false
+	}
+	r.current, r.queue = r.queue[0], r.queue[1:]
+	r.ordered, r.back = now, time.Time{}
+	registration, _ := reg.get(r.current)
+	r.baseline = len(registration.Unreachable)
+	restartLog.WithField("peer", r.current.String()).Info("Telling peer to restart")
+	return true
+}
+
+func (r *restarts) report() protocol.AdminRestart {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	if status.State == "running" && r.current != (wgtypes.Key{}) {
+		status.Current = r.current.String()
+	}
+	status.Pending = nil
+	for _, k := range r.queue {
+		status.Pending = append(status.Pending, k.String())
+	}
+	return status
+}
+
+func (s *overlayServer) runRestarts() {
+	ticker := time.NewTicker(restartCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.restarts.check(s.reg, time.Now()) {
+			// Wake up the peer so that it learns about the restart at once
+			s.notifier.bump()
+		}
+	}
+}
+
+// startRestart restarts the online peers of the group, which are ordered by key
+func (s *overlayServer) startRestart(group string, timeout time.Duration) error {
+	now := time.Now()
+	online := s.reg.heartbeats(now.Add(-heartbeatTimeout))
+	peerGroups := s.peerGroups()
+	keys := make(map[wgtypes.Key]bool)
+	for k := range peerGroups {
+		keys[k] = true
+	}
+	for k := range online {
+		keys[k] = true
+	}
+	var peers, skipped []wgtypes.Key
+	for k := range keys {
+		if !peerGroups.Has(k, group) || !s.allowed(k) {
+			continue
+		}
+		if _, ok := online[k]; ok {
+			peers = append(peers, k)
+		} else {
+			skipped = append(skipped, k)
+		}
+	}
+	if len(peers) == 0 {
+		return errors.Errorf("No online peers in group %s", group)
+	}
+	byKey := func(keys []wgtypes.Key) func(i, j int) bool {
+		return func(i, j int) bool { return keys[i].String() < keys[j].String() }
+	}
+	sort.Slice(peers, byKey(peers))
+	sort.Slice(skipped, byKey(skipped))
+	if err := s.restarts.start(group, peers, skipped, timeout, now); err != nil {
+		return err
+	}
+	restartLog.Infof("Rolling restart of %d peers in group %s", len(peers), group)
+	if s.restarts.check(s.reg, now) {
+		s.notifier.bump()
+	}
+	return nil
+}
+
+func (s *overlayServer) handleAdminRestart(w http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req protocol.AdminRestartRequest
+		body := http.MaxBytesReader(w, request.Body, maxAdminRequestSize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, "Could not decode request", http.StatusBadRequest)
+			return
+		}
+		if req.Group == "" || req.TimeoutSecs <= 0 {
+			http.Error(w, "A group and a timeout are required", http.StatusBadRequest)
+			return
+		}
+		if err := s.startRestart(req.Group, time.Duration(req.TimeoutSecs)*time.Second); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.restarts.report())
+}
+
+func (s *overlayServer) handleRestart(w http.ResponseWriter, request *http.Request) {
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	registration, _ := s.reg.get(key)
+	restart := protocol.Restart{Restart: s.restarts.due(key, registration.Started)}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(restart); err != nil {
+		http.Error(w, "Could not serialize restart", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		restartLog.WithError(err).Error("Could not write response")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+)
+
+// revocations lists the revoked keys, ordered so that the list only changes
+// with them
+func (s *overlayServer) revocations() protocol.Revocations {
+	var revocations protocol.Revocations
+	for _, r := range s.store.List() {
+		if r.Revoked {
+			revocations.Keys = append(revocations.Keys, r.PublicKey)
+		}
+	}
+	sort.Slice(revocations.Keys, func(i, j int) bool {
+		return bytes.Compare(revocations.Keys[i][:], revocations.Keys[j][:]) < 0
+	})
+	return revocations
+}
+
+func (s *overlayServer) handleRevoked(w http.ResponseWriter, request *http.Request) {
+	if _, code := s.requester(request); code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.revocations()); err != nil {
+		http.Error(w, "Could not serialize revocations", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		syncLog.WithError(err).Error("Could not write response")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/gob"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var rotationLog = logging.For("rotation")
+
+const (
+	// Time between all peers configuring the next key and switching to it,
+	// leaving watching clients time to fetch the cutover
+	cutoverDelay = 15 * time.Second
+	// Rotations proceed without the acknowledgement of peers that are offline
+	rotationAckTimeout = 10 * time.Minute
+)
+
+type rotation struct {
+	store.Rotation
+	old, next wgtypes.Key
+}
+
+// rotations returns the rotations in progress by old key
+func (s *overlayServer) rotations() map[wgtypes.Key]rotation {
+	rotations := make(map[wgtypes.Key]rotation)
+	for _, r := range s.store.List() {
+		if r.Rotation == nil {
+			continue
+		}
+		next, err := wgtypes.ParseKey(r.Rotation.NextKey)
+		if err != nil {
+			rotationLog.WithError(err).Warn("Ignored rotation with invalid key of ", r.PublicKey)
+			continue
+		}
+		rotations[r.PublicKey] = rotation{Rotation: *r.Rotation, old: r.PublicKey, next: next}
+	}
+	return rotations
+}
+
+// standbyPeers returns the next keys of the rotations to be configured on the
+// server's device
+func (s *overlayServer) standbyPeers() []wg.Peer {
+	var peers []wg.Peer
+	for _, r := range s.rotations() {
+		peers = append(peers, wg.Peer{PublicKey: r.next, Standby: true})
+	}
+	return peers
+}
+
+func (s *overlayServer) handleRotate(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	var req protocol.Rotation
+	body := http.MaxBytesReader(w, request.Body, maxRegistrationSize)
+	if err := gob.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "Could not decode rotation", http.StatusBadRequest)
+		return
+	}
+	if req.NextKey == (wgtypes.Key{}) || req.NextKey == key {
+		http.Error(w, "Invalid next key", http.StatusBadRequest)
+		return
+	}
+	if r, ok := s.rotations()[key]; ok {
+		if r.next != req.NextKey {
+			http.Error(w, "Another rotation is in progress", http.StatusConflict)
+		}
+		return
+	}
+	if r, _ := s.store.Get(key); r.Renumbering != nil {
+		http.Error(w, "Peer is being renumbered", http.StatusConflict)
+		return
+	}
+	if _, known := s.store.Get(req.NextKey); known || s.configured.has(req.NextKey) {
+		http.Error(w, "Next key is already in use", http.StatusConflict)
+		return
+	}
+	if _, err := s.store.Update(key, func(r *store.Record) {
+		r.Rotation = &store.Rotation{NextKey: req.NextKey.String(), Started: time.Now().UTC()}
+	}); err != nil {
+		rotationLog.WithError(err).Error("Could not record rotation")
+		http.Error(w, "Could not record rotation", http.StatusInternalServerError)
+		return
+	}
+	if err := s.wgState.AddPeers([]wg.Peer{{PublicKey: req.NextKey, Standby: true}}); err != nil {
+		rotationLog.WithError(err).Error("Could not add next key")
+	}
+	rotationLog.Infof("Peer %s is rotating to %s", key, req.NextKey)
+	s.changed()
+}
+
+// runRotations schedules and completes rotations
+func (s *overlayServer) runRotations() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkRotations(time.Now())
+	}
+}
+
+func (s *overlayServer) checkRotations(now time.Time) {
+	rotations := s.rotations()
+	if len(rotations) == 0 {
+		return
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		rotationLog.WithError(err).Error("Could not get peers")
+		return
+	}
+	for _, r := range rotations {
+		if r.Cutover.IsZero() {
+			timedOut := now.Sub(r.Started) > rotationAckTimeout
+			if !timedOut && !s.acknowledged(r, peers, rotations) {
+				continue
+			}
+			if timedOut {
+				rotationLog.Warnf("Not all peers configured %s in time; rotating anyway", r.next)
+			}
+			cutover := now.Add(cutoverDelay).UTC()
+			if _, err := s.store.Update(r.old, func(rec *store.Record) {
+				rec.Rotation.Cutover = cutover
+			}); err != nil {
+				rotationLog.WithError(err).Error("Could not schedule rotation")
+				continue
+			}
+			rotationLog.Infof("Rotation of %s to %s cuts over at %s", r.old, r.next, cutover)
+			s.changed()
+		} else if !now.Before(r.Cutover) {
+			s.finishRotation(r)
+			s.changed()
+		}
+	}
+}
+
+// acknowledged reports whether every peer that sees the rotating peer has
+// configured its next key
+func (s *overlayServer) acknowledged(r rotation, peers []wg.Peer, rotations map[wgtypes.Key]rotation) bool {
+	peerGroups := s.peerGroups()
+	standby := make(map[wgtypes.Key]bool, len(rotations))
+	for _, other := range rotations {
+		standby[other.next] = true
+	}
+	for _, p := range peers {
+		if p.PublicKey == r.old || standby[p.PublicKey] {
+			continue
+		}
+		if s.policy != nil && !s.policy.Visible(peerGroups, p.PublicKey, r.old) {
+			continue
+		}
+		if !s.reg.hasStandby(p.PublicKey, r.next) {
+			return false
+		}
+	}
+	return true
+}
+
+// finishRotation hands the address and metadata of the old key over to the
+// next key and retires the old key
+func (s *overlayServer) finishRotation(r rotation) {
+	old, _ := s.store.Get(r.old)
+	var pinned net.IP
+	if s.alloc != nil {
+		if ip, ok := s.alloc.Lookup(r.old); ok {
+			if err := s.alloc.Release(r.old); err != nil {
+				rotationLog.WithError(err).Error("Could not release address of ", r.old)
+			}
+			if _, err := s.alloc.Request(r.next, ip); err != nil {
+				rotationLog.WithError(err).Error("Could not move address to ", r.next)
+			}
+		}
+	} else if old.Address != nil {
+		pinned = old.Address
+	} else {
+		pinned = s.wgState.GetOverlayAddress(r.old).IP
+	}
+	groups := s.peerGroups()[r.old]
+	if _, err := s.store.Update(r.next, func(rec *store.Record) {
+		rec.Hostname = old.Hostname
+		rec.Routes = old.Routes
+		rec.Annotations = old.Annotations
+		rec.Groups = groups
+		rec.Approved = true
+		rec.Token = old.Token
+		rec.Address = pinned
+	}); err != nil {
+		rotationLog.WithError(err).Error("Could not record rotated key ", r.next)
+		return
+	}
+	if _, err := s.store.Update(r.old, func(rec *store.Record) {
+		rec.Approved = false
+		rec.Revoked = true
+		rec.Address = nil
+		rec.Rotation = nil
+	}); err != nil {
+		rotationLog.WithError(err).Error("Could not retire key ", r.old)
+	}
+	s.reg.delete(r.old)
+	// Moving the addresses to the next key takes them from the old one
+	if err := s.wgState.AddPeers([]wg.Peer{s.devicePeer(r.next)}); err != nil {
+		rotationLog.WithError(err).Error("Could not configure rotated key ", r.next)
+	}
+	if err := s.wgState.RemovePeers([]wgtypes.Key{r.old}); err != nil {
+		rotationLog.WithError(err).Error("Could not remove retired key ", r.old)
+	}
+	rotationLog.Infof("Peer %s rotated to %s", r.old, r.next)
+	s.events.emit(protocol.Event{Event: eventKeyRotated, Peer: r.old.String(), NextKey: r.next.String()})
+}
@@ -2,121 +2,1066 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/jimzhong/wireguard-overlay/internal/accounting"
+	"github.com/jimzhong/wireguard-overlay/internal/activation"
+	"github.com/jimzhong/wireguard-overlay/internal/cleanup"
 	"github.com/jimzhong/wireguard-overlay/internal/config"
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/enroll"
+	"github.com/jimzhong/wireguard-overlay/internal/firewall"
+	"github.com/jimzhong/wireguard-overlay/internal/groups"
+	"github.com/jimzhong/wireguard-overlay/internal/ipam"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/noise"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/store"
+	"github.com/jimzhong/wireguard-overlay/internal/support"
+	"github.com/jimzhong/wireguard-overlay/internal/tcprelay"
+	"github.com/jimzhong/wireguard-overlay/internal/tracing"
+	"github.com/jimzhong/wireguard-overlay/internal/transport"
 	"github.com/jimzhong/wireguard-overlay/internal/wg"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func newHttpServer(wgState *wg.State, port int) *http.Server {
-	mux := http.NewServeMux()
-	c := cache.New(5*time.Second, time.Minute)
-	mux.HandleFunc("/",
-		func(w http.ResponseWriter, request *http.Request) {
-			cached, found := c.Get("")
-			logrus.Debug("Cache hit: ", found)
-			var serialized []byte
-			if found {
-				var ok bool
-				serialized, ok = cached.([]byte)
-				if !ok {
-					http.Error(w, "Could not read serialized peers", http.StatusInternalServerError)
-				}
-			} else {
-				peers, _ := wgState.GetPeers()
-				for i := range peers {
-					// Clients should not see these fields
-					peers[i].KeepaliveInterval = 0
-					peers[i].PresharedKey = wgtypes.Key{}
-				}
-				var buf bytes.Buffer
-				if err := gob.NewEncoder(&buf).Encode(peers); err != nil {
-					http.Error(w, "Could not serialize peers", http.StatusInternalServerError)
-					return
-				}
-				serialized = buf.Bytes()
-				c.SetDefault("", serialized)
+// syncLog logs the registrations and peer queries of clients
+var syncLog = logging.For("sync")
+
+const (
+	maxRegistrationSize = 4096
+	// Clients watching for changes are answered after this long at the latest
+	watchTimeout = 25 * time.Second
+)
+
+// The FileDescriptorName of the sockets passed by socket activation
+const (
+	activatedPeers    = "peers"
+	activatedEnroll   = "enroll"
+	activatedAdmin    = "admin"
+	activatedTCPRelay = "tcp-relay"
+	activatedReplica  = "replica"
+)
+
+// overlayServer answers registrations and peer queries from clients
+type overlayServer struct {
+	wgState *wg.State
+	cache   *cache.Cache
+	// history keeps the recent peer lists to send deltas against
+	history  *peerHistory
+	reg      *registry
+	alloc    *ipam.Allocator
+	groups   groups.Groups
+	policy   *groups.Policy
+	topology *groups.Topology
+	// hubs is set when region hubs forward between regions
+	hubs        *groups.Hubs
+	acl         []groups.ACLRule
+	store       *store.Store
+	configured  *allowlist
+	notifier    *notifier
+	tokens      *enroll.Tokens
+	diagnostics *diagnostics
+	partition   partition
+	prefixes    groups.Prefixes
+	traversal   *traversal
+	churn       *churn
+	restarts    *restarts
+	derivation  *derivation
+	// liveness is set when peers that stop registering are evicted
+	liveness *liveness
+	// recordTTL, if set, is how long distributed peer records are valid
+	recordTTL time.Duration
+	// quotas is set when the traffic of the clients is accounted
+	quotas *quotas
+	// verifier is set when the endpoints clients claim are verified
+	verifier *endpointVerifier
+	limits   *apiLimits
+	replays  *replayGuard
+	// identities restrict the peers client certificates may act as
+	identities tlsIdentities
+	// replicas is set when the server runs as one of several
+	replicas *replicas
+	// events is set when lifecycle events are posted or logged
+	events *events
+}
+
+// prefixFor returns the range in which to allocate the address of the peer
+func (s *overlayServer) prefixFor(key wgtypes.Key) *net.IPNet {
+	return s.prefixes.For(s.peerGroups(), key)
+}
+
+// changed drops cached peer lists and wakes up watching clients
+func (s *overlayServer) changed() {
+	s.cache.Flush()
+	s.notifier.bump()
+}
+
+// allowed reports whether the key may be part of the overlay
+func (s *overlayServer) allowed(key wgtypes.Key) bool {
+	r, _ := s.store.Get(key)
+	return !r.Revoked && (r.Approved || s.configured.has(key))
+}
+
+// peerGroups merges the configured groups with those set through the admin API
+func (s *overlayServer) peerGroups() groups.Groups {
+	g := make(groups.Groups, len(s.groups))
+	for k, v := range s.groups {
+		g[k] = append([]string(nil), v...)
+	}
+	for _, r := range s.store.List() {
+		g[r.PublicKey] = append(g[r.PublicKey], r.Groups...)
+	}
+	return g
+}
+
+// requester identifies the client that sent the request, as done by limit
+func (s *overlayServer) requester(request *http.Request) (wgtypes.Key, int) {
+	key, ok := request.Context().Value(requesterKey{}).(wgtypes.Key)
+	if !ok {
+		var code int
+		if key, code = s.identify(request); code != http.StatusOK {
+			return key, code
+		}
+	}
+	// Peers removed from the overlay may still be on the device for a moment
+	if !s.allowed(key) {
+		return wgtypes.Key{}, http.StatusForbidden
+	}
+	return key, http.StatusOK
+}
+
+// noiseConn is the context key of the Noise connection of a request
+type noiseConn struct{}
+
+// identify looks up the client by the overlay address the request came from
+func (s *overlayServer) identify(request *http.Request) (wgtypes.Key, int) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return wgtypes.Key{}, http.StatusBadRequest
+	}
+	peers, err := s.wgState.GetPeers()
+	if err != nil {
+		return wgtypes.Key{}, http.StatusInternalServerError
+	}
+	key, ok := peerByAddr(peers, net.ParseIP(host))
+	if !ok {
+		return wgtypes.Key{}, http.StatusForbidden
+	}
+	if conn, ok := request.Context().Value(noiseConn{}).(*noise.Conn); ok {
+		if remote, err := conn.RemoteKey(); err != nil || remote != key {
+			syncLog.WithField("peer", key.String()).Warn("Noise handshake was not made with the key of the peer")
+			return wgtypes.Key{}, http.StatusForbidden
+		}
+	}
+	if request.TLS != nil && s.identities != nil {
+		if len(request.TLS.PeerCertificates) == 0 || !s.identities.allows(request.TLS.PeerCertificates[0], key) {
+			syncLog.WithField("peer", key.String()).Warn("Client certificate may not act as the peer")
+			return wgtypes.Key{}, http.StatusForbidden
+		}
+	}
+	return key, http.StatusOK
+}
+
+func (s *overlayServer) handleRegister(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, request.Body, maxRegistrationSize))
+	if err != nil {
+		http.Error(w, "Could not read registration", http.StatusBadRequest)
+		return
+	}
+	if err := s.replays.check(key, request.Header, data, time.Now()); err != nil {
+		syncLog.WithField("peer", key.String()).WithError(err).Warn("Rejected registration")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var registration protocol.Registration
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&registration); err != nil {
+		http.Error(w, "Could not decode registration", http.StatusBadRequest)
+		return
+	}
+	if err := protocol.CheckMetadata(registration.Metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	syncLog.WithField("peer", key.String()).Debugf("Registration: %+v", registration)
+	// A conflicting address rejects the registration before anything of it
+	// is recorded
+	leased := false
+	if s.alloc != nil && registration.RequestedAddr != nil {
+		if prefix := s.prefixFor(key); prefix != nil && !prefix.Contains(registration.RequestedAddr) {
+			http.Error(w, "Requested address is outside of the group prefix "+prefix.String(), http.StatusConflict)
+			return
+		}
+		if leased, err = s.alloc.Request(key, registration.RequestedAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if leased {
+			syncLog.Infof("Leased requested address %s to %s", registration.RequestedAddr, key)
+			if err := s.wgState.AddPeers([]wg.Peer{s.devicePeer(key)}); err != nil {
+				syncLog.WithError(err).Error("Could not update peer address")
+			}
+		}
+	}
+	_, known := s.reg.get(key)
+	changed := s.reg.set(key, registration)
+	if s.verifier != nil {
+		s.verifier.check(key, registration, time.Now())
+	}
+	back := s.liveness != nil && s.liveness.online(key)
+	if back || leased {
+		changed = true
+	}
+	if !known || back {
+		event := protocol.Event{Event: eventRegistered, Peer: key.String()}
+		if registration.Endpoint != nil {
+			event.Endpoint = registration.Endpoint.String()
+		}
+		s.events.emit(event)
+	}
+	if changed {
+		s.changed()
+	}
+	s.negotiateAddressVersion()
+	s.coordinatePunches(key, registration.Unreachable)
+}
+
+// handleDeregister stops distributing a peer that shuts down, and tells the
+// other clients to remove it right away
+func (s *overlayServer) handleDeregister(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	if s.reg.depart(key) {
+		syncLog.WithField("peer", key.String()).Info("Peer deregistered")
+		s.events.emit(protocol.Event{Event: eventDeregistered, Peer: key.String()})
+		s.changed()
+	}
+}
+
+// tunnelled reports whether the peer reaches the server through the TCP relay,
+// which wireguard observes as a loopback endpoint
+func tunnelled(p wg.Peer) bool {
+	ip := net.ParseIP(p.IP)
+	return ip != nil && ip.IsLoopback()
+}
+
+// recordExpiry returns when a record distributed now lapses: between half a
+// TTL and a TTL from now. Records are renewed every half TTL rather than with
+// every list, so that lists in between stay the same and deltas stay small.
+func recordExpiry(now time.Time, ttl time.Duration) time.Time {
+	return now.Truncate(ttl / 2).Add(ttl)
+}
+
+// peersFor returns the peers to distribute to the receiver. If hidden is not
+// nil, the reasons for leaving out the other peers are recorded in it.
+func (s *overlayServer) peersFor(receiver wgtypes.Key, hidden map[wgtypes.Key]string) ([]wg.Peer, error) {
+	all, err := s.wgState.GetPeers()
+	if err != nil {
+		return nil, err
+	}
+	s.reg.apply(all)
+	peerGroups := s.peerGroups()
+	rotations := s.rotations()
+	var homes map[wgtypes.Key]wgtypes.Key
+	if s.hubs != nil {
+		homes = s.homes(all)
+	}
+	standby := make(map[wgtypes.Key]bool, len(rotations))
+	for _, r := range rotations {
+		standby[r.next] = true
+	}
+	hide := func(key wgtypes.Key, reason string) {
+		if hidden != nil {
+			hidden[key] = reason
+		}
+	}
+	peers := make([]wg.Peer, 0, len(all))
+	for _, p := range all {
+		if standby[p.PublicKey] {
+			// Distributed as the next key of the rotating peer
+			hide(p.PublicKey, "next key of a rotating peer")
+			continue
+		}
+		if p.PublicKey != receiver && s.reg.hasDeparted(p.PublicKey) {
+			hide(p.PublicKey, "deregistered")
+			continue
+		}
+		if p.PublicKey != receiver && s.liveness != nil && s.liveness.isOffline(p.PublicKey) {
+			hide(p.PublicKey, "offline")
+			continue
+		}
+		if p.PublicKey != receiver && s.quotas.over(p.PublicKey) {
+			hide(p.PublicKey, "over traffic quota")
+			continue
+		}
+		if s.policy != nil && !s.policy.Visible(peerGroups, receiver, p.PublicKey) {
+			hide(p.PublicKey, "group policy")
+			continue
+		}
+		if p.PublicKey != receiver && !s.topology.Direct(peerGroups, receiver, p.PublicKey) {
+			p.ThroughServer = true
+		}
+		if r, _ := s.store.Get(p.PublicKey); r.Static {
+			// The apps of static peers only configure the server
+			p.ThroughServer = true
+		}
+		if s.hubs != nil {
+			p.Hub = s.hubs.Region(p.PublicKey)
+			if via, ok := s.hubs.Via(receiver, homes[receiver], p.PublicKey, homes[p.PublicKey]); ok && !p.ThroughServer {
+				p.Via = via
+			}
+		}
+		if r, ok := rotations[p.PublicKey]; ok {
+			p.NextKey = r.next
+			p.Cutover = r.Cutover
+		}
+		if tunnelled(p) || p.ThroughServer {
+			// Only reachable through the server
+			p.IP, p.Port = "", 0
+		} else if reg, ok := s.reg.get(p.PublicKey); ok {
+			if c := candidates(p, reg); len(c) > 1 {
+				p.Candidates = c
 			}
-			if serialized == nil {
-				http.Error(w, "Could not get serialized peers", http.StatusInternalServerError)
+		}
+		p.Addresses = s.addresses(p.PublicKey)
+		p.AddressVersion = s.derivation.version()
+		if s.recordTTL > 0 {
+			p.Expires = recordExpiry(time.Now(), s.recordTTL)
+		}
+		// Clients should not see these fields
+		p.KeepaliveInterval = 0
+		p.PresharedKey = wgtypes.Key{}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+func (s *overlayServer) handlePeers(w http.ResponseWriter, request *http.Request) {
+	// Only enrolled peers may fetch the list
+	receiver, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	// Without a policy or hubs every client receives the same list
+	cacheKey := ""
+	if s.policy != nil || s.hubs != nil {
+		cacheKey = receiver.String()
+	}
+	cached, found := s.cache.Get(cacheKey)
+	syncLog.WithField("peer", receiver.String()).Debug("Peer list requested, cache hit: ", found)
+	var list *peerList
+	if found {
+		var ok bool
+		list, ok = cached.(*peerList)
+		if !ok {
+			http.Error(w, "Could not read serialized peers", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		_, span := tracing.Start(request.Context(), "build peer list")
+		peers, err := s.peersFor(receiver, nil)
+		if err != nil {
+			tracing.End(span, err)
+			http.Error(w, "Could not get peers", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(peers)
+		span.SetAttributes(attribute.Int("peers", len(peers)))
+		tracing.End(span, err)
+		if err != nil {
+			http.Error(w, "Could not serialize peers", http.StatusInternalServerError)
+			return
+		}
+		list = s.history.record(cacheKey, peers, buf.Bytes())
+		s.cache.SetDefault(cacheKey, list)
+	}
+	query := request.URL.Query()
+	// Further pages are taken from the list of the first one
+	if g := query.Get("generation"); g != "" {
+		generation, _ := strconv.ParseUint(g, 10, 64)
+		if list = s.history.find(cacheKey, generation); list == nil {
+			http.Error(w, "Peer list expired", http.StatusGone)
+			return
+		}
+	}
+	var body []byte
+	// Clients that have a recent list are sent what changed since
+	if since, err := strconv.ParseUint(query.Get("since"), 10, 64); err == nil && query.Get("generation") == "" {
+		if delta, ok := s.history.delta(cacheKey, since, list); ok {
+			if body, err = encode(delta); err != nil {
+				http.Error(w, "Could not serialize peers", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set(protocol.DeltaHeader, "1")
+		}
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 && body == nil {
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		if page := list.page(offset, limit); len(page) != len(list.peers) {
+			if body, err = encode(page); err != nil {
+				http.Error(w, "Could not serialize peers", http.StatusInternalServerError)
 				return
 			}
-			_, err := w.Write(serialized)
-			if err != nil {
-				logrus.WithError(err).Error("Could not write response")
+		}
+		w.Header().Set(protocol.TotalHeader, strconv.Itoa(len(list.peers)))
+	}
+	w.Header().Set(protocol.GenerationHeader, strconv.FormatUint(list.generation, 10))
+	if s.replicas != nil {
+		protocol.SetReplicas(w.Header(), s.replicas.list())
+	}
+	if body == nil {
+		body = list.serialized
+		if len(body) >= minCompressed && acceptsGzip(request) {
+			body = list.compressed()
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	} else if len(body) >= minCompressed && acceptsGzip(request) {
+		body = compress(body)
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	_, err := w.Write(body)
+	if err != nil {
+		syncLog.WithError(err).Error("Could not write response")
+	}
+}
+
+func (s *overlayServer) handleWatch(w http.ResponseWriter, request *http.Request) {
+	if _, code := s.requester(request); code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	gen, _ := s.notifier.current()
+	if since := request.URL.Query().Get("since"); since != "" {
+		n, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid generation", http.StatusBadRequest)
+			return
+		}
+		gen = s.notifier.wait(request.Context(), n, watchTimeout)
+	}
+	if _, err := fmt.Fprint(w, gen); err != nil {
+		syncLog.WithError(err).Error("Could not write response")
+	}
+}
+
+// newAPIServer returns the server side of the transport of the kind, which
+// answers the peer API
+func newAPIServer(s *overlayServer, kind string) (transport.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.RegisterPath, s.handleRegister)
+	mux.HandleFunc(protocol.DeregisterPath, s.handleDeregister)
+	mux.HandleFunc(protocol.WatchPath, s.handleWatch)
+	mux.HandleFunc(protocol.RotatePath, s.handleRotate)
+	mux.HandleFunc(protocol.DiagnosticsPath, s.handleDiagnostics)
+	mux.HandleFunc(protocol.PunchPath, s.handlePunch)
+	mux.HandleFunc(protocol.RestartPath, s.handleRestart)
+	mux.HandleFunc(protocol.ACLPath, s.handleACL)
+	mux.HandleFunc(protocol.RevokedPath, s.handleRevoked)
+	mux.HandleFunc(protocol.VerifyPath, s.handleVerify)
+	mux.HandleFunc(protocol.PeersPath, s.handlePeers)
+	return transport.NewServer(kind, transport.ServerOptions{
+		API:            versioned(s.limit(tracing.Handler(mux))),
+		MaxHeaderBytes: maxAPIHeaderSize,
+		WatchTimeout:   watchTimeout,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if c, ok := conn.(*noise.Conn); ok {
+				return context.WithValue(ctx, noiseConn{}, c)
 			}
-		})
-	addr := net.TCPAddr{
-		IP:   wgState.OverlayAddr.IP,
-		Port: port,
+			return ctx
+		},
+	})
+}
+
+func setUpFirewall(iface string, port int, backend string, overlayPorts []string, relay bool) (firewall.Firewall, error) {
+	ports, err := firewall.ParsePorts(overlayPorts)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) != 0 {
+		// Clients fetch peers through the overlay
+		ports = append(ports, firewall.Port{Proto: "tcp", Port: port})
+	}
+	fw, err := firewall.New(backend)
+	if err != nil {
+		return nil, err
+	}
+	return fw, fw.Apply(firewall.Rules{
+		Interface:    iface,
+		ListenPort:   port,
+		OverlayPorts: ports,
+		Relay:        relay,
+	})
+}
+
+// loadAllocator loads the leases and allocates addresses to the peers that
+// have none yet. Derived addresses are reserved since clients keep using them
+// to reach the server.
+func loadAllocator(wgState *wg.State, path string, peers []wg.Peer, prefixFor func(wgtypes.Key) *net.IPNet, readOnly bool) (*ipam.Allocator, error) {
+	reserved := []net.IP{wgState.OverlayAddr.IP}
+	for _, p := range peers {
+		reserved = append(reserved, wgState.GetOverlayAddress(p.PublicKey).IP)
+	}
+	alloc, err := ipam.Load(wgState.OverlayNetwork, path, reserved)
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		alloc.ReadOnly()
+	}
+	for _, p := range peers {
+		if _, err := alloc.AllocateIn(p.PublicKey, prefixFor(p.PublicKey)); err != nil {
+			return nil, err
+		}
+	}
+	return alloc, nil
+}
+
+// devicePeer returns the peer as the server configures it on its device: with
+// both its derived address and its leased addresses, if it has any. A pinned
+// address replaces the derived one, which a peer renumbered away from it keeps
+// only until the window ends.
+func (s *overlayServer) devicePeer(key wgtypes.Key) wg.Peer {
+	addrs := s.addresses(key)
+	if len(addrs) == 0 {
+		return wg.Peer{PublicKey: key, Addresses: s.derivedAddresses(key), AllowedIPs: s.routes(key)}
+	}
+	if s.alloc == nil {
+		return wg.Peer{PublicKey: key, Addresses: addrs, AllowedIPs: s.routes(key)}
+	}
+	derived := s.wgState.GetOverlayAddress(key).IP
+	peer := wg.Peer{PublicKey: key, Addresses: []net.IP{derived}, AllowedIPs: s.routes(key)}
+	for _, a := range addrs {
+		if !a.Equal(derived) {
+			peer.Addresses = append(peer.Addresses, a)
+		}
 	}
-	server := &http.Server{
-		Addr:         addr.String(),
-		ReadTimeout:  3 * time.Second,
-		WriteTimeout: 6 * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      mux,
+	return peer
+}
+
+// routes returns the networks the peer advertises, which are routed to it
+func (s *overlayServer) routes(key wgtypes.Key) []net.IPNet {
+	r, _ := s.store.Get(key)
+	var routes []net.IPNet
+	for _, route := range r.Routes {
+		if _, n, err := net.ParseCIDR(route); err == nil {
+			routes = append(routes, *n)
+		}
+	}
+	return routes
+}
+
+// addresses returns the leased or pinned address of the peer, followed by its
+// previous address while it is being renumbered
+func (s *overlayServer) addresses(key wgtypes.Key) []net.IP {
+	addr, ok := s.address(key)
+	if !ok {
+		return nil
+	}
+	addrs := []net.IP{addr}
+	if r, _ := s.store.Get(key); r.Renumbering != nil {
+		addrs = append(addrs, r.Renumbering.From)
+	}
+	return addrs
+}
+
+// address returns the leased or pinned address of the peer
+func (s *overlayServer) address(key wgtypes.Key) (net.IP, bool) {
+	if s.alloc != nil {
+		return s.alloc.Lookup(key)
+	}
+	if r, _ := s.store.Get(key); r.Address != nil {
+		return r.Address, true
 	}
-	return server
+	return nil, false
+}
+
+// peerConfig allocates an address to the peer if needed and returns the peer
+// as the server configures it on its device
+func (s *overlayServer) peerConfig(key wgtypes.Key) (wg.Peer, error) {
+	if s.alloc != nil {
+		if _, err := s.alloc.AllocateIn(key, s.prefixFor(key)); err != nil {
+			return wg.Peer{}, err
+		}
+	}
+	return s.devicePeer(key), nil
 }
 
 func main() {
+	defer cleanup.Run()
+	defer cleanup.Recover()
+	subcommand := config.Subcommand()
+	if subcommand == "config" {
+		if err := config.RunCommand("server"); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
 	config, err := config.LoadServerConfig()
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	logLevel, err := logrus.ParseLevel(config.LogLevel)
+	if err := logging.Setup(config.LogFormat, config.LogLevel, config.LogLevels); err != nil {
+		logrus.Fatal(err)
+	}
+
+	switch subcommand {
+	case "":
+	case "support-bundle":
+		path, err := support.WriteBundle(config.Interface, config)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not create support bundle")
+		}
+		fmt.Println(path)
+		return
+	case "log-levels":
+		if err := logging.RunCommand(config.ControlSocket, config.LogLevels); err != nil {
+			logrus.WithError(err).Fatal("Could not set log levels")
+		}
+		return
+	case "debug-peer":
+		if err := logging.RunDebugCommand(config.ControlSocket, config.DebugPeer, config.DebugMinutes); err != nil {
+			logrus.WithError(err).Fatal("Could not debug peer")
+		}
+		return
+	case "self-test":
+		if err := wg.SelfTest(); err != nil {
+			logrus.WithError(err).Fatal("Self-test failed")
+		}
+		fmt.Println("Self-test passed")
+		return
+	case "mobile-peer":
+		if err := runMobileCommand(config.ControlSocket, config.MobileEndpoint, config.MobileHostname, config.MobileGroups, config.MobileConfig); err != nil {
+			logrus.WithError(err).Fatal("Could not provision mobile peer")
+		}
+		return
+	default:
+		logrus.Fatal("Unknown command: ", subcommand)
+	}
+	if config.SelfTest {
+		if err := wg.SelfTest(); err != nil {
+			logrus.WithError(err).Fatal("Self-test failed")
+		}
+		logrus.Info("Self-test passed")
+	}
+	activated, err := activation.Listeners()
 	if err != nil {
-		logrus.WithError(err).Fatal("Could not parse loglevel")
+		logrus.WithError(err).Fatal("Could not take over activated sockets")
+	}
+	for name, listeners := range activated {
+		switch name {
+		case activatedPeers, activatedEnroll, activatedAdmin, activatedTCPRelay, activatedReplica:
+		default:
+			logrus.Warnf("Ignoring %d activated sockets named %q", len(listeners), name)
+		}
 	}
-	logrus.SetLevel(logLevel)
 
-	wgState, err := wg.New(config.Interface, config.Port, (net.IPNet)(*config.OverlayNet), config.PrivateKey)
+	wgState, err := wg.New(config.Interface, config.Port, (net.IPNet)(*config.OverlayNet), []byte(config.AddressSalt), config.PrivateKey)
 	if err != nil {
 		logrus.WithError(err).Fatal("Could not instantiate wireguard controller")
 	}
+	if config.Netns != "" {
+		if config.Firewall != "none" {
+			logrus.Fatal("Firewall rules are not supported with netns")
+		}
+		if err := wgState.SetNetns(config.Netns); err != nil {
+			logrus.WithError(err).Fatal("Could not use network namespace")
+		}
+	}
+	logging.SetNode(wgState.PublicKey().String())
+	if config.DryRun {
+		wgState.DryRun(os.Stdout)
+	}
+	extraNets, err := config.ExtraNetworks()
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse extra overlay networks")
+	}
+	wgState.SetExtraNetworks(extraNets)
+	wgState.SetUpdateRate(config.PeerUpdateRate, config.PeerUpdateBurst)
+	wgState.SetBatchSize(config.PeerApplyBatch)
+	wgState.SetPolicyRouting(config.FirewallMark, config.RoutingTable)
+	if err := wgState.SetRouteAttributes(config.RouteMetric, config.RouteMarker); err != nil {
+		logrus.WithError(err).Fatal("Could not set route attributes")
+	}
 	if err := wgState.SetUpInterface(); err != nil {
 		logrus.WithError(err).Fatal("Could not up interface")
 	}
-	defer func() {
+	cleanup.Register("down interface", func() error {
 		logrus.Info("Exiting...")
-		if err := wgState.DownInterface(); err != nil {
-			logrus.WithError(err).Error("Could not down interface")
+		wgState.Stop()
+		return wgState.DownInterface()
+	})
+
+	if config.Relay {
+		if err := wgState.EnableForwarding(); err != nil {
+			logrus.WithError(err).Fatal("Could not enable relaying")
+		}
+	}
+	if config.Firewall != "none" && !config.DryRun {
+		fw, err := setUpFirewall(config.Interface, config.Port, config.Firewall, config.FirewallOverlayPorts, config.Relay)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up firewall")
+		}
+		cleanup.Register("clean up firewall rules", fw.Cleanup)
+	}
+	if config.ReconcileIntervalSecs > 0 && !config.DryRun {
+		go wgState.RunReconcile(time.Duration(config.ReconcileIntervalSecs) * time.Second)
+	}
+
+	var statusHandler *status.Handler
+	if config.StatusAddr != "" && !config.DryRun {
+		if err := wg.InNetns(config.Netns, func() (err error) {
+			statusHandler, err = status.NewHandler(config.Interface)
+			return err
+		}); err != nil {
+			logrus.WithError(err).Fatal("Could not instantiate status handler")
 		}
-	}()
+		statusServer, err := status.ListenAndServe(config.StatusAddr, statusHandler)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start status server")
+		}
+		defer statusServer.Close()
+	}
 
+	peerStore, err := openPeerStore(config.PeersStore, config.PeersFile, store.Options{
+		Endpoints: config.PeersStoreEndpoints,
+		Prefix:    config.PeersStorePrefix,
+		Token:     config.PeersStoreToken,
+	}, config.PeersStoreCA)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not open peer records")
+	}
+	configured, err := newAllowlist(config.ClientPubkeys, config.ClientPubkeysFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not load allowlist")
+	}
 	peers := make([]wg.Peer, 0, len(config.ClientPubkeys))
-	for _, p := range config.ClientPubkeys {
-		pubkey, err := wgtypes.ParseKey(p)
+	for _, k := range configured.list() {
+		if r, _ := peerStore.Get(k); !r.Revoked {
+			peers = append(peers, wg.Peer{PublicKey: k})
+		}
+	}
+	for _, r := range peerStore.List() {
+		if r.Approved && !r.Revoked && !configured.has(r.PublicKey) {
+			peers = append(peers, wg.Peer{PublicKey: r.PublicKey})
+		}
+	}
+	peerGroups, err := groups.ParseGroups(config.PeerGroups)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse peer groups")
+	}
+	policy, err := groups.ParsePolicy(config.GroupPolicy)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse group policy")
+	}
+	topology, err := groups.ParseTopology(config.Topology, config.TopologyAdjacency)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse topology")
+	}
+	if topology != nil && !config.Relay {
+		logrus.Fatal("The hub and custom topologies require relay, so that the server forwards between clients")
+	}
+	hubs, err := groups.ParseHubs(config.RegionHubs)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse region hubs")
+	}
+	acl, err := groups.ParseACL(config.ACL)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse ACL")
+	}
+
+	prefixes, err := groups.ParsePrefixes(config.GroupPrefixes, wgState.OverlayNetwork)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not parse group prefixes")
+	}
+
+	addressVersion := derive.Version(config.AddressVersion)
+	if !addressVersion.Supported() {
+		logrus.Fatal("Unsupported address version: ", config.AddressVersion)
+	}
+
+	overlay := &overlayServer{
+		wgState:     wgState,
+		cache:       cache.New(5*time.Second, time.Minute),
+		reg:         newRegistry(),
+		groups:      peerGroups,
+		policy:      policy,
+		topology:    topology,
+		hubs:        hubs,
+		acl:         acl,
+		store:       peerStore,
+		configured:  configured,
+		notifier:    newNotifier(),
+		history:     newPeerHistory(),
+		diagnostics: newDiagnostics(),
+		prefixes:    prefixes,
+		traversal:   newTraversal(),
+		churn:       newChurn(),
+		restarts:    &restarts{},
+		derivation:  newDerivation(addressVersion),
+	}
+	if config.AddressMode == "ipam" {
+		overlay.alloc, err = loadAllocator(wgState, config.LeasesFile, peers, overlay.prefixFor, config.DryRun)
 		if err != nil {
-			logrus.WithError(err).Warn("Skipped invalid key: ", p)
-			continue
+			logrus.WithError(err).Fatal("Could not load address leases")
 		}
-		peers = append(peers, wg.Peer{PublicKey: pubkey})
+	} else if config.AddressMode != "derived" {
+		logrus.Fatal("Unknown address mode: ", config.AddressMode)
+	} else if len(overlay.prefixes) != 0 {
+		logrus.Fatal("Group prefixes require the ipam address mode")
+	}
+	overlay.holdRenumbered()
+	for i := range peers {
+		peers[i] = overlay.devicePeer(peers[i].PublicKey)
 	}
+	peers = append(peers, overlay.standbyPeers()...)
 	logrus.Debug("Adding peers: ", peers)
 	if err = wgState.AddPeers(peers); err != nil {
 		logrus.WithError(err).Error("Could not add peers")
 	}
+	if config.DryRun {
+		wgState.FinishDryRun()
+		return
+	}
+	if config.OTLPURL != "" {
+		flush, err := tracing.Setup(config.OTLPURL, "wireguard-overlay-server")
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up tracing")
+		}
+		defer flush()
+	}
+	if config.ControlSocket != "" {
+		ctl, err := control.Listen(config.ControlSocket)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not open control socket")
+		} else {
+			defer ctl.Close()
+			ctl.Handle(control.LogPath, logging.Handler())
+			ctl.Handle(control.DebugPath, logging.DebugHandler())
+			ctl.Handle(control.MobilePath, overlay.mobileHandler(config.Relay))
+		}
+	}
+	go wgState.TraceDebuggedPeer()
+	if config.DebugPeer != "" && config.DebugMinutes > 0 {
+		if _, err := wgtypes.ParseKey(config.DebugPeer); err != nil {
+			logrus.WithError(err).Fatal("Could not parse debug-peer")
+		}
+		logging.DebugPeer(config.DebugPeer, time.Duration(config.DebugMinutes)*time.Minute)
+	}
+	overlay.events, err = newEvents(config.EventWebhook, config.AuditLog)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up events")
+	}
+	peerStore.OnChange(overlay.recordChanged)
+	go overlay.runRotations()
+	go overlay.runRenumberings()
+	go overlay.runPartitionDetection(config.AlertWebhook)
+	go overlay.runChurnTracking()
+	go overlay.runRestarts()
+	if config.ClientPubkeysFile != "" {
+		go overlay.runAllowlist()
+	}
+	overlay.recordTTL = time.Duration(config.PeerRecordTTLSecs) * time.Second
+	if config.VerifyEndpointsPort != 0 {
+		verifier, err := newEndpointVerifier(config.VerifyEndpointsPort, overlay.observedIP)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up endpoint verification")
+		}
+		overlay.verifier = verifier
+		overlay.reg.trusted = verifier.trusted
+	}
+	if config.PeerTTLSecs > 0 {
+		overlay.liveness = newLiveness(time.Duration(config.PeerTTLSecs)*time.Second, time.Now())
+		go overlay.runLiveness()
+	}
+	if config.TrafficQuotaMB > 0 && config.AccountingPeriod == "" {
+		logrus.Fatal("traffic-quota requires accounting-period")
+	}
+	if config.AccountingPeriod != "" {
+		a, err := accounting.New(config.AccountingFile, config.AccountingPeriod, int64(config.TrafficQuotaMB)<<20)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up traffic accounting")
+		}
+		if config.QuotaAction != "alert" && config.QuotaAction != "remove" {
+			logrus.Fatalf("Unknown quota action %q (alert/remove)", config.QuotaAction)
+		}
+		overlay.quotas = &quotas{Accounting: a, remove: config.QuotaAction == "remove"}
+		if statusHandler != nil {
+			statusHandler.AddCollector(a.Collect)
+			statusHandler.SetPeerUsage(a.Usage)
+		}
+		go overlay.runAccounting()
+	}
+	if statusHandler != nil {
+		statusHandler.AddCollector(overlay.churn.collect)
+		statusHandler.SetPeerMetadata(overlay.reg.metadata)
+	}
 
-	server := newHttpServer(wgState, config.Port)
+	overlay.replays = newReplayGuard(wgState.PrivateKey(), time.Duration(config.RegistrationWindowSecs)*time.Second, config.RequireSignedRegistration)
+	overlay.limits = &apiLimits{
+		byIP:  newLimiters(config.APIRate, config.APIBurst),
+		byKey: newLimiters(config.APIRate, config.APIBurst),
+	}
+	if statusHandler != nil {
+		statusHandler.AddCollector(overlay.limits.collect)
+	}
+	server, err := newAPIServer(overlay, config.Transport)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up peer API")
+	}
 	defer server.Close()
-	go func() {
-		if err := server.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
+	listeners := activated[activatedPeers]
+	if len(listeners) == 0 {
+		var l net.Listener
+		// The peer API listens on the overlay address, in the namespace of the
+		// interface
+		addr := net.TCPAddr{IP: wgState.OverlayAddr.IP, Port: config.Port}
+		if err := wg.InNetns(config.Netns, func() (err error) {
+			l, err = net.Listen("tcp", addr.String())
+			return err
+		}); err != nil {
 			logrus.WithError(err).Fatal("Could not start server")
 		}
-	}()
-	logrus.Info("Server is running. Pubkey: ", wgState.PublicKey)
+		listeners = []net.Listener{l}
+	}
+	if config.APINoise && config.APITLSCert != "" {
+		logrus.Fatal("api-noise and api-tls-cert cannot be combined")
+	}
+	tlsConfig, err := apiTLS(config.APITLSCert, config.APITLSKey, config.APITLSClientCA)
+	if err != nil {
+		logrus.WithError(err).Fatal("Could not set up TLS on the peer API")
+	}
+	if overlay.identities, err = parseTLSIdentities(config.APITLSIdentities); err != nil {
+		logrus.WithError(err).Fatal("Could not parse TLS identities")
+	}
+	for i := range listeners {
+		listeners[i] = newCapListener(listeners[i], overlay.limits, config.APIMaxConns, config.APIMaxConnsPerIP)
+		if tlsConfig != nil {
+			listeners[i] = tls.NewListener(listeners[i], tlsConfig)
+		}
+		if config.APINoise {
+			listeners[i] = noise.NewListener(listeners[i], wgState.PrivateKey())
+		}
+	}
+	serveAll(server, listeners, "peer API")
+
+	if config.EnrollAddr != "" || len(activated[activatedEnroll]) > 0 {
+		overlay.tokens, err = enroll.Load(config.TokensFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not load enrollment tokens")
+		}
+		// New clients are not on the overlay yet, so any address goes
+		listeners, err := listenNamed(activated, activatedEnroll, config.EnrollAddr, true)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start enrollment server")
+		}
+		enrollTLSConfig, err := enrollTLS(config.EnrollTLSCert, config.EnrollTLSKey)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not set up TLS on the enrollment listener")
+		}
+		if enrollTLSConfig != nil {
+			for i := range listeners {
+				listeners[i] = tls.NewListener(listeners[i], enrollTLSConfig)
+			}
+		} else {
+			enrollLog.Warn("Enrollment tokens and bootstraps are sent in the clear; set enroll-tls-cert")
+		}
+		enrollServer := newEnrollServer(overlay)
+		defer enrollServer.Close()
+		serveAll(enrollServer, listeners, "enrollment")
+	}
+	if config.AdminAddr != "" || len(activated[activatedAdmin]) > 0 {
+		if config.AdminToken == "" {
+			logrus.Fatal("An admin token is required to enable the admin API")
+		}
+		listeners, err := listenNamed(activated, activatedAdmin, config.AdminAddr, false)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start admin server")
+		}
+		adminServer := newAdminServer(overlay, config.AdminToken, config.AdminDashboard)
+		defer adminServer.Close()
+		serveAll(adminServer, listeners, "admin API")
+	}
+	if len(config.ReplicaPeers) != 0 {
+		if config.ReplicaToken == "" {
+			logrus.Fatal("A replica token is required to run as a replica")
+		}
+		if config.AddressMode != "derived" {
+			logrus.Fatal("Replicas require the derived address mode, since leases are not shared")
+		}
+		if config.PeersStore == "file" {
+			logrus.Warn("Replicas keep separate peer records in peers-file; use an etcd or Consul peer store")
+		}
+		id := config.ReplicaID
+		if id == "" {
+			if id, err = os.Hostname(); err != nil {
+				logrus.WithError(err).Fatal("Could not get hostname for replica-id")
+			}
+		}
+		if overlay.replicas, err = newReplicas(id, config.ReplicaEndpoint, config.ReplicaToken, config.ReplicaPeers); err != nil {
+			logrus.WithError(err).Fatal("Could not set up replicas")
+		}
+		listeners, err := listenNamed(activated, activatedReplica, config.ReplicaAddr, false)
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start replica server")
+		}
+		replicaServer := newReplicaServer(overlay)
+		defer replicaServer.Close()
+		serveAll(replicaServer, listeners, "replica API")
+		if statusHandler != nil {
+			statusHandler.AddCollector(overlay.replicas.collect)
+		}
+		go overlay.runReplicas()
+	}
+	if config.TCPRelayAddr != "" || len(activated[activatedTCPRelay]) > 0 {
+		listener, err := listenTCPRelay(config.TCPRelayAddr, config.TCPRelayCert, config.TCPRelayKey, activated[activatedTCPRelay])
+		if err != nil {
+			logrus.WithError(err).Fatal("Could not start TCP relay")
+		}
+		defer listener.Close()
+		go func() {
+			target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: config.Port}
+			if err := tcprelay.Serve(listener, target); err != nil && !errors.Is(err, net.ErrClosed) {
+				logrus.WithError(err).Fatal("TCP relay failed")
+			}
+		}()
+	}
+	logrus.Info("Server is running. Pubkey: ", wgState.PublicKey())
 
 	incomingSigs := make(chan os.Signal, 1)
 	signal.Notify(incomingSigs, syscall.SIGTERM, os.Interrupt)
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// listenTCPRelay listens for clients tunnelling wireguard over TCP, wrapping
+// the listener in TLS if a certificate is given. A socket passed by socket
+// activation is used instead of listening on addr.
+func listenTCPRelay(addr, certFile, keyFile string, activated []net.Listener) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not load TCP relay certificate")
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	var listener net.Listener
+	if len(activated) > 0 {
+		listener = activated[0]
+	} else {
+		var err error
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, errors.Wrapf(err, "Could not listen on %s", addr)
+		}
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
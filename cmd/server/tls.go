@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// tlsIdentities maps the SANs of client certificates to the peers they may
+// act as
+type tlsIdentities map[string][]wgtypes.Key
+
+func parseTLSIdentities(entries []string) (tlsIdentities, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	t := make(tlsIdentities)
+	for _, e := range entries {
+		i := strings.LastIndex(e, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("Invalid TLS identity %q; expected san=pubkey", e)
+		}
+		key, err := wgtypes.ParseKey(e[i+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key in TLS identity %q", e)
+		}
+		t[e[:i]] = append(t[e[:i]], key)
+	}
+	return t, nil
+}
+
+// allows reports whether the certificate has a SAN that may act as the peer
+func (t tlsIdentities) allows(cert *x509.Certificate, key wgtypes.Key) bool {
+	sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, san := range sans {
+		for _, k := range t[san] {
+			if k == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enrollTLS returns the TLS config of the enrollment listener, or nil without
+// a certificate. Clients are not asked for certificates, as they present
+// their token instead.
+func enrollTLS(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, errors.Wrap(err, "Could not load enrollment certificate")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		},
+	}, nil
+}
+
+// apiTLS returns the TLS config of the peer API, requiring client certificates
+// of the CA, or nil without a certificate. The certificate is read again for
+// every handshake, so that it can be renewed without a restart.
+func apiTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	if clientCA == "" {
+		return nil, errors.New("TLS on the peer API requires api-tls-client-ca")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, errors.Wrap(err, "Could not load peer API certificate")
+	}
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read client CA")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificates in %s", clientCA)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  roots,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		},
+	}, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var verifyLog = logging.For("verify")
+
+const (
+	// A cookie has to come back within this long
+	cookieTimeout = 30 * time.Second
+	// A verified address is trusted for this long, and verified again once
+	// half of it passed
+	verifiedTTL = 24 * time.Hour
+	// Only this many addresses a client claims are verified at a time
+	maxClaimed = 8
+)
+
+// endpointVerifier checks that the endpoints clients claim, through port
+// mappings, STUN or their LAN addresses, are theirs before they are handed out,
+// so that no client can have the others send traffic to a victim. It sends a
+// cookie to the probe port at each claimed address and trusts the address once
+// the client returns the cookie over the overlay. Addresses that wireguard
+// observes the client at need no cookie.
+type endpointVerifier struct {
+	port int
+	conn *net.UDPConn
+	// observed returns the address wireguard last saw the client at
+	observed func(wgtypes.Key) net.IP
+	mu       sync.Mutex
+	pending  map[string]challenge
+	verified map[wgtypes.Key]map[string]time.Time
+}
+
+type challenge struct {
+	key  wgtypes.Key
+	ip   string
+	sent time.Time
+}
+
+func newEndpointVerifier(port int, observed func(wgtypes.Key) net.IP) (*endpointVerifier, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not listen for endpoint verification")
+	}
+	return &endpointVerifier{
+		port:     port,
+		conn:     conn,
+		observed: observed,
+		pending:  make(map[string]challenge),
+		verified: make(map[wgtypes.Key]map[string]time.Time),
+	}, nil
+}
+
+// claimedIPs returns the addresses of the endpoints the client claims
+func claimedIPs(reg protocol.Registration) []net.IP {
+	var ips []net.IP
+	for _, e := range append([]*net.UDPAddr{reg.Endpoint, reg.Reflexive}, reg.LocalEndpoints...) {
+		if e != nil && len(ips) < maxClaimed {
+			ips = append(ips, e.IP)
+		}
+	}
+	return ips
+}
+
+// check sends cookies to the claimed addresses that are not verified yet
+func (v *endpointVerifier) check(key wgtypes.Key, reg protocol.Registration, now time.Time) {
+	observed := v.observed(key)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for cookie, c := range v.pending {
+		if now.Sub(c.sent) > cookieTimeout {
+			delete(v.pending, cookie)
+		}
+	}
+	for _, ip := range claimedIPs(reg) {
+		if observed != nil && ip.Equal(observed) {
+			v.trust(key, ip.String(), now)
+			continue
+		}
+		if t, ok := v.verified[key][ip.String()]; ok && now.Sub(t) < verifiedTTL/2 {
+			continue
+		}
+		if v.challenged(key, ip.String()) {
+			continue
+		}
+		cookie := make([]byte, protocol.CookieSize)
+		if _, err := rand.Read(cookie); err != nil {
+			verifyLog.WithError(err).Error("Could not generate cookie")
+			return
+		}
+		addr := &net.UDPAddr{IP: ip, Port: v.port}
+		if _, err := v.conn.WriteToUDP(protocol.CookiePacket(cookie), addr); err != nil {
+			verifyLog.WithField("peer", key.String()).WithError(err).Debug("Could not send cookie to ", addr)
+			continue
+		}
+		v.pending[string(cookie)] = challenge{key: key, ip: ip.String(), sent: now}
+		verifyLog.WithField("peer", key.String()).Debug("Sent cookie to ", addr)
+	}
+}
+
+func (v *endpointVerifier) challenged(key wgtypes.Key, ip string) bool {
+	for _, c := range v.pending {
+		if c.key == key && c.ip == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *endpointVerifier) trust(key wgtypes.Key, ip string, now time.Time) {
+	if v.verified[key] == nil {
+		v.verified[key] = make(map[string]time.Time)
+	}
+	v.verified[key][ip] = now
+}
+
+// confirm trusts the address the cookie was sent to, if the client it was
+// sent for returned it in time
+func (v *endpointVerifier) confirm(key wgtypes.Key, cookie []byte, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.pending[string(cookie)]
+	if !ok || c.key != key || now.Sub(c.sent) > cookieTimeout {
+		return false
+	}
+	delete(v.pending, string(cookie))
+	v.trust(key, c.ip, now)
+	verifyLog.WithField("peer", key.String()).Info("Verified endpoint address ", c.ip)
+	return true
+}
+
+// trusted reports whether the client may be handed out at the address
+func (v *endpointVerifier) trusted(key wgtypes.Key, ip net.IP) bool {
+	if v == nil {
+		return true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	t, ok := v.verified[key][ip.String()]
+	return ok && time.Since(t) < verifiedTTL
+}
+
+// observedIP returns the address wireguard last saw the client at, if any
+func (s *overlayServer) observedIP(key wgtypes.Key) net.IP {
+	stats, err := s.wgState.GetPeerStats()
+	if err != nil {
+		verifyLog.WithError(err).Error("Could not get peers")
+		return nil
+	}
+	for _, p := range stats {
+		if p.PublicKey == key && p.Endpoint != nil {
+			return p.Endpoint.IP
+		}
+	}
+	return nil
+}
+
+func (s *overlayServer) handleVerify(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, code := s.requester(request)
+	if code != http.StatusOK {
+		http.Error(w, "Could not identify peer", code)
+		return
+	}
+	if s.verifier == nil {
+		http.Error(w, "Endpoints are not verified", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(request.Body, 1024))
+	if err != nil {
+		http.Error(w, "Could not read verification", http.StatusBadRequest)
+		return
+	}
+	var verification protocol.Verification
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&verification); err != nil {
+		http.Error(w, "Could not decode verification", http.StatusBadRequest)
+		return
+	}
+	if !s.verifier.confirm(key, verification.Cookie, time.Now()) {
+		http.Error(w, "Unknown or expired cookie", http.StatusForbidden)
+		return
+	}
+	s.changed()
+}
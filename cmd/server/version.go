@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+)
+
+var versionLog = logging.For("version")
+
+// versioned announces the protocol version and capabilities of the server on
+// every response, and turns away clients too old to understand it, rather
+// than have them misread the gob encoded answers
+func versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		protocol.SetVersion(w.Header())
+		client, err := protocol.GetVersion(request.Header)
+		if err != nil {
+			versionLog.WithField("addr", request.RemoteAddr).WithError(err).Warn("Rejected client")
+			http.Error(w, err.Error(), http.StatusUpgradeRequired)
+			return
+		}
+		versionLog.WithField("addr", request.RemoteAddr).Trace("Client speaks ", client)
+		next.ServeHTTP(w, request)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// handleAdminView renders the peer list the client with the key would receive
+// right now, after the group policy, liveness and rotations, so that why a node
+// does not see another can be answered without touching the node
+func (s *overlayServer) handleAdminView(w http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := wgtypes.ParseKey(request.URL.Query().Get("key"))
+	if err != nil {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(key) {
+		http.Error(w, "Peer is not part of the overlay and receives no peers", http.StatusNotFound)
+		return
+	}
+	hidden := make(map[wgtypes.Key]string)
+	peers, err := s.peersFor(key, hidden)
+	if err != nil {
+		http.Error(w, "Could not get peers", http.StatusInternalServerError)
+		return
+	}
+	_, registered := s.reg.get(key)
+	view := protocol.AdminView{
+		PublicKey:  key.String(),
+		Groups:     s.peerGroups()[key],
+		Registered: registered,
+		Peers:      make([]protocol.AdminViewPeer, 0, len(peers)),
+	}
+	listed := make(map[wgtypes.Key]bool, len(peers))
+	for _, p := range peers {
+		listed[p.PublicKey] = true
+		vp := protocol.AdminViewPeer{PublicKey: p.PublicKey.String(), ThroughServer: p.ThroughServer}
+		if p.Via != (wgtypes.Key{}) {
+			vp.Via = p.Via.String()
+		}
+		for _, a := range s.wgState.PeerAddresses(p) {
+			vp.Addresses = append(vp.Addresses, a.String())
+		}
+		if p.IP != "" {
+			vp.Endpoint = net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+		}
+		for _, c := range p.Candidates {
+			vp.Candidates = append(vp.Candidates, c.String())
+		}
+		if p.NextKey != (wgtypes.Key{}) {
+			vp.NextKey = p.NextKey.String()
+		}
+		if !p.Cutover.IsZero() {
+			cutover := p.Cutover
+			vp.Cutover = &cutover
+		}
+		view.Peers = append(view.Peers, vp)
+	}
+	// Known peers that are not on the device are not distributed to anyone
+	for _, r := range s.store.List() {
+		if _, ok := hidden[r.PublicKey]; ok || listed[r.PublicKey] {
+			continue
+		}
+		switch {
+		case r.Revoked:
+			hidden[r.PublicKey] = "revoked"
+		case !r.Approved && !s.configured.has(r.PublicKey):
+			hidden[r.PublicKey] = "not approved"
+		}
+	}
+	for k, reason := range hidden {
+		view.Hidden = append(view.Hidden, protocol.AdminHidden{PublicKey: k.String(), Reason: reason})
+	}
+	sort.Slice(view.Peers, func(i, j int) bool { return view.Peers[i].PublicKey < view.Peers[j].PublicKey })
+	sort.Slice(view.Hidden, func(i, j int) bool { return view.Hidden[i].PublicKey < view.Hidden[j].PublicKey })
+	writeJSON(w, view)
+}
@@ -0,0 +1,213 @@
+package accounting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Periods over which the traffic is accumulated, in UTC
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// Accounting accumulates the traffic of every peer over the current period
+// from the counters of the device, which start over when a peer is configured
+// again or the device is recreated. With a path, the usage is kept in a file
+// so that it survives restarts.
+type Accounting struct {
+	path   string
+	period string
+	// quota, if set, is the bytes a peer may send and receive per period
+	quota int64
+	mu    sync.Mutex
+	state state
+}
+
+type state struct {
+	// Start is the beginning of the current period
+	Start time.Time         `json:"start"`
+	Peers map[string]*usage `json:"peers"`
+}
+
+type usage struct {
+	Received    int64 `json:"received_bytes"`
+	Transmitted int64 `json:"transmitted_bytes"`
+	// LastReceived and LastTransmitted are the counters of the last sample
+	LastReceived    int64 `json:"last_received_bytes"`
+	LastTransmitted int64 `json:"last_transmitted_bytes"`
+	Exceeded        bool  `json:"exceeded,omitempty"`
+}
+
+// New returns the accounting over the period, reading the usage from path if
+// it exists
+func New(path, period string, quota int64) (*Accounting, error) {
+	if period != PeriodDay && period != PeriodMonth {
+		return nil, errors.Errorf("Unknown accounting period %q (day/month)", period)
+	}
+	a := &Accounting{path: path, period: period, quota: quota, state: state{Peers: make(map[string]*usage)}}
+	if path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read traffic usage")
+	}
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode traffic usage in %s", path)
+	}
+	if a.state.Peers == nil {
+		a.state.Peers = make(map[string]*usage)
+	}
+	return a, nil
+}
+
+// start returns the beginning of the period around now
+func (a *Accounting) start(now time.Time) time.Time {
+	now = now.UTC()
+	if a.period == PeriodMonth {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Sample adds the traffic since the last sample. It returns the peers that
+// exceeded the quota with it, and those whose quota was lifted because a new
+// period began.
+func (a *Accounting) Sample(stats []wg.PeerStats, now time.Time) (exceeded, lifted []wgtypes.Key, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if start := a.start(now); !start.Equal(a.state.Start) {
+		a.state.Start = start
+		for k, u := range a.state.Peers {
+			if u.Exceeded {
+				if key, err := wgtypes.ParseKey(k); err == nil {
+					lifted = append(lifted, key)
+				}
+			}
+			u.Received, u.Transmitted, u.Exceeded = 0, 0, false
+		}
+	}
+	present := make(map[string]bool, len(stats))
+	for _, s := range stats {
+		k := s.PublicKey.String()
+		present[k] = true
+		u, ok := a.state.Peers[k]
+		if !ok {
+			u = &usage{}
+			a.state.Peers[k] = u
+		}
+		u.Received += delta(s.RxBytes, u.LastReceived)
+		u.Transmitted += delta(s.TxBytes, u.LastTransmitted)
+		u.LastReceived, u.LastTransmitted = s.RxBytes, s.TxBytes
+		if a.quota > 0 && !u.Exceeded && u.Received+u.Transmitted > a.quota {
+			u.Exceeded = true
+			exceeded = append(exceeded, s.PublicKey)
+		}
+	}
+	for k, u := range a.state.Peers {
+		if present[k] {
+			continue
+		}
+		// Counted again from zero when the peer is configured again
+		u.LastReceived, u.LastTransmitted = 0, 0
+		if u.Received == 0 && u.Transmitted == 0 && !u.Exceeded {
+			delete(a.state.Peers, k)
+		}
+	}
+	return exceeded, lifted, a.save()
+}
+
+// delta returns the traffic since the last counter, which starts over when
+// it went backwards
+func delta(counter, last int64) int64 {
+	if counter < last {
+		return counter
+	}
+	return counter - last
+}
+
+func (a *Accounting) save() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return errors.Wrap(err, "Could not create traffic usage directory")
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "Could not write traffic usage")
+	}
+	return errors.Wrap(os.Rename(tmp, a.path), "Could not write traffic usage")
+}
+
+// Exceeded reports whether the peer exceeded the quota this period
+func (a *Accounting) Exceeded(key wgtypes.Key) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.state.Peers[key.String()]
+	return ok && u.Exceeded
+}
+
+// Usage returns the usage of the current period by public key
+func (a *Accounting) Usage() map[string]status.PeerUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage := make(map[string]status.PeerUsage, len(a.state.Peers))
+	for k, u := range a.state.Peers {
+		usage[k] = status.PeerUsage{
+			Since:       a.state.Start,
+			Received:    u.Received,
+			Transmitted: u.Transmitted,
+			Quota:       a.quota,
+			Exceeded:    u.Exceeded,
+		}
+	}
+	return usage
+}
+
+// Collect writes the usage metrics
+func (a *Accounting) Collect(m *status.Metrics) {
+	usage := a.Usage()
+	keys := make([]string, 0, len(usage))
+	for k := range usage {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	period := status.Label("period", a.period)
+	var rx, tx, exceeded []status.Sample
+	for _, k := range keys {
+		labels := status.Label("public_key", k) + "," + period
+		rx = append(rx, status.Sample{Labels: labels, Value: float64(usage[k].Received)})
+		tx = append(tx, status.Sample{Labels: labels, Value: float64(usage[k].Transmitted)})
+		if a.quota > 0 {
+			v := 0.0
+			if usage[k].Exceeded {
+				v = 1
+			}
+			exceeded = append(exceeded, status.Sample{Labels: labels, Value: v})
+		}
+	}
+	m.Write("wireguard_overlay_peer_period_receive_bytes", "gauge", "Bytes received from the peer in the current accounting period.", rx...)
+	m.Write("wireguard_overlay_peer_period_transmit_bytes", "gauge", "Bytes sent to the peer in the current accounting period.", tx...)
+	if a.quota > 0 {
+		m.Write("wireguard_overlay_peer_quota_exceeded", "gauge", "1 if the peer exceeded its traffic quota in the current period.", exceeded...)
+	}
+}
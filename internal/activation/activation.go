@@ -0,0 +1,54 @@
+// Package activation takes over the sockets that systemd passes to a socket
+// activated service, so that it can serve privileged ports without root,
+// start on demand and keep accepting connections across restarts.
+package activation
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// The first passed file descriptor, after stdin, stdout and stderr
+const listenFdsStart = 3
+
+// Listeners returns the passed sockets by their FileDescriptorName. It
+// returns nothing unless the process was socket activated, and unsets the
+// environment so that child processes do not take the sockets as well.
+func Listeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not use passed socket %s", name)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
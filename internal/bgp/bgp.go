@@ -0,0 +1,271 @@
+// Package bgp announces routes to BGP neighbors, e.g. a local gobgpd, bird or
+// FRR that installs them and passes them on to the rest of the network. It
+// only announces: the routes the neighbors send are ignored.
+package bgp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var log = logging.For("bgp")
+
+const (
+	defaultPort  = 179
+	holdTime     = 90
+	dialTimeout  = 10 * time.Second
+	connectRetry = 30 * time.Second
+)
+
+// Route is a network reachable through the next hop
+type Route struct {
+	Dst     net.IPNet
+	NextHop net.IP
+}
+
+// Speaker keeps a session with every neighbor and announces the routes to
+// them. Routes are withdrawn when a session ends, so they disappear with the
+// speaker.
+type Speaker struct {
+	asn, peerASN uint32
+	routerID     [4]byte
+	neighbors    []string
+	mu           sync.Mutex
+	routes       map[string]Route
+	// changed wakes up the session of each neighbor
+	changed []chan struct{}
+	closed  chan struct{}
+}
+
+// New returns a speaker in AS asn for the neighbors, host[:port], in AS
+// peerASN. The sessions start with Run.
+func New(asn, peerASN uint32, routerID net.IP, neighbors []string) (*Speaker, error) {
+	id := routerID.To4()
+	if id == nil {
+		return nil, errors.Errorf("BGP router ID %s is not an IPv4 address", routerID)
+	}
+	if asn == 0 || peerASN == 0 {
+		return nil, errors.New("BGP AS numbers must not be 0")
+	}
+	s := &Speaker{
+		asn:     asn,
+		peerASN: peerASN,
+		routes:  make(map[string]Route),
+		closed:  make(chan struct{}),
+	}
+	copy(s.routerID[:], id)
+	for _, n := range neighbors {
+		if _, _, err := net.SplitHostPort(n); err != nil {
+			n = net.JoinHostPort(n, strconv.Itoa(defaultPort))
+		}
+		s.neighbors = append(s.neighbors, n)
+		s.changed = append(s.changed, make(chan struct{}, 1))
+	}
+	return s, nil
+}
+
+// Run connects to the neighbors, and reconnects until the speaker is closed
+func (s *Speaker) Run() {
+	for i := range s.neighbors {
+		go s.run(s.neighbors[i], s.changed[i])
+	}
+}
+
+// Announce replaces the announced routes
+func (s *Speaker) Announce(routes []Route) {
+	s.mu.Lock()
+	s.routes = make(map[string]Route, len(routes))
+	for _, r := range routes {
+		s.routes[r.Dst.String()] = r
+	}
+	s.mu.Unlock()
+	for _, c := range s.changed {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close ends the sessions, withdrawing the routes
+func (s *Speaker) Close() {
+	close(s.closed)
+}
+
+func (s *Speaker) announced() map[string]Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	routes := make(map[string]Route, len(s.routes))
+	for k, r := range s.routes {
+		routes[k] = r
+	}
+	return routes
+}
+
+func (s *Speaker) run(neighbor string, changed chan struct{}) {
+	nlog := log.WithField("neighbor", neighbor)
+	for {
+		err := s.session(neighbor, changed)
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+		nlog.WithError(err).Warn("BGP session ended")
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+// session establishes a session with the neighbor and keeps the routes
+// announced to it up to date, until it fails or the speaker is closed
+func (s *Speaker) session(neighbor string, changed chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", neighbor, dialTimeout)
+	if err != nil {
+		return errors.Wrap(err, "Could not connect to BGP neighbor")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(holdTime * time.Second))
+	if _, err := conn.Write(openMessage(s.asn, holdTime, s.routerID)); err != nil {
+		return errors.Wrap(err, "Could not send BGP OPEN")
+	}
+	typ, body, err := readMessage(conn)
+	if err != nil {
+		return errors.Wrap(err, "Could not read BGP OPEN")
+	}
+	if typ == msgNotification {
+		return notificationError(body)
+	}
+	if typ != msgOpen {
+		return errors.Errorf("Unexpected BGP message type %d instead of OPEN", typ)
+	}
+	o, err := parseOpen(body)
+	if err != nil {
+		conn.Write(notificationMessage(errOpen, 0))
+		return err
+	}
+	if o.asn != s.peerASN {
+		conn.Write(notificationMessage(errOpen, errBadPeerAS))
+		return errors.Errorf("BGP neighbor is in AS %d instead of %d", o.asn, s.peerASN)
+	}
+	hold := time.Duration(holdTime) * time.Second
+	if o.holdTime < holdTime {
+		hold = time.Duration(o.holdTime) * time.Second
+	}
+	if _, err := conn.Write(keepaliveMessage()); err != nil {
+		return errors.Wrap(err, "Could not send BGP KEEPALIVE")
+	}
+	// The session is established once the neighbor confirms with a KEEPALIVE
+	if typ, body, err = readMessage(conn); err != nil {
+		return errors.Wrap(err, "Could not read BGP KEEPALIVE")
+	}
+	if typ == msgNotification {
+		return notificationError(body)
+	}
+	if typ != msgKeepalive {
+		return errors.Errorf("Unexpected BGP message type %d instead of KEEPALIVE", typ)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Any message of the neighbor resets the hold timer
+	received := make(chan error, 1)
+	alive := make(chan struct{}, 1)
+	go func() {
+		for {
+			typ, body, err := readMessage(conn)
+			if err != nil {
+				received <- err
+				return
+			}
+			if typ == msgNotification {
+				received <- notificationError(body)
+				return
+			}
+			select {
+			case alive <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	log.WithField("neighbor", neighbor).Info("BGP session established")
+
+	// A hold time of zero turns keepalives off
+	var keepalive, expiry <-chan time.Time
+	var holdTimer *time.Timer
+	if hold != 0 {
+		ticker := time.NewTicker(hold / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+		holdTimer = time.NewTimer(hold)
+		defer holdTimer.Stop()
+		expiry = holdTimer.C
+	}
+	sent := make(map[string]Route)
+	internal := s.asn == s.peerASN
+	for {
+		if err := s.sendChanges(conn, sent, internal); err != nil {
+			return err
+		}
+		select {
+		case <-s.closed:
+			conn.Write(notificationMessage(errCease, 0))
+			return nil
+		case err := <-received:
+			return err
+		case <-alive:
+			if holdTimer != nil {
+				if !holdTimer.Stop() {
+					<-holdTimer.C
+				}
+				holdTimer.Reset(hold)
+			}
+		case <-expiry:
+			conn.Write(notificationMessage(errHoldTimer, 0))
+			return errors.New("BGP hold timer expired")
+		case <-keepalive:
+			if _, err := conn.Write(keepaliveMessage()); err != nil {
+				return errors.Wrap(err, "Could not send BGP KEEPALIVE")
+			}
+		case <-changed:
+		}
+	}
+}
+
+// sendChanges announces and withdraws what changed since sent
+func (s *Speaker) sendChanges(conn net.Conn, sent map[string]Route, internal bool) error {
+	routes := s.announced()
+	for k, r := range sent {
+		if _, ok := routes[k]; ok {
+			continue
+		}
+		if _, err := conn.Write(withdrawMessage(r.Dst)); err != nil {
+			return errors.Wrap(err, "Could not send BGP UPDATE")
+		}
+		delete(sent, k)
+	}
+	for k, r := range routes {
+		if prev, ok := sent[k]; ok && prev.NextHop.Equal(r.NextHop) {
+			continue
+		}
+		if _, err := conn.Write(updateMessage(r, s.asn, internal)); err != nil {
+			return errors.Wrap(err, "Could not send BGP UPDATE")
+		}
+		sent[k] = r
+	}
+	return nil
+}
+
+func notificationError(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("BGP neighbor sent a NOTIFICATION")
+	}
+	return errors.Errorf("BGP neighbor sent a NOTIFICATION with error code %d, subcode %d", body[0], body[1])
+}
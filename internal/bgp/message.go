@@ -0,0 +1,230 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// BGP-4 as specified in RFC 4271, with the multiprotocol extensions of RFC
+// 4760, four-octet AS numbers of RFC 6793, and IPv6 next hops for IPv4 routes
+// of RFC 8950
+const (
+	version    = 4
+	headerLen  = 19
+	maxMessage = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capExtendedNH     = 5
+	capFourOctetAS    = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrLocalPref = 5
+	attrMPReach   = 14
+	attrMPUnreach = 15
+
+	flagOptional    = 0x80
+	flagTransitive  = 0x40
+	flagExtendedLen = 0x10
+
+	originIGP  = 0
+	asSequence = 2
+	// asTrans stands in for four-octet AS numbers in the OPEN
+	asTrans = 23456
+
+	// Error codes of NOTIFICATION messages
+	errOpen      = 2
+	errBadPeerAS = 2
+	errHoldTimer = 4
+	errCease     = 6
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+// message frames the body as a message of the type
+func message(typ byte, body []byte) []byte {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	copy(msg, marker)
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = typ
+	return append(msg, body...)
+}
+
+// readMessage returns the type and body of the next message
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(header[:16], marker) {
+		return 0, nil, errors.New("Invalid BGP message marker")
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMessage {
+		return 0, nil, errors.Errorf("Invalid BGP message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+func openMessage(asn uint32, holdTime uint16, routerID [4]byte) []byte {
+	var caps []byte
+	capability := func(code byte, value ...byte) {
+		caps = append(append(caps, code, byte(len(value))), value...)
+	}
+	capability(capMultiprotocol, 0, afiIPv4, 0, safiUnicast)
+	capability(capMultiprotocol, 0, afiIPv6, 0, safiUnicast)
+	capability(capExtendedNH, 0, afiIPv4, 0, safiUnicast, 0, afiIPv6)
+	as := make([]byte, 4)
+	binary.BigEndian.PutUint32(as, asn)
+	capability(capFourOctetAS, as...)
+
+	body := []byte{version, 0, 0, 0, 0}
+	as2 := uint16(asTrans)
+	if asn <= 0xffff {
+		as2 = uint16(asn)
+	}
+	binary.BigEndian.PutUint16(body[1:], as2)
+	binary.BigEndian.PutUint16(body[3:], holdTime)
+	body = append(body, routerID[:]...)
+	body = append(body, byte(2+len(caps)), paramCapabilities, byte(len(caps)))
+	return message(msgOpen, append(body, caps...))
+}
+
+// open is what matters of the OPEN of a neighbor
+type open struct {
+	asn      uint32
+	holdTime uint16
+}
+
+func parseOpen(body []byte) (*open, error) {
+	if len(body) < 10 {
+		return nil, errors.New("Truncated BGP OPEN")
+	}
+	if body[0] != version {
+		return nil, errors.Errorf("Unsupported BGP version %d", body[0])
+	}
+	o := &open{asn: uint32(binary.BigEndian.Uint16(body[1:])), holdTime: binary.BigEndian.Uint16(body[3:])}
+	params := body[10:]
+	if len(params) < int(body[9]) {
+		return nil, errors.New("Truncated BGP OPEN parameters")
+	}
+	params = params[:body[9]]
+	fourOctet := false
+	for len(params) >= 2 {
+		typ, value := params[0], params[2:]
+		if len(value) < int(params[1]) {
+			return nil, errors.New("Truncated BGP OPEN parameter")
+		}
+		value, params = value[:params[1]], value[params[1]:]
+		if typ != paramCapabilities {
+			continue
+		}
+		for len(value) >= 2 {
+			code, length := value[0], int(value[1])
+			if len(value) < 2+length {
+				return nil, errors.New("Truncated BGP capability")
+			}
+			if code == capFourOctetAS && length == 4 {
+				o.asn = binary.BigEndian.Uint32(value[2:])
+				fourOctet = true
+			}
+			value = value[2+length:]
+		}
+	}
+	if !fourOctet {
+		return nil, errors.New("BGP neighbor does not support four-octet AS numbers")
+	}
+	return o, nil
+}
+
+func notificationMessage(code, subcode byte) []byte {
+	return message(msgNotification, []byte{code, subcode})
+}
+
+func keepaliveMessage() []byte {
+	return message(msgKeepalive, nil)
+}
+
+func familyOf(ip net.IP) (uint16, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return afiIPv4, ip4
+	}
+	return afiIPv6, ip.To16()
+}
+
+// prefix encodes a network as NLRI
+func prefix(n net.IPNet) []byte {
+	ones, bits := n.Mask.Size()
+	afi, ip := familyOf(n.IP)
+	if afi == afiIPv4 && bits == 8*net.IPv6len {
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	return append([]byte{byte(ones)}, ip[:(ones+7)/8]...)
+}
+
+func attribute(flags, code byte, value []byte) []byte {
+	if len(value) > 0xff {
+		attr := []byte{flags | flagExtendedLen, code, 0, 0}
+		binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+		return append(attr, value...)
+	}
+	return append([]byte{flags, code, byte(len(value))}, value...)
+}
+
+// updateMessage announces the route, with the AS of the speaker on the path
+// unless the neighbor is in the same AS
+func updateMessage(route Route, asn uint32, internal bool) []byte {
+	afi, dst := familyOf(route.Dst.IP)
+	_, nextHop := familyOf(route.NextHop)
+	var attrs []byte
+	attrs = append(attrs, attribute(flagTransitive, attrOrigin, []byte{originIGP})...)
+	if internal {
+		attrs = append(attrs, attribute(flagTransitive, attrASPath, nil)...)
+		attrs = append(attrs, attribute(flagTransitive, attrLocalPref, []byte{0, 0, 0, 100})...)
+	} else {
+		path := []byte{asSequence, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(path[2:], asn)
+		attrs = append(attrs, attribute(flagTransitive, attrASPath, path)...)
+	}
+	reach := []byte{0, 0, safiUnicast, byte(len(nextHop))}
+	binary.BigEndian.PutUint16(reach, afi)
+	reach = append(append(reach, nextHop...), 0)
+	reach = append(reach, prefix(net.IPNet{IP: dst, Mask: route.Dst.Mask})...)
+	attrs = append(attrs, attribute(flagOptional, attrMPReach, reach)...)
+	return update(attrs)
+}
+
+// withdrawMessage withdraws the route
+func withdrawMessage(dst net.IPNet) []byte {
+	afi, ip := familyOf(dst.IP)
+	unreach := []byte{0, 0, safiUnicast}
+	binary.BigEndian.PutUint16(unreach, afi)
+	unreach = append(unreach, prefix(net.IPNet{IP: ip, Mask: dst.Mask})...)
+	return update(attribute(flagOptional, attrMPUnreach, unreach))
+}
+
+// update frames the path attributes as an UPDATE without withdrawn routes or
+// IPv4 NLRI of its own
+func update(attrs []byte) []byte {
+	body := make([]byte, 4, 4+len(attrs))
+	binary.BigEndian.PutUint16(body[2:], uint16(len(attrs)))
+	return message(msgUpdate, append(body, attrs...))
+}
@@ -0,0 +1,53 @@
+// Package cleanup undoes the changes a daemon made to the host when it exits,
+// including through logrus.Fatal and panics, which skip deferred calls
+package cleanup
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu    sync.Mutex
+	steps []step
+)
+
+type step struct {
+	what string
+	undo func() error
+}
+
+func init() {
+	logrus.RegisterExitHandler(Run)
+}
+
+// Register adds a step to undo on exit. Steps run in reverse order of
+// registration.
+func Register(what string, undo func() error) {
+	mu.Lock()
+	defer mu.Unlock()
+	steps = append(steps, step{what: what, undo: undo})
+}
+
+// Run undoes the registered steps. Later calls do nothing.
+func Run() {
+	mu.Lock()
+	pending := steps
+	steps = nil
+	mu.Unlock()
+	for i := len(pending) - 1; i >= 0; i-- {
+		if err := pending[i].undo(); err != nil {
+			logrus.WithError(err).Errorf("Could not %s", pending[i].what)
+		}
+	}
+}
+
+// Recover cleans up before passing a panic on. Defer it first thing in main.
+func Recover() {
+	if r := recover(); r != nil {
+		logrus.Error("Panic: ", r)
+		Run()
+		panic(r)
+	}
+}
@@ -3,10 +3,18 @@ package config
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/jimzhong/wireguard-overlay/internal/provision"
+	"github.com/pkg/errors"
 	"github.com/stevenroose/gonfig"
 )
 
+// defaultServerPort matches the default of the port options
+const defaultServerPort = 54321
+
 // type base_config struct {
 // 	OverlayNet *network `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay network (CIDR format)" default:"fd80:dead:beef:1234::/64"`
 // 	Interface  string   `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
@@ -15,36 +23,290 @@ import (
 // }
 
 type client_config struct {
-	ConfigFile              string   `id:"config" desc:"config file"`
-	OverlayNet              *network `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay network (CIDR format)" default:"fd80:dead:beef:1234::/64"`
-	Interface               string   `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
-	LogLevel                string   `id:"log-level" desc:"set the verbosity (debug/info/warn/error)" default:"info"`
-	PrivateKey              string   `id:"private-key" desc:"private key for wireguard; must be 32 bytes base64 encoded;"`
-	ServerAddr              *net.IP  `id:"server-addr" desc:"IP address of the server"`
-	ServerPort              int      `id:"port" desc:"server's wireguard port (UDP) and peer query port (TCP)" default:"54321"`
-	ServerPubkey            string   `id:"server-pubkey" desc:"base64 encoded public key of the server"`
-	PresharedKey            string   `id:"preshared-key" desc:"base64 encoded symmetric encryption for data communication between clients"`
-	PeerRefreshIntervalSecs int      `id:"peer-refresh-interval" desc:"interval between peer refreshes in seconds" default:"20"`
+	ConfigFile                string   `id:"config" desc:"config file (JSON, YAML or TOML)"`
+	OverlayNet                *network `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay network (CIDR format)" default:"fd80:dead:beef:1234::/64"`
+	ExtraOverlayNets          []string `id:"extra-overlay-nets" desc:"further overlay networks (CIDR format), e.g. an IPv4 one besides an IPv6 overlay-net, in each of which every node derives an address as well; must be the same on all nodes"`
+	AddressSalt               string   `id:"address-salt" desc:"salt of the mesh mixed into the derivation of overlay addresses, so that a key has different addresses in different meshes; must be the same on all nodes"`
+	Interface                 string   `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
+	LogLevel                  string   `id:"log-level" desc:"set the verbosity (debug/info/warn/error)" default:"info"`
+	LogFormat                 string   `id:"log-format" desc:"log output format (text/json)" default:"text"`
+	LogLevels                 []string `id:"log-levels" desc:"levels of single subsystems overriding log-level, e.g. sync=debug"`
+	OTLPURL                   string   `id:"otlp-url" desc:"URL of an OTLP/HTTP collector to which to export traces of the peer sync, e.g. http://localhost:4318 (default: disabled)"`
+	ControlSocket             string   `id:"control-socket" desc:"unix socket for runtime control, e.g. of log levels; empty to disable" default:"/run/wireguard-overlay/client.sock"`
+	DebugPeer                 string   `id:"debug-peer" desc:"public key of a peer whose entries to log at debug level for debug-minutes after start, or when running the debug-peer command"`
+	DebugMinutes              int      `id:"debug-minutes" desc:"minutes to debug debug-peer for; 0 stops debugging with the debug-peer command" default:"10"`
+	SelfTest                  bool     `id:"self-test" desc:"check kernel wireguard with a handshake between two throwaway namespaces before setting up the interface"`
+	DryRun                    bool     `id:"dry-run" desc:"print the interface configuration, addresses, routes and peer changes that would be applied and exit, without touching the kernel"`
+	ImportWgQuick             string   `id:"import-wg-quick" desc:"wg-quick configuration whose private key (unless one is configured), listen port and peers to start from; the peers are replaced once the first sync succeeds"`
+	PrivateKey                string   `id:"private-key" desc:"private key for wireguard; must be 32 bytes base64 encoded;"`
+	KeyFile                   string   `id:"key-file" desc:"file holding the private key, created from private-key or a new key if missing; required for key rotation"`
+	KeyRotationHours          int      `id:"key-rotation-interval" desc:"rotate the key after this many hours; 0 disables rotation" default:"0"`
+	ClusterKey                string   `id:"cluster-key" desc:"base64 encoded 16, 24 or 32 byte key shared by all nodes; enables gossip discovery without a server"`
+	GossipPort                int      `id:"gossip-port" desc:"port (TCP and UDP) on which to gossip with other nodes" default:"54325"`
+	GossipJoin                []string `id:"gossip-join" desc:"host:port of nodes through which to join the gossip cluster"`
+	GossipAdvertiseAddr       string   `id:"gossip-advertise-addr" desc:"underlay address to advertise to other nodes, e.g. when behind NAT (default: detected)"`
+	Wesher                    bool     `id:"wesher" desc:"gossip as a wesher node named wesher-name, with the address wesher derives from the name, to join a wesher mesh; wesher nodes all use the same wireguard port"`
+	WesherName                string   `id:"wesher-name" desc:"name of the node among wesher nodes (default: hostname)"`
+	WesherPort                int      `id:"wesher-port" desc:"wireguard port of the wesher nodes, on which this node listens as well in wesher mode" default:"51820"`
+	ListenPortRange           string   `id:"listen-port-range" desc:"ports, first-last, from which to pick the first free one as wireguard port, e.g. to match firewall rules (default: any port the kernel picks)"`
+	WesherState               string   `id:"wesher-state" desc:"wesher cluster state file, e.g. /var/lib/wesher/state.json, from which to import the cluster key and the nodes to join unless cluster-key and gossip-join are set"`
+	Kubernetes                bool     `id:"kubernetes" desc:"publish the record of the node as annotations of its Kubernetes node and discover peers from the API server instead of a server; needs get, list and patch on nodes"`
+	KubeNode                  string   `id:"kube-node" desc:"name of the Kubernetes node, e.g. set through the downward API (default: the hostname)"`
+	KubeAdvertiseAddr         string   `id:"kube-advertise-addr" desc:"underlay address to publish for the node (default: its InternalIP)"`
+	KubePodRoutes             bool     `id:"kube-pod-routes" desc:"route the pod networks of the nodes through the overlay"`
+	DockerSubnets             []string `id:"docker-subnets" desc:"subnets, at most one IPv4 and one IPv6, from which to address the containers of this node through the wireguard-overlay Docker network and IPAM driver; the other nodes have to route them here, e.g. as routes of the node on the server (default: no driver)"`
+	ACL                       bool     `id:"acl" desc:"enforce the ACL the server distributes on traffic from the overlay, using nftables"`
+	ServerAddr                string   `id:"server-addr" desc:"IP address or hostname of the server"`
+	ServerResolveIntervalSecs int      `id:"server-resolve-interval" desc:"interval in seconds between resolving a server-addr hostname again; 0 to resolve only at startup" default:"300"`
+	ServerPort                int      `id:"port" desc:"server's wireguard port (UDP) and peer query port (TCP)" default:"54321"`
+	Transport                 string   `id:"transport" desc:"how to exchange peers with the server: over its peer API, or by reading them from transport-file without a server (http/file)" default:"http"`
+	TransportFile             string   `id:"transport-file" desc:"file holding the peers, gob encoded as served by the server, for the file transport"`
+	PeerCache                 string   `id:"peer-cache" desc:"file in which to keep the last peer list applied, which is applied at startup so that tunnels come back while the server is unreachable; empty to disable" default:"/var/lib/wireguard-overlay/client-peers.cache"`
+	ServerTLSCA               string   `id:"server-tls-ca" desc:"CA bundle (PEM) verifying the certificate of the server; enables TLS on the peer API, which the server must have enabled as well"`
+	ServerTLSName             string   `id:"server-tls-name" desc:"name to verify the certificate of the server against (default: server-addr)"`
+	TLSCert                   string   `id:"tls-cert" desc:"client certificate (PEM) to present to the server's peer API"`
+	TLSKey                    string   `id:"tls-key" desc:"key (PEM) of tls-cert"`
+	Noise                     bool     `id:"noise" desc:"secure the peer API with a Noise IK handshake authenticated by the wireguard keys; the server must have api-noise set"`
+	ServerPubkey              string   `id:"server-pubkey" desc:"base64 encoded public key of the server; learnt from the server when enrolling if not set"`
+	PresharedKey              string   `id:"preshared-key" desc:"base64 encoded symmetric encryption for data communication between clients"`
+	PeerRefreshIntervalSecs   int      `id:"peer-refresh-interval" desc:"interval between peer refreshes in seconds" default:"20"`
+	PeerRefreshMaxBackoffSecs int      `id:"peer-refresh-max-backoff" desc:"longest wait in seconds between retries while the server cannot be reached" default:"300"`
+	PeerPageSize              int      `id:"peer-page-size" desc:"fetch full peer lists this many peers per request, for large meshes over slow links (0: all at once)"`
+	PeerUpdateRate            float64  `id:"peer-update-rate" desc:"maximum number of new or changed peers applied per second; 0 for unlimited" default:"50"`
+	DrainSecs                 int      `id:"drain" desc:"seconds to keep the tunnels up for open connections when told to exit, before deregistering from the server" default:"0"`
+	ReconcileIntervalSecs     int      `id:"reconcile-interval" desc:"interval in seconds between checks that repair peers, keys and ports changed on the wireguard device by other means; 0 to disable" default:"60"`
+	PeerUpdateBurst           int      `id:"peer-update-burst" desc:"number of peers that may be applied at once before pacing kicks in" default:"100"`
+	PeerApplyBatch            int      `id:"peer-apply-batch" desc:"most peers applied to the device per call; 0 for all at once" default:"256"`
+	RequestedAddr             *net.IP  `id:"requested-addr" desc:"overlay address to request when the server allocates addresses"`
+	StatusAddr                string   `id:"status-addr" desc:"address on which to serve the status and metrics API, e.g. 127.0.0.1:9586 (default: disabled)"`
+	ProbePort                 int      `id:"probe-port" desc:"UDP port on which to probe the round trip time and loss to peers over the overlay, and answer their probes; must be the same on all nodes (default: disabled)"`
+	ProbeIntervalSecs         int      `id:"probe-interval" desc:"interval in seconds between probes of each peer" default:"10"`
+	AccountingPeriod          string   `id:"accounting-period" desc:"period over which the traffic with every peer is accounted, day or month in UTC (default: disabled)"`
+	AccountingFile            string   `id:"accounting-file" desc:"file in which the accounted traffic is kept across restarts (default: memory only)"`
+	TrafficQuotaMB            int      `id:"traffic-quota" desc:"megabytes each peer may exchange with this client per accounting period; 0 for unlimited" default:"0"`
+	QuotaAction               string   `id:"quota-action" desc:"what to do with peers over traffic-quota: log a warning, or also remove them until the period ends (alert/remove)" default:"alert"`
+	TestTimeoutSecs           int      `id:"test-timeout" desc:"seconds for which the connectivity-test command retries until its checks pass" default:"60"`
+	PortMapping               string   `id:"port-mapping" desc:"ask the router to map the wireguard port and advertise the mapped endpoint (none/upnp/natpmp/auto)" default:"none"`
+	FirewallMark              int      `id:"fwmark" desc:"firewall mark of the packets wireguard sends, for policy routing; 0 for none" default:"0"`
+	Netns                     string   `id:"netns" desc:"network namespace, by name as with ip netns or by path such as /proc/<pid>/ns/net, into which to move the interface; the encrypted traffic still uses the network of the daemon (default: none)"`
+	RoutingTable              int      `id:"routing-table" desc:"routing table to which to add the overlay routes instead of main; 0 for main" default:"0"`
+	RouteMetric               int      `id:"route-metric" desc:"metric of the routes the daemon adds, to rank them against those of other daemons; 0 for the kernel default" default:"0"`
+	RouteMarker               int      `id:"route-marker" desc:"protocol number marking the routes the daemon adds, by which it removes exactly those on exit and after an unclean one; must differ from route-protocol" default:"78"`
+	IncludeRoutes             []string `id:"include-routes" desc:"cidr=pubkey entries routing further networks through the overlay to the peer with the base64 encoded public key, e.g. 0.0.0.0/0 to an exit node; they must not cover the server address"`
+	ExcludeRoutes             []string `id:"exclude-routes" desc:"networks (CIDR format) not to route through the overlay even if peers advertise them, e.g. the LAN; the server address is never routed through it"`
+	RouteExport               string   `id:"route-export" desc:"how to route the networks peers advertise: as routes through the interface, as such routes with route-protocol for babeld to redistribute, or by announcing them to bgp-neighbors instead (static/babel/bgp)" default:"static"`
+	RouteProtocol             int      `id:"route-protocol" desc:"protocol number of the routes of peer networks with route-export babel, for babeld's redistribute proto" default:"87"`
+	BGPASN                    int      `id:"bgp-asn" desc:"AS number of the node with route-export bgp" default:"64512"`
+	BGPPeerASN                int      `id:"bgp-peer-asn" desc:"AS number of bgp-neighbors (default: bgp-asn)"`
+	BGPNeighbors              []string `id:"bgp-neighbors" desc:"host[:port] of BGP speakers, e.g. a local gobgpd, bird or FRR, to which to announce the networks of peers with route-export bgp"`
+	BGPRouterID               string   `id:"bgp-router-id" desc:"BGP identifier, an IPv4 address (default: derived from the public key)"`
+	Firewall                  string   `desc:"install firewall rules accepting wireguard and overlay traffic (none/nftables/iptables)" default:"none"`
+	FirewallOverlayPorts      []string `id:"firewall-overlay-ports" desc:"only accept new connections from the overlay on these ports, e.g. tcp/22 (default: accept all)"`
+	EnrollToken               string   `id:"enroll-token" desc:"enrollment token to present to the server if the server does not know this client yet"`
+	EnrollPort                int      `id:"enroll-port" desc:"TCP port of the server's enrollment listener" default:"54323"`
+	EnrollTLSCA               string   `id:"enroll-tls-ca" desc:"CA bundle (PEM) verifying the certificate of the server's enrollment listener, against server-tls-name; enables TLS for enrolling, which the server must have enabled as well"`
+	RelayFallback             bool     `id:"relay-fallback" desc:"relay traffic through the server to peers that cannot be reached directly; the server must have relay enabled"`
+	TCPRelay                  string   `id:"tcp-relay" desc:"host:port of the server's TCP relay through which to tunnel wireguard when UDP to the server is blocked (default: disabled)"`
+	TCPRelayTLS               bool     `id:"tcp-relay-tls" desc:"wrap the TCP relay tunnel in TLS, verifying the server certificate against the system roots"`
+	ReportFailures            bool     `id:"report-failures" desc:"report peers that cannot be reached to the server for debugging"`
+	HandshakeDiagnosis        int      `id:"handshake-diagnosis" desc:"two minute intervals a peer that is sent traffic may go without a handshake before the likely cause is logged and counted in the metrics; 0 to disable" default:"3"`
+	STUNServers               []string `id:"stun-servers" desc:"STUN servers (host:port) with which to discover the public endpoint and NAT behaviour; the NAT behaviour needs two (default: disabled)"`
+	LANEndpoints              bool     `id:"lan-endpoints" desc:"advertise the addresses of the local interfaces, so that peers on the same LAN connect directly"`
+	CaptivePortalURL          string   `id:"captive-portal-url" desc:"URL answering 204 No Content when the internet is reachable, used to detect captive portals (default: disabled)"`
+	CaptivePortalIntervalSecs int      `id:"captive-portal-interval" desc:"interval between captive portal checks in seconds" default:"60"`
+	STUNIntervalSecs          int      `id:"stun-interval" desc:"interval between STUN checks in seconds; 0 checks only at startup" default:"300"`
+	NAT64Prefix               string   `id:"nat64-prefix" desc:"IPv6 /96 prefix through which to reach IPv4 endpoints; auto discovers it via DNS64 when there is no IPv4 route (auto/none/prefix)" default:"auto"`
+	Overlays                  []string `id:"overlays" desc:"config files of further overlays to join, each with its own interface, key, network and server"`
+	Metadata                  []string `id:"metadata" desc:"name=value labels of this client passed on to the other peers, e.g. datacenter=fra1, role=db or owner=alice"`
 }
 
+// ClientConfig is the config of one overlay of the client
+type ClientConfig = client_config
+
 type server_config struct {
-	ConfigFile    string   `id:"config" desc:"config file"`
-	OverlayNet    *network `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay network (CIDR format)" default:"fd80:dead:beef:1234::/64"`
-	Interface     string   `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
-	LogLevel      string   `id:"log-level" desc:"set the verbosity (debug/info/warn/error)" default:"info"`
-	PrivateKey    string   `id:"private-key" desc:"private key for wireguard; must be 32 bytes base64 encoded;"`
-	Port          int      `id:"port" desc:"wireguard listen port (UDP) and peer query listen port (TCP)" default:"54321"`
-	ClientPubkeys []string `id:"client-pubkeys" desc:"base64 encoded public keys of the clients"`
+	ConfigFile                string   `id:"config" desc:"config file (JSON, YAML or TOML)"`
+	OverlayNet                *network `id:"overlay-net" desc:"the network in which to allocate addresses for the overlay network (CIDR format)" default:"fd80:dead:beef:1234::/64"`
+	ExtraOverlayNets          []string `id:"extra-overlay-nets" desc:"further overlay networks (CIDR format), e.g. an IPv4 one besides an IPv6 overlay-net, in each of which every node derives an address as well; must be the same on all nodes"`
+	AddressSalt               string   `id:"address-salt" desc:"salt of the mesh mixed into the derivation of overlay addresses, so that a key has different addresses in different meshes; must be the same on all nodes"`
+	Interface                 string   `desc:"name of the wireguard interface to create and manage" default:"wgoverlay"`
+	LogLevel                  string   `id:"log-level" desc:"set the verbosity (debug/info/warn/error)" default:"info"`
+	LogFormat                 string   `id:"log-format" desc:"log output format (text/json)" default:"text"`
+	LogLevels                 []string `id:"log-levels" desc:"levels of single subsystems overriding log-level, e.g. rotation=debug"`
+	OTLPURL                   string   `id:"otlp-url" desc:"URL of an OTLP/HTTP collector to which to export traces of the peer sync, e.g. http://localhost:4318 (default: disabled)"`
+	ControlSocket             string   `id:"control-socket" desc:"unix socket for runtime control, e.g. of log levels; empty to disable" default:"/run/wireguard-overlay/server.sock"`
+	DebugPeer                 string   `id:"debug-peer" desc:"public key of a peer whose entries to log at debug level for debug-minutes after start, or when running the debug-peer command"`
+	DebugMinutes              int      `id:"debug-minutes" desc:"minutes to debug debug-peer for; 0 stops debugging with the debug-peer command" default:"10"`
+	MobileEndpoint            string   `id:"mobile-endpoint" desc:"underlay host:port at which the wireguard apps reach the server, written into the configs of the mobile-peer command"`
+	MobileHostname            string   `id:"mobile-hostname" desc:"hostname of the peer provisioned by the mobile-peer command"`
+	MobileGroups              []string `id:"mobile-groups" desc:"groups of the peer provisioned by the mobile-peer command"`
+	MobileConfig              string   `id:"mobile-config" desc:"file to which the mobile-peer command writes the wg-quick config, with mode 0600 (default: stdout)"`
+	SelfTest                  bool     `id:"self-test" desc:"check kernel wireguard with a handshake between two throwaway namespaces before setting up the interface"`
+	DryRun                    bool     `id:"dry-run" desc:"print the interface configuration, addresses, routes and peer changes that would be applied and exit, without touching the kernel"`
+	PrivateKey                string   `id:"private-key" desc:"private key for wireguard; must be 32 bytes base64 encoded;"`
+	Port                      int      `id:"port" desc:"wireguard listen port (UDP) and peer query listen port (TCP)" default:"54321"`
+	ClientPubkeys             []string `id:"client-pubkeys" desc:"base64 encoded public keys of the clients"`
+	ClientPubkeysFile         string   `id:"client-pubkeys-file" desc:"file listing further public keys of clients, one per line; it is read again when it changes, and clients removed from it are evicted"`
+	PeerUpdateRate            float64  `id:"peer-update-rate" desc:"maximum number of new or changed peers applied per second; 0 for unlimited" default:"50"`
+	APIRate                   float64  `id:"api-rate" desc:"requests per second each address and each peer may send to the peer API on average; 0 for unlimited" default:"10"`
+	APIBurst                  int      `id:"api-burst" desc:"requests each address and each peer may send to the peer API at once, beyond api-rate" default:"50"`
+	APIMaxConns               int      `id:"api-max-conns" desc:"open connections to the peer API at most; 0 for unlimited" default:"4096"`
+	APIMaxConnsPerIP          int      `id:"api-max-conns-per-ip" desc:"open connections to the peer API from one address at most; 0 for unlimited" default:"16"`
+	APITLSCert                string   `id:"api-tls-cert" desc:"certificate (PEM) of the peer API; enables TLS with client certificates, which all clients must then use"`
+	APITLSKey                 string   `id:"api-tls-key" desc:"key (PEM) of api-tls-cert"`
+	APITLSClientCA            string   `id:"api-tls-client-ca" desc:"CA bundle (PEM) verifying the certificates of clients"`
+	APITLSIdentities          []string `id:"api-tls-identities" desc:"san=pubkey entries allowing a client certificate with the DNS, email, URI or IP SAN to act as the peer; a SAN may be listed for several peers (default: any certificate of the CA for any peer)"`
+	APINoise                  bool     `id:"api-noise" desc:"require a Noise IK handshake authenticated by the wireguard keys on the peer API, which all clients must then set noise for"`
+	Transport                 string   `id:"transport" desc:"transport over which the peer API answers the clients; they must use the same" default:"http"`
+	RegistrationWindowSecs    int      `id:"registration-window" desc:"seconds a signed registration may be off the clock of the server before it is rejected as a replay" default:"120"`
+	RequireSignedRegistration bool     `id:"require-signed-registration" desc:"reject registrations that are not signed with the key of the client, as sent by older clients"`
+	VerifyEndpointsPort       int      `id:"verify-endpoints" desc:"probe-port of the clients, to which cookies are sent to verify the endpoints they claim before handing them out; 0 hands them out unverified" default:"0"`
+	PeerRecordTTLSecs         int      `id:"peer-record-ttl" desc:"seconds for which distributed peer records are valid; clients remove peers whose records lapse, even without contact to the server. 0 distributes records without expiry" default:"0"`
+	PeerTTLSecs               int      `id:"peer-ttl" desc:"seconds within which peers must register again, or be marked offline and no longer distributed until they do; 0 keeps them" default:"0"`
+	ReconcileIntervalSecs     int      `id:"reconcile-interval" desc:"interval in seconds between checks that repair peers, keys and ports changed on the wireguard device by other means; 0 to disable" default:"60"`
+	PeerUpdateBurst           int      `id:"peer-update-burst" desc:"number of peers that may be applied at once before pacing kicks in" default:"100"`
+	PeerApplyBatch            int      `id:"peer-apply-batch" desc:"most peers applied to the device per call; 0 for all at once" default:"256"`
+	StatusAddr                string   `id:"status-addr" desc:"address on which to serve the status and metrics API, e.g. 127.0.0.1:9586 (default: disabled)"`
+	AccountingPeriod          string   `id:"accounting-period" desc:"period over which the traffic with every client is accounted, day or month in UTC (default: disabled)"`
+	AccountingFile            string   `id:"accounting-file" desc:"file in which the accounted traffic is kept across restarts (default: memory only)"`
+	TrafficQuotaMB            int      `id:"traffic-quota" desc:"megabytes each client may exchange with the server per accounting period; 0 for unlimited" default:"0"`
+	QuotaAction               string   `id:"quota-action" desc:"what to do with clients over traffic-quota: emit a quota_exceeded event, or also leave them out of the peer lists until the period ends (alert/remove)" default:"alert"`
+	PeerGroups                []string `id:"peer-groups" desc:"tag clients with groups as group:pubkey entries"`
+	GroupPolicy               []string `id:"group-policy" desc:"receiver:visible group entries controlling which peers each client receives; * matches any group (default: everyone sees everyone)"`
+	Topology                  string   `id:"topology" desc:"which clients configure each other directly: all (mesh), only the server (hub), or those adjacent per topology-adjacency (custom); the others are reached through the server, which needs relay (mesh/hub/custom)" default:"mesh"`
+	TopologyAdjacency         []string `id:"topology-adjacency" desc:"group:group entries whose members mesh directly in the custom topology, or same for peers sharing a group; * matches any group"`
+	RegionHubs                []string `id:"region-hubs" desc:"region=pubkey entries of the clients that forward overlay traffic between regions; clients reach the others through the hub of their region label, or the nearest hub"`
+	ACL                       []string `id:"acl" desc:"allow|deny src dst [proto[/port]] rules on new connections between groups, e.g. allow web db tcp/5432, enforced by clients with acl set; the first match decides, unmatched connections are accepted"`
+	AddressMode               string   `id:"address-mode" desc:"how client addresses are assigned: derived from public keys or allocated by the server (derived/ipam)" default:"derived"`
+	GroupPrefixes             []string `id:"group-prefixes" desc:"group:cidr entries allocating the addresses of group members within the prefix in ipam address mode; the first matching group wins"`
+	AddressVersion            int      `id:"address-version" desc:"address derivation version to move the mesh to once every client supports it, in derived address mode" default:"1"`
+	LeasesFile                string   `id:"leases-file" desc:"file in which to persist allocated addresses in ipam address mode" default:"/var/lib/wireguard-overlay/leases.json"`
+	PeersFile                 string   `id:"peers-file" desc:"file in which to persist peers approved, revoked or annotated through the admin API" default:"/var/lib/wireguard-overlay/peers.json"`
+	PeersStore                string   `id:"peers-store" desc:"where to keep the peer records: file (peers-file), etcd or consul; servers sharing an etcd or Consul store see each other's changes" default:"file"`
+	PeersStoreEndpoints       []string `id:"peers-store-endpoints" desc:"URLs of the etcd or Consul servers, e.g. https://etcd1:2379, tried in turn"`
+	PeersStorePrefix          string   `id:"peers-store-prefix" desc:"key prefix of the peer records in etcd or Consul" default:"wireguard-overlay/peers/"`
+	PeersStoreToken           string   `id:"peers-store-token" desc:"Consul ACL token, or user:password for etcd"`
+	PeersStoreCA              string   `id:"peers-store-ca" desc:"CA certificates (PEM) to verify the etcd or Consul servers with (default: the system roots)"`
+	ReplicaPeers              []string `id:"replica-peers" desc:"URLs of the replica APIs of the other servers sharing the key, overlay and peer store, e.g. http://10.1.0.2:54326, with which to exchange registrations"`
+	ReplicaAddr               string   `id:"replica-addr" desc:"comma separated addresses on which to serve the replica API to the other replicas"`
+	ReplicaToken              string   `id:"replica-token" desc:"bearer token the replicas authenticate each other with"`
+	ReplicaID                 string   `id:"replica-id" desc:"name of this replica (default: the hostname)"`
+	ReplicaEndpoint           string   `id:"replica-endpoint" desc:"underlay host:port at which clients reach this replica, announced to them for failing over"`
+	Relay                     bool     `desc:"forward traffic between clients that cannot reach each other directly"`
+	TCPRelayAddr              string   `id:"tcp-relay-addr" desc:"address on which to accept wireguard tunnelled over TCP from clients whose UDP is blocked, e.g. :443 (default: disabled)"`
+	TCPRelayCert              string   `id:"tcp-relay-cert" desc:"TLS certificate file of the TCP relay; TLS is used if set"`
+	TCPRelayKey               string   `id:"tcp-relay-key" desc:"TLS key file of the TCP relay"`
+	AlertWebhook              string   `id:"alert-webhook" desc:"URL to which to post JSON alerts, e.g. when the mesh partitions (default: log only)"`
+	EventWebhook              string   `id:"event-webhook" desc:"URL to which to post peer lifecycle events as JSON, e.g. registrations, evictions and revocations (default: disabled)"`
+	AuditLog                  string   `id:"audit-log" desc:"file to which to append peer lifecycle events as JSON lines (default: disabled)"`
+	AdminAddr                 string   `id:"admin-addr" desc:"comma separated addresses on which to serve the admin API, e.g. 127.0.0.1:54322,[::1]:54322; hosts may be interface names but not wildcards (default: disabled)"`
+	AdminToken                string   `id:"admin-token" desc:"bearer token required by the admin API"`
+	AdminDashboard            bool     `id:"admin-dashboard" desc:"serve a web dashboard of the mesh at the root of the admin API; it asks for the admin token in the browser"`
+	EnrollAddr                string   `id:"enroll-addr" desc:"comma separated underlay addresses on which new clients enroll with tokens minted through the admin API and bootstrap, e.g. :54323 or eth0:54323 (default: disabled)"`
+	EnrollTLSCert             string   `id:"enroll-tls-cert" desc:"certificate (PEM) of the enrollment listener; enables TLS, which clients must then use with enroll-tls-ca"`
+	EnrollTLSKey              string   `id:"enroll-tls-key" desc:"key (PEM) of enroll-tls-cert"`
+	TokensFile                string   `id:"tokens-file" desc:"file in which to persist enrollment tokens" default:"/var/lib/wireguard-overlay/tokens.json"`
+	FirewallMark              int      `id:"fwmark" desc:"firewall mark of the packets wireguard sends, for policy routing; 0 for none" default:"0"`
+	Netns                     string   `id:"netns" desc:"network namespace, by name as with ip netns or by path such as /proc/<pid>/ns/net, into which to move the interface; the encrypted traffic still uses the network of the daemon (default: none)"`
+	RoutingTable              int      `id:"routing-table" desc:"routing table to which to add the overlay routes instead of main; 0 for main" default:"0"`
+	RouteMetric               int      `id:"route-metric" desc:"metric of the routes the daemon adds, to rank them against those of other daemons; 0 for the kernel default" default:"0"`
+	RouteMarker               int      `id:"route-marker" desc:"protocol number marking the routes the daemon adds, by which it removes exactly those on exit and after an unclean one" default:"78"`
+	Firewall                  string   `desc:"install firewall rules accepting wireguard and overlay traffic (none/nftables/iptables)" default:"none"`
+	FirewallOverlayPorts      []string `id:"firewall-overlay-ports" desc:"only accept new connections from the overlay on these ports, e.g. tcp/22 (default: accept all)"`
+}
+
+type exporter_config struct {
+	ConfigFile string `id:"config" desc:"config file (JSON, YAML or TOML)"`
+	Interface  string `desc:"name of the existing wireguard interface to export" default:"wg0"`
+	LogLevel   string `id:"log-level" desc:"set the verbosity (debug/info/warn/error)" default:"info"`
+	StatusAddr string `id:"status-addr" desc:"address on which to serve the status and metrics API" default:"127.0.0.1:9586"`
+}
+
+type meshctl_config struct {
+	ConfigFile         string   `id:"config" desc:"config file (JSON, YAML or TOML)"`
+	AdminURL           string   `id:"admin-url" desc:"URL of the server admin API" default:"http://127.0.0.1:54322"`
+	AdminToken         string   `id:"admin-token" desc:"bearer token of the admin API"`
+	Key                string   `desc:"base64 encoded public key of the peer to act on"`
+	Hostname           string   `desc:"hostname to set on the peer"`
+	Routes             []string `desc:"routes (CIDR format) to set on the peer"`
+	Groups             []string `desc:"groups to set on the peer"`
+	Annotations        []string `desc:"annotations (name=value) to set on the peer; an empty value removes one"`
+	Address            string   `desc:"overlay address to renumber the peer to"`
+	WindowSecs         int      `id:"window" desc:"seconds during which the previous address stays valid when renumbering" default:"600"`
+	TTLSecs            int      `id:"ttl" desc:"lifetime of minted enrollment tokens in seconds; 0 for no expiry" default:"86400"`
+	Uses               int      `desc:"number of enrollments a minted token allows; 0 for unlimited" default:"1"`
+	Group              string   `desc:"group whose peers to restart; * for all"`
+	RestartTimeoutSecs int      `id:"restart-timeout" desc:"seconds each peer has to come back healthy during a rolling restart" default:"300"`
+}
+
+// EnvPrefix is the prefix of the environment variables setting options, e.g.
+// WGOVERLAY_LOG_LEVEL for log-level
+const EnvPrefix = "WGOVERLAY_"
+
+// fileDecoders are the supported config file formats by extension
+var fileDecoders = map[string]gonfig.FileDecoderFn{
+	".json": gonfig.DecoderJSON,
+	".yaml": gonfig.DecoderYAML,
+	".yml":  gonfig.DecoderYAML,
+	".toml": gonfig.DecoderTOML,
+}
+
+func decoderFor(path string) gonfig.FileDecoderFn {
+	if d, ok := fileDecoders[strings.ToLower(filepath.Ext(path))]; ok {
+		return d
+	}
+	return gonfig.DecoderTryAll
+}
+
+// configPath returns the config file given with --config or in the
+// environment, or else the default file of the component in the first format
+// that exists
+func configPath(component string) string {
+	for i, arg := range os.Args[1:] {
+		if (arg == "--config" || arg == "-config") && i+2 < len(os.Args) {
+			return os.Args[i+2]
+		} else if strings.HasPrefix(arg, "--config=") || strings.HasPrefix(arg, "-config=") {
+			return arg[strings.Index(arg, "=")+1:]
+		}
+	}
+	if path, ok := os.LookupEnv(EnvPrefix + "CONFIG"); ok {
+		return path
+	}
+	file := components[component].file
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return file
+}
+
+// load reads the config of the component from its file, then from the
+// environment and then from the command line, each overriding the former
+func load(component string, config interface{}) error {
+	path := configPath(component)
+	return gonfig.Load(config, gonfig.Conf{
+		ConfigFileVariable:  "config",
+		FileDecoder:         decoderFor(path),
+		FileDefaultFilename: path,
+		EnvPrefix:           EnvPrefix,
+	})
+}
+
+// components are the programs with a config file
+var components = map[string]struct {
+	config func() interface{}
+	file   string
+}{
+	"server":   {func() interface{} { return &server_config{} }, "/etc/wireguard-overlay/server.json"},
+	"client":   {func() interface{} { return &client_config{} }, "/etc/wireguard-overlay/client.json"},
+	"exporter": {func() interface{} { return &exporter_config{} }, "/etc/wireguard-overlay/exporter.json"},
+	"meshctl":  {func() interface{} { return &meshctl_config{} }, "/etc/wireguard-overlay/meshctl.json"},
 }
 
 func LoadServerConfig() (*server_config, error) {
 	var config server_config
-	err := gonfig.Load(&config, gonfig.Conf{
-		ConfigFileVariable:  "config",
-		FileDecoder:         gonfig.DecoderJSON,
-		FileDefaultFilename: "/etc/wireguard-overlay/server.json",
-		EnvDisable:          true})
-	if err != nil {
+	if err := load("server", &config); err != nil {
 		return nil, err
 	}
 	return &config, nil
@@ -52,19 +314,95 @@ func LoadServerConfig() (*server_config, error) {
 
 func LoadClientConfig() (*client_config, error) {
 	var config client_config
-	err := gonfig.Load(&config, gonfig.Conf{
-		ConfigFileVariable:  "config",
-		FileDecoder:         gonfig.DecoderJSON,
-		FileDefaultFilename: "/etc/wireguard-overlay/client.json",
-		EnvDisable:          true})
+	if err := load("client", &config); err != nil {
+		return nil, err
+	}
+	if err := applyProvisioned(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// LoadClientOverlay reads the config of a further overlay from its file only;
+// the environment and the command line apply to the main overlay
+func LoadClientOverlay(path string) (*client_config, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Wrapf(err, "Could not load overlay %s", path)
+	}
+	var config client_config
+	if err := gonfig.Load(&config, gonfig.Conf{
+		FileDecoder:         decoderFor(path),
+		FileDefaultFilename: path,
+		FlagDisable:         true,
+		EnvDisable:          true,
+	}); err != nil {
+		return nil, errors.Wrapf(err, "Could not load overlay %s", path)
+	}
+	if len(config.Overlays) != 0 {
+		return nil, errors.Errorf("Overlay %s lists overlays itself", path)
+	}
+	return &config, nil
+}
+
+// applyProvisioned fills the options that were left unset, or at their
+// default, with the defaults compiled into the binary
+func applyProvisioned(config *client_config) error {
+	d, err := provision.Load()
 	if err != nil {
+		return err
+	}
+	for _, v := range []struct {
+		value string
+		to    *string
+	}{
+		{d.ServerAddr, &config.ServerAddr},
+		{d.ServerPubkey, &config.ServerPubkey},
+		{d.EnrollToken, &config.EnrollToken},
+		{d.KeyFile, &config.KeyFile},
+	} {
+		if *v.to == "" {
+			*v.to = v.value
+		}
+	}
+	if d.ServerPort != 0 && config.ServerPort == defaultServerPort {
+		config.ServerPort = d.ServerPort
+	}
+	return nil
+}
+
+func LoadExporterConfig() (*exporter_config, error) {
+	var config exporter_config
+	if err := load("exporter", &config); err != nil {
 		return nil, err
 	}
 	return &config, nil
 }
 
+func LoadMeshctlConfig() (*meshctl_config, error) {
+	var config meshctl_config
+	if err := load("meshctl", &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Subcommand removes a leading subcommand (such as support-bundle) from the
+// command line so that the remaining flags can be parsed as usual
+func Subcommand() string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return ""
+	}
+	cmd := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	return cmd
+}
+
 type network net.IPNet
 
+func (n *network) String() string {
+	return (*net.IPNet)(n).String()
+}
+
 // UnmarshalText parses the provided byte array into the network receiver
 func (n *network) UnmarshalText(data []byte) error {
 	_, ipnet, err := net.ParseCIDR(string(data))
@@ -77,3 +415,33 @@ func (n *network) UnmarshalText(data []byte) error {
 	*n = network(*ipnet)
 	return nil
 }
+
+// ExtraNetworks parses extra-overlay-nets
+func (c *client_config) ExtraNetworks() ([]net.IPNet, error) {
+	return extraNetworks(c.OverlayNet, c.ExtraOverlayNets)
+}
+
+// ExtraNetworks parses extra-overlay-nets
+func (c *server_config) ExtraNetworks() ([]net.IPNet, error) {
+	return extraNetworks(c.OverlayNet, c.ExtraOverlayNets)
+}
+
+// extraNetworks parses the further overlay networks, which must not overlap
+// each other or the overlay network
+func extraNetworks(overlayNet *network, cidrs []string) ([]net.IPNet, error) {
+	nets := []net.IPNet{net.IPNet(*overlayNet)}
+	for _, c := range cidrs {
+		var n network
+		if err := n.UnmarshalText([]byte(c)); err != nil {
+			return nil, errors.Wrapf(err, "Invalid overlay network %q", c)
+		}
+		extra := net.IPNet(n)
+		for _, other := range nets {
+			if other.Contains(extra.IP) || extra.Contains(other.IP) {
+				return nil, errors.Errorf("Overlay network %s overlaps %s", &extra, &other)
+			}
+		}
+		nets = append(nets, extra)
+	}
+	return nets[1:], nil
+}
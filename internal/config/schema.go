@@ -0,0 +1,250 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/stevenroose/gonfig"
+)
+
+// Property is the JSON schema of a config option
+type Property struct {
+	Type        string      `json:"type"`
+	Format      string      `json:"format,omitempty"`
+	Items       *Property   `json:"items,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// JSONSchema is the schema of a config file
+type JSONSchema struct {
+	Schema               string              `json:"$schema"`
+	Title                string              `json:"title"`
+	Type                 string              `json:"type"`
+	Properties           map[string]Property `json:"properties"`
+	AdditionalProperties bool                `json:"additionalProperties"`
+}
+
+var (
+	typeOfNetwork = reflect.TypeOf(&network{})
+	typeOfIP      = reflect.TypeOf(&net.IP{})
+)
+
+// Schema returns the schema of the config file of the component (client,
+// server, exporter or meshctl)
+func Schema(component string) (JSONSchema, error) {
+	c, ok := components[component]
+	if !ok {
+		return JSONSchema{}, errors.Errorf("Unknown component %q", component)
+	}
+	schema := JSONSchema{
+		Schema:     "http://json-schema.org/draft-07/schema#",
+		Title:      "wireguard-overlay " + component + " config",
+		Type:       "object",
+		Properties: make(map[string]Property),
+	}
+	t := reflect.TypeOf(c.config()).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		id := f.Tag.Get("id")
+		if id == "" {
+			id = strings.ToLower(f.Name)
+		}
+		if id == "config" {
+			// Only read from the command line
+			continue
+		}
+		p, err := property(f.Type)
+		if err != nil {
+			return JSONSchema{}, errors.Wrapf(err, "Option %s", id)
+		}
+		p.Description = f.Tag.Get("desc")
+		if d, ok := f.Tag.Lookup("default"); ok {
+			p.Default = defaultValue(p, d)
+		}
+		schema.Properties[id] = p
+	}
+	return schema, nil
+}
+
+func property(t reflect.Type) (Property, error) {
+	switch {
+	case t == typeOfNetwork:
+		return Property{Type: "string", Format: "cidr"}, nil
+	case t == typeOfIP:
+		return Property{Type: "string", Format: "ip"}, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return Property{Type: "string"}, nil
+	case reflect.Bool:
+		return Property{Type: "boolean"}, nil
+	case reflect.Int:
+		return Property{Type: "integer"}, nil
+	case reflect.Float64:
+		return Property{Type: "number"}, nil
+	case reflect.Slice:
+		items, err := property(t.Elem())
+		if err != nil {
+			return Property{}, err
+		}
+		return Property{Type: "array", Items: &items}, nil
+	}
+	return Property{}, errors.Errorf("Unsupported type %s", t)
+}
+
+func defaultValue(p Property, d string) interface{} {
+	switch p.Type {
+	case "integer":
+		if v, err := strconv.Atoi(d); err == nil {
+			return v
+		}
+	case "number":
+		if v, err := strconv.ParseFloat(d, 64); err == nil {
+			return v
+		}
+	case "boolean":
+		if v, err := strconv.ParseBool(d); err == nil {
+			return v
+		}
+	}
+	return d
+}
+
+// Validate checks the config file at path against the schema of the component
+// and loads it like the component would, without starting anything
+func Validate(component, path string) []error {
+	schema, err := Schema(component)
+	if err != nil {
+		return []error{err}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []error{errors.Wrap(err, "Could not read config file")}
+	}
+	decoded, err := decoderFor(path)(data)
+	if err != nil {
+		return []error{errors.Wrap(err, "Could not decode config file")}
+	}
+	// Checked as JSON, whatever the format of the file
+	var file map[string]interface{}
+	if data, err = json.Marshal(decoded); err == nil {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return []error{errors.Wrap(err, "Could not decode config file")}
+	}
+	keys := make([]string, 0, len(file))
+	for k := range file {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var errs []error
+	for _, k := range keys {
+		p, ok := schema.Properties[k]
+		if !ok {
+			errs = append(errs, errors.Errorf("%s: unknown option", k))
+			continue
+		}
+		if err := check(p, file[k]); err != nil {
+			errs = append(errs, errors.Errorf("%s: %s", k, err))
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	// Catches what the schema cannot express, e.g. the size of the overlay
+	if err := gonfig.Load(components[component].config(), gonfig.Conf{
+		FileDecoder:         decoderFor(path),
+		FileDefaultFilename: path,
+		FlagDisable:         true,
+		EnvDisable:          true,
+		HelpDisable:         true}); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func check(p Property, v interface{}) error {
+	switch p.Type {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return errors.Errorf("expected a string, got %v", v)
+		}
+		switch p.Format {
+		case "cidr":
+			if _, _, err := net.ParseCIDR(s); err != nil {
+				return errors.Errorf("invalid CIDR %q", s)
+			}
+		case "ip":
+			if net.ParseIP(s) == nil {
+				return errors.Errorf("invalid IP address %q", s)
+			}
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return errors.Errorf("expected a boolean, got %v", v)
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return errors.Errorf("expected an integer, got %v", v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return errors.Errorf("expected a number, got %v", v)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return errors.Errorf("expected an array, got %v", v)
+		}
+		for i, item := range items {
+			if err := check(*p.Items, item); err != nil {
+				return errors.Errorf("item %d: %s", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RunCommand runs the config subcommand of the component: schema prints the
+// schema of its config file, validate checks a config file given with
+// --config, or the default one
+func RunCommand(component string) error {
+	switch action := Subcommand(); action {
+	case "schema":
+		schema, err := Schema(component)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	case "validate":
+		path := configPath(component)
+		errs := Validate(component, path)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		}
+		if len(errs) != 0 {
+			return errors.Errorf("Config file %s is invalid", path)
+		}
+		fmt.Printf("%s is valid\n", path)
+		return nil
+	default:
+		return errors.Errorf("Unknown config command %q; expected schema or validate", action)
+	}
+}
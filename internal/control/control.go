@@ -0,0 +1,119 @@
+// Package control serves the runtime control API of a daemon on a unix
+// socket. Only users that can open the socket, which is created with mode
+// 0600, can use it.
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LogPath gets and sets the log levels
+	LogPath = "/log"
+	// DebugPath starts and stops debugging a peer
+	DebugPath = "/debug"
+	// PeersPath lists the peers with their status
+	PeersPath = "/peers"
+	// SyncPath reports the state of the sync with the server
+	SyncPath = "/sync"
+	// MobilePath provisions a static peer for the wireguard apps
+	MobilePath = "/mobile"
+)
+
+// Server is the control API of a daemon
+type Server struct {
+	mux    *http.ServeMux
+	server *http.Server
+	path   string
+}
+
+// Listen creates the socket at path, replacing a stale one
+func Listen(path string) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "Could not create control socket directory")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Could not remove stale control socket")
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not listen on control socket")
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "Could not restrict control socket")
+	}
+	s := &Server{mux: http.NewServeMux(), path: path}
+	s.server = &http.Server{Handler: s.mux, ReadTimeout: 3 * time.Second}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Control socket stopped")
+		}
+	}()
+	return s, nil
+}
+
+// Handle adds a handler to the control API
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() error {
+	err := s.server.Close()
+	os.Remove(s.path)
+	return err
+}
+
+// Call sends the body (if any) to the control API at the socket and decodes
+// the response into out
+func Call(socket, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://control"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Could not reach control socket %s", socket)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("daemon responded %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,129 @@
+package derive
+
+import (
+	"crypto/sha256"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Version identifies an overlay address derivation algorithm. The algorithm
+// of a version must never change, since nodes that disagree on the address of
+// a peer cannot reach it.
+type Version uint8
+
+const (
+	// V1 copies the trailing bytes of the SHA-256 of the public key into the
+	// host part of the network. Host parts of all zeros or all ones are not
+	// avoided.
+	V1 Version = 1
+	// V2 fills every host bit, also of prefixes that do not end on a byte
+	// boundary, from the BLAKE2s-256 of the public key, and skips host parts
+	// of all zeros or all ones.
+	V2 Version = 2
+
+	// Current is the version of the addresses nodes derive before a server
+	// announces another one, and always of the address of the server
+	Current = V1
+)
+
+// algorithms are the supported derivation algorithms by version
+var algorithms = map[Version]func(net.IPNet, wgtypes.Key, []byte) net.IPNet{
+	V1: v1,
+	V2: v2,
+}
+
+// Versions returns the supported versions in ascending order
+func Versions() []Version {
+	versions := make([]Version, 0, len(algorithms))
+	for v := range algorithms {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// ParseVersion parses a version given as a number, optionally prefixed by v
+func ParseVersion(s string) (Version, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "v"), 10, 8)
+	if err != nil || !Version(n).Supported() {
+		return 0, errors.Errorf("Unsupported address derivation version %q", s)
+	}
+	return Version(n).Normalize(), nil
+}
+
+// Normalize maps the zero version, sent by nodes that predate versioning,
+// to V1
+func (v Version) Normalize() Version {
+	if v == 0 {
+		return V1
+	}
+	return v
+}
+
+// Supported reports whether this node can derive addresses of the version
+func (v Version) Supported() bool {
+	_, ok := algorithms[v.Normalize()]
+	return ok
+}
+
+// Address derives the overlay address of pubkey in the network using the
+// algorithm of version v. A salt, if any, is hashed before the public key, so
+// that the same key has unrelated addresses in meshes with different salts.
+// The returned network is a host network, either /32 or /128.
+func Address(v Version, network net.IPNet, pubkey wgtypes.Key, salt []byte) (net.IPNet, error) {
+	algorithm, ok := algorithms[v.Normalize()]
+	if !ok {
+		return net.IPNet{}, errors.Errorf("Unsupported address derivation version %d", v)
+	}
+	return algorithm(network, pubkey, salt), nil
+}
+
+func v1(ipnet net.IPNet, pubkey wgtypes.Key, salt []byte) net.IPNet {
+	bits, size := ipnet.Mask.Size()
+	ip := make([]byte, len(ipnet.IP))
+	copy(ip, []byte(ipnet.IP))
+	hb := sha256.Sum256(append(append([]byte(nil), salt...), pubkey[:]...))
+	for i := 1; i <= (size-bits)/8; i++ {
+		ip[len(ip)-i] = hb[len(hb)-i]
+	}
+	return net.IPNet{
+		IP:   net.IP(ip),
+		Mask: net.CIDRMask(size, size), // either /32 or /128, depending if ipv4 or ipv6
+	}
+}
+
+func v2(ipnet net.IPNet, pubkey wgtypes.Key, salt []byte) net.IPNet {
+	bits, size := ipnet.Mask.Size()
+	hostBits := size - bits
+	network := ipnet.IP.Mask(ipnet.Mask)
+	ip := make(net.IP, len(network))
+	input := append(append([]byte("wireguard-overlay address v2"), salt...), pubkey[:]...)
+	// Hash again, with a counter appended, while the host part is reserved
+	for counter := byte(0); ; counter++ {
+		hb := blake2s.Sum256(append(input, counter))
+		copy(ip, network)
+		zeros, ones := true, true
+		for i := 0; i < hostBits; i++ {
+			byteIndex, bit := len(ip)-1-i/8, byte(1)<<uint(i%8)
+			if hb[len(hb)-1-i/8]&bit != 0 {
+				ip[byteIndex] |= bit
+				zeros = false
+			} else {
+				ones = false
+			}
+		}
+		if hostBits < 2 || (!zeros && !ones) {
+			break
+		}
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(size, size),
+	}
+}
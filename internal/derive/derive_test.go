@@ -0,0 +1,55 @@
+package derive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// vector is a published pubkey to address mapping of a derivation version.
+// Other implementations can use vectors.json to check their compatibility.
+type vector struct {
+	Version   Version `json:"version"`
+	Network   string  `json:"network"`
+	Salt      string  `json:"salt,omitempty"`
+	PublicKey string  `json:"public_key"`
+	Address   string  `json:"address"`
+}
+
+func TestVectors(t *testing.T) {
+	data, err := os.ReadFile("vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []vector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Could not decode vectors: %v", err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("No vectors")
+	}
+	for _, v := range vectors {
+		v := v
+		t.Run(fmt.Sprintf("v%d/%s/%s", v.Version, v.Network, v.PublicKey), func(t *testing.T) {
+			_, network, err := net.ParseCIDR(v.Network)
+			if err != nil {
+				t.Fatalf("Invalid network: %v", err)
+			}
+			key, err := wgtypes.ParseKey(v.PublicKey)
+			if err != nil {
+				t.Fatalf("Invalid key: %v", err)
+			}
+			addr, err := Address(v.Version, *network, key, []byte(v.Salt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !addr.IP.Equal(net.ParseIP(v.Address)) {
+				t.Errorf("Derived %s, want %s", addr.IP, v.Address)
+			}
+		})
+	}
+}
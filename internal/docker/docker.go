@@ -0,0 +1,101 @@
+// Package docker is a Docker network and IPAM driver that attaches containers
+// to the overlay. Containers get addresses from subnets of the node that the
+// other nodes route to it, and sit on a bridge per network, from which the
+// host forwards their traffic into the overlay.
+package docker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/pkg/errors"
+)
+
+var dockerLog = logging.For("docker")
+
+// Name is the name of the driver, for docker network create -d and
+// --ipam-driver
+const Name = "wireguard-overlay"
+
+// SocketPath is where Docker discovers the driver
+const SocketPath = "/run/docker/plugins/" + Name + ".sock"
+
+// Plugin serves the driver on the plugin socket
+type Plugin struct {
+	server *http.Server
+	ipam   *ipam
+}
+
+// Listen serves the driver on the plugin socket, handing out addresses from
+// the subnets, at most one IPv4 and one IPv6
+func Listen(subnets []net.IPNet) (*Plugin, error) {
+	ipam, err := newIPAM(subnets)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(SocketPath), 0755); err != nil {
+		return nil, errors.Wrap(err, "Could not create plugin directory")
+	}
+	if err := os.Remove(SocketPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Could not remove stale plugin socket")
+	}
+	l, err := net.Listen("unix", SocketPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not listen on plugin socket")
+	}
+	p := &Plugin{ipam: ipam}
+	mux := http.NewServeMux()
+	handle(mux, "/Plugin.Activate", func(json.RawMessage) (interface{}, error) {
+		return map[string][]string{"Implements": {"IpamDriver", "NetworkDriver"}}, nil
+	})
+	p.ipam.register(mux)
+	registerNetwork(mux)
+	p.server = &http.Server{Handler: mux}
+	go func() {
+		if err := p.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			dockerLog.WithError(err).Error("Plugin socket stopped")
+		}
+	}()
+	return p, nil
+}
+
+// Close stops serving and removes the socket
+func (p *Plugin) Close() error {
+	err := p.server.Close()
+	os.Remove(SocketPath)
+	return err
+}
+
+// handle serves a call of the plugin API: f gets the JSON request and returns
+// the response, or the error to report to Docker
+func handle(mux *http.ServeMux, path string, f func(json.RawMessage) (interface{}, error)) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var req json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			// Some calls come without a body
+			req = json.RawMessage("{}")
+		}
+		res, err := f(req)
+		w.Header().Set("Content-Type", "application/vnd.docker.plugins.v1+json")
+		if err != nil {
+			dockerLog.WithError(err).Warnf("Could not handle %s", path)
+			w.WriteHeader(http.StatusInternalServerError)
+			res = map[string]string{"Err": err.Error()}
+		}
+		if res == nil {
+			res = struct{}{}
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			dockerLog.WithError(err).Error("Could not write response")
+		}
+	})
+}
+
+// nothing answers calls that need no action
+func nothing(json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
@@ -0,0 +1,143 @@
+package docker
+
+import (
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ipam hands out the addresses of the subnets; the pool of a subnet is named
+// by its CIDR
+type ipam struct {
+	mu      sync.Mutex
+	subnets map[bool]net.IPNet
+	used    map[string]map[string]bool
+}
+
+func newIPAM(subnets []net.IPNet) (*ipam, error) {
+	m := &ipam{subnets: make(map[bool]net.IPNet), used: make(map[string]map[string]bool)}
+	for _, s := range subnets {
+		v6 := s.IP.To4() == nil
+		if _, ok := m.subnets[v6]; ok {
+			return nil, errors.Errorf("Only one IPv4 and one IPv6 subnet are supported, got %s", s.String())
+		}
+		m.subnets[v6] = s
+	}
+	return m, nil
+}
+
+func (m *ipam) register(mux *http.ServeMux) {
+	handle(mux, "/IpamDriver.GetCapabilities", func(json.RawMessage) (interface{}, error) {
+		return map[string]bool{"RequiresMACAddress": false}, nil
+	})
+	handle(mux, "/IpamDriver.GetDefaultAddressSpaces", func(json.RawMessage) (interface{}, error) {
+		return map[string]string{"LocalDefaultAddressSpace": "local", "GlobalDefaultAddressSpace": "global"}, nil
+	})
+	handle(mux, "/IpamDriver.RequestPool", m.requestPool)
+	handle(mux, "/IpamDriver.ReleasePool", nothing)
+	handle(mux, "/IpamDriver.RequestAddress", m.requestAddress)
+	handle(mux, "/IpamDriver.ReleaseAddress", m.releaseAddress)
+}
+
+func (m *ipam) requestPool(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		Pool string
+		V6   bool
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	family := "IPv4"
+	if req.V6 {
+		family = "IPv6"
+	}
+	subnet, ok := m.subnets[req.V6]
+	if !ok {
+		return nil, errors.Errorf("No %s subnet is configured for containers", family)
+	}
+	if req.Pool != "" && req.Pool != subnet.String() {
+		return nil, errors.Errorf("The %s subnet of the containers of this node is %s", family, subnet.String())
+	}
+	return map[string]string{"PoolID": subnet.String(), "Pool": subnet.String()}, nil
+}
+
+func (m *ipam) requestAddress(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		PoolID  string
+		Address string
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	_, subnet, err := net.ParseCIDR(req.PoolID)
+	if err != nil {
+		return nil, errors.Errorf("Unknown pool %s", req.PoolID)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := m.used[req.PoolID]
+	if used == nil {
+		used = make(map[string]bool)
+		m.used[req.PoolID] = used
+	}
+	var ip net.IP
+	if req.Address != "" {
+		if ip = net.ParseIP(req.Address); ip == nil || !subnet.Contains(ip) {
+			return nil, errors.Errorf("Address %s is not in pool %s", req.Address, req.PoolID)
+		}
+		if used[ip.String()] {
+			return nil, errors.Errorf("Address %s is in use", req.Address)
+		}
+	} else if ip = nextFree(subnet, used); ip == nil {
+		return nil, errors.Errorf("Pool %s is exhausted", req.PoolID)
+	}
+	used[ip.String()] = true
+	address := net.IPNet{IP: ip, Mask: subnet.Mask}
+	return map[string]string{"Address": address.String()}, nil
+}
+
+func (m *ipam) releaseAddress(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		PoolID  string
+		Address string
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ip := net.ParseIP(req.Address); ip != nil {
+		delete(m.used[req.PoolID], ip.String())
+	}
+	return nil, nil
+}
+
+// nextFree returns the lowest unused address of the subnet, leaving out the
+// network address and, for IPv4, the broadcast address. Only the first 65536
+// addresses are searched, which is plenty for the containers of a node.
+func nextFree(subnet *net.IPNet, used map[string]bool) net.IP {
+	base := subnet.IP.To4()
+	if base == nil {
+		base = subnet.IP.To16()
+	}
+	ones, bits := subnet.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last := new(big.Int).Sub(size, big.NewInt(1))
+	if len(base) == net.IPv4len {
+		last.Sub(last, big.NewInt(1))
+	}
+	start := new(big.Int).SetBytes(base)
+	for i := big.NewInt(1); i.Cmp(last) <= 0 && i.Cmp(big.NewInt(1<<16)) <= 0; i.Add(i, big.NewInt(1)) {
+		b := new(big.Int).Add(start, i).Bytes()
+		ip := make(net.IP, len(base))
+		copy(ip[len(ip)-len(b):], b)
+		if !used[ip.String()] {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// The names of links are derived from the IDs Docker assigns, so that nothing
+// has to be remembered across restarts; link names have at most 15 bytes
+func bridgeName(network string) string    { return "wgo" + short(network) }
+func hostVethName(endpoint string) string { return "wgh" + short(endpoint) }
+func peerVethName(endpoint string) string { return "wgc" + short(endpoint) }
+
+func short(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func registerNetwork(mux *http.ServeMux) {
+	handle(mux, "/NetworkDriver.GetCapabilities", func(json.RawMessage) (interface{}, error) {
+		return map[string]string{"Scope": "local", "ConnectivityScope": "global"}, nil
+	})
+	handle(mux, "/NetworkDriver.CreateNetwork", createNetwork)
+	handle(mux, "/NetworkDriver.DeleteNetwork", deleteNetwork)
+	handle(mux, "/NetworkDriver.CreateEndpoint", nothing)
+	handle(mux, "/NetworkDriver.DeleteEndpoint", leave)
+	handle(mux, "/NetworkDriver.EndpointOperInfo", func(json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"Value": map[string]string{}}, nil
+	})
+	handle(mux, "/NetworkDriver.Join", join)
+	handle(mux, "/NetworkDriver.Leave", leave)
+	for _, call := range []string{"DiscoverNew", "DiscoverDelete", "ProgramExternalConnectivity", "RevokeExternalConnectivity", "AllocateNetwork", "FreeNetwork"} {
+		handle(mux, "/NetworkDriver."+call, nothing)
+	}
+}
+
+type ipData struct {
+	Gateway string
+}
+
+// createNetwork creates the bridge of the network with the gateway addresses
+// and lets the host forward between it and the overlay
+func createNetwork(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		NetworkID string
+		IPv4Data  []ipData
+		IPv6Data  []ipData
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	name := bridgeName(req.NetworkID)
+	if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+		return nil, errors.Wrapf(err, "Could not create bridge %s", name)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get link information for %s", name)
+	}
+	for family, pools := range map[string][]ipData{"ipv4": req.IPv4Data, "ipv6": req.IPv6Data} {
+		for _, p := range pools {
+			if p.Gateway == "" {
+				continue
+			}
+			addr, err := netlink.ParseAddr(p.Gateway)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid gateway %s", p.Gateway)
+			}
+			if err := netlink.AddrReplace(link, addr); err != nil {
+				return nil, errors.Wrapf(err, "Could not set address for %s", name)
+			}
+			path := fmt.Sprintf("/proc/sys/net/%s/conf/%s/forwarding", family, name)
+			if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
+				return nil, errors.Wrapf(err, "Could not enable forwarding on %s", name)
+			}
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, errors.Wrapf(err, "Could not enable interface %s", name)
+	}
+	dockerLog.Infof("Created bridge %s for network %s", name, req.NetworkID)
+	return nil, nil
+}
+
+func deleteNetwork(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		NetworkID string
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	name := bridgeName(req.NetworkID)
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		// Already gone
+		return nil, nil
+	}
+	return nil, errors.Wrapf(netlink.LinkDel(link), "Could not remove bridge %s", name)
+}
+
+// join creates a veth pair, attaches one end to the bridge and hands the other
+// to Docker, which moves it into the container
+func join(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		NetworkID  string
+		EndpointID string
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	bridge, err := netlink.LinkByName(bridgeName(req.NetworkID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not find the bridge of network %s", req.NetworkID)
+	}
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: hostVethName(req.EndpointID), MasterIndex: bridge.Attrs().Index},
+		PeerName:  peerVethName(req.EndpointID),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, errors.Wrapf(err, "Could not create veth %s", veth.Name)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return nil, errors.Wrapf(err, "Could not enable interface %s", veth.Name)
+	}
+	res := map[string]interface{}{
+		"InterfaceName": map[string]string{"SrcName": veth.PeerName, "DstPrefix": "eth"},
+	}
+	// The gateways are the addresses of the bridge
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get addresses of %s", bridge.Attrs().Name)
+	}
+	for _, a := range addrs {
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if a.IP.To4() != nil {
+			res["Gateway"] = a.IP.String()
+		} else {
+			res["GatewayIPv6"] = a.IP.String()
+		}
+	}
+	return res, nil
+}
+
+// leave removes the veth pair of the endpoint; removing one end removes both
+func leave(data json.RawMessage) (interface{}, error) {
+	var req struct {
+		EndpointID string
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	link, err := netlink.LinkByName(hostVethName(req.EndpointID))
+	if err != nil {
+		return nil, nil
+	}
+	return nil, errors.Wrapf(netlink.LinkDel(link), "Could not remove veth %s", link.Attrs().Name)
+}
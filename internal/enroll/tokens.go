@@ -0,0 +1,141 @@
+package enroll
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidToken is returned for unknown, expired or used up tokens
+var ErrInvalidToken = errors.New("Invalid or expired enrollment token")
+
+type token struct {
+	// Expires is zero for tokens that do not expire
+	Expires time.Time `json:"expires,omitempty"`
+	// Remaining is the number of enrollments left; 0 means unlimited
+	Remaining int `json:"remaining,omitempty"`
+}
+
+// Tokens persists enrollment tokens. Only hashes of the tokens are stored.
+type Tokens struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]token
+}
+
+// Load reads the tokens from path, if it exists
+func Load(path string) (*Tokens, error) {
+	t := &Tokens{path: path, tokens: make(map[string]token)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read enrollment tokens")
+	}
+	if err := json.Unmarshal(data, &t.tokens); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode enrollment tokens in %s", path)
+	}
+	return t, nil
+}
+
+func (t *Tokens) save() error {
+	data, err := json.MarshalIndent(t.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return errors.Wrap(err, "Could not create enrollment token directory")
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "Could not write enrollment tokens")
+	}
+	return errors.Wrap(os.Rename(tmp, t.path), "Could not write enrollment tokens")
+}
+
+// Hash returns what is kept of the token, by which a client that enrolled
+// with it is recognized when it presents it again
+func Hash(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// Matches reports whether tok is the token of the hash
+func Matches(hashed, tok string) bool {
+	return hashed != "" && subtle.ConstantTimeCompare([]byte(hashed), []byte(Hash(tok))) == 1
+}
+
+// expire drops expired tokens
+func (t *Tokens) expire(now time.Time) {
+	for h, tok := range t.tokens {
+		if !tok.Expires.IsZero() && now.After(tok.Expires) {
+			delete(t.tokens, h)
+		}
+	}
+}
+
+// Mint creates a token valid for ttl (0 for no expiry) and uses enrollments
+// (0 for unlimited). At least one of them must be limited.
+func (t *Tokens) Mint(ttl time.Duration, uses int) (string, time.Time, error) {
+	if ttl <= 0 && uses <= 0 {
+		return "", time.Time{}, errors.New("Tokens must be limited in time or uses")
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "Could not generate token")
+	}
+	tok := base64.RawURLEncoding.EncodeToString(buf)
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UTC()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	t.tokens[Hash(tok)] = token{Expires: expires, Remaining: uses}
+	if err := t.save(); err != nil {
+		delete(t.tokens, Hash(tok))
+		return "", time.Time{}, err
+	}
+	return tok, expires, nil
+}
+
+// Redeem uses up one enrollment of the token
+func (t *Tokens) Redeem(tok string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	h := Hash(tok)
+	var found string
+	for known := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(h)) == 1 {
+			found = known
+		}
+	}
+	if found == "" {
+		return ErrInvalidToken
+	}
+	old := t.tokens[found]
+	switch {
+	case old.Remaining == 1:
+		delete(t.tokens, found)
+	case old.Remaining > 1:
+		t.tokens[found] = token{Expires: old.Expires, Remaining: old.Remaining - 1}
+	}
+	if err := t.save(); err != nil {
+		t.tokens[found] = old
+		return err
+	}
+	return nil
+}
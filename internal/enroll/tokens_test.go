@@ -0,0 +1,164 @@
+package enroll
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T) *Tokens {
+	t.Helper()
+	tokens, err := Load(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestMint(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		uses    int
+		ok      bool
+		expires bool
+	}{
+		{"unlimited", 0, 0, false, false},
+		{"limited in time", time.Hour, 0, true, true},
+		{"limited in uses", 0, 1, true, false},
+		{"limited in both", time.Hour, 3, true, true},
+	}
+	for _, tt := range tests {
+		tokens := load(t)
+		tok, expires, err := tokens.Mint(tt.ttl, tt.uses)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			if len(tokens.tokens) != 0 {
+				t.Errorf("%s: rejected token was kept", tt.name)
+			}
+			continue
+		}
+		if expires.IsZero() == tt.expires {
+			t.Errorf("%s: expires %s, want expiry %v", tt.name, expires, tt.expires)
+		}
+		if _, ok := tokens.tokens[tok]; ok {
+			t.Errorf("%s: token was kept instead of its hash", tt.name)
+		}
+		if _, ok := tokens.tokens[Hash(tok)]; !ok {
+			t.Errorf("%s: hash of the token was not kept", tt.name)
+		}
+	}
+	other, _, _ := load(t).Mint(time.Hour, 0)
+	if tok, _, _ := load(t).Mint(time.Hour, 0); tok == other || len(tok) < 40 {
+		t.Errorf("Minted %q after %q, want distinct random tokens", tok, other)
+	}
+}
+
+func TestRedeem(t *testing.T) {
+	tokens := load(t)
+	tok, _, err := tokens.Mint(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimited, _, err := tokens.Mint(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := tokens.Mint(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens.tokens[Hash(expired)] = token{Expires: time.Now().Add(-time.Second)}
+	tests := []struct {
+		name string
+		tok  string
+		ok   bool
+	}{
+		{"first use", tok, true},
+		{"second use", tok, true},
+		{"used up", tok, false},
+		{"unlimited", unlimited, true},
+		{"unlimited again", unlimited, true},
+		{"expired", expired, false},
+		{"unknown", "unknown", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		if err := tokens.Redeem(tt.tok); (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+	if _, ok := tokens.tokens[Hash(expired)]; ok {
+		t.Error("Expired token was kept")
+	}
+}
+
+func TestRedeemPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens", "tokens.json")
+	tokens, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, _, err := tokens.Mint(time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Redeem(tok); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Redeem(tok); err != nil {
+		t.Errorf("Token with a use left was rejected after a restart: %v", err)
+	}
+	if err := restarted.Redeem(tok); err == nil {
+		t.Error("Token was redeemed more often than minted for across a restart")
+	}
+}
+
+func TestRedeemSaveFailure(t *testing.T) {
+	tokens := load(t)
+	tok, _, err := tokens.Mint(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory of the tokens cannot be created below a file
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := tokens.path
+	tokens.path = filepath.Join(blocker, "tokens.json")
+	if err := tokens.Redeem(tok); err == nil {
+		t.Error("Redeem succeeded without saving")
+	}
+	tokens.path = path
+	if err := tokens.Redeem(tok); err != nil {
+		t.Errorf("Token failed to save was used up: %v", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		hashed string
+		tok    string
+		want   bool
+	}{
+		{"same", Hash("token"), "token", true},
+		{"other", Hash("token"), "tokem", false},
+		{"no hash", "", "", false},
+		{"no token", Hash("token"), "", false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.hashed, tt.tok); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const nftACLTable = "wireguard_overlay_acl"
+
+// ACLRule allows or denies new connections into the node from the sources,
+// or from anywhere if Any is set, with the protocol and port
+type ACLRule struct {
+	Allow   bool
+	Any     bool
+	Sources []net.IPNet
+	// Proto is any, tcp, udp or icmp; Port is 0 for any port
+	Proto string
+	Port  int
+}
+
+// aclRuleset evaluates the rules in order for new connections arriving on the
+// interface; the first match decides and unmatched connections are accepted
+func aclRuleset(iface string, rules []ACLRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\n", nftACLTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", nftACLTable)
+	fmt.Fprintf(&b, "table inet %s {\n", nftACLTable)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority -1; policy accept;\n")
+	iif := fmt.Sprintf("iifname %q", iface)
+	fmt.Fprintf(&b, "\t\t%s ct state established,related accept\n", iif)
+	for _, r := range rules {
+		verdict := "drop"
+		if r.Allow {
+			verdict = "accept"
+		}
+		match := ""
+		switch {
+		case r.Proto == "icmp":
+			match = " meta l4proto { icmp, ipv6-icmp }"
+		case r.Port != 0:
+			match = fmt.Sprintf(" %s dport %d", r.Proto, r.Port)
+		case r.Proto == "tcp" || r.Proto == "udp":
+			match = " meta l4proto " + r.Proto
+		}
+		if r.Any {
+			fmt.Fprintf(&b, "\t\t%s%s %s\n", iif, match, verdict)
+			continue
+		}
+		var v4, v6 []string
+		for _, s := range r.Sources {
+			if s.IP.To4() != nil {
+				v4 = append(v4, s.String())
+			} else {
+				v6 = append(v6, s.String())
+			}
+		}
+		if len(v4) != 0 {
+			fmt.Fprintf(&b, "\t\t%s ip saddr { %s }%s %s\n", iif, strings.Join(v4, ", "), match, verdict)
+		}
+		if len(v6) != 0 {
+			fmt.Fprintf(&b, "\t\t%s ip6 saddr { %s }%s %s\n", iif, strings.Join(v6, ", "), match, verdict)
+		}
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// ApplyACL replaces the ACL of the interface with the rules, using nftables.
+// The ACL has its own table, so it applies along with the rules of Firewall.
+func ApplyACL(iface string, rules []ACLRule) error {
+	return run(aclRuleset(iface, rules), "nft", "-f", "-")
+}
+
+// CleanupACL removes the ACL
+func CleanupACL() error {
+	return run("", "nft", "delete", "table", "inet", nftACLTable)
+}
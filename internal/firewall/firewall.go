@@ -0,0 +1,90 @@
+package firewall
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Port is a transport protocol and port, written as tcp/22 or udp/53
+type Port struct {
+	Proto string
+	Port  int
+}
+
+func (p Port) String() string {
+	return fmt.Sprintf("%s/%d", p.Proto, p.Port)
+}
+
+// ParsePort parses a port in the proto/port form
+func ParsePort(s string) (Port, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "udp") {
+		return Port{}, fmt.Errorf("invalid port %q; expected tcp/<port> or udp/<port>", s)
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return Port{}, fmt.Errorf("invalid port number in %q", s)
+	}
+	return Port{Proto: parts[0], Port: port}, nil
+}
+
+// ParsePorts parses a list of ports in the proto/port form
+func ParsePorts(ss []string) ([]Port, error) {
+	ports := make([]Port, 0, len(ss))
+	for _, s := range ss {
+		p, err := ParsePort(s)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// Rules describes the traffic the node wants to accept
+type Rules struct {
+	// Interface is the overlay interface
+	Interface string
+	// ListenPort is the wireguard UDP port on the underlay
+	ListenPort int
+	// OverlayPorts restricts new connections from the overlay to these ports.
+	// If empty, all traffic from the overlay is accepted.
+	OverlayPorts []Port
+	// Relay accepts traffic forwarded between peers of the overlay interface
+	Relay bool
+}
+
+// Firewall installs rules in a dedicated table or chain so that they can be
+// removed without touching rules managed by others
+type Firewall interface {
+	// Apply replaces any previously installed rules
+	Apply(rules Rules) error
+	// Cleanup removes the installed rules
+	Cleanup() error
+}
+
+// New returns the firewall backend by name (nftables or iptables)
+func New(backend string) (Firewall, error) {
+	switch backend {
+	case "nftables":
+		return &nftables{}, nil
+	case "iptables":
+		return &iptables{}, nil
+	}
+	return nil, errors.Errorf("Unknown firewall backend %q", backend)
+}
+
+func run(stdin string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package firewall
+
+import (
+	"strconv"
+)
+
+const (
+	iptablesChain        = "WGOVERLAY"
+	iptablesForwardChain = "WGOVERLAY-FWD"
+)
+
+type iptables struct {
+	relay bool
+}
+
+var iptablesCommands = []struct {
+	name string
+	icmp string
+}{
+	{"iptables", "icmp"},
+	{"ip6tables", "ipv6-icmp"},
+}
+
+func (t *iptables) Apply(rules Rules) error {
+	for _, c := range iptablesCommands {
+		// Creating an existing chain fails, flushing it makes Apply repeatable
+		if err := run("", c.name, "-N", iptablesChain); err != nil {
+			if err := run("", c.name, "-F", iptablesChain); err != nil {
+				return err
+			}
+		}
+		var specs [][]string
+		if rules.ListenPort != 0 {
+			specs = append(specs, []string{"-p", "udp", "--dport", strconv.Itoa(rules.ListenPort), "-j", "ACCEPT"})
+		}
+		iif := []string{"-i", rules.Interface}
+		if len(rules.OverlayPorts) == 0 {
+			specs = append(specs, append(iif, "-j", "ACCEPT"))
+		} else {
+			specs = append(specs,
+				append(iif, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"),
+				append(iif, "-p", c.icmp, "-j", "ACCEPT"))
+			for _, p := range rules.OverlayPorts {
+				specs = append(specs, append(iif, "-p", p.Proto, "--dport", strconv.Itoa(p.Port), "-j", "ACCEPT"))
+			}
+			specs = append(specs, append(iif, "-j", "DROP"))
+		}
+		for _, spec := range specs {
+			if err := run("", c.name, append([]string{"-A", iptablesChain}, spec...)...); err != nil {
+				return err
+			}
+		}
+		if err := run("", c.name, "-C", "INPUT", "-j", iptablesChain); err != nil {
+			if err := run("", c.name, "-I", "INPUT", "-j", iptablesChain); err != nil {
+				return err
+			}
+		}
+		if rules.Relay {
+			if err := t.applyForward(c.name, rules.Interface); err != nil {
+				return err
+			}
+		}
+	}
+	t.relay = rules.Relay
+	return nil
+}
+
+func (t *iptables) applyForward(name string, iface string) error {
+	if err := run("", name, "-N", iptablesForwardChain); err != nil {
+		if err := run("", name, "-F", iptablesForwardChain); err != nil {
+			return err
+		}
+	}
+	if err := run("", name, "-A", iptablesForwardChain, "-i", iface, "-o", iface, "-j", "ACCEPT"); err != nil {
+		return err
+	}
+	if err := run("", name, "-C", "FORWARD", "-j", iptablesForwardChain); err != nil {
+		return run("", name, "-I", "FORWARD", "-j", iptablesForwardChain)
+	}
+	return nil
+}
+
+func (t *iptables) Cleanup() error {
+	var firstErr error
+	for _, c := range iptablesCommands {
+		commands := [][]string{
+			{"-D", "INPUT", "-j", iptablesChain},
+			{"-F", iptablesChain},
+			{"-X", iptablesChain},
+		}
+		if t.relay {
+			commands = append(commands,
+				[]string{"-D", "FORWARD", "-j", iptablesForwardChain},
+				[]string{"-F", iptablesForwardChain},
+				[]string{"-X", iptablesForwardChain})
+		}
+		for _, args := range commands {
+			if err := run("", c.name, args...); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,52 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+const nftTable = "wireguard_overlay"
+
+type nftables struct{}
+
+func (n *nftables) ruleset(rules Rules) string {
+	var b strings.Builder
+	// Declaring the table before deleting it makes the delete succeed even
+	// when the table does not exist yet, so the script is idempotent
+	fmt.Fprintf(&b, "table inet %s\n", nftTable)
+	fmt.Fprintf(&b, "delete table inet %s\n", nftTable)
+	fmt.Fprintf(&b, "table inet %s {\n", nftTable)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority 0; policy accept;\n")
+	if rules.ListenPort != 0 {
+		fmt.Fprintf(&b, "\t\tudp dport %d accept\n", rules.ListenPort)
+	}
+	iif := fmt.Sprintf("iifname %q", rules.Interface)
+	if len(rules.OverlayPorts) == 0 {
+		fmt.Fprintf(&b, "\t\t%s accept\n", iif)
+	} else {
+		fmt.Fprintf(&b, "\t\t%s ct state established,related accept\n", iif)
+		fmt.Fprintf(&b, "\t\t%s meta l4proto { icmp, ipv6-icmp } accept\n", iif)
+		for _, p := range rules.OverlayPorts {
+			fmt.Fprintf(&b, "\t\t%s %s dport %d accept\n", iif, p.Proto, p.Port)
+		}
+		fmt.Fprintf(&b, "\t\t%s drop\n", iif)
+	}
+	b.WriteString("\t}\n")
+	if rules.Relay {
+		b.WriteString("\tchain forward {\n")
+		b.WriteString("\t\ttype filter hook forward priority 0; policy accept;\n")
+		fmt.Fprintf(&b, "\t\t%s oifname %q accept\n", iif, rules.Interface)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (n *nftables) Apply(rules Rules) error {
+	return run(n.ruleset(rules), "nft", "-f", "-")
+}
+
+func (n *nftables) Cleanup() error {
+	return run("", "nft", "delete", "table", "inet", nftTable)
+}
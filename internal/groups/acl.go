@@ -0,0 +1,51 @@
+package groups
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ACLRule allows or denies new connections from members of Src to members of
+// Dst with the protocol and, for tcp and udp, the port
+type ACLRule struct {
+	Allow bool
+	Src   string
+	Dst   string
+	// Proto is any, tcp, udp or icmp; Port is 0 for any port
+	Proto string
+	Port  int
+}
+
+// ParseACL parses "allow|deny src dst [proto[/port]]" entries, e.g. "allow web
+// db tcp/5432". Either group may be the wildcard, and the protocol defaults to
+// any.
+func ParseACL(entries []string) ([]ACLRule, error) {
+	var rules []ACLRule
+	for _, e := range entries {
+		fields := strings.Fields(e)
+		if len(fields) != 3 && len(fields) != 4 || fields[0] != "allow" && fields[0] != "deny" {
+			return nil, errors.Errorf("Invalid ACL rule %q; expected allow|deny src dst [proto[/port]]", e)
+		}
+		r := ACLRule{Allow: fields[0] == "allow", Src: fields[1], Dst: fields[2], Proto: "any"}
+		if len(fields) == 4 {
+			parts := strings.SplitN(fields[3], "/", 2)
+			r.Proto = parts[0]
+			switch r.Proto {
+			case "any", "icmp", "tcp", "udp":
+			default:
+				return nil, errors.Errorf("Invalid protocol in ACL rule %q; expected any, icmp, tcp or udp", e)
+			}
+			if len(parts) == 2 {
+				port, err := strconv.Atoi(parts[1])
+				if err != nil || port <= 0 || port > 65535 || r.Proto != "tcp" && r.Proto != "udp" {
+					return nil, errors.Errorf("Invalid port in ACL rule %q", e)
+				}
+				r.Port = port
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,87 @@
+package groups
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Wildcard matches any group, including peers without groups
+const Wildcard = "*"
+
+// Groups maps public keys to the groups they are tagged with
+type Groups map[wgtypes.Key][]string
+
+// ParseGroups parses group:pubkey entries. A key may be tagged with several
+// groups by listing it multiple times.
+func ParseGroups(entries []string) (Groups, error) {
+	g := make(Groups)
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[0] == Wildcard {
+			return nil, errors.Errorf("Invalid peer group %q; expected group:pubkey", e)
+		}
+		key, err := wgtypes.ParseKey(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key in peer group %q", e)
+		}
+		g[key] = append(g[key], parts[0])
+	}
+	return g, nil
+}
+
+// Has reports whether key is tagged with group
+func (g Groups) Has(key wgtypes.Key, group string) bool {
+	if group == Wildcard {
+		return true
+	}
+	for _, m := range g[key] {
+		if m == group {
+			return true
+		}
+	}
+	return false
+}
+
+type rule struct {
+	receiver string
+	visible  string
+}
+
+// Policy decides which peers are distributed to which clients
+type Policy struct {
+	rules []rule
+}
+
+// ParsePolicy parses receiver:visible entries, meaning that members of the
+// receiver group are sent the members of the visible group. Either side may
+// be the wildcard. An empty policy lets every peer see every other peer.
+func ParsePolicy(entries []string) (*Policy, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	p := &Policy{}
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("Invalid group policy %q; expected receiver:visible", e)
+		}
+		p.rules = append(p.rules, rule{receiver: parts[0], visible: parts[1]})
+	}
+	return p, nil
+}
+
+// Visible reports whether peer may be distributed to receiver. Peers always
+// see themselves.
+func (p *Policy) Visible(g Groups, receiver, peer wgtypes.Key) bool {
+	if p == nil || receiver == peer {
+		return true
+	}
+	for _, r := range p.rules {
+		if g.Has(receiver, r.receiver) && g.Has(peer, r.visible) {
+			return true
+		}
+	}
+	return false
+}
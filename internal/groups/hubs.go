@@ -0,0 +1,119 @@
+package groups
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// RegionLabel is the metadata label with which clients name their region
+const RegionLabel = "region"
+
+// Hubs are the peers that forward overlay traffic between regions. Every
+// client has a home hub: one of its region, if there is one, the hub it found
+// nearest otherwise. Clients with the same home reach each other directly and
+// the others through it; hubs mesh with each other and reach the clients of
+// other homes through their hub. Every packet thus takes the same hubs in both
+// directions, as wireguard expects of the source addresses it receives.
+type Hubs struct {
+	regions  map[wgtypes.Key]string
+	byRegion map[string][]wgtypes.Key
+	all      []wgtypes.Key
+}
+
+// ParseHubs parses region=pubkey entries. A region may have several hubs, among
+// which its clients are spread. It returns nil without entries.
+func ParseHubs(entries []string) (*Hubs, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	h := &Hubs{regions: make(map[wgtypes.Key]string), byRegion: make(map[string][]wgtypes.Key)}
+	for _, e := range entries {
+		// Base64 keys may end in =, region names have none
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("Invalid region hub %q; expected region=pubkey", e)
+		}
+		key, err := wgtypes.ParseKey(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key in region hub %q", e)
+		}
+		if r, ok := h.regions[key]; ok {
+			return nil, errors.Errorf("Hub %s is already the hub of region %s", key, r)
+		}
+		h.regions[key] = parts[0]
+		h.byRegion[parts[0]] = append(h.byRegion[parts[0]], key)
+		h.all = append(h.all, key)
+	}
+	for _, keys := range h.byRegion {
+		sortKeys(keys)
+	}
+	sortKeys(h.all)
+	return h, nil
+}
+
+func sortKeys(keys []wgtypes.Key) {
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+}
+
+// Region returns the region of the hub, or "" if the peer is no hub
+func (h *Hubs) Region(key wgtypes.Key) string {
+	if h == nil {
+		return ""
+	}
+	return h.regions[key]
+}
+
+// Home returns the hub of the peer: the peer itself if it is a hub. Otherwise
+// the nearest hub it reported, if that is a hub of its region or it has no
+// region with hubs, or else a hub of its region or any hub, picked by its key
+// so that clients are spread evenly. Only hubs that are up are picked; without
+// any, the peer has no home and false is returned.
+func (h *Hubs) Home(key wgtypes.Key, region string, nearest wgtypes.Key, up func(wgtypes.Key) bool) (wgtypes.Key, bool) {
+	if _, ok := h.regions[key]; ok {
+		return key, true
+	}
+	var candidates []wgtypes.Key
+	for _, c := range h.byRegion[region] {
+		if up(c) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, c := range h.all {
+			if up(c) {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return wgtypes.Key{}, false
+	}
+	for _, c := range candidates {
+		if c == nearest {
+			return c, true
+		}
+	}
+	return candidates[binary.BigEndian.Uint32(key[:4])%uint32(len(candidates))], true
+}
+
+// Via returns the hub through which the receiver reaches the peer, given the
+// homes of both, and whether it reaches it through one rather than directly
+func (h *Hubs) Via(receiver, receiverHome, peer, peerHome wgtypes.Key) (wgtypes.Key, bool) {
+	if h == nil || receiver == peer || receiverHome == peerHome {
+		return wgtypes.Key{}, false
+	}
+	_, receiverHub := h.regions[receiver]
+	_, peerHub := h.regions[peer]
+	switch {
+	case receiverHub && peerHub:
+		return wgtypes.Key{}, false
+	case receiverHub:
+		return peerHome, true
+	}
+	return receiverHome, true
+}
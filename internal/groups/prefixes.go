@@ -0,0 +1,59 @@
+package groups
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type prefix struct {
+	group  string
+	prefix net.IPNet
+}
+
+// Prefixes carve the overlay network into per-group ranges
+type Prefixes []prefix
+
+// ParsePrefixes parses group:cidr entries. The prefixes must lie within the
+// overlay network and must not overlap.
+func ParsePrefixes(entries []string, overlay net.IPNet) (Prefixes, error) {
+	var p Prefixes
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[0] == Wildcard {
+			return nil, errors.Errorf("Invalid group prefix %q; expected group:cidr", e)
+		}
+		_, ipnet, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid prefix in group prefix %q", e)
+		}
+		ones, _ := ipnet.Mask.Size()
+		overlayOnes, _ := overlay.Mask.Size()
+		if !overlay.Contains(ipnet.IP) || ones < overlayOnes {
+			return nil, errors.Errorf("Group prefix %s is not within the overlay network %s", ipnet, &overlay)
+		}
+		for _, other := range p {
+			if other.group == parts[0] {
+				return nil, errors.Errorf("Group %s has more than one prefix", parts[0])
+			}
+			if other.prefix.Contains(ipnet.IP) || ipnet.Contains(other.prefix.IP) {
+				return nil, errors.Errorf("Group prefixes %s and %s overlap", ipnet, &other.prefix)
+			}
+		}
+		p = append(p, prefix{group: parts[0], prefix: *ipnet})
+	}
+	return p, nil
+}
+
+// For returns the prefix of the first listed group the key is tagged with, or
+// nil if none applies
+func (p Prefixes) For(g Groups, key wgtypes.Key) *net.IPNet {
+	for i := range p {
+		if g.Has(key, p[i].group) {
+			return &p[i].prefix
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package groups
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Topology modes
+const (
+	// TopologyMesh lets every client reach every other directly
+	TopologyMesh = "mesh"
+	// TopologyHub lets clients only reach the server directly
+	TopologyHub = "hub"
+	// TopologyCustom lets the clients that are adjacent reach each other
+	// directly
+	TopologyCustom = "custom"
+)
+
+// SameGroup is the adjacency of the peers that share a group
+const SameGroup = "same"
+
+// Topology decides which peers configure each other directly. The others
+// reach each other through the server.
+type Topology struct {
+	hub       bool
+	same      bool
+	adjacency []rule
+}
+
+// ParseTopology parses the mode and, in the custom mode, the adjacency out of
+// a:b entries, meaning that members of groups a and b mesh directly, and the
+// SameGroup entry. Either side may be the wildcard. The mesh mode returns nil.
+func ParseTopology(mode string, adjacency []string) (*Topology, error) {
+	switch mode {
+	case TopologyMesh:
+		if len(adjacency) != 0 {
+			return nil, errors.New("Adjacency requires the custom topology")
+		}
+		return nil, nil
+	case TopologyHub:
+		if len(adjacency) != 0 {
+			return nil, errors.New("Adjacency requires the custom topology")
+		}
+		return &Topology{hub: true}, nil
+	case TopologyCustom:
+	default:
+		return nil, errors.Errorf("Unknown topology %s (mesh/hub/custom)", mode)
+	}
+	t := &Topology{}
+	for _, e := range adjacency {
+		if e == SameGroup {
+			t.same = true
+			continue
+		}
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("Invalid adjacency %q; expected group:group or %s", e, SameGroup)
+		}
+		t.adjacency = append(t.adjacency, rule{receiver: parts[0], visible: parts[1]})
+	}
+	return t, nil
+}
+
+// Direct reports whether a and b configure each other directly
+func (t *Topology) Direct(g Groups, a, b wgtypes.Key) bool {
+	if t == nil || a == b {
+		return true
+	}
+	if t.hub {
+		return false
+	}
+	if t.same {
+		for _, group := range g[a] {
+			if g.Has(b, group) {
+				return true
+			}
+		}
+	}
+	for _, r := range t.adjacency {
+		if g.Has(a, r.receiver) && g.Has(b, r.visible) || g.Has(b, r.receiver) && g.Has(a, r.visible) {
+			return true
+		}
+	}
+	return false
+}
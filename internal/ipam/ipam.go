@@ -0,0 +1,237 @@
+package ipam
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Allocator leases addresses of the overlay network to public keys and
+// persists the leases so that a key keeps its address across restarts
+type Allocator struct {
+	mu       sync.Mutex
+	network  net.IPNet
+	path     string
+	leases   map[wgtypes.Key]net.IP
+	reserved []net.IP
+	// readOnly allocators keep leases in memory only
+	readOnly bool
+}
+
+// Load reads the leases from path, if it exists. Reserved addresses are never
+// leased; they should include the addresses derived from the public keys.
+func Load(network net.IPNet, path string, reserved []net.IP) (*Allocator, error) {
+	a := &Allocator{
+		network:  network,
+		path:     path,
+		leases:   make(map[wgtypes.Key]net.IP),
+		reserved: reserved,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read leases")
+	}
+	var stored map[string]string
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode leases in %s", path)
+	}
+	for k, v := range stored {
+		key, err := wgtypes.ParseKey(k)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key in %s", path)
+		}
+		ip := net.ParseIP(v)
+		if ip == nil || !network.Contains(ip) {
+			return nil, errors.Errorf("Invalid lease %s for %s in %s", v, k, path)
+		}
+		a.leases[key] = ip
+	}
+	return a, nil
+}
+
+// ReadOnly keeps the leases made from now on from being written, for dry runs
+func (a *Allocator) ReadOnly() {
+	a.readOnly = true
+}
+
+func (a *Allocator) save() error {
+	if a.readOnly {
+		return nil
+	}
+	stored := make(map[string]string, len(a.leases))
+	for k, v := range a.leases {
+		stored[k.String()] = v.String()
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return errors.Wrap(err, "Could not create lease directory")
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "Could not write leases")
+	}
+	return errors.Wrap(os.Rename(tmp, a.path), "Could not write leases")
+}
+
+// usable reports whether ip may be leased to key
+func (a *Allocator) usable(ip net.IP, key wgtypes.Key) bool {
+	ip = normalize(ip)
+	if !a.network.Contains(ip) {
+		return false
+	}
+	// Neither the all-zeros nor the all-ones host address
+	host := new(big.Int).SetBytes(ip)
+	base := new(big.Int).SetBytes(normalize(a.network.IP))
+	ones, bits := a.network.Mask.Size()
+	last := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)), big.NewInt(1))
+	offset := new(big.Int).Sub(host, base)
+	if offset.Sign() == 0 || offset.Cmp(last) == 0 {
+		return false
+	}
+	for _, r := range a.reserved {
+		if r.Equal(ip) {
+			return false
+		}
+	}
+	for k, l := range a.leases {
+		if k != key && l.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the address leased to key
+func (a *Allocator) Lookup(key wgtypes.Key) (net.IP, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ip, ok := a.leases[key]
+	return ip, ok
+}
+
+// Allocate returns the address leased to key, leasing the next free address
+// of the network if there is none yet
+func (a *Allocator) Allocate(key wgtypes.Key) (net.IP, error) {
+	return a.AllocateIn(key, nil)
+}
+
+// AllocateIn is like Allocate but leases addresses within the prefix, moving
+// a lease that lies outside of it. A nil prefix means the whole network.
+func (a *Allocator) AllocateIn(key wgtypes.Key, prefix *net.IPNet) (net.IP, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	within := a.network
+	if prefix != nil {
+		within = *prefix
+	}
+	current, ok := a.leases[key]
+	if ok && within.Contains(current) {
+		return current, nil
+	}
+	ones, bits := within.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	base := new(big.Int).SetBytes(normalize(within.IP))
+	for i := big.NewInt(1); i.Cmp(size) < 0; i.Add(i, big.NewInt(1)) {
+		ip := toIP(new(big.Int).Add(base, i), len(normalize(within.IP)))
+		if a.usable(ip, key) {
+			a.leases[key] = ip
+			if err := a.save(); err != nil {
+				if ok {
+					a.leases[key] = current
+				} else {
+					delete(a.leases, key)
+				}
+				return nil, err
+			}
+			return ip, nil
+		}
+		if i.IsInt64() && i.Int64() > maxScan {
+			break
+		}
+	}
+	return nil, errors.Errorf("No free address left in %s", &within)
+}
+
+// maxScan bounds the search for a free address in huge (e.g. /64) networks
+var maxScan int64 = 1 << 20
+
+// Request leases the preferred address to key, replacing its current lease.
+// It reports whether the lease changed.
+func (a *Allocator) Request(key wgtypes.Key, preferred net.IP) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current, ok := a.leases[key]
+	if ok && current.Equal(preferred) {
+		return false, nil
+	}
+	if !a.usable(preferred, key) {
+		return false, errors.Errorf("Address %s is not available", preferred)
+	}
+	a.leases[key] = normalize(preferred)
+	if err := a.save(); err != nil {
+		if ok {
+			a.leases[key] = current
+		} else {
+			delete(a.leases, key)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Reserve keeps ip from being leased until it is unreserved
+func (a *Allocator) Reserve(ip net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reserved = append(a.reserved, normalize(ip))
+}
+
+// Unreserve undoes one Reserve of ip
+func (a *Allocator) Unreserve(ip net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, r := range a.reserved {
+		if r.Equal(ip) {
+			a.reserved = append(a.reserved[:i], a.reserved[i+1:]...)
+			return
+		}
+	}
+}
+
+// Release removes the lease of key
+func (a *Allocator) Release(key wgtypes.Key) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.leases[key]; !ok {
+		return nil
+	}
+	delete(a.leases, key)
+	return a.save()
+}
+
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func toIP(n *big.Int, size int) net.IP {
+	b := n.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
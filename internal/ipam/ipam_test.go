@@ -0,0 +1,247 @@
+package ipam
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey()
+}
+
+func mustCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func load(t *testing.T, network string, reserved ...string) *Allocator {
+	t.Helper()
+	var ips []net.IP
+	for _, r := range reserved {
+		ips = append(ips, net.ParseIP(r))
+	}
+	a, err := Load(mustCIDR(t, network), filepath.Join(t.TempDir(), "leases.json"), ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		reserved []string
+		want     []string
+	}{
+		// Neither the network nor the broadcast address is leased
+		{"small network", "10.0.0.0/30", nil, []string{"10.0.0.1", "10.0.0.2", ""}},
+		{"reserved", "10.0.0.0/29", []string{"10.0.0.1", "10.0.0.3"}, []string{"10.0.0.2", "10.0.0.4"}},
+		{"ipv6", "fd00::/126", []string{"fd00::2"}, []string{"fd00::1", ""}},
+	}
+	for _, tt := range tests {
+		a := load(t, tt.network, tt.reserved...)
+		for i, want := range tt.want {
+			ip, err := a.Allocate(newKey(t))
+			if want == "" {
+				if err == nil {
+					t.Errorf("%s: allocation %d got %s, want none left", tt.name, i, ip)
+				}
+				continue
+			}
+			if err != nil || !ip.Equal(net.ParseIP(want)) {
+				t.Errorf("%s: allocation %d got %s (%v), want %s", tt.name, i, ip, err, want)
+			}
+		}
+	}
+}
+
+func TestAllocateKeepsLease(t *testing.T) {
+	a := load(t, "10.0.0.0/24")
+	key := newKey(t)
+	first, err := a.Allocate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Allocate(newKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := a.Allocate(key); err != nil || !again.Equal(first) {
+		t.Errorf("Allocating again got %s (%v), want %s", again, err, first)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	a := load(t, "10.0.0.0/24", "10.0.0.9")
+	key, other := newKey(t), newKey(t)
+	if _, err := a.Request(other, net.ParseIP("10.0.0.7")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		preferred string
+		changed   bool
+		ok        bool
+	}{
+		{"free", "10.0.0.5", true, true},
+		{"current", "10.0.0.5", false, true},
+		{"moved", "10.0.0.6", true, true},
+		{"network address", "10.0.0.0", false, false},
+		{"broadcast address", "10.0.0.255", false, false},
+		{"outside", "10.0.1.5", false, false},
+		{"reserved", "10.0.0.9", false, false},
+		{"leased to another key", "10.0.0.7", false, false},
+	}
+	for _, tt := range tests {
+		changed, err := a.Request(key, net.ParseIP(tt.preferred))
+		if (err == nil) != tt.ok || changed != tt.changed {
+			t.Errorf("%s: got changed %v (%v), want %v and ok %v", tt.name, changed, err, tt.changed, tt.ok)
+		}
+	}
+	if ip, _ := a.Lookup(key); !ip.Equal(net.ParseIP("10.0.0.6")) {
+		t.Errorf("Lease is %s after rejected requests, want 10.0.0.6", ip)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	a := load(t, "10.0.0.0/24")
+	ip := net.ParseIP("10.0.0.5")
+	a.Reserve(ip)
+	if _, err := a.Request(newKey(t), ip); err == nil {
+		t.Error("Reserved address was leased")
+	}
+	a.Unreserve(ip)
+	if _, err := a.Request(newKey(t), ip); err != nil {
+		t.Errorf("Unreserved address was not leased: %v", err)
+	}
+}
+
+func TestSaveFailureRollsBack(t *testing.T) {
+	a := load(t, "10.0.0.0/24")
+	key := newKey(t)
+	if _, err := a.Request(key, net.ParseIP("10.0.0.5")); err != nil {
+		t.Fatal(err)
+	}
+	// The directory of the leases cannot be created below a file
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.path = filepath.Join(blocker, "leases.json")
+	if _, err := a.Request(key, net.ParseIP("10.0.0.6")); err == nil {
+		t.Error("Request succeeded without saving")
+	}
+	if ip, _ := a.Lookup(key); !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("Lease is %s after a failed request, want 10.0.0.5", ip)
+	}
+	fresh := newKey(t)
+	if _, err := a.Allocate(fresh); err == nil {
+		t.Error("Allocation succeeded without saving")
+	}
+	if ip, ok := a.Lookup(fresh); ok {
+		t.Errorf("Failed allocation left lease %s", ip)
+	}
+	if err := a.Release(key); err == nil {
+		t.Error("Release succeeded without saving")
+	}
+}
+
+func TestMaxScan(t *testing.T) {
+	defer func(n int64) { maxScan = n }(maxScan)
+	maxScan = 4
+	a := load(t, "fd00::/64", "fd00::1", "fd00::2", "fd00::3", "fd00::4", "fd00::5")
+	if ip, err := a.Allocate(newKey(t)); err == nil {
+		t.Errorf("Allocation scanned past the bound to %s", ip)
+	}
+	maxScan = 5
+	if ip, err := a.Allocate(newKey(t)); err != nil || !ip.Equal(net.ParseIP("fd00::6")) {
+		t.Errorf("Allocation got %s (%v), want fd00::6", ip, err)
+	}
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	network := mustCIDR(t, "10.0.0.0/24")
+	path := filepath.Join(t.TempDir(), "leases", "leases.json")
+	a, err := Load(network, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newKey(t)
+	ip, err := a.Allocate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Load(network, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := b.Lookup(key); !ok || !got.Equal(ip) {
+		t.Errorf("Lease after restart is %s (%v), want %s", got, ok, ip)
+	}
+	if again, err := b.Allocate(key); err != nil || !again.Equal(ip) {
+		t.Errorf("Allocating after restart got %s (%v), want %s", again, err, ip)
+	}
+	if _, err := Load(mustCIDR(t, "10.1.0.0/24"), path, nil); err == nil {
+		t.Error("Leases outside the network were loaded")
+	}
+}
+
+func TestAllocateIn(t *testing.T) {
+	a := load(t, "10.0.0.0/16")
+	prefix := mustCIDR(t, "10.0.4.0/30")
+	var keys []wgtypes.Key
+	for i := 0; i < 4; i++ {
+		keys = append(keys, newKey(t))
+	}
+	// The scan starts after the first address of the prefix. Its last one is
+	// no broadcast address of the overlay network, so it is leased.
+	for i, want := range []string{"10.0.4.1", "10.0.4.2", "10.0.4.3", ""} {
+		ip, err := a.AllocateIn(keys[i], &prefix)
+		if want == "" {
+			if err == nil {
+				t.Errorf("Allocation %d got %s, want none left in %s", i, ip, &prefix)
+			}
+			continue
+		}
+		if err != nil || !ip.Equal(net.ParseIP(want)) || !prefix.Contains(ip) {
+			t.Errorf("Allocation %d got %s (%v), want %s", i, ip, err, want)
+		}
+	}
+}
+
+func TestAllocateInMovesLease(t *testing.T) {
+	a := load(t, "10.0.0.0/16")
+	key := newKey(t)
+	if _, err := a.Request(key, net.ParseIP("10.0.9.9")); err != nil {
+		t.Fatal(err)
+	}
+	inside := mustCIDR(t, "10.0.0.0/17")
+	if ip, err := a.AllocateIn(key, &inside); err != nil || !ip.Equal(net.ParseIP("10.0.9.9")) {
+		t.Errorf("Lease within the prefix moved to %s (%v)", ip, err)
+	}
+	prefix := mustCIDR(t, "10.0.4.0/24")
+	ip, err := a.AllocateIn(key, &prefix)
+	if err != nil || !prefix.Contains(ip) {
+		t.Fatalf("Lease outside the prefix moved to %s (%v), want within %s", ip, err, &prefix)
+	}
+	if leased, _ := a.Lookup(key); !leased.Equal(ip) {
+		t.Errorf("Lease is %s, want %s", leased, ip)
+	}
+	// The old address is free again
+	if _, err := a.Request(newKey(t), net.ParseIP("10.0.9.9")); err != nil {
+		t.Errorf("Previous address was not freed: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Package kube is a minimal client of the Kubernetes API, enough for nodes to
+// publish records as annotations of their node objects and to read those of
+// the others. It authenticates with the service account of the pod.
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// serviceAccount is where the kubelet mounts the credentials of the pod
+const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const requestTimeout = 10 * time.Second
+
+// Node is the part of a node object the overlay uses
+type Node struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		PodCIDR  string   `json:"podCIDR"`
+		PodCIDRs []string `json:"podCIDRs"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+// InternalIP returns the InternalIP address of the node, if any
+func (n *Node) InternalIP() net.IP {
+	for _, a := range n.Status.Addresses {
+		if a.Type == "InternalIP" {
+			return net.ParseIP(a.Address)
+		}
+	}
+	return nil
+}
+
+// PodCIDRs returns the pod networks allocated to the node
+func (n *Node) PodCIDRs() []net.IPNet {
+	cidrs := n.Spec.PodCIDRs
+	if len(cidrs) == 0 && n.Spec.PodCIDR != "" {
+		cidrs = []string{n.Spec.PodCIDR}
+	}
+	var networks []net.IPNet
+	for _, c := range cidrs {
+		if _, n, err := net.ParseCIDR(c); err == nil {
+			networks = append(networks, *n)
+		}
+	}
+	return networks
+}
+
+// Client talks to the API server of the cluster
+type Client struct {
+	api       string
+	tokenFile string
+	http      *http.Client
+}
+
+// InCluster returns a client of the API server of the cluster the pod runs in
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccount, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read cluster CA")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("Could not parse cluster CA")
+	}
+	return &Client{
+		api:       "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccount, "token"),
+		http: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+	}, nil
+}
+
+// do sends the body, if any, JSON encoded and decodes the response into out
+func (c *Client) do(method, path, contentType string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.api+path, reader)
+	if err != nil {
+		return err
+	}
+	// The kubelet replaces the token before it expires
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return errors.Wrap(err, "Could not read service account token")
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("API server responded %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Nodes lists the nodes of the cluster
+func (c *Client) Nodes() ([]Node, error) {
+	var list struct {
+		Items []Node `json:"items"`
+	}
+	if err := c.do(http.MethodGet, "/api/v1/nodes", "", nil, &list); err != nil {
+		return nil, errors.Wrap(err, "Could not list nodes")
+	}
+	return list.Items, nil
+}
+
+// Node gets the node with the name
+func (c *Client) Node(name string) (*Node, error) {
+	var node Node
+	if err := c.do(http.MethodGet, "/api/v1/nodes/"+name, "", nil, &node); err != nil {
+		return nil, errors.Wrapf(err, "Could not get node %s", name)
+	}
+	return &node, nil
+}
+
+// Annotate sets the annotations of the node; nil values remove them
+func (c *Client) Annotate(name string, annotations map[string]*string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	}
+	return errors.Wrapf(c.do(http.MethodPatch, "/api/v1/nodes/"+name, "application/merge-patch+json", patch, nil), "Could not annotate node %s", name)
+}
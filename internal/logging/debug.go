@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DebugPeer logs the entries about the peer at debug level for d, whatever
+// the levels of their subsystems. It replaces the previous session, if any.
+func DebugPeer(peer string, d time.Duration) time.Time {
+	mu.Lock()
+	if debugTimer != nil {
+		debugTimer.Stop()
+	}
+	until := time.Now().Add(d)
+	debugged, debugUntil = peer, until
+	debugTimer = time.AfterFunc(d, func() { stopDebugPeer(until) })
+	apply()
+	mu.Unlock()
+	logrus.WithField("peer", peer).Infof("Debugging peer until %s", until.Format(time.RFC3339))
+	return until
+}
+
+// StopDebugPeer ends the debug session
+func StopDebugPeer() {
+	stopDebugPeer(time.Time{})
+}
+
+// stopDebugPeer ends the session, if it ends at until or until is zero, so
+// that a late timer does not end the next session
+func stopDebugPeer(until time.Time) {
+	mu.Lock()
+	peer := debugged
+	if peer == "" || (!until.IsZero() && !until.Equal(debugUntil)) {
+		mu.Unlock()
+		return
+	}
+	if debugTimer != nil {
+		debugTimer.Stop()
+	}
+	debugged, debugUntil, debugTimer = "", time.Time{}, nil
+	apply()
+	mu.Unlock()
+	logrus.WithField("peer", peer).Info("Stopped debugging peer")
+}
+
+// Debugged returns the peer being debugged, if any
+func Debugged() (string, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	return debugged, debugged != ""
+}
+
+// DebugSession is a running debug session. Minutes set to 0 stops it.
+type DebugSession struct {
+	Peer    string    `json:"peer"`
+	Minutes int       `json:"minutes,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+}
+
+// DebugHandler serves the debug session and starts or stops one on POST
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req DebugSession
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+				http.Error(w, "Could not decode request", http.StatusBadRequest)
+				return
+			}
+			if req.Minutes <= 0 {
+				StopDebugPeer()
+				break
+			}
+			if _, err := wgtypes.ParseKey(req.Peer); err != nil {
+				http.Error(w, "Invalid public key", http.StatusBadRequest)
+				return
+			}
+			DebugPeer(req.Peer, time.Duration(req.Minutes)*time.Minute)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		session := DebugSession{Peer: debugged, Until: debugUntil}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(session); err != nil {
+			logrus.WithError(err).Error("Could not write response")
+		}
+	})
+}
+
+// RunDebugCommand starts a debug session of the peer for the given minutes,
+// or stops the running one if minutes is 0, on the daemon behind the control
+// socket
+func RunDebugCommand(socket, peer string, minutes int) error {
+	if minutes > 0 && peer == "" {
+		return errors.New("A peer key is required")
+	}
+	var session DebugSession
+	if err := control.Call(socket, http.MethodPost, control.DebugPath, DebugSession{Peer: peer, Minutes: minutes}, &session); err != nil {
+		return err
+	}
+	if session.Peer == "" {
+		fmt.Println("Not debugging any peer")
+		return nil
+	}
+	fmt.Printf("Debugging %s until %s\n", session.Peer, session.Until.Format(time.RFC3339))
+	return nil
+}
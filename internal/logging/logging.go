@@ -0,0 +1,243 @@
+// Package logging sets up the log output and lets the level of each subsystem
+// be set apart from the global level, also at runtime.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu sync.Mutex
+	// subsystems log through their own logger, which shares the output,
+	// formatter and hooks of the standard logger but not its level
+	subsystems = make(map[string]*logrus.Logger)
+	overrides  = make(map[string]logrus.Level)
+	global     = logrus.InfoLevel
+	// debugged is the peer whose entries are logged at debug level until
+	// debugUntil, whatever the level of their subsystem
+	debugged   string
+	debugUntil time.Time
+	debugTimer *time.Timer
+)
+
+// For returns the logger of a subsystem. Its entries carry the subsystem as a
+// field.
+func For(subsystem string) *logrus.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	l, ok := subsystems[subsystem]
+	if !ok {
+		std := logrus.StandardLogger()
+		l = logrus.New()
+		l.Out = std.Out
+		l.Formatter = std.Formatter
+		l.Hooks = std.Hooks
+		l.ExitFunc = std.ExitFunc
+		l.SetLevel(raised(levelOf(subsystem)))
+		subsystems[subsystem] = l
+	}
+	return l.WithField("subsystem", subsystem)
+}
+
+// Setup sets the output format (text or json), the global level and the
+// overrides given as subsystem=level
+func Setup(format, level string, levels []string) error {
+	var formatter logrus.Formatter
+	switch format {
+	case "text":
+		formatter = &logrus.TextFormatter{}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return errors.Errorf("Unknown log format %q", format)
+	}
+	globalLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return errors.Wrap(err, "Could not parse loglevel")
+	}
+	formatter = &filter{next: formatter}
+	logrus.SetFormatter(formatter)
+	mu.Lock()
+	for _, l := range subsystems {
+		l.SetFormatter(formatter)
+	}
+	global = globalLevel
+	apply()
+	mu.Unlock()
+	return SetLevels(levels)
+}
+
+// SetNode adds the node to every entry
+func SetNode(node string) {
+	logrus.AddHook(nodeHook(node))
+}
+
+type nodeHook string
+
+func (h nodeHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h nodeHook) Fire(e *logrus.Entry) error {
+	e.Data["node"] = string(h)
+	return nil
+}
+
+// levelOf returns the level set for the subsystem, "" for the standard logger
+func levelOf(subsystem string) logrus.Level {
+	if level, ok := overrides[subsystem]; ok {
+		return level
+	}
+	return global
+}
+
+// raised returns the level a logger needs so that the entries of a debugged
+// peer pass it
+func raised(level logrus.Level) logrus.Level {
+	if debugged != "" && level < logrus.DebugLevel {
+		return logrus.DebugLevel
+	}
+	return level
+}
+
+// apply sets the levels of the loggers
+func apply() {
+	logrus.SetLevel(raised(global))
+	for name, l := range subsystems {
+		l.SetLevel(raised(levelOf(name)))
+	}
+}
+
+// filter drops the entries that only pass because a peer is debugged
+type filter struct {
+	next logrus.Formatter
+}
+
+func (f *filter) Format(e *logrus.Entry) ([]byte, error) {
+	subsystem, _ := e.Data["subsystem"].(string)
+	mu.Lock()
+	drop := e.Level > levelOf(subsystem) && (debugged == "" || e.Data["peer"] != debugged)
+	mu.Unlock()
+	if drop {
+		return nil, nil
+	}
+	return f.next.Format(e)
+}
+
+// SetLevels applies levels given as subsystem=level, or as a bare level for
+// the global level. The level default drops the override of a subsystem.
+func SetLevels(levels []string) error {
+	for _, spec := range levels {
+		name, value := "", spec
+		if i := strings.Index(spec, "="); i >= 0 {
+			name, value = spec[:i], spec[i+1:]
+		}
+		var level logrus.Level
+		if name == "" || value != "default" {
+			var err error
+			if level, err = logrus.ParseLevel(value); err != nil {
+				return errors.Wrapf(err, "Invalid log level %q", spec)
+			}
+		}
+		mu.Lock()
+		switch {
+		case name == "":
+			global = level
+		case value == "default":
+			delete(overrides, name)
+		default:
+			overrides[name] = level
+		}
+		apply()
+		mu.Unlock()
+	}
+	return nil
+}
+
+// Levels are the global level and the effective level of every subsystem
+type Levels struct {
+	Level      string            `json:"level"`
+	Subsystems map[string]string `json:"subsystems"`
+	// Overridden lists the subsystems whose level is set apart
+	Overridden []string `json:"overridden,omitempty"`
+}
+
+// Current returns the levels in effect
+func Current() Levels {
+	mu.Lock()
+	defer mu.Unlock()
+	levels := Levels{Level: global.String(), Subsystems: make(map[string]string, len(subsystems))}
+	for name := range subsystems {
+		levels.Subsystems[name] = levelOf(name).String()
+	}
+	for name := range overrides {
+		levels.Overridden = append(levels.Overridden, name)
+	}
+	sort.Strings(levels.Overridden)
+	return levels
+}
+
+// LevelsRequest changes levels at runtime, given like for SetLevels
+type LevelsRequest struct {
+	Levels []string `json:"levels"`
+}
+
+// Handler serves the levels and changes them on POST
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req LevelsRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+				http.Error(w, "Could not decode request", http.StatusBadRequest)
+				return
+			}
+			if err := SetLevels(req.Levels); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logrus.Infof("Log levels changed: %s", strings.Join(req.Levels, ","))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Current()); err != nil {
+			logrus.WithError(err).Error("Could not write response")
+		}
+	})
+}
+
+// RunCommand applies the levels, if any, to the daemon behind the control
+// socket and prints the levels in effect
+func RunCommand(socket string, levels []string) error {
+	var current Levels
+	if len(levels) == 0 {
+		if err := control.Call(socket, http.MethodGet, control.LogPath, nil, &current); err != nil {
+			return err
+		}
+	} else if err := control.Call(socket, http.MethodPost, control.LogPath, LevelsRequest{Levels: levels}, &current); err != nil {
+		return err
+	}
+	fmt.Println("global:", current.Level)
+	names := make([]string, 0, len(current.Subsystems))
+	for name := range current.Subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, current.Subsystems[name])
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+// Package noise secures connections with the Noise IK handshake
+// (Noise_IK_25519_ChaChaPoly_BLAKE2s), authenticating both ends by their
+// wireguard keys. The initiator has to know the static key of the responder
+// beforehand, as clients know the key of the server.
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	protocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+	prologue     = "wireguard-overlay control"
+	// Messages are framed with their length in 2 bytes
+	maxMessage = 65535
+	maxPayload = maxMessage - tagLen
+	keyLen     = 32
+	tagLen     = 16
+)
+
+// Conn is a connection secured by the handshake, which runs on first use
+type Conn struct {
+	net.Conn
+	initiator bool
+	static    wgtypes.Key
+	remote    wgtypes.Key
+	once      sync.Once
+	err       error
+	send      *cipherState
+	recv      *cipherState
+	rmu       sync.Mutex
+	wmu       sync.Mutex
+	pending   []byte
+}
+
+// Client secures conn as the initiator with the static key, expecting the
+// responder to have the remote key
+func Client(conn net.Conn, static, remote wgtypes.Key) *Conn {
+	return &Conn{Conn: conn, initiator: true, static: static, remote: remote}
+}
+
+// Server secures conn as the responder with the static key
+func Server(conn net.Conn, static wgtypes.Key) *Conn {
+	return &Conn{Conn: conn, static: static}
+}
+
+// Handshake runs the handshake unless it ran already
+func (c *Conn) Handshake() error {
+	c.once.Do(func() { c.err = c.handshake() })
+	return c.err
+}
+
+// RemoteKey returns the static key the other end authenticated with
+func (c *Conn) RemoteKey() (wgtypes.Key, error) {
+	if err := c.Handshake(); err != nil {
+		return wgtypes.Key{}, err
+	}
+	return c.remote, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		frame, err := readFrame(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.pending, err = c.recv.open(frame[:0], nil, frame); err != nil {
+			return 0, errors.New("Could not decrypt message")
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+		frame := c.send.seal(make([]byte, 2, 2+len(chunk)+tagLen), nil, chunk)
+		binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+		if _, err := c.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *Conn) handshake() error {
+	var s symmetric
+	s.h = hashOf([]byte(protocolName))
+	s.ck = s.h
+	s.mixHash([]byte(prologue))
+	responder := c.remote
+	if !c.initiator {
+		responder = c.static.PublicKey()
+	}
+	s.mixHash(responder[:])
+	e, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return errors.Wrap(err, "Could not generate ephemeral key")
+	}
+	ePub := e.PublicKey()
+	if c.initiator {
+		// -> e, es, s, ss
+		msg := append([]byte{}, ePub[:]...)
+		s.mixHash(ePub[:])
+		if err := s.mixDH(e, c.remote); err != nil {
+			return err
+		}
+		pub := c.static.PublicKey()
+		msg = s.encryptAndHash(msg, pub[:])
+		if err := s.mixDH(c.static, c.remote); err != nil {
+			return err
+		}
+		msg = s.encryptAndHash(msg, nil)
+		if err := writeFrame(c.Conn, msg); err != nil {
+			return errors.Wrap(err, "Could not send handshake")
+		}
+		// <- e, ee, se
+		if msg, err = readFrame(c.Conn); err != nil {
+			return errors.Wrap(err, "Could not receive handshake response")
+		}
+		if len(msg) != keyLen+tagLen {
+			return errors.New("Invalid handshake response")
+		}
+		var re wgtypes.Key
+		copy(re[:], msg)
+		s.mixHash(re[:])
+		if err := s.mixDH(e, re); err != nil {
+			return err
+		}
+		if err := s.mixDH(c.static, re); err != nil {
+			return err
+		}
+		if _, err := s.decryptAndHash(msg[keyLen:]); err != nil {
+			return errors.New("Could not authenticate the responder")
+		}
+		c.send, c.recv = s.split()
+		return nil
+	}
+	// -> e, es, s, ss
+	msg, err := readFrame(c.Conn)
+	if err != nil {
+		return errors.Wrap(err, "Could not receive handshake")
+	}
+	if len(msg) != 2*keyLen+2*tagLen {
+		return errors.New("Invalid handshake")
+	}
+	var re wgtypes.Key
+	copy(re[:], msg)
+	s.mixHash(re[:])
+	if err := s.mixDH(c.static, re); err != nil {
+		return err
+	}
+	rs, err := s.decryptAndHash(msg[keyLen : 2*keyLen+tagLen])
+	if err != nil {
+		return errors.New("Could not decrypt the initiator's key")
+	}
+	copy(c.remote[:], rs)
+	if err := s.mixDH(c.static, c.remote); err != nil {
+		return err
+	}
+	if _, err := s.decryptAndHash(msg[2*keyLen+tagLen:]); err != nil {
+		return errors.New("Could not authenticate the initiator")
+	}
+	// <- e, ee, se
+	msg = append([]byte{}, ePub[:]...)
+	s.mixHash(ePub[:])
+	if err := s.mixDH(e, re); err != nil {
+		return err
+	}
+	if err := s.mixDH(e, c.remote); err != nil {
+		return err
+	}
+	msg = s.encryptAndHash(msg, nil)
+	if err := writeFrame(c.Conn, msg); err != nil {
+		return errors.Wrap(err, "Could not send handshake response")
+	}
+	c.recv, c.send = s.split()
+	return nil
+}
+
+// NewListener returns a listener securing the connections it accepts as the
+// responder with the static key
+func NewListener(l net.Listener, static wgtypes.Key) net.Listener {
+	return &listener{Listener: l, static: static}
+}
+
+type listener struct {
+	net.Listener
+	static wgtypes.Key
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.static), nil
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// symmetric is the symmetric state of the handshake
+type symmetric struct {
+	ck [keyLen]byte
+	h  [keyLen]byte
+	k  *cipherState
+}
+
+func (s *symmetric) mixHash(data []byte) {
+	s.h = hashOf(s.h[:], data)
+}
+
+func (s *symmetric) mixKey(ikm []byte) {
+	var k [keyLen]byte
+	s.ck, k = hkdf(s.ck, ikm)
+	s.k = newCipherState(k)
+}
+
+func (s *symmetric) mixDH(private, public wgtypes.Key) error {
+	shared, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return errors.Wrap(err, "Invalid key in handshake")
+	}
+	s.mixKey(shared)
+	return nil
+}
+
+// encryptAndHash appends the encrypted plaintext to out. All messages of IK
+// are encrypted, so the key is always set.
+func (s *symmetric) encryptAndHash(out, plaintext []byte) []byte {
+	ciphertext := s.k.seal(nil, s.h[:], plaintext)
+	s.mixHash(ciphertext)
+	return append(out, ciphertext...)
+}
+
+func (s *symmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.k.open(nil, s.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the cipher states from the initiator and from the responder
+func (s *symmetric) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(s.ck, nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(k [keyLen]byte) *cipherState {
+	aead, _ := chacha20poly1305.New(k[:])
+	return &cipherState{aead: aead}
+}
+
+func (c *cipherState) nonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce[:]
+}
+
+func (c *cipherState) seal(out, ad, plaintext []byte) []byte {
+	return c.aead.Seal(out, c.nonce(), plaintext, ad)
+}
+
+func (c *cipherState) open(out, ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(out, c.nonce(), ciphertext, ad)
+}
+
+func newHash() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func hashOf(data ...[]byte) (sum [keyLen]byte) {
+	h := newHash()
+	for _, d := range data {
+		h.Write(d)
+	}
+	h.Sum(sum[:0])
+	return sum
+}
+
+func hmacOf(key []byte, data ...[]byte) (sum [keyLen]byte) {
+	m := hmac.New(newHash, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	m.Sum(sum[:0])
+	return sum
+}
+
+// hkdf derives two keys from the chaining key and the input key material
+func hkdf(ck [keyLen]byte, ikm []byte) ([keyLen]byte, [keyLen]byte) {
+	prk := hmacOf(ck[:], ikm)
+	k1 := hmacOf(prk[:], []byte{1})
+	k2 := hmacOf(prk[:], k1[:], []byte{2})
+	return k1, k2
+}
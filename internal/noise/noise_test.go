@@ -0,0 +1,171 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func generateKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// recordingConn records the size of each write and, once tampering is set,
+// flips a bit of the last byte written
+type recordingConn struct {
+	net.Conn
+	mu       sync.Mutex
+	writes   []int
+	tamper   bool
+	recorded bool
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.recorded {
+		c.writes = append(c.writes, len(b))
+	}
+	if c.tamper {
+		b = append([]byte{}, b...)
+		b[len(b)-1] ^= 1
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// pair connects a client and a server over a pipe and runs the handshake on
+// both, returning the error of each side
+func pair(t *testing.T, client, server, remote wgtypes.Key) (*Conn, *Conn, *recordingConn, error, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	raw := &recordingConn{Conn: a}
+	c := Client(raw, client, remote)
+	s := Server(b, server)
+	done := make(chan error, 1)
+	go func() {
+		err := s.Handshake()
+		if err != nil {
+			// Unblocks the client waiting for the response
+			b.Close()
+		}
+		done <- err
+	}()
+	clientErr := c.Handshake()
+	return c, s, raw, clientErr, <-done
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := generateKey(t), generateKey(t)
+	c, s, _, clientErr, serverErr := pair(t, client, server, server.PublicKey())
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("Handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	if key, err := c.RemoteKey(); err != nil || key != server.PublicKey() {
+		t.Errorf("Client sees remote key %s (%v), want %s", key, err, server.PublicKey())
+	}
+	if key, err := s.RemoteKey(); err != nil || key != client.PublicKey() {
+		t.Errorf("Server sees remote key %s (%v), want %s", key, err, client.PublicKey())
+	}
+	for _, dir := range []struct {
+		name string
+		from *Conn
+		to   *Conn
+	}{
+		{"client to server", c, s},
+		{"server to client", s, c},
+	} {
+		msg := []byte("peers " + dir.name)
+		go dir.from.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("%s: got %q, want %q", dir.name, got, msg)
+		}
+	}
+}
+
+func TestWrongResponderKey(t *testing.T) {
+	client, server, other := generateKey(t), generateKey(t), generateKey(t)
+	_, _, _, clientErr, serverErr := pair(t, client, server, other.PublicKey())
+	if clientErr == nil {
+		t.Error("Client completed the handshake with the wrong responder key")
+	}
+	if serverErr == nil {
+		t.Error("Server accepted a handshake meant for another key")
+	}
+}
+
+func TestTamperedFrame(t *testing.T) {
+	client, server := generateKey(t), generateKey(t)
+	c, s, raw, clientErr, serverErr := pair(t, client, server, server.PublicKey())
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("Handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	raw.mu.Lock()
+	raw.tamper = true
+	raw.mu.Unlock()
+	go c.Write([]byte("register"))
+	if _, err := s.Read(make([]byte, 64)); err == nil {
+		t.Error("Tampered frame was decrypted")
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	client, server := generateKey(t), generateKey(t)
+	c, s, raw, clientErr, serverErr := pair(t, client, server, server.PublicKey())
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("Handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	raw.mu.Lock()
+	raw.recorded = true
+	raw.mu.Unlock()
+	msg := make([]byte, 2*maxPayload+100)
+	if _, err := rand.Read(msg); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		n, err := c.Write(msg)
+		if err == nil && n != len(msg) {
+			t.Errorf("Wrote %d bytes, want %d", n, len(msg))
+		}
+		written <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("Message changed on the way")
+	}
+	want := []int{2 + maxMessage, 2 + maxMessage, 2 + 100 + tagLen}
+	raw.mu.Lock()
+	defer raw.mu.Unlock()
+	if len(raw.writes) != len(want) {
+		t.Fatalf("Sent %d frames (%v), want %d", len(raw.writes), raw.writes, len(want))
+	}
+	for i := range want {
+		if raw.writes[i] != want[i] {
+			t.Errorf("Frame %d has %d bytes, want %d", i, raw.writes[i], want[i])
+		}
+	}
+}
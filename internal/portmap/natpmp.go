@@ -0,0 +1,115 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NAT-PMP as specified in RFC 6886
+const (
+	natpmpPort           = 5351
+	natpmpVersion        = 0
+	natpmpOpExternal     = 0
+	natpmpOpMapUDP       = 1
+	natpmpResponseFlag   = 128
+	natpmpTries          = 4
+	natpmpInitialTimeout = 250 * time.Millisecond
+)
+
+type natpmp struct {
+	gateway net.IP
+}
+
+func discoverNATPMP() (Mapper, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	m := &natpmp{gateway: gw}
+	if _, err := m.externalIP(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *natpmp) String() string {
+	return "NAT-PMP gateway " + m.gateway.String()
+}
+
+// call sends the request and waits for a response to the same opcode,
+// retransmitting with exponential backoff
+func (m *natpmp) call(req []byte, respLen int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: m.gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not connect to NAT-PMP gateway")
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	timeout := natpmpInitialTimeout
+	for i := 0; i < natpmpTries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, errors.Wrap(err, "Could not send NAT-PMP request")
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, errors.Wrap(err, "Could not read NAT-PMP response")
+		}
+		if n < respLen || buf[0] != natpmpVersion || buf[1] != req[1]|natpmpResponseFlag {
+			continue
+		}
+		if result := binary.BigEndian.Uint16(buf[2:4]); result != 0 {
+			return nil, errors.Errorf("NAT-PMP gateway returned result code %d", result)
+		}
+		return buf[:n], nil
+	}
+	return nil, errors.New("NAT-PMP gateway did not respond")
+}
+
+func (m *natpmp) externalIP() (net.IP, error) {
+	resp, err := m.call([]byte{natpmpVersion, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (m *natpmp) mapUDP(port, external int, lifetime time.Duration) (int, time.Duration, error) {
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(req[4:6], uint16(port))
+	binary.BigEndian.PutUint16(req[6:8], uint16(external))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := m.call(req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	mapped := int(binary.BigEndian.Uint16(resp[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return mapped, granted, nil
+}
+
+func (m *natpmp) Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	mapped, granted, err := m.mapUDP(port, port, lifetime)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &net.UDPAddr{IP: ip, Port: mapped}, granted, nil
+}
+
+func (m *natpmp) Unmap(port int) error {
+	_, _, err := m.mapUDP(port, 0, 0)
+	return err
+}
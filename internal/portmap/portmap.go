@@ -0,0 +1,188 @@
+package portmap
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	requestedLifetime = time.Hour
+	minRenewInterval  = 30 * time.Second
+	retryInterval     = time.Minute
+)
+
+// Mapper asks a router to forward an external UDP port to this host
+type Mapper interface {
+	// Map requests (or renews) a mapping for the local UDP port and returns
+	// the external endpoint and the lifetime granted by the router.
+	// A zero lifetime means the mapping does not expire.
+	Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error)
+	// Unmap removes the mapping for the local UDP port
+	Unmap(port int) error
+	String() string
+}
+
+// Discover finds a port mapping capable router using the given method
+// (upnp, natpmp or auto)
+func Discover(method string) (Mapper, error) {
+	switch method {
+	case "natpmp":
+		return discoverNATPMP()
+	case "upnp":
+		return discoverUPnP()
+	case "auto":
+		if m, err := discoverNATPMP(); err == nil {
+			return m, nil
+		} else {
+			logrus.WithError(err).Debug("NAT-PMP is not available")
+		}
+		return discoverUPnP()
+	}
+	return nil, errors.Errorf("Unknown port mapping method %q", method)
+}
+
+// defaultGateway returns the IPv4 gateway of the default route
+func defaultGateway() (net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list routes")
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Gw != nil {
+			return r.Gw, nil
+		}
+	}
+	return nil, errors.New("No default IPv4 gateway")
+}
+
+// PortMapping keeps a mapping alive by renewing it before it expires
+type PortMapping struct {
+	mapper   Mapper
+	port     int
+	mu       sync.Mutex
+	external *net.UDPAddr
+	// kept is the mapping made in the background, once Keep made it
+	kept *PortMapping
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPortMapping maps the local UDP port and starts renewing the mapping in
+// the background. Close must be called to remove the mapping.
+func NewPortMapping(mapper Mapper, port int) (*PortMapping, error) {
+	external, lifetime, err := mapper.Map(port, requestedLifetime)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not map port %d with %s", port, mapper)
+	}
+	logrus.Infof("Mapped UDP port %d to %s with %s", port, external, mapper)
+	pm := &PortMapping{
+		mapper:   mapper,
+		port:     port,
+		external: external,
+		done:     make(chan struct{}),
+	}
+	pm.wg.Add(1)
+	go pm.renew(lifetime)
+	return pm, nil
+}
+
+// Keep maps the local UDP port with a router found with the method, like
+// Discover and NewPortMapping, but keeps trying in the background while no
+// router can be found or the mapping fails, e.g. while the router boots.
+// External returns nil until the port is mapped.
+func Keep(method string, port int) (*PortMapping, error) {
+	switch method {
+	case "natpmp", "upnp", "auto":
+	default:
+		return nil, errors.Errorf("Unknown port mapping method %q", method)
+	}
+	pm := &PortMapping{port: port, done: make(chan struct{})}
+	pm.wg.Add(1)
+	go func() {
+		defer pm.wg.Done()
+		for {
+			mapper, err := Discover(method)
+			if err == nil {
+				var kept *PortMapping
+				if kept, err = NewPortMapping(mapper, port); err == nil {
+					pm.mu.Lock()
+					pm.kept = kept
+					pm.mu.Unlock()
+					return
+				}
+			}
+			logrus.WithError(err).Warnf("Could not map port %d, retrying in %s", port, retryInterval)
+			select {
+			case <-pm.done:
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}()
+	return pm, nil
+}
+
+func renewInterval(lifetime time.Duration) time.Duration {
+	if lifetime == 0 {
+		// Permanent mappings are refreshed anyway in case the router reboots
+		return requestedLifetime / 2
+	}
+	if lifetime/2 < minRenewInterval {
+		return minRenewInterval
+	}
+	return lifetime / 2
+}
+
+func (pm *PortMapping) renew(lifetime time.Duration) {
+	defer pm.wg.Done()
+	timer := time.NewTimer(renewInterval(lifetime))
+	defer timer.Stop()
+	for {
+		select {
+		case <-pm.done:
+			return
+		case <-timer.C:
+		}
+		external, lifetime, err := pm.mapper.Map(pm.port, requestedLifetime)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not renew port mapping")
+			timer.Reset(retryInterval)
+			continue
+		}
+		pm.mu.Lock()
+		if !external.IP.Equal(pm.external.IP) || external.Port != pm.external.Port {
+			logrus.Infof("Port mapping changed from %s to %s", pm.external, external)
+		}
+		pm.external = external
+		pm.mu.Unlock()
+		timer.Reset(renewInterval(lifetime))
+	}
+}
+
+// External returns the external endpoint of the mapping
+func (pm *PortMapping) External() *net.UDPAddr {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.kept != nil {
+		return pm.kept.External()
+	}
+	return pm.external
+}
+
+// Close stops renewing and removes the mapping from the router
+func (pm *PortMapping) Close() error {
+	close(pm.done)
+	pm.wg.Wait()
+	if pm.kept != nil {
+		return pm.kept.Close()
+	}
+	if pm.mapper == nil {
+		return nil
+	}
+	return pm.mapper.Unmap(pm.port)
+}
@@ -0,0 +1,261 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ssdpAddr      = "239.255.255.250:1900"
+	ssdpTimeout   = 3 * time.Second
+	soapTimeout   = 5 * time.Second
+	igdDeviceType = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	mappingDesc   = "wireguard-overlay"
+	// UPnP error returned by routers that only accept permanent leases
+	errOnlyPermanentLeases = "725"
+)
+
+var wanServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnp struct {
+	controlURL  string
+	serviceType string
+	localIP     net.IP
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+func (d *upnpDevice) findService(serviceType string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].findService(serviceType); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// ssdpSearch multicasts a search for an internet gateway device and
+// returns the location of its description
+func ssdpSearch() (*url.URL, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open SSDP socket")
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: " + igdDeviceType + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+		return nil, errors.Wrap(err, "Could not send SSDP search")
+	}
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "No UPnP internet gateway device found")
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
+		if loc, err := url.Parse(res.Header.Get("Location")); err == nil && loc.Host != "" {
+			return loc, nil
+		}
+	}
+}
+
+func discoverUPnP() (Mapper, error) {
+	loc, err := ssdpSearch()
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: soapTimeout}
+	res, err := client.Get(loc.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not fetch UPnP device description")
+	}
+	defer res.Body.Close()
+	var root upnpRoot
+	if err := xml.NewDecoder(res.Body).Decode(&root); err != nil {
+		return nil, errors.Wrap(err, "Could not decode UPnP device description")
+	}
+	base := loc
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	for _, st := range wanServiceTypes {
+		control := root.Device.findService(st)
+		if control == "" {
+			continue
+		}
+		ref, err := url.Parse(control)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid UPnP control URL")
+		}
+		// The router forwards to the address we reach it from
+		conn, err := net.Dial("udp4", loc.Host)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not determine local address")
+		}
+		localIP := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		return &upnp{
+			controlURL:  base.ResolveReference(ref).String(),
+			serviceType: st,
+			localIP:     localIP,
+		}, nil
+	}
+	return nil, errors.New("UPnP device has no WAN connection service")
+}
+
+func (m *upnp) String() string {
+	return "UPnP gateway " + m.controlURL
+}
+
+// soap invokes an action on the WAN connection service and returns the raw
+// response body
+func (m *upnp) soap(action string, args [][2]string) ([]byte, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, m.serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a[0])
+		xml.EscapeText(&body, []byte(a[1]))
+		fmt.Fprintf(&body, "</%s>", a[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequest(http.MethodPost, m.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.serviceType, action))
+	client := http.Client{Timeout: soapTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not call UPnP action %s", action)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read UPnP response for %s", action)
+	}
+	if res.StatusCode != http.StatusOK {
+		var fault struct {
+			Code string `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		}
+		xml.Unmarshal(data, &fault)
+		return nil, &upnpError{action: action, code: fault.Code, status: res.StatusCode}
+	}
+	return data, nil
+}
+
+type upnpError struct {
+	action string
+	code   string
+	status int
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP action %s failed with status %d (error code %s)", e.action, e.status, e.code)
+}
+
+func (m *upnp) externalIP() (net.IP, error) {
+	data, err := m.soap("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(data, &res); err != nil {
+		return nil, errors.Wrap(err, "Could not decode external address")
+	}
+	ip := net.ParseIP(strings.TrimSpace(res.IP))
+	if ip == nil {
+		return nil, errors.Errorf("Router returned invalid external address %q", res.IP)
+	}
+	return ip, nil
+}
+
+func (m *upnp) addMapping(port int, lifetime time.Duration) error {
+	_, err := m.soap("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(port)},
+		{"NewProtocol", "UDP"},
+		{"NewInternalPort", strconv.Itoa(port)},
+		{"NewInternalClient", m.localIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", mappingDesc},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	})
+	return err
+}
+
+func (m *upnp) Map(port int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	err := m.addMapping(port, lifetime)
+	if ue, ok := err.(*upnpError); ok && ue.code == errOnlyPermanentLeases {
+		lifetime = 0
+		err = m.addMapping(port, lifetime)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	ip, err := m.externalIP()
+	if err != nil {
+		return nil, 0, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, lifetime, nil
+}
+
+func (m *upnp) Unmap(port int) error {
+	_, err := m.soap("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(port)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
@@ -0,0 +1,225 @@
+package protocol
+
+import "time"
+
+const (
+	// AdminPeersPath lists the peers known to the server
+	AdminPeersPath = "/api/peers"
+	// AdminApprovePath approves a public key to join the overlay
+	AdminApprovePath = "/api/peers/approve"
+	// AdminRevokePath removes a public key from the overlay
+	AdminRevokePath = "/api/peers/revoke"
+	// AdminKickPath drops the current session of a peer
+	AdminKickPath = "/api/peers/kick"
+	// AdminMetadataPath sets the metadata of a peer
+	AdminMetadataPath = "/api/peers/metadata"
+	// AdminAnnotatePath sets or removes annotations of a peer
+	AdminAnnotatePath = "/api/peers/annotate"
+	// AdminRenumberPath moves a peer to a new overlay address
+	AdminRenumberPath = "/api/peers/renumber"
+	// AdminDiagnosticsPath lists the failures reported by clients
+	AdminDiagnosticsPath = "/api/diagnostics"
+	// AdminPartitionPath reports whether the mesh is partitioned
+	AdminPartitionPath = "/api/partition"
+	// AdminChurnPath reports how often peers come and go
+	AdminChurnPath = "/api/churn"
+	// AdminRestartPath starts a rolling restart of a group and reports its
+	// progress
+	AdminRestartPath = "/api/restart"
+	// AdminViewPath renders the peer list a client would receive
+	AdminViewPath = "/api/view"
+	// AdminTokensPath mints an enrollment token
+	AdminTokensPath = "/api/tokens"
+	// AdminTopologyPath lists the links between the peers
+	AdminTopologyPath = "/api/topology"
+	// DashboardPath serves the web dashboard
+	DashboardPath = "/"
+)
+
+// AdminPeer is a peer as listed by the admin API
+type AdminPeer struct {
+	PublicKey string   `json:"public_key"`
+	Hostname  string   `json:"hostname,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	// Configured peers are listed in the server config
+	Configured bool     `json:"configured"`
+	Approved   bool     `json:"approved"`
+	Revoked    bool     `json:"revoked"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	// Static peers run the stock wireguard apps
+	Static bool `json:"static,omitempty"`
+	// NAT is the NAT behaviour the peer discovered with STUN
+	NAT string `json:"nat,omitempty"`
+	// Island is set on peers cut off from the largest part of the mesh
+	Island int `json:"island,omitempty"`
+	// Offline peers did not register within the peer TTL and are not
+	// distributed
+	Offline bool `json:"offline,omitempty"`
+	// Annotations are operator notes, e.g. a ticket link
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Metadata are the labels the peer registered with
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// LastSeen is when the peer last registered
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// LastHandshake and the byte counters are those of the server's session
+	// with the peer
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	ReceiveBytes  int64      `json:"receive_bytes,omitempty"`
+	TransmitBytes int64      `json:"transmit_bytes,omitempty"`
+}
+
+// AdminRequest is the JSON body of the admin actions. Metadata fields that
+// are omitted are left unchanged.
+type AdminRequest struct {
+	PublicKey string    `json:"public_key"`
+	Hostname  *string   `json:"hostname,omitempty"`
+	Routes    *[]string `json:"routes,omitempty"`
+	Groups    *[]string `json:"groups,omitempty"`
+	// Annotations are set by name; empty values remove them
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Address and WindowSecs are the new address and the time during which
+	// the old one stays valid when renumbering
+	Address    string `json:"address,omitempty"`
+	WindowSecs int    `json:"window_secs,omitempty"`
+}
+
+// AdminTokenRequest is the JSON body for minting an enrollment token. Zero
+// values mean unlimited, but at least one must be set.
+type AdminTokenRequest struct {
+	TTLSecs int `json:"ttl_secs"`
+	Uses    int `json:"uses"`
+}
+
+// AdminToken is a freshly minted enrollment token
+type AdminToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// AdminDiagnostic is a failure reported by a client about a peer
+type AdminDiagnostic struct {
+	Reporter string    `json:"reporter"`
+	Peer     string    `json:"peer"`
+	Received time.Time `json:"received"`
+	Diagnostic
+}
+
+// AdminPartition lists the islands the mesh has split into, largest first
+type AdminPartition struct {
+	Partitioned bool       `json:"partitioned"`
+	Since       time.Time  `json:"since,omitempty"`
+	Islands     [][]string `json:"islands,omitempty"`
+}
+
+// AdminChurn counts how often a peer came online, went offline and moved to
+// another endpoint in the last hour
+type AdminChurn struct {
+	PublicKey       string    `json:"public_key"`
+	Online          bool      `json:"online"`
+	Joins           int       `json:"joins"`
+	Leaves          int       `json:"leaves"`
+	EndpointChanges int       `json:"endpoint_changes"`
+	LastEvent       time.Time `json:"last_event"`
+	// Flappy peers had so many events that their NAT or link is likely broken
+	Flappy bool `json:"flappy"`
+}
+
+// AdminRestartRequest starts a rolling restart of the online peers of a group
+type AdminRestartRequest struct {
+	Group string `json:"group"`
+	// TimeoutSecs is how long each peer has to come back healthy
+	TimeoutSecs int `json:"timeout_secs"`
+}
+
+// AdminRestart is the progress of the last rolling restart
+type AdminRestart struct {
+	Group string `json:"group,omitempty"`
+	// State is running, done or failed, or empty if there was none
+	State   string    `json:"state,omitempty"`
+	Started time.Time `json:"started,omitempty"`
+	// Current is the peer restarting now
+	Current   string   `json:"current,omitempty"`
+	Restarted []string `json:"restarted,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+	// Skipped peers were offline when the restart started
+	Skipped []string `json:"skipped,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// Alert is posted to the alert webhook
+type Alert struct {
+	// Event is partition or partition_resolved
+	Event   string     `json:"event"`
+	Time    time.Time  `json:"time"`
+	Islands [][]string `json:"islands,omitempty"`
+}
+
+// Event is a peer lifecycle event, posted to the event webhook and appended to
+// the audit log
+type Event struct {
+	// Event is registered, deregistered, endpoint_changed, evicted, approved,
+	// revoked, key_rotated, quota_exceeded or handshake_failing
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Peer  string    `json:"peer"`
+	// Endpoint is the one registered or moved to, and PreviousEndpoint the one
+	// moved from
+	Endpoint         string `json:"endpoint,omitempty"`
+	PreviousEndpoint string `json:"previous_endpoint,omitempty"`
+	// NextKey is the key a rotated peer moved to
+	NextKey string `json:"next_key,omitempty"`
+	// Reason is why a peer was evicted, who approved or revoked it, or the
+	// likely cause of failing handshakes
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdminView is the peer list a client would receive right now, with the peers
+// it would not receive and why
+type AdminView struct {
+	PublicKey string   `json:"public_key"`
+	Groups    []string `json:"groups,omitempty"`
+	// Registered is set once the client registered since the server started
+	Registered bool            `json:"registered"`
+	Peers      []AdminViewPeer `json:"peers"`
+	Hidden     []AdminHidden   `json:"hidden,omitempty"`
+}
+
+// AdminViewPeer is a peer as the client would receive it
+type AdminViewPeer struct {
+	PublicKey  string     `json:"public_key"`
+	Addresses  []string   `json:"addresses,omitempty"`
+	Endpoint   string     `json:"endpoint,omitempty"`
+	Candidates []string   `json:"candidates,omitempty"`
+	NextKey    string     `json:"next_key,omitempty"`
+	Cutover    *time.Time `json:"cutover,omitempty"`
+	// ThroughServer is set on peers the client reaches through the server
+	ThroughServer bool `json:"through_server,omitempty"`
+	// Via is the region hub through which the client reaches the peer
+	Via string `json:"via,omitempty"`
+}
+
+// AdminHidden is a peer left out of a client's peer list
+type AdminHidden struct {
+	PublicKey string `json:"public_key"`
+	Reason    string `json:"reason"`
+}
+
+// AdminTopology is how the peers distributed by the server reach each other
+type AdminTopology struct {
+	Server string      `json:"server"`
+	Links  []AdminLink `json:"links"`
+}
+
+// AdminLink joins two peers that may reach each other under the group policy
+type AdminLink struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// ThroughServer is set if the topology routes the link over the server
+	ThroughServer bool `json:"through_server,omitempty"`
+	// Via is the region hub through which A reaches B, if any
+	Via string `json:"via,omitempty"`
+	// Broken is set if either peer reported the other as unreachable
+	Broken bool `json:"broken,omitempty"`
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Headers authenticating a registration. The MAC covers the timestamp, the
+// nonce and the body, keyed with the Diffie-Hellman secret of the client and
+// server keys, so that only the client can make it and only the server can
+// check it.
+const (
+	TimestampHeader = "X-Wireguard-Overlay-Timestamp"
+	NonceHeader     = "X-Wireguard-Overlay-Nonce"
+	MACHeader       = "X-Wireguard-Overlay-Mac"
+)
+
+// SignRegistration returns the headers authenticating the registration body
+// of the client with the private key to the server with the public key
+func SignRegistration(private, server wgtypes.Key, body []byte, now time.Time) (http.Header, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "Could not generate nonce")
+	}
+	mac, err := registrationMAC(private, server, now.UnixNano(), nonce, body)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set(TimestampHeader, strconv.FormatInt(now.UnixNano(), 10))
+	header.Set(NonceHeader, base64.RawURLEncoding.EncodeToString(nonce))
+	header.Set(MACHeader, base64.RawURLEncoding.EncodeToString(mac))
+	return header, nil
+}
+
+// VerifyRegistration checks the headers of the registration body for the
+// server with the private key from the client with the public key, and
+// returns the timestamp and the nonce
+func VerifyRegistration(private, client wgtypes.Key, header http.Header, body []byte) (time.Time, string, error) {
+	nanos, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return time.Time{}, "", errors.New("Invalid registration timestamp")
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(header.Get(NonceHeader))
+	if err != nil || len(nonce) < 16 {
+		return time.Time{}, "", errors.New("Invalid registration nonce")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(header.Get(MACHeader))
+	if err != nil {
+		return time.Time{}, "", errors.New("Invalid registration MAC")
+	}
+	want, err := registrationMAC(private, client, nanos, nonce, body)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if !hmac.Equal(mac, want) {
+		return time.Time{}, "", errors.New("Registration MAC does not match the key of the peer")
+	}
+	return time.Unix(0, nanos), string(nonce), nil
+}
+
+func registrationMAC(private, public wgtypes.Key, nanos int64, nonce, body []byte) ([]byte, error) {
+	secret, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid key for registration MAC")
+	}
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte("wireguard-overlay registration"))
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(nanos))
+	m.Write(ts[:])
+	m.Write(nonce)
+	m.Write(body)
+	return m.Sum(nil), nil
+}
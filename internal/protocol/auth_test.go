@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestVerifyRegistration(t *testing.T) {
+	var keys [3]wgtypes.Key
+	for i := range keys {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k
+	}
+	client, server, other := keys[0], keys[1], keys[2]
+	body := []byte("registration")
+	now := time.Unix(1700000000, 123)
+	tests := []struct {
+		name   string
+		signer wgtypes.Key
+		claims wgtypes.Key
+		body   []byte
+		edit   func(h map[string][]string)
+		ok     bool
+	}{
+		{name: "valid", signer: client, claims: client.PublicKey(), body: body, ok: true},
+		{name: "other key", signer: other, claims: client.PublicKey(), body: body},
+		{name: "modified body", signer: client, claims: client.PublicKey(), body: []byte("registratioN")},
+		{name: "modified timestamp", signer: client, claims: client.PublicKey(), body: body, edit: func(h map[string][]string) {
+			h[TimestampHeader] = []string{"1700000001000000123"}
+		}},
+		{name: "short nonce", signer: client, claims: client.PublicKey(), body: body, edit: func(h map[string][]string) {
+			h[NonceHeader] = []string{"AAAA"}
+		}},
+		{name: "invalid MAC", signer: client, claims: client.PublicKey(), body: body, edit: func(h map[string][]string) {
+			h[MACHeader] = []string{"!"}
+		}},
+	}
+	for _, tt := range tests {
+		header, err := SignRegistration(tt.signer, server.PublicKey(), body, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.edit != nil {
+			tt.edit(header)
+		}
+		timestamp, nonce, err := VerifyRegistration(server, tt.claims, header, tt.body)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (!timestamp.Equal(now) || len(nonce) != 16) {
+			t.Errorf("%s: got timestamp %s and a nonce of %d bytes, want %s and 16", tt.name, timestamp, len(nonce), now)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// GenerationHeader of peer list responses holds the generation of the
+	// list. Clients pass it back in the since query parameter of PeersPath to
+	// receive only what changed.
+	GenerationHeader = "X-Wireguard-Overlay-Generation"
+	// DeltaHeader is set on peer list responses whose body is a gob encoded
+	// PeerDelta instead of the full list
+	DeltaHeader = "X-Wireguard-Overlay-Delta"
+	// TotalHeader is set on peer list responses to requests with a limit
+	// query parameter, which return that many peers from offset on. Clients
+	// fetch the further pages of the list of the generation in the generation
+	// query parameter, which answers 410 once the server no longer has it.
+	TotalHeader = "X-Wireguard-Overlay-Total"
+)
+
+// PeerDelta turns the peer list of generation Since into that of Generation
+type PeerDelta struct {
+	Since      uint64
+	Generation uint64
+	// Changed are the peers added or changed since, in full
+	Changed []wg.Peer
+	Removed []wgtypes.Key
+}
+
+// Apply returns the peers of the delta's generation, given those of its
+// Since generation
+func (d PeerDelta) Apply(peers []wg.Peer) []wg.Peer {
+	drop := make(map[wgtypes.Key]bool, len(d.Removed)+len(d.Changed))
+	for _, k := range d.Removed {
+		drop[k] = true
+	}
+	for _, p := range d.Changed {
+		drop[p.PublicKey] = true
+	}
+	applied := make([]wg.Peer, 0, len(peers)+len(d.Changed))
+	for _, p := range peers {
+		if !drop[p.PublicKey] {
+			applied = append(applied, p)
+		}
+	}
+	return append(applied, d.Changed...)
+}
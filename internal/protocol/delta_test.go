@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerDeltaApply(t *testing.T) {
+	var keys [3]wgtypes.Key
+	for i := range keys {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k.PublicKey()
+	}
+	a := wg.Peer{IP: "192.0.2.1", Port: 51820, PublicKey: keys[0]}
+	b := wg.Peer{IP: "192.0.2.2", Port: 51820, PublicKey: keys[1]}
+	c := wg.Peer{IP: "192.0.2.3", Port: 51820, PublicKey: keys[2]}
+	moved := b
+	moved.IP = "198.51.100.2"
+	tests := []struct {
+		name  string
+		peers []wg.Peer
+		delta PeerDelta
+		want  []wg.Peer
+	}{
+		{"unchanged", []wg.Peer{a, b}, PeerDelta{}, []wg.Peer{a, b}},
+		{"add", []wg.Peer{a, b}, PeerDelta{Changed: []wg.Peer{c}}, []wg.Peer{a, b, c}},
+		{"add to none", nil, PeerDelta{Changed: []wg.Peer{a}}, []wg.Peer{a}},
+		{"remove", []wg.Peer{a, b, c}, PeerDelta{Removed: []wgtypes.Key{b.PublicKey}}, []wg.Peer{a, c}},
+		{"remove unknown", []wg.Peer{a}, PeerDelta{Removed: []wgtypes.Key{c.PublicKey}}, []wg.Peer{a}},
+		{"change", []wg.Peer{a, b, c}, PeerDelta{Changed: []wg.Peer{moved}}, []wg.Peer{a, c, moved}},
+		{"all at once", []wg.Peer{a, b}, PeerDelta{Changed: []wg.Peer{moved, c}, Removed: []wgtypes.Key{a.PublicKey}}, []wg.Peer{moved, c}},
+	}
+	for _, tt := range tests {
+		before := append([]wg.Peer(nil), tt.peers...)
+		got := tt.delta.Apply(tt.peers)
+		if !reflect.DeepEqual(got, tt.want) && !(len(got) == 0 && len(tt.want) == 0) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(tt.peers, before) {
+			t.Errorf("%s: Apply changed the peers it was given", tt.name)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Limits of the metadata of a peer, which every client receives
+const (
+	MaxMetadata      = 16
+	maxMetadataValue = 256
+)
+
+// Metadata names double as metric labels, so they follow the label syntax
+var metadataName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,63}$`)
+
+// ParseMetadata parses name=value entries, e.g. datacenter=fra1
+func ParseMetadata(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	metadata := make(map[string]string, len(entries))
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid metadata %q; expected name=value", e)
+		}
+		metadata[parts[0]] = parts[1]
+	}
+	return metadata, CheckMetadata(metadata)
+}
+
+// CheckMetadata checks the metadata against the limits
+func CheckMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadata {
+		return errors.Errorf("More than %d metadata entries", MaxMetadata)
+	}
+	for name, value := range metadata {
+		if !metadataName.MatchString(name) || name == "interface" || name == "public_key" {
+			return errors.Errorf("Invalid metadata name %q; expected lower case letters, digits and underscores", name)
+		}
+		if len(value) > maxMetadataValue {
+			return errors.Errorf("Metadata %s is longer than %d bytes", name, maxMetadataValue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"net"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/firewall"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// PeersPath serves the gob encoded list of peers
+	PeersPath = "/"
+	// RegisterPath accepts a gob encoded Registration from a client
+	RegisterPath = "/register"
+	// WatchPath blocks until the peers change, given the last seen generation
+	// in the since query parameter, and responds with the current generation
+	WatchPath = "/watch"
+	// RotatePath accepts a gob encoded Rotation from a client
+	RotatePath = "/rotate"
+	// PunchPath serves the gob encoded Punches scheduled for the client
+	PunchPath = "/punch"
+	// DiagnosticsPath accepts a gob encoded Diagnostic from a client
+	DiagnosticsPath = "/diagnostics"
+	// RestartPath serves a gob encoded Restart telling the client whether to
+	// restart
+	RestartPath = "/restart"
+	// ACLPath serves the gob encoded ACL the client is to enforce
+	ACLPath = "/acl"
+	// RevokedPath serves the gob encoded Revocations
+	RevokedPath = "/revoked"
+	// DeregisterPath tells the server that the client is shutting down, so
+	// that it stops distributing it until it registers again
+	DeregisterPath = "/deregister"
+	// EnrollPath accepts a gob encoded Enrollment on the enrollment listener
+	// and answers with a gob encoded Bootstrap
+	EnrollPath = "/enroll"
+)
+
+// Registration carries what a client wants the server to know about it that
+// the server cannot observe from the wireguard session itself
+type Registration struct {
+	// Endpoint is the publicly reachable underlay endpoint of the client,
+	// e.g. obtained from a port mapping on its router. If nil, the server
+	// distributes the endpoint observed by wireguard.
+	Endpoint *net.UDPAddr
+	// RequestedAddr is the overlay address the client would like to be
+	// allocated when the server manages addresses
+	RequestedAddr net.IP
+	// Standby are the next keys of rotating peers that the client has
+	// configured, acknowledging that the rotation may proceed
+	Standby []wgtypes.Key
+	// Unreachable are the peers the client currently fails to handshake with.
+	// Registrations double as heartbeats for the connectivity matrix.
+	Unreachable []wgtypes.Key
+	// Reflexive is the public endpoint of the wireguard port as discovered
+	// with STUN, if the NAT lets peers reach it. It is a hole punching
+	// candidate and does not replace the observed endpoint.
+	Reflexive *net.UDPAddr
+	// NAT is the NAT behaviour discovered with STUN, if any
+	NAT string
+	// LocalEndpoints are the addresses of the local interfaces with the
+	// wireguard port, through which peers on the same LAN can connect
+	// directly
+	LocalEndpoints []*net.UDPAddr
+	// AddressVersions are the address derivation versions the client
+	// supports, so that the server can negotiate a newer one
+	AddressVersions []derive.Version
+	// Started is when the client process started, so that the server can tell
+	// that it restarted
+	Started time.Time
+	// Metadata are labels of the client, e.g. its datacenter, role or owner,
+	// which the server passes on to the other clients
+	Metadata map[string]string
+	// ListenPort is the wireguard port of the client, also when the kernel
+	// picked it. Behind a NAT that keeps ports, or with the port forwarded,
+	// peers reach it at the observed address with this port.
+	ListenPort int
+	// NearestHub is the region hub with the lowest round trip time from the
+	// client, which becomes its home hub unless its region has other hubs
+	NearestHub wgtypes.Key
+}
+
+// Restart orders a client to restart during a rolling restart
+type Restart struct {
+	Restart bool
+}
+
+// ACL is what the client is to enforce on traffic from the overlay, resolved
+// by the server from the group rules that apply to the client
+type ACL struct {
+	Rules []firewall.ACLRule
+}
+
+// Revocations are the keys revoked on the server, among them those retired by
+// key rotations. Clients remove them and do not configure them again, whatever
+// peer list they come with.
+type Revocations struct {
+	Keys []wgtypes.Key
+}
+
+// Rotation announces the key a client is going to switch to. The client keeps
+// its current key until the server sets the cutover time in the peer list.
+type Rotation struct {
+	NextKey wgtypes.Key
+}
+
+// Enrollment is sent by a new client, over the underlay, to have its public
+// key added to the overlay
+type Enrollment struct {
+	PublicKey wgtypes.Key
+	Token     string
+}
+
+// Bootstrap tells an enrolled client, which reached the server over the
+// underlay, how to reach it over the overlay
+type Bootstrap struct {
+	PublicKey wgtypes.Key
+	// Port is the wireguard port, on which the server also serves the peer
+	// API at its overlay address
+	Port    int
+	Network net.IPNet
+	// SaltDigest is the SHA-256 of the address salt, if any, so that clients
+	// notice when theirs differs without learning it
+	SaltDigest []byte
+}
+
+// Diagnostic describes why a client cannot reach a peer
+type Diagnostic struct {
+	Peer wgtypes.Key `json:"-"`
+	// Endpoints are the endpoints of the peer tried while failing
+	Endpoints     []string  `json:"endpoints"`
+	FailingSince  time.Time `json:"failing_since"`
+	LastHandshake time.Time `json:"last_handshake,omitempty"`
+	TxBytes       int64     `json:"tx_bytes"`
+	RxBytes       int64     `json:"rx_bytes"`
+	Error         string    `json:"error"`
+	// Cause is the likely cause: no_endpoint, udp_blocked, key_mismatch or
+	// clock_skew
+	Cause string `json:"cause,omitempty"`
+	// NAT is how the client is reachable: port-mapped, public or nat
+	NAT string `json:"nat"`
+}
+
+// Punch asks a client to send to the candidate endpoints of a peer at the
+// given time, while the peer does the same, to open both NATs
+type Punch struct {
+	Peer       wgtypes.Key
+	Candidates []*net.UDPAddr
+	At         time.Time
+}
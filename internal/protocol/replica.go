@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// ReplicaPath serves the gob encoded ReplicaState of a server to the
+	// other replicas
+	ReplicaPath = "/replica"
+	// ReplicasHeader of peer list responses holds the JSON encoded replicas
+	// of the server
+	ReplicasHeader = "X-Wireguard-Overlay-Replicas"
+)
+
+// Replica is one of several servers sharing the key, the overlay address and
+// the peer records, which clients may reach at its endpoint
+type Replica struct {
+	ID string `json:"id"`
+	// Endpoint is the underlay wireguard endpoint as host:port
+	Endpoint string `json:"endpoint"`
+	// Healthy is set while the replica answers the others
+	Healthy bool `json:"healthy"`
+}
+
+// ReplicaState is what a replica tells the others about the clients that
+// registered with it
+type ReplicaState struct {
+	ID string
+	// Endpoint is where clients reach the replica, if it announces one
+	Endpoint      string
+	Registrations []ReplicaRegistration
+}
+
+// ReplicaRegistration is the last registration of a client. Its endpoint is
+// the one the replica observed, unless the client registered one.
+type ReplicaRegistration struct {
+	PublicKey    wgtypes.Key
+	Registration Registration
+	Seen         time.Time
+}
+
+// SetReplicas adds the replicas to the header of a response
+func SetReplicas(header http.Header, replicas []Replica) {
+	if data, err := json.Marshal(replicas); err == nil {
+		header.Set(ReplicasHeader, string(data))
+	}
+}
+
+// GetReplicas returns the replicas in the header of a response, if any
+func GetReplicas(header http.Header) []Replica {
+	var replicas []Replica
+	if value := header.Get(ReplicasHeader); value != "" {
+		json.Unmarshal([]byte(value), &replicas)
+	}
+	return replicas
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import "bytes"
+
+// VerifyPath accepts a gob encoded Verification from a client
+const VerifyPath = "/verify"
+
+// Endpoints claimed by clients are verified with cookies, which the server
+// sends to the claimed address over the underlay and the client returns
+// over the overlay. Only the holder of the key can return them, and only if
+// it receives traffic at that address.
+const (
+	CookieSize = 16
+	// VerifySize is the size of cookie packets: the magic and the cookie
+	VerifySize = len(verifyMagic) + CookieSize
+)
+
+var verifyMagic = [4]byte{'w', 'g', 'o', 'v'}
+
+// Verification returns a cookie the client received
+type Verification struct {
+	Cookie []byte
+}
+
+// CookiePacket returns the packet carrying the cookie
+func CookiePacket(cookie []byte) []byte {
+	return append(append([]byte(nil), verifyMagic[:]...), cookie...)
+}
+
+// ParseCookiePacket returns the cookie of a cookie packet
+func ParseCookiePacket(packet []byte) ([]byte, bool) {
+	if len(packet) != VerifySize || !bytes.HasPrefix(packet, verifyMagic[:]) {
+		return nil, false
+	}
+	return append([]byte(nil), packet[len(verifyMagic):]...), true
+}
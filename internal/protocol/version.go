@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the peer exchange. It is raised when a message
+// changes in a way the other side cannot decode, e.g. a gob encoded field
+// changing its type; features that are only added are announced as
+// capabilities instead.
+const Version = 1
+
+// MinVersion is the oldest version of the other side still understood
+const MinVersion = 1
+
+const (
+	// VersionHeader of every request and response of the peer API holds the
+	// version of the sender
+	VersionHeader = "X-Wireguard-Overlay-Version"
+	// CapabilitiesHeader holds the comma separated capabilities of the sender
+	CapabilitiesHeader = "X-Wireguard-Overlay-Capabilities"
+)
+
+// Capabilities of the peer exchange
+const (
+	// CapDelta is sending the changes since a generation of the peer list
+	CapDelta = "delta"
+	// CapPaging is fetching full peer lists in pages
+	CapPaging = "paging"
+	// CapWatch is blocking until the peer list changes
+	CapWatch = "watch"
+	// CapRoutes is distributing the networks routed to peers
+	CapRoutes = "routes"
+	// CapPunch is coordinating hole punching between peers
+	CapPunch = "punch"
+	// CapACL is the access control list of the overlay
+	CapACL = "acl"
+	// CapRotation is rotating keys announced at RotatePath
+	CapRotation = "rotation"
+	// CapRestart is rolling restarts
+	CapRestart = "restart"
+	// CapRevocations is the list of revoked keys at RevokedPath
+	CapRevocations = "revocations"
+	// CapVerify is verifying the endpoints clients claim with cookies
+	CapVerify = "verify"
+)
+
+// Capabilities are those this version supports
+var Capabilities = []string{CapDelta, CapPaging, CapWatch, CapRoutes, CapPunch, CapACL, CapRotation, CapRestart, CapRevocations, CapVerify}
+
+// legacyCapabilities are those of servers and clients from before versions
+// were announced
+var legacyCapabilities = []string{CapDelta, CapPaging, CapWatch, CapRoutes, CapPunch, CapACL, CapRotation, CapRestart}
+
+// Peer is what the other side of the exchange announced
+type Peer struct {
+	Version      int
+	Capabilities map[string]bool
+}
+
+// Supports reports whether the other side has the capability
+func (p Peer) Supports(capability string) bool {
+	return p.Capabilities[capability]
+}
+
+// SetVersion announces the version and capabilities of this side
+func SetVersion(header http.Header) {
+	header.Set(VersionHeader, strconv.Itoa(Version))
+	header.Set(CapabilitiesHeader, strings.Join(Capabilities, ","))
+}
+
+// GetVersion returns what the other side announced. Those that announce
+// nothing are of version 1 with the capabilities of the time. It fails if the
+// other side is too old.
+func GetVersion(header http.Header) (Peer, error) {
+	v := header.Get(VersionHeader)
+	if v == "" {
+		return newPeer(1, legacyCapabilities), nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return Peer{}, errors.Errorf("Invalid protocol version %q", v)
+	}
+	if version < MinVersion {
+		return Peer{}, errors.Errorf("Protocol version %d is older than the oldest supported %d; upgrade it", version, MinVersion)
+	}
+	var capabilities []string
+	for _, c := range strings.Split(header.Get(CapabilitiesHeader), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			capabilities = append(capabilities, c)
+		}
+	}
+	return newPeer(version, capabilities), nil
+}
+
+func newPeer(version int, capabilities []string) Peer {
+	p := Peer{Version: version, Capabilities: make(map[string]bool, len(capabilities))}
+	for _, c := range capabilities {
+		p.Capabilities[c] = true
+	}
+	return p
+}
+
+// String lists the version and the capabilities in order
+func (p Peer) String() string {
+	capabilities := make([]string, 0, len(p.Capabilities))
+	for c := range p.Capabilities {
+		capabilities = append(capabilities, c)
+	}
+	sort.Strings(capabilities)
+	return "v" + strconv.Itoa(p.Version) + " (" + strings.Join(capabilities, ",") + ")"
+}
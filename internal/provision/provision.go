@@ -0,0 +1,65 @@
+// Package provision holds client defaults compiled into the binary, so that
+// an organization can ship a client that joins its mesh without any local
+// configuration. Defaults come from provision.json, embedded at build time,
+// and from variables set with the linker, which take precedence:
+//
+//	go build -ldflags "-X github.com/jimzhong/wireguard-overlay/internal/provision.ServerAddr=vpn.example.com" ./cmd/client
+package provision
+
+import (
+	_ "embed"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed provision.json
+var embedded []byte
+
+// Set with -ldflags -X
+var (
+	ServerAddr   string
+	ServerPort   string
+	ServerPubkey string
+	EnrollToken  string
+	KeyFile      string
+)
+
+// Defaults are the provisioned values of client options, named like them.
+// Empty values are not provisioned.
+type Defaults struct {
+	ServerAddr string `json:"server-addr"`
+	ServerPort int    `json:"port"`
+	// ServerPubkey pins the server the client trusts
+	ServerPubkey string `json:"server-pubkey"`
+	EnrollToken  string `json:"enroll-token"`
+	// KeyFile lets the client generate and keep its key on first run
+	KeyFile string `json:"key-file"`
+}
+
+// Load returns the provisioned defaults
+func Load() (Defaults, error) {
+	var d Defaults
+	if err := json.Unmarshal(embedded, &d); err != nil {
+		return Defaults{}, errors.Wrap(err, "Could not decode embedded provision.json")
+	}
+	for _, v := range []struct {
+		value string
+		to    *string
+	}{
+		{ServerAddr, &d.ServerAddr},
+		{ServerPubkey, &d.ServerPubkey},
+		{EnrollToken, &d.EnrollToken},
+		{KeyFile, &d.KeyFile},
+	} {
+		if v.value != "" {
+			*v.to = v.value
+		}
+	}
+	if ServerPort != "" {
+		if err := json.Unmarshal([]byte(ServerPort), &d.ServerPort); err != nil {
+			return Defaults{}, errors.Wrapf(err, "Invalid provisioned port %q", ServerPort)
+		}
+	}
+	return d, nil
+}
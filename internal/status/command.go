@@ -0,0 +1,47 @@
+package status
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+)
+
+// RunCommand lists the peers of the daemon behind the control socket with
+// their last errors
+func RunCommand(socket string) error {
+	var st Status
+	if err := control.Call(socket, http.MethodGet, control.PeersPath, nil, &st); err != nil {
+		return err
+	}
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].PublicKey < st.Peers[j].PublicKey })
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBLIC KEY\tENDPOINT\tLAST HANDSHAKE\tRTT\tLOSS\tMETADATA\tLAST ERROR")
+	now := time.Now()
+	for _, p := range st.Peers {
+		handshake := "never"
+		if !p.LastHandshakeTime.IsZero() {
+			handshake = ago(now, p.LastHandshakeTime)
+		}
+		rtt, loss := "", ""
+		if l := p.Latency; l != nil {
+			rtt, loss = fmt.Sprintf("%.1fms", l.RTT), fmt.Sprintf("%.0f%%", l.Loss*100)
+		}
+		lastError := ""
+		if e := p.LastError; e != nil {
+			lastError = fmt.Sprintf("%s: %s (%s)", e.Kind, e.Message, ago(now, e.Time))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.PublicKey, p.Endpoint, handshake, rtt, loss,
+			strings.TrimPrefix(metadataLabels(p.Metadata), ","), lastError)
+	}
+	return w.Flush()
+}
+
+func ago(now, t time.Time) string {
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,382 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Status is the JSON document served at /status
+type Status struct {
+	Interface  string       `json:"interface"`
+	PublicKey  string       `json:"public_key"`
+	ListenPort int          `json:"listen_port"`
+	Peers      []PeerStatus `json:"peers"`
+}
+
+type PeerStatus struct {
+	PublicKey         string     `json:"public_key"`
+	Endpoint          string     `json:"endpoint,omitempty"`
+	AllowedIPs        []string   `json:"allowed_ips"`
+	LastHandshakeTime time.Time  `json:"last_handshake_time"`
+	ReceiveBytes      int64      `json:"receive_bytes"`
+	TransmitBytes     int64      `json:"transmit_bytes"`
+	KeepaliveInterval string     `json:"keepalive_interval,omitempty"`
+	LastError         *PeerError `json:"last_error,omitempty"`
+	// Metadata are the labels the peer registered with the server
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Latency is measured by probes over the overlay
+	Latency *PeerLatency `json:"latency,omitempty"`
+	// Usage is the traffic of the current accounting period
+	Usage *PeerUsage `json:"usage,omitempty"`
+}
+
+// PeerUsage is the traffic of a peer since the start of the accounting period
+type PeerUsage struct {
+	Since       time.Time `json:"since"`
+	Received    int64     `json:"received_bytes"`
+	Transmitted int64     `json:"transmitted_bytes"`
+	// Quota is the bytes allowed per period in both directions, 0 if
+	// unlimited
+	Quota    int64 `json:"quota_bytes,omitempty"`
+	Exceeded bool  `json:"exceeded,omitempty"`
+}
+
+// PeerLatency is the round trip time and loss of the recent probes of a peer
+type PeerLatency struct {
+	// RTT is the average of the answered probes, in milliseconds
+	RTT    float64 `json:"rtt_ms"`
+	Loss   float64 `json:"loss"`
+	Probes int     `json:"probes"`
+}
+
+// PeerError is the most recent failure with a peer
+type PeerError struct {
+	// Kind is e.g. handshake timeout, endpoint unreachable or rejected
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Sync is the state of a client's sync with the server
+type Sync struct {
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+	Peers       int       `json:"peers"`
+	// Captive is set behind a captive portal, Tunnelled while the session
+	// with the server runs over the TCP relay
+	Captive   bool `json:"captive,omitempty"`
+	Tunnelled bool `json:"tunnelled,omitempty"`
+	// Server is the public key of the server
+	Server string `json:"server,omitempty"`
+}
+
+// Handler serves the status and metrics of a wireguard device. It only reads
+// the device, so it works for devices managed by other tools as well.
+type Handler struct {
+	client *wgctrl.Client
+	iface  string
+	mux    *http.ServeMux
+	mu     sync.Mutex
+	// collectors add the metrics of other subsystems
+	collectors []Collector
+	// peerErrors returns the last errors by public key
+	peerErrors func() map[string]PeerError
+	// peerMetadata returns the metadata by public key
+	peerMetadata func() map[string]map[string]string
+	// peerLatency returns the probe statistics by public key
+	peerLatency func() map[string]PeerLatency
+	// peerUsage returns the traffic of the accounting period by public key
+	peerUsage func() map[string]PeerUsage
+}
+
+// Collector writes metrics that do not come from the device
+type Collector func(m *Metrics)
+
+func NewHandler(iface string) (*Handler, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{client: client, iface: iface, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/status", h.ServeStatus)
+	h.mux.HandleFunc("/metrics", h.serveMetrics)
+	return h, nil
+}
+
+// AddCollector appends the metrics of c to /metrics
+func (h *Handler) AddCollector(c Collector) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.collectors = append(h.collectors, c)
+}
+
+// SetPeerErrors makes the status report the errors that errors returns
+func (h *Handler) SetPeerErrors(errors func() map[string]PeerError) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.peerErrors = errors
+}
+
+// SetPeerMetadata makes the status and metrics report the metadata that
+// metadata returns
+func (h *Handler) SetPeerMetadata(metadata func() map[string]map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.peerMetadata = metadata
+}
+
+// SetPeerLatency makes the status and metrics report the probe statistics
+// that latency returns
+func (h *Handler) SetPeerLatency(latency func() map[string]PeerLatency) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.peerLatency = latency
+}
+
+// SetPeerUsage makes the status report the traffic that usage returns
+func (h *Handler) SetPeerUsage(usage func() map[string]PeerUsage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.peerUsage = usage
+}
+
+// usage returns the traffic of the accounting period by public key, if set
+func (h *Handler) usage() map[string]PeerUsage {
+	h.mu.Lock()
+	peerUsage := h.peerUsage
+	h.mu.Unlock()
+	if peerUsage == nil {
+		return nil
+	}
+	return peerUsage()
+}
+
+// latency returns the probe statistics by public key, if set
+func (h *Handler) latency() map[string]PeerLatency {
+	h.mu.Lock()
+	peerLatency := h.peerLatency
+	h.mu.Unlock()
+	if peerLatency == nil {
+		return nil
+	}
+	return peerLatency()
+}
+
+// metadata returns the metadata by public key, if set
+func (h *Handler) metadata() map[string]map[string]string {
+	h.mu.Lock()
+	peerMetadata := h.peerMetadata
+	h.mu.Unlock()
+	if peerMetadata == nil {
+		return nil
+	}
+	return peerMetadata()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Status reads the current state of the device
+func (h *Handler) Status() (*Status, error) {
+	device, err := h.client.Device(h.iface)
+	if err != nil {
+		return nil, err
+	}
+	st := &Status{
+		Interface:  device.Name,
+		PublicKey:  device.PublicKey.String(),
+		ListenPort: device.ListenPort,
+		Peers:      make([]PeerStatus, 0, len(device.Peers)),
+	}
+	metadata := h.metadata()
+	latency := h.latency()
+	usage := h.usage()
+	for _, p := range device.Peers {
+		ps := peerStatus(&p)
+		ps.Metadata = metadata[ps.PublicKey]
+		if l, ok := latency[ps.PublicKey]; ok {
+			ps.Latency = &l
+		}
+		if u, ok := usage[ps.PublicKey]; ok {
+			ps.Usage = &u
+		}
+		st.Peers = append(st.Peers, ps)
+	}
+	h.mu.Lock()
+	peerErrors := h.peerErrors
+	h.mu.Unlock()
+	if peerErrors == nil {
+		return st, nil
+	}
+	errs := peerErrors()
+	for i := range st.Peers {
+		if e, ok := errs[st.Peers[i].PublicKey]; ok {
+			st.Peers[i].LastError = &e
+			delete(errs, st.Peers[i].PublicKey)
+		}
+	}
+	// Rejected peers are not on the device
+	for key, e := range errs {
+		e := e
+		st.Peers = append(st.Peers, PeerStatus{PublicKey: key, LastError: &e})
+	}
+	return st, nil
+}
+
+func peerStatus(p *wgtypes.Peer) PeerStatus {
+	ps := PeerStatus{
+		PublicKey:         p.PublicKey.String(),
+		AllowedIPs:        make([]string, 0, len(p.AllowedIPs)),
+		LastHandshakeTime: p.LastHandshakeTime,
+		ReceiveBytes:      p.ReceiveBytes,
+		TransmitBytes:     p.TransmitBytes,
+	}
+	if p.Endpoint != nil {
+		ps.Endpoint = p.Endpoint.String()
+	}
+	for _, a := range p.AllowedIPs {
+		ps.AllowedIPs = append(ps.AllowedIPs, a.String())
+	}
+	if p.PersistentKeepaliveInterval != 0 {
+		ps.KeepaliveInterval = p.PersistentKeepaliveInterval.String()
+	}
+	return ps
+}
+
+// ServeStatus serves the status as JSON
+func (h *Handler) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	st, err := h.Status()
+	if err != nil {
+		http.Error(w, "Could not read device", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(st); err != nil {
+		logrus.WithError(err).Error("Could not write status")
+	}
+}
+
+func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	device, err := h.client.Device(h.iface)
+	if err != nil {
+		http.Error(w, "Could not read device", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := NewMetrics(w)
+	iface := Label("interface", device.Name)
+	m.Write("wireguard_overlay_peers", "gauge", "Number of configured peers.",
+		Sample{iface, float64(len(device.Peers))})
+	metadata := h.metadata()
+	latency := h.latency()
+	var rx, tx, hs, info, rtt, loss []Sample
+	for _, p := range device.Peers {
+		labels := iface + "," + Label("public_key", p.PublicKey.String())
+		if m, ok := metadata[p.PublicKey.String()]; ok {
+			info = append(info, Sample{labels + metadataLabels(m), 1})
+		}
+		if l, ok := latency[p.PublicKey.String()]; ok {
+			rtt = append(rtt, Sample{labels, l.RTT / 1000})
+			loss = append(loss, Sample{labels, l.Loss})
+		}
+		rx = append(rx, Sample{labels, float64(p.ReceiveBytes)})
+		tx = append(tx, Sample{labels, float64(p.TransmitBytes)})
+		last := 0.0
+		if !p.LastHandshakeTime.IsZero() {
+			last = float64(p.LastHandshakeTime.Unix())
+		}
+		hs = append(hs, Sample{labels, last})
+	}
+	m.Write("wireguard_overlay_peer_receive_bytes_total", "counter", "Bytes received from the peer.", rx...)
+	m.Write("wireguard_overlay_peer_transmit_bytes_total", "counter", "Bytes sent to the peer.", tx...)
+	m.Write("wireguard_overlay_peer_last_handshake_seconds", "gauge", "Unix time of the last handshake with the peer, 0 if none.", hs...)
+	if len(info) != 0 {
+		m.Write("wireguard_overlay_peer_info", "gauge", "Metadata of the peer as labels.", info...)
+	}
+	if len(rtt) != 0 {
+		m.Write("wireguard_overlay_peer_rtt_seconds", "gauge", "Average round trip time of the recent probes of the peer.", rtt...)
+		m.Write("wireguard_overlay_peer_probe_loss_ratio", "gauge", "Share of the recent probes of the peer that were lost.", loss...)
+	}
+	h.mu.Lock()
+	collectors := h.collectors
+	h.mu.Unlock()
+	for _, c := range collectors {
+		c(m)
+	}
+}
+
+// ListenAndServe serves the handler on addr in the background
+func ListenAndServe(addr string, handler http.Handler) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 6 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Status server stopped")
+		}
+	}()
+	return server, nil
+}
+
+// Sample is a value of a metric with its labels, formatted with Label
+type Sample struct {
+	Labels string
+	Value  float64
+}
+
+// Metrics writes the prometheus text exposition format
+type Metrics struct {
+	w io.Writer
+}
+
+func NewMetrics(w io.Writer) *Metrics {
+	return &Metrics{w: w}
+}
+
+func (m *Metrics) Write(name, kind, help string, samples ...Sample) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(m.w, "%s{%s} %g\n", name, s.Labels, s.Value)
+	}
+}
+
+// metadataLabels formats the metadata as labels ordered by name, each
+// preceded by a comma
+func metadataLabels(metadata map[string]string) string {
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("," + Label(name, metadata[name]))
+	}
+	return b.String()
+}
+
+func Label(name, value string) string {
+	return fmt.Sprintf("%s=%q", name, value)
+}
@@ -0,0 +1,273 @@
+package status
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/jimzhong/wireguard-overlay/internal/control"
+)
+
+const topInterval = 2 * time.Second
+
+type counters struct {
+	rx, tx int64
+	at     time.Time
+}
+
+// Orders of the peers, cycled through with the s key
+const (
+	byKey = iota
+	byHandshake
+	byRx
+	byTx
+	topOrders
+)
+
+var orderNames = [topOrders]string{"public key", "handshake", "receive rate", "transmit rate"}
+
+// RunTop shows the peers of the daemon behind the control socket with their
+// overlay addresses, endpoints, handshake ages and transfer rates, refreshed
+// every two seconds like top, until interrupted or q is pressed. s changes
+// the order of the peers. If the daemon cannot be reached and device is
+// given, the peers are read from the device it returns the handler of,
+// without the state of the sync.
+func RunTop(socket string, device func() (*Handler, error)) error {
+	read := func() (*Status, *Sync, error) {
+		var st Status
+		if err := control.Call(socket, http.MethodGet, control.PeersPath, nil, &st); err != nil {
+			return nil, nil, err
+		}
+		var sync Sync
+		if err := control.Call(socket, http.MethodGet, control.SyncPath, nil, &sync); err != nil {
+			// The server has no sync
+			return &st, nil, nil
+		}
+		return &st, &sync, nil
+	}
+	if _, _, err := read(); err != nil {
+		if device == nil {
+			return err
+		}
+		h, herr := device()
+		if herr != nil {
+			return err
+		}
+		read = func() (*Status, *Sync, error) {
+			st, err := h.Status()
+			return st, nil, err
+		}
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(interrupt)
+	keys := make(chan byte)
+	// Keys only work on a terminal
+	if restore, err := cbreak(os.Stdin); err == nil {
+		defer restore()
+		go readKeys(keys)
+	}
+	// Hide the cursor while drawing and show it again on the way out
+	fmt.Print("\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\n")
+	ticker := time.NewTicker(topInterval)
+	defer ticker.Stop()
+	previous := make(map[string]counters)
+	order := byKey
+	var rates map[string][2]float64
+	for tick := true; ; {
+		st, sync, err := read()
+		if err != nil {
+			return err
+		}
+		// Resorting does not take new rates
+		if tick {
+			rates = updateRates(st, previous, time.Now())
+		}
+		screen, err := drawTop(st, sync, rates, order, time.Now())
+		if err != nil {
+			return err
+		}
+		// Home the cursor and clear the screen in one write, so that the
+		// screen does not flicker
+		os.Stdout.Write(append([]byte("\x1b[H\x1b[2J"), screen...))
+		select {
+		case <-ticker.C:
+			tick = true
+		case key := <-keys:
+			switch key {
+			case 'q', 'Q':
+				return nil
+			case 's', 'S':
+				order = (order + 1) % topOrders
+			}
+			tick = false
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+// updateRates returns the receive and transmit rates of the peers since the
+// counters in previous, and remembers the current ones there
+func updateRates(st *Status, previous map[string]counters, now time.Time) map[string][2]float64 {
+	rates := make(map[string][2]float64, len(st.Peers))
+	seen := make(map[string]bool, len(st.Peers))
+	for _, p := range st.Peers {
+		seen[p.PublicKey] = true
+		if c, ok := previous[p.PublicKey]; ok && now.After(c.at) {
+			secs := now.Sub(c.at).Seconds()
+			rates[p.PublicKey] = [2]float64{float64(p.ReceiveBytes-c.rx) / secs, float64(p.TransmitBytes-c.tx) / secs}
+		}
+		previous[p.PublicKey] = counters{rx: p.ReceiveBytes, tx: p.TransmitBytes, at: now}
+	}
+	for k := range previous {
+		if !seen[k] {
+			delete(previous, k)
+		}
+	}
+	return rates
+}
+
+// drawTop renders one screen with the peers in the order
+func drawTop(st *Status, sync *Sync, rates map[string][2]float64, order int, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s  %s  port %d  %s\n", st.Interface, st.PublicKey, st.ListenPort, now.Format("15:04:05"))
+	switch {
+	case sync == nil:
+		fmt.Fprintln(&buf, "Sync: unknown (read from the device)")
+	case sync.LastAttempt.IsZero():
+		fmt.Fprintln(&buf, "Sync: not started")
+	case sync.LastError != "":
+		since := "never"
+		if !sync.LastSuccess.IsZero() {
+			since = ago(now, sync.LastSuccess)
+		}
+		fmt.Fprintf(&buf, "Sync: failing, last success %s: %s\n", since, sync.LastError)
+	default:
+		fmt.Fprintf(&buf, "Sync: ok %s, %d peers", ago(now, sync.LastSuccess), sync.Peers)
+		if sync.Tunnelled {
+			fmt.Fprint(&buf, ", tunnelled over TCP")
+		}
+		fmt.Fprintln(&buf)
+	}
+	if sync != nil && !sync.NextAttempt.IsZero() {
+		fmt.Fprintf(&buf, "Next refresh in %s", sync.NextAttempt.Sub(now).Round(time.Second))
+		if sync.Captive {
+			fmt.Fprint(&buf, ", paused behind a captive portal")
+		}
+		fmt.Fprintln(&buf)
+	}
+	fmt.Fprintln(&buf)
+
+	peers := st.Peers
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		switch order {
+		case byHandshake:
+			if !a.LastHandshakeTime.Equal(b.LastHandshakeTime) {
+				return a.LastHandshakeTime.After(b.LastHandshakeTime)
+			}
+		case byRx, byTx:
+			i := order - byRx
+			if ra, rb := rates[a.PublicKey][i], rates[b.PublicKey][i]; ra != rb {
+				return ra > rb
+			}
+		}
+		return a.PublicKey < b.PublicKey
+	})
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBLIC KEY\tADDRESS\tENDPOINT\tHANDSHAKE\tRX/S\tTX/S\tRX\tTX\tLAST ERROR")
+	for _, p := range peers {
+		handshake := "never"
+		if !p.LastHandshakeTime.IsZero() {
+			handshake = ago(now, p.LastHandshakeTime)
+		}
+		rxRate, txRate := "", ""
+		if r, ok := rates[p.PublicKey]; ok {
+			rxRate, txRate = bytesize(r[0]), bytesize(r[1])
+		}
+		lastError := ""
+		if e := p.LastError; e != nil {
+			lastError = fmt.Sprintf("%s (%s)", e.Kind, ago(now, e.Time))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.PublicKey, overlayAddress(p.AllowedIPs), p.Endpoint, handshake,
+			rxRate, txRate, bytesize(float64(p.ReceiveBytes)), bytesize(float64(p.TransmitBytes)), lastError)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "\nSorted by %s. s to sort differently, q or Ctrl-C to quit\n", orderNames[order])
+	return buf.Bytes(), nil
+}
+
+// overlayAddress is the first host address among the allowed IPs, which is
+// the overlay address of the peer, and the others are routes
+func overlayAddress(allowedIPs []string) string {
+	for _, a := range allowedIPs {
+		ip, network, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		if ones, bits := network.Mask.Size(); ones == bits {
+			return ip.String()
+		}
+	}
+	return strings.Join(allowedIPs, ",")
+}
+
+// cbreak makes the terminal pass keys as they are pressed, without echoing
+// them, and returns how to restore it. It fails if f is not a terminal.
+func cbreak(f *os.File) (func(), error) {
+	var old syscall.Termios
+	if err := termios(f, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+	t := old
+	t.Lflag &^= syscall.ICANON | syscall.ECHO
+	t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+	if err := termios(f, syscall.TCSETS, &t); err != nil {
+		return nil, err
+	}
+	return func() { termios(f, syscall.TCSETS, &old) }, nil
+}
+
+func termios(f *os.File, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func readKeys(keys chan<- byte) {
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); err != nil {
+			return
+		} else if n == 1 {
+			keys <- b[0]
+		}
+	}
+}
+
+// bytesize formats a number of bytes with a binary unit
+func bytesize(n float64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n /= 1024; n >= 1024 && i < len(units)-1; n /= 1024 {
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Blocking queries wait this long for a change
+const consulWait = 5 * time.Minute
+
+// consulBackend keeps the records in the KV store of Consul. Updates are
+// check-and-set on the modify index of the record, so that servers sharing the
+// records do not overwrite each other.
+type consulBackend struct {
+	remote *remote
+	prefix string
+	token  string
+	mu     sync.Mutex
+	// index is that of the last load, from which watching starts
+	index uint64
+}
+
+// NewConsul returns a backend keeping the records in Consul
+func NewConsul(options Options) (Backend, error) {
+	r, err := newRemote(options)
+	if err != nil {
+		return nil, err
+	}
+	return &consulBackend{remote: r, prefix: strings.TrimPrefix(options.Prefix, "/"), token: options.Token}, nil
+}
+
+type consulKV struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// get returns the entries below path, and the index of the KV store.
+// Missing ones are no error.
+func (b *consulBackend) get(client *http.Client, path string, query string) ([]consulKV, uint64, error) {
+	res, err := b.remote.do(client, func(base string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, base+"/v1/kv/"+path+"?"+query, nil)
+		if err == nil && b.token != "" {
+			req.Header.Set("X-Consul-Token", b.token)
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not read peer records from Consul")
+	}
+	index, _ := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, index, nil
+	}
+	if err := checkResponse(res); err != nil {
+		return nil, 0, errors.Wrap(err, "Could not read peer records from Consul")
+	}
+	defer res.Body.Close()
+	var kvs []consulKV
+	if err := json.NewDecoder(res.Body).Decode(&kvs); err != nil {
+		return nil, 0, errors.Wrap(err, "Could not decode Consul response")
+	}
+	return kvs, index, nil
+}
+
+func (b *consulBackend) entry(kv consulKV) (Entry, error) {
+	e, err := parseRecord(strings.TrimPrefix(kv.Key, b.prefix), kv.Value)
+	e.Revision = int64(kv.ModifyIndex)
+	return e, err
+}
+
+func (b *consulBackend) Load() (map[wgtypes.Key]Entry, error) {
+	kvs, index, err := b.get(b.remote.client, b.prefix, "recurse")
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[wgtypes.Key]Entry, len(kvs))
+	for _, kv := range kvs {
+		e, err := b.entry(kv)
+		if err != nil {
+			return nil, err
+		}
+		entries[e.Record.PublicKey] = e
+	}
+	b.mu.Lock()
+	b.index = index
+	b.mu.Unlock()
+	return entries, nil
+}
+
+func (b *consulBackend) Update(key wgtypes.Key, update func(r *Record)) (Entry, error) {
+	path := b.prefix + recordName(key)
+	for conflicts := 0; conflicts < maxConflicts; conflicts++ {
+		kvs, _, err := b.get(b.remote.client, path, "")
+		if err != nil {
+			return Entry{}, err
+		}
+		var current Entry
+		if len(kvs) != 0 {
+			if current, err = b.entry(kvs[0]); err != nil {
+				return Entry{}, err
+			}
+		}
+		r := current.Record
+		update(&r)
+		value, err := json.Marshal(r)
+		if err != nil {
+			return Entry{}, err
+		}
+		// An index of 0 only creates the key
+		res, err := b.remote.do(b.remote.client, func(base string) (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPut, base+"/v1/kv/"+path+"?cas="+strconv.FormatInt(current.Revision, 10), bytes.NewReader(value))
+			if err == nil && b.token != "" {
+				req.Header.Set("X-Consul-Token", b.token)
+			}
+			return req, err
+		})
+		if err != nil {
+			return Entry{}, errors.Wrap(err, "Could not write peer record to Consul")
+		}
+		if err := checkResponse(res); err != nil {
+			return Entry{}, errors.Wrap(err, "Could not write peer record to Consul")
+		}
+		var stored bool
+		err = json.NewDecoder(res.Body).Decode(&stored)
+		res.Body.Close()
+		if err != nil {
+			return Entry{}, errors.Wrap(err, "Could not decode Consul response")
+		}
+		if !stored {
+			continue
+		}
+		// Consul does not return the new index. The record read back may
+		// already be a later version, which is as good.
+		kvs, _, err = b.get(b.remote.client, path, "")
+		if err != nil || len(kvs) == 0 {
+			return Entry{Record: r}, err
+		}
+		return b.entry(kvs[0])
+	}
+	return Entry{}, errors.Errorf("Record of %s keeps changing", key)
+}
+
+func (b *consulBackend) Watch(changed func(Entry)) {
+	for {
+		if err := b.watch(changed); err != nil {
+			storeLog.WithError(err).Warn("Could not watch Consul")
+			time.Sleep(watchRetry)
+		}
+	}
+}
+
+// watch waits for the records to change with a blocking query and reports
+// those modified since the last index
+func (b *consulBackend) watch(changed func(Entry)) error {
+	b.mu.Lock()
+	index := b.index
+	b.mu.Unlock()
+	query := "recurse&index=" + strconv.FormatUint(index, 10) + "&wait=" + consulWait.String()
+	kvs, next, err := b.get(b.remote.watcher, b.prefix, query)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if kv.ModifyIndex <= index {
+			continue
+		}
+		e, err := b.entry(kv)
+		if err != nil {
+			storeLog.WithError(err).Warn("Ignored invalid record in Consul")
+			continue
+		}
+		changed(e)
+	}
+	// The index goes backwards when Consul restores a snapshot, and then
+	// starts over
+	if next < index {
+		next = 0
+	}
+	b.mu.Lock()
+	b.index = next
+	b.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// etcdBackend keeps the records in etcd through its JSON gateway (the /v3
+// API of etcd 3.4 and later). Updates are transactions on the revision of the
+// record, so that servers sharing the records do not overwrite each other.
+type etcdBackend struct {
+	remote   *remote
+	prefix   string
+	user     string
+	password string
+	mu       sync.Mutex
+	token    string
+	// revision is that of the last load, from which watching starts
+	revision int64
+}
+
+// NewEtcd returns a backend keeping the records in etcd
+func NewEtcd(options Options) (Backend, error) {
+	r, err := newRemote(options)
+	if err != nil {
+		return nil, err
+	}
+	b := &etcdBackend{remote: r, prefix: options.Prefix}
+	if options.Token != "" {
+		i := strings.IndexByte(options.Token, ':')
+		if i < 0 {
+			return nil, errors.New("The etcd token must be user:password")
+		}
+		b.user, b.password = options.Token[:i], options.Token[i+1:]
+	}
+	return b, nil
+}
+
+// etcdInt is an int64, which the gateway sends as a string
+type etcdInt int64
+
+func (i *etcdInt) UnmarshalJSON(data []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*i = etcdInt(n)
+	return err
+}
+
+type etcdKV struct {
+	Key         []byte  `json:"key"`
+	Value       []byte  `json:"value"`
+	ModRevision etcdInt `json:"mod_revision"`
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+func (b *etcdBackend) call(client *http.Client, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := b.authenticate(attempt != 0)
+		if err != nil {
+			return nil, err
+		}
+		res, err := b.remote.do(client, func(base string) (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPost, base+path, bytes.NewReader(data))
+			if err == nil && token != "" {
+				req.Header.Set("Authorization", token)
+			}
+			return req, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Tokens expire, so a rejected one is renewed once
+		if res.StatusCode == http.StatusUnauthorized && token != "" && attempt == 0 {
+			res.Body.Close()
+			continue
+		}
+		if err := checkResponse(res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+}
+
+// authenticate returns the token to send, fetching one if there is none or
+// renew is set
+func (b *etcdBackend) authenticate(renew bool) (string, error) {
+	if b.user == "" {
+		return "", nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" && !renew {
+		return b.token, nil
+	}
+	data, _ := json.Marshal(map[string]string{"name": b.user, "password": b.password})
+	res, err := b.remote.do(b.remote.client, func(base string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, base+"/v3/auth/authenticate", bytes.NewReader(data))
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := checkResponse(res); err != nil {
+		return "", errors.Wrap(err, "Could not authenticate with etcd")
+	}
+	defer res.Body.Close()
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return "", errors.Wrap(err, "Could not authenticate with etcd")
+	}
+	b.token = out.Token
+	return b.token, nil
+}
+
+// rangeEnd is the end of the keys starting with prefix
+func rangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+func (b *etcdBackend) get(keys, end []byte) ([]etcdKV, int64, error) {
+	body := map[string]interface{}{"key": keys}
+	if end != nil {
+		body["range_end"] = end
+	}
+	res, err := b.call(b.remote.client, "/v3/kv/range", body)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not read peer records from etcd")
+	}
+	defer res.Body.Close()
+	var out struct {
+		Header etcdHeader `json:"header"`
+		KVs    []etcdKV   `json:"kvs"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, 0, errors.Wrap(err, "Could not decode etcd response")
+	}
+	return out.KVs, int64(out.Header.Revision), nil
+}
+
+func (b *etcdBackend) entry(kv etcdKV) (Entry, error) {
+	e, err := parseRecord(strings.TrimPrefix(string(kv.Key), b.prefix), kv.Value)
+	e.Revision = int64(kv.ModRevision)
+	return e, err
+}
+
+func (b *etcdBackend) Load() (map[wgtypes.Key]Entry, error) {
+	kvs, revision, err := b.get([]byte(b.prefix), rangeEnd(b.prefix))
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[wgtypes.Key]Entry, len(kvs))
+	for _, kv := range kvs {
+		e, err := b.entry(kv)
+		if err != nil {
+			return nil, err
+		}
+		entries[e.Record.PublicKey] = e
+	}
+	b.mu.Lock()
+	b.revision = revision
+	b.mu.Unlock()
+	return entries, nil
+}
+
+func (b *etcdBackend) Update(key wgtypes.Key, update func(r *Record)) (Entry, error) {
+	name := []byte(b.prefix + recordName(key))
+	for conflicts := 0; conflicts < maxConflicts; conflicts++ {
+		kvs, _, err := b.get(name, nil)
+		if err != nil {
+			return Entry{}, err
+		}
+		var current Entry
+		if len(kvs) != 0 {
+			if current, err = b.entry(kvs[0]); err != nil {
+				return Entry{}, err
+			}
+		}
+		r := current.Record
+		update(&r)
+		value, err := json.Marshal(r)
+		if err != nil {
+			return Entry{}, err
+		}
+		// A missing key has revision 0
+		res, err := b.call(b.remote.client, "/v3/kv/txn", map[string]interface{}{
+			"compare": []map[string]interface{}{{
+				"key":          name,
+				"target":       "MOD",
+				"result":       "EQUAL",
+				"mod_revision": strconv.FormatInt(current.Revision, 10),
+			}},
+			"success": []map[string]interface{}{{
+				"request_put": map[string]interface{}{"key": name, "value": value},
+			}},
+		})
+		if err != nil {
+			return Entry{}, errors.Wrap(err, "Could not write peer record to etcd")
+		}
+		var out struct {
+			Header    etcdHeader `json:"header"`
+			Succeeded bool       `json:"succeeded"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if err != nil {
+			return Entry{}, errors.Wrap(err, "Could not decode etcd response")
+		}
+		if out.Succeeded {
+			return Entry{Record: r, Revision: int64(out.Header.Revision)}, nil
+		}
+	}
+	return Entry{}, errors.Errorf("Record of %s keeps changing", key)
+}
+
+func (b *etcdBackend) Watch(changed func(Entry)) {
+	for {
+		if err := b.watch(changed); err != nil {
+			storeLog.WithError(err).Warn("Could not watch etcd")
+		}
+		time.Sleep(watchRetry)
+	}
+}
+
+// watch follows the changes from the last revision seen. If etcd compacted
+// that revision away, the records are loaded again.
+func (b *etcdBackend) watch(changed func(Entry)) error {
+	b.mu.Lock()
+	start := b.revision + 1
+	b.mu.Unlock()
+	res, err := b.call(b.remote.watcher, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(b.prefix),
+			"range_end":      rangeEnd(b.prefix),
+			"start_revision": strconv.FormatInt(start, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var msg struct {
+			Result struct {
+				CompactRevision etcdInt `json:"compact_revision"`
+				Events          []struct {
+					Type string `json:"type"`
+					KV   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return errors.New(msg.Error.Message)
+		}
+		if msg.Result.CompactRevision != 0 {
+			entries, err := b.Load()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				changed(e)
+			}
+			return errors.New("Watched revision was compacted")
+		}
+		for _, ev := range msg.Result.Events {
+			// The records are never deleted
+			if ev.Type == "DELETE" {
+				continue
+			}
+			e, err := b.entry(ev.KV)
+			if err != nil {
+				storeLog.WithError(err).Warn("Ignored invalid record in etcd")
+				continue
+			}
+			changed(e)
+		}
+		if len(msg.Result.Events) != 0 {
+			b.mu.Lock()
+			b.revision = int64(msg.Result.Events[len(msg.Result.Events)-1].KV.ModRevision)
+			b.mu.Unlock()
+		}
+	}
+}
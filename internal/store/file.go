@@ -0,0 +1,84 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fileBackend keeps the records in a JSON file that only one server writes
+type fileBackend struct {
+	mu      sync.Mutex
+	path    string
+	records map[wgtypes.Key]Record
+}
+
+func (b *fileBackend) Load() (map[wgtypes.Key]Entry, error) {
+	b.records = make(map[wgtypes.Key]Record)
+	entries := make(map[wgtypes.Key]Entry)
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read peer records")
+	}
+	var stored map[string]Record
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode peer records in %s", b.path)
+	}
+	for k, r := range stored {
+		key, err := wgtypes.ParseKey(k)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid key in %s", b.path)
+		}
+		r.PublicKey = key
+		b.records[key] = r
+		entries[key] = Entry{Record: r}
+	}
+	return entries, nil
+}
+
+func (b *fileBackend) Update(key wgtypes.Key, update func(r *Record)) (Entry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, existed := b.records[key]
+	r := old
+	update(&r)
+	b.records[key] = r
+	if err := b.save(); err != nil {
+		if existed {
+			b.records[key] = old
+		} else {
+			delete(b.records, key)
+		}
+		return Entry{}, err
+	}
+	return Entry{Record: r}, nil
+}
+
+func (b *fileBackend) Watch(func(Entry)) {}
+
+func (b *fileBackend) save() error {
+	stored := make(map[string]Record, len(b.records))
+	for k, r := range b.records {
+		stored[k.String()] = r
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return errors.Wrap(err, "Could not create peer record directory")
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "Could not write peer records")
+	}
+	return errors.Wrap(os.Rename(tmp, b.path), "Could not write peer records")
+}
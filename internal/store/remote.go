@@ -0,0 +1,122 @@
+package store
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	remoteTimeout = 10 * time.Second
+	// A failed watch is started again after this long
+	watchRetry = 5 * time.Second
+	// Updates give up after this many concurrent changes of the record
+	maxConflicts = 10
+)
+
+// Options configure the connection to etcd or Consul
+type Options struct {
+	// Endpoints are base URLs, e.g. https://etcd1:2379, tried in turn
+	Endpoints []string
+	// Prefix is prepended to the keys of the records
+	Prefix string
+	// Token is the ACL token of Consul, or user:password for etcd
+	Token string
+	TLS   *tls.Config
+}
+
+// remote sends requests to the first endpoint that answers
+type remote struct {
+	mu        sync.Mutex
+	endpoints []string
+	client    *http.Client
+	// watcher has no timeout, since watches stay open
+	watcher *http.Client
+}
+
+func newRemote(options Options) (*remote, error) {
+	if len(options.Endpoints) == 0 {
+		return nil, errors.New("No endpoints given")
+	}
+	transport := &http.Transport{TLSClientConfig: options.TLS, Proxy: http.ProxyFromEnvironment}
+	r := &remote{
+		client:  &http.Client{Timeout: remoteTimeout, Transport: transport},
+		watcher: &http.Client{Transport: transport},
+	}
+	for _, e := range options.Endpoints {
+		r.endpoints = append(r.endpoints, strings.TrimSuffix(e, "/"))
+	}
+	return r, nil
+}
+
+// do sends the request built for an endpoint, moving on to the next endpoint
+// if one cannot be reached. The endpoint that answered is tried first next
+// time.
+func (r *remote) do(client *http.Client, build func(base string) (*http.Request, error)) (*http.Response, error) {
+	r.mu.Lock()
+	endpoints := append([]string(nil), r.endpoints...)
+	r.mu.Unlock()
+	var lastErr error
+	for i, base := range endpoints {
+		req, err := build(base)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if i != 0 {
+			r.mu.Lock()
+			r.endpoints = append([]string{base}, append(endpoints[:i:i], endpoints[i+1:]...)...)
+			r.mu.Unlock()
+		}
+		return res, nil
+	}
+	return nil, errors.Wrap(lastErr, "Could not reach any endpoint")
+}
+
+// checkResponse returns an error for responses other than 200 OK, closing
+// their body
+func checkResponse(res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	return fmt.Errorf("%s responded %s: %s", res.Request.URL.Host, res.Status, strings.TrimSpace(string(msg)))
+}
+
+// recordName names the record of key below the prefix. URL-safe base64 keeps
+// slashes out of Consul paths.
+func recordName(key wgtypes.Key) string {
+	return base64.URLEncoding.EncodeToString(key[:])
+}
+
+func parseRecord(name string, value []byte) (Entry, error) {
+	raw, err := base64.URLEncoding.DecodeString(name)
+	if err != nil {
+		return Entry{}, errors.Wrapf(err, "Invalid record name %s", name)
+	}
+	key, err := wgtypes.NewKey(raw)
+	if err != nil {
+		return Entry{}, errors.Wrapf(err, "Invalid record name %s", name)
+	}
+	var r Record
+	if err := json.Unmarshal(value, &r); err != nil {
+		return Entry{}, errors.Wrapf(err, "Could not decode record of %s", key)
+	}
+	r.PublicKey = key
+	return Entry{Record: r}, nil
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var storeLog = logging.For("store")
+
+// Record is what the server knows about a peer beyond its wireguard state
+type Record struct {
+	PublicKey wgtypes.Key `json:"-"`
+	Hostname  string      `json:"hostname,omitempty"`
+	Routes    []string    `json:"routes,omitempty"`
+	Groups    []string    `json:"groups,omitempty"`
+	// Annotations are operator notes by name, e.g. a ticket link
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Approved peers are distributed in addition to the configured ones
+	Approved bool `json:"approved,omitempty"`
+	// Revoked peers are never distributed, even if configured
+	Revoked bool `json:"revoked,omitempty"`
+	// Token is the hash of the enrollment token the peer enrolled with,
+	// which it presents again when it restarts
+	Token string `json:"token,omitempty"`
+	// Static peers run the stock wireguard apps instead of the daemon: they
+	// never register and are reached through the server
+	Static bool `json:"static,omitempty"`
+	// Address pins the overlay address of a peer that took over the address
+	// of a rotated key
+	Address net.IP `json:"address,omitempty"`
+	// Rotation is set while the peer rotates to a new key
+	Rotation *Rotation `json:"rotation,omitempty"`
+	// Renumbering is set while the peer moves to a new address
+	Renumbering *Renumbering `json:"renumbering,omitempty"`
+}
+
+// Rotation tracks the switch of a peer to a new key
+type Rotation struct {
+	NextKey string    `json:"next_key"`
+	Started time.Time `json:"started"`
+	// Cutover is when peers switch to the new key; zero until all peers
+	// have configured it
+	Cutover time.Time `json:"cutover"`
+}
+
+// Renumbering keeps the previous address of a peer valid until the end of the
+// transition window
+type Renumbering struct {
+	From  net.IP    `json:"from"`
+	Until time.Time `json:"until"`
+}
+
+// Entry is a record as of a revision of the backend. Revisions grow with
+// every write; backends without other writers leave them zero.
+type Entry struct {
+	Record   Record
+	Revision int64
+}
+
+// Backend persists the records of a Store
+type Backend interface {
+	// Load returns all records by key
+	Load() (map[wgtypes.Key]Entry, error)
+	// Update applies update to the current record of key, or to a new one,
+	// and stores the result. If another writer changed the record in the
+	// meantime, update is applied again to its version.
+	Update(key wgtypes.Key, update func(r *Record)) (Entry, error)
+	// Watch calls changed with the records other writers store, until the
+	// process exits. It returns at once if there are no other writers.
+	Watch(changed func(Entry))
+}
+
+// Store keeps the peer records of a backend, which several servers may share
+type Store struct {
+	mu       sync.Mutex
+	backend  Backend
+	records  map[wgtypes.Key]Entry
+	onChange func(old, r Record)
+}
+
+// Open loads the records from the JSON file at path, if it exists
+func Open(path string) (*Store, error) {
+	return OpenBackend(&fileBackend{path: path})
+}
+
+// OpenBackend loads the records from the backend and follows the changes of
+// other writers
+func OpenBackend(b Backend) (*Store, error) {
+	records, err := b.Load()
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{backend: b, records: records}
+	go b.Watch(s.changed)
+	return s, nil
+}
+
+// OnChange sets a function called with the old and the new record when
+// another writer changes one
+func (s *Store) OnChange(f func(old, r Record)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = f
+}
+
+func (s *Store) changed(e Entry) {
+	s.mu.Lock()
+	old, ok := s.records[e.Record.PublicKey]
+	// Our own writes come back as well, and events may be older than a
+	// write that was just made
+	if ok && e.Revision <= old.Revision {
+		s.mu.Unlock()
+		return
+	}
+	s.records[e.Record.PublicKey] = e
+	f := s.onChange
+	s.mu.Unlock()
+	if reflect.DeepEqual(old.Record, e.Record) {
+		return
+	}
+	storeLog.WithField("peer", e.Record.PublicKey.String()).Debug("Record changed by another server")
+	if f != nil {
+		f(old.Record, e.Record)
+	}
+}
+
+// Get returns the record of key
+func (s *Store) Get(key wgtypes.Key) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.records[key]
+	return e.Record, ok
+}
+
+// List returns all records ordered by public key
+func (s *Store) List() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]Record, 0, len(s.records))
+	for _, e := range s.records {
+		records = append(records, e.Record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].PublicKey.String() < records[j].PublicKey.String()
+	})
+	return records
+}
+
+// Update modifies the record of key, creating it if needed, and persists it.
+// With a shared backend, update may run more than once.
+func (s *Store) Update(key wgtypes.Key, update func(r *Record)) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := s.backend.Update(key, func(r *Record) {
+		r.PublicKey = key
+		update(r)
+		r.PublicKey = key
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	if old, ok := s.records[key]; !ok || e.Revision >= old.Revision {
+		s.records[key] = e
+	}
+	return e.Record, nil
+}
@@ -0,0 +1,219 @@
+// Package stun discovers the public endpoint and NAT behaviour of the host
+// with STUN binding requests (RFC 5389)
+package stun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	magicCookie     = 0x2112A442
+	bindingRequest  = 0x0001
+	bindingResponse = 0x0101
+	headerSize      = 20
+
+	attrMappedAddress    = 0x0001
+	attrXorMappedAddress = 0x0020
+)
+
+// NAT behaviours, from the point of view of a peer trying to reach the host
+const (
+	// NATNone means the host is reachable under its local address
+	NATNone = "none"
+	// NATIndependent mappings are the same towards every destination, so
+	// peers can reach the host under the discovered endpoint
+	NATIndependent = "endpoint-independent"
+	// NATDependent (symmetric) mappings differ per destination
+	NATDependent = "endpoint-dependent"
+	// NATUnknown is reported when only one server answered
+	NATUnknown = "unknown"
+)
+
+// Result is what the STUN servers observed
+type Result struct {
+	// Mapped is the public endpoint of the socket used for the queries
+	Mapped *net.UDPAddr
+	// LocalPort is the port of that socket
+	LocalPort int
+	NAT       string
+}
+
+// PortPreserved reports whether the NAT kept the local port
+func (r Result) PortPreserved() bool {
+	return r.Mapped.Port == r.LocalPort
+}
+
+// Discover queries the servers (host:port) in order from one socket. With
+// answers from two servers it also tells the NAT behaviour apart.
+func Discover(servers []string, timeout time.Duration) (Result, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "Could not open STUN socket")
+	}
+	defer conn.Close()
+	result := Result{
+		LocalPort: conn.LocalAddr().(*net.UDPAddr).Port,
+		NAT:       NATUnknown,
+	}
+	var lastErr error
+	for _, server := range servers {
+		mapped, err := Query(conn, server, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if result.Mapped == nil {
+			result.Mapped = mapped
+			if isLocal(mapped.IP) && result.PortPreserved() {
+				result.NAT = NATNone
+				break
+			}
+			continue
+		}
+		if mapped.IP.Equal(result.Mapped.IP) && mapped.Port == result.Mapped.Port {
+			result.NAT = NATIndependent
+		} else {
+			result.NAT = NATDependent
+		}
+		break
+	}
+	if result.Mapped == nil {
+		if lastErr == nil {
+			lastErr = errors.New("No STUN servers configured")
+		}
+		return Result{}, lastErr
+	}
+	return result, nil
+}
+
+// Query sends a binding request to the server and returns the mapped address
+// it reports. The request is retransmitted until the timeout.
+func Query(conn *net.UDPConn, server string, timeout time.Duration) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not resolve STUN server %s", server)
+	}
+	request := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(request[0:], bindingRequest)
+	binary.BigEndian.PutUint32(request[4:], magicCookie)
+	if _, err := rand.Read(request[8:headerSize]); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for wait := 250 * time.Millisecond; time.Now().Before(deadline); wait *= 2 {
+		if _, err := conn.WriteToUDP(request, addr); err != nil {
+			return nil, errors.Wrapf(err, "Could not send to STUN server %s", server)
+		}
+		next := time.Now().Add(wait)
+		if next.After(deadline) {
+			next = deadline
+		}
+		if err := conn.SetReadDeadline(next); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+				continue
+			}
+			if mapped, ok := parseResponse(buf[:n], request[8:headerSize]); ok {
+				return mapped, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("STUN server %s did not answer", server)
+}
+
+// parseResponse returns the mapped address of a binding response to the
+// transaction
+func parseResponse(msg, transaction []byte) (*net.UDPAddr, bool) {
+	if len(msg) < headerSize ||
+		binary.BigEndian.Uint16(msg[0:]) != bindingResponse ||
+		binary.BigEndian.Uint32(msg[4:]) != magicCookie ||
+		!bytes.Equal(msg[8:headerSize], transaction) {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if headerSize+length > len(msg) {
+		return nil, false
+	}
+	var mapped *net.UDPAddr
+	attrs := msg[headerSize : headerSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+size]
+		switch typ {
+		case attrXorMappedAddress:
+			if a, ok := parseAddress(value, msg[4:headerSize]); ok {
+				return a, true
+			}
+		case attrMappedAddress:
+			if a, ok := parseAddress(value, nil); ok {
+				mapped = a
+			}
+		}
+		// Attributes are padded to multiples of 4 bytes
+		attrs = attrs[4+(size+3)&^3:]
+	}
+	return mapped, mapped != nil
+}
+
+// parseAddress decodes an address attribute, XORed with the key (the magic
+// cookie followed by the transaction ID) unless the key is nil
+func parseAddress(value, key []byte) (*net.UDPAddr, bool) {
+	if len(value) < 4 {
+		return nil, false
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil, false
+	}
+	if len(value) < 4+size {
+		return nil, false
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if key != nil {
+		port ^= uint16(magicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, true
+}
+
+func isLocal(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package support
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/status"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+const redacted = "<redacted>"
+
+// secretField reports whether a config field holds a secret
+func secretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"private", "preshared", "secret", "token", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// bundle collects files and scrubs known secrets from all of them
+type bundle struct {
+	files   []file
+	secrets []string
+}
+
+type file struct {
+	name string
+	data []byte
+}
+
+func (b *bundle) add(name string, data []byte) {
+	for _, s := range b.secrets {
+		data = bytes.ReplaceAll(data, []byte(s), []byte(redacted))
+	}
+	b.files = append(b.files, file{name, data})
+}
+
+func (b *bundle) addf(name string, format string, args ...interface{}) {
+	b.add(name, []byte(fmt.Sprintf(format, args...)))
+}
+
+// addConfig adds the config with secret fields redacted and remembers the
+// secret values so that they are scrubbed from logs as well
+func (b *bundle) addConfig(config interface{}) {
+	v := reflect.Indirect(reflect.ValueOf(config))
+	sanitized := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i).Interface()
+		if s, ok := value.(fmt.Stringer); ok {
+			value = s.String()
+		}
+		if secretField(name) {
+			if s, ok := value.(string); ok && s != "" {
+				b.secrets = append(b.secrets, s)
+			}
+			value = redacted
+		}
+		sanitized[name] = value
+	}
+	data, err := json.MarshalIndent(sanitized, "", "  ")
+	if err != nil {
+		b.addf("config.json.error", "%v\n", err)
+		return
+	}
+	b.add("config.json", data)
+}
+
+func (b *bundle) addDevice(iface string) {
+	handler, err := status.NewHandler(iface)
+	if err == nil {
+		var st *status.Status
+		if st, err = handler.Status(); err == nil {
+			data, _ := json.MarshalIndent(st, "", "  ")
+			b.add("device.json", data)
+			return
+		}
+	}
+	b.addf("device.json.error", "%v\n", err)
+}
+
+func (b *bundle) addNetwork(iface string) {
+	var sb strings.Builder
+	if link, err := netlink.LinkByName(iface); err != nil {
+		fmt.Fprintf(&sb, "link %s: %v\n", iface, err)
+	} else {
+		attrs := link.Attrs()
+		fmt.Fprintf(&sb, "link %s: type=%s mtu=%d state=%s flags=%s\n", iface, link.Type(), attrs.MTU, attrs.OperState, attrs.Flags)
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			fmt.Fprintf(&sb, "addresses: %v\n", err)
+		}
+		for _, a := range addrs {
+			fmt.Fprintf(&sb, "address %s\n", a.IPNet)
+		}
+	}
+	b.add("interface.txt", []byte(sb.String()))
+
+	sb.Reset()
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		fmt.Fprintf(&sb, "%v\n", err)
+	}
+	for _, r := range routes {
+		fmt.Fprintln(&sb, r.String())
+	}
+	b.add("routes.txt", []byte(sb.String()))
+}
+
+func (b *bundle) addCommand(name string, cmd string, args ...string) {
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		out = append(out, []byte(fmt.Sprintf("\n%s: %v\n", cmd, err))...)
+	}
+	b.add(name, out)
+}
+
+func (b *bundle) addDiagnostics() {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&sb, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if v, err := ioutil.ReadFile("/proc/version"); err == nil {
+		fmt.Fprintf(&sb, "kernel: %s", v)
+	}
+	_, err := os.Stat("/sys/module/wireguard")
+	fmt.Fprintf(&sb, "wireguard kernel module loaded: %t\n", err == nil)
+	sockets, _ := filepath.Glob("/var/run/wireguard/*.sock")
+	fmt.Fprintf(&sb, "userspace wireguard sockets: %v\n", sockets)
+	for _, f := range []string{"/proc/sys/net/ipv4/ip_forward", "/proc/sys/net/ipv6/conf/all/forwarding"} {
+		if v, err := ioutil.ReadFile(f); err == nil {
+			fmt.Fprintf(&sb, "%s: %s", f, v)
+		}
+	}
+	b.add("diagnostics.txt", []byte(sb.String()))
+}
+
+func (b *bundle) write(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range b.files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// WriteBundle collects the sanitized config, device state, network state,
+// recent logs and diagnostics of this node into a tar.gz archive in the
+// current directory and returns its path
+func WriteBundle(iface string, config interface{}) (string, error) {
+	b := &bundle{}
+	b.addConfig(config)
+	b.addDevice(iface)
+	b.addNetwork(iface)
+	b.addDiagnostics()
+	b.addCommand("logs.txt", "journalctl", "--no-pager", "-n", "2000", "_COMM="+filepath.Base(os.Args[0]))
+	path := fmt.Sprintf("wireguard-overlay-support-%s.tar.gz", time.Now().Format("20060102-150405"))
+	if err := b.write(path); err != nil {
+		return "", errors.Wrap(err, "Could not write support bundle")
+	}
+	return path, nil
+}
@@ -0,0 +1,232 @@
+// Package tcprelay tunnels wireguard packets over TCP, optionally wrapped in
+// TLS, for networks that block UDP. Each packet is sent as a frame prefixed
+// with its length as a big endian uint16.
+package tcprelay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Wireguard packets fit in a single frame
+	maxFrameSize = 1<<16 - 1
+	// Connections without traffic are closed; wireguard keepalives keep
+	// used ones open
+	idleTimeout = 3 * time.Minute
+	// Connections beyond this are refused
+	maxConns    = 1024
+	dialTimeout = 10 * time.Second
+)
+
+func writeFrame(w io.Writer, packet []byte) error {
+	if len(packet) > maxFrameSize {
+		return errors.Errorf("Packet of %d bytes is too large", len(packet))
+	}
+	frame := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	copy(frame[2:], packet)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Serve accepts tunnels on the listener and forwards their packets to the
+// wireguard port at target, each tunnel from its own UDP socket so that
+// wireguard can tell the clients apart. It returns when the listener is
+// closed.
+func Serve(listener net.Listener, target *net.UDPAddr) error {
+	slots := make(chan struct{}, maxConns)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			logrus.Warn("Refused TCP relay connection from ", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			if err := serveConn(conn, target); err != nil {
+				logrus.WithError(err).Debug("TCP relay connection from ", conn.RemoteAddr(), " ended")
+			}
+		}()
+	}
+}
+
+func serveConn(conn net.Conn, target *net.UDPAddr) error {
+	defer conn.Close()
+	udp, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return errors.Wrap(err, "Could not open UDP socket")
+	}
+	defer udp.Close()
+	logrus.Debugf("Relaying %s over TCP via %s", conn.RemoteAddr(), udp.LocalAddr())
+	go func() {
+		buf := make([]byte, maxFrameSize)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if err := writeFrame(conn, buf[:n]); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+	r := bufio.NewReader(conn)
+	buf := make([]byte, maxFrameSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return err
+		}
+		packet, err := readFrame(r, buf)
+		if err != nil {
+			return err
+		}
+		if _, err := udp.Write(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// Proxy takes the packets wireguard sends to its local address and tunnels
+// them to a relay, dialling it when needed
+type Proxy struct {
+	relay string
+	tls   *tls.Config
+	local *net.UDPConn
+	mu    sync.Mutex
+	conn  net.Conn
+	// peer is the address of the wireguard socket
+	peer *net.UDPAddr
+}
+
+// NewProxy listens on a loopback UDP port for packets to tunnel to the relay
+// (host:port). With a TLS config, the tunnel is wrapped in TLS.
+func NewProxy(relay string, tlsConfig *tls.Config) (*Proxy, error) {
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not listen for packets to relay")
+	}
+	p := &Proxy{relay: relay, tls: tlsConfig, local: local}
+	go p.run()
+	return p, nil
+}
+
+// LocalAddr is the endpoint wireguard should send to
+func (p *Proxy) LocalAddr() *net.UDPAddr {
+	return p.local.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the proxy
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.mu.Unlock()
+	return p.local.Close()
+}
+
+func (p *Proxy) run() {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, from, err := p.local.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		conn, err := p.connect(from)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not connect to TCP relay")
+			continue
+		}
+		if err := writeFrame(conn, buf[:n]); err != nil {
+			logrus.WithError(err).Debug("Could not send to TCP relay")
+			p.drop(conn)
+		}
+	}
+}
+
+// connect returns the tunnel, dialling it if there is none
+func (p *Proxy) connect(from *net.UDPAddr) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peer = from
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if p.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.relay, p.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", p.relay)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logrus.Info("Connected to TCP relay ", p.relay)
+	p.conn = conn
+	go p.receive(conn)
+	return conn, nil
+}
+
+func (p *Proxy) drop(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.Close()
+	if p.conn == conn {
+		p.conn = nil
+	}
+}
+
+// receive hands the packets coming from the relay to wireguard
+func (p *Proxy) receive(conn net.Conn) {
+	defer p.drop(conn)
+	r := bufio.NewReader(conn)
+	buf := make([]byte, maxFrameSize)
+	for {
+		packet, err := readFrame(r, buf)
+		if err != nil {
+			logrus.WithError(err).Debug("TCP relay connection ended")
+			return
+		}
+		p.mu.Lock()
+		peer := p.peer
+		p.mu.Unlock()
+		if _, err := p.local.WriteToUDP(packet, peer); err != nil {
+			return
+		}
+	}
+}
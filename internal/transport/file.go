@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"encoding/gob"
+	"os"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+)
+
+// The file is checked for changes this often while watching
+const filePoll = time.Second
+
+// File reads a gob encoded peer list, as served by the server, from a file
+// that is provisioned by other means. There is no server to register with, so
+// registering succeeds without effect and the requests that need a server fail.
+type File struct {
+	path string
+}
+
+// NewFile returns the transport reading the peers from path
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (t *File) Register(protocol.Registration) error {
+	return nil
+}
+
+func (t *File) Deregister() error {
+	return nil
+}
+
+func (t *File) FetchPeers(context.Context) ([]wg.Peer, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open peers file")
+	}
+	defer f.Close()
+	var peers []wg.Peer
+	if err := gob.NewDecoder(f).Decode(&peers); err != nil {
+		return nil, errors.Wrapf(err, "Could not decode peers file %s", t.path)
+	}
+	return peers, nil
+}
+
+// Watch uses the modification time of the file as generation
+func (t *File) Watch(since uint64) (uint64, error) {
+	for deadline := time.Now().Add(watchTimeout); ; time.Sleep(filePoll) {
+		info, err := os.Stat(t.path)
+		if err != nil {
+			return 0, errors.Wrap(err, "Could not watch peers file")
+		}
+		gen := uint64(info.ModTime().UnixNano())
+		if gen != since || time.Now().After(deadline) {
+			return gen, nil
+		}
+	}
+}
+
+func (t *File) FetchPunches() ([]protocol.Punch, error) {
+	return nil, nil
+}
+
+func (t *File) FetchRestart() (bool, error) {
+	return false, nil
+}
+
+func (t *File) FetchACL() (protocol.ACL, error) {
+	return protocol.ACL{}, nil
+}
+
+func (t *File) FetchRevocations() (protocol.Revocations, error) {
+	return protocol.Revocations{}, nil
+}
+
+func (t *File) Replicas() []protocol.Replica {
+	return nil
+}
+
+func (t *File) ReportFailure(protocol.Diagnostic) error {
+	return errors.New("The file transport has no server to report to")
+}
+
+func (t *File) AnnounceRotation(protocol.Rotation) error {
+	return errors.New("The file transport has no server to rotate keys with")
+}
+
+func (t *File) VerifyEndpoint(protocol.Verification) error {
+	return errors.New("The file transport has no server to verify endpoints with")
+}
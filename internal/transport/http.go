@@ -0,0 +1,500 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/tracing"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const requestTimeout = 11 * time.Second
+
+// Peer lists are fetched in full at least this often, in case a delta was
+// applied wrongly
+const fullResyncInterval = 10 * time.Minute
+
+const (
+	// A page of a peer list is tried this many times before the fetch gives
+	// up, waiting pageRetryDelay after the first failure and twice as long
+	// after each further one
+	pageAttempts   = 4
+	pageRetryDelay = time.Second
+)
+
+// HTTP exchanges gob encoded requests with the peer API of the server
+type HTTP struct {
+	server  net.TCPAddr
+	scheme  string
+	options HTTPOptions
+	// transport connects from the namespace of the overlay interface and
+	// speaks TLS, if configured
+	transport http.RoundTripper
+	mu        sync.Mutex
+	replicas  []protocol.Replica
+	// fetching is held by a fetch of the peers for the state below it, apart
+	// from mu, which the responses take to record what the server announced
+	fetching sync.Mutex
+	// peers are those of generation, against which deltas are fetched.
+	// lastFull is when the list was last fetched in full.
+	peers      []wg.Peer
+	generation uint64
+	lastFull   time.Time
+	// partial are the pages fetched of a paged list that was not completed,
+	// which the next fetch continues while the server keeps its generation
+	partial           []wg.Peer
+	partialGeneration string
+	partialTotal      string
+	// peer is what the server last announced, and known whether it answered
+	// at all
+	peer  protocol.Peer
+	known bool
+	// clockOffset is how far the clock of the server was ahead at its last
+	// response, if it sent its time
+	clockOffset time.Duration
+	clocked     bool
+}
+
+// statusError is a response other than 200 OK
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "Server responded " + e.status
+}
+
+// HTTPOptions are the optional settings of the HTTP transport
+type HTTPOptions struct {
+	// Netns is the network namespace to connect from
+	Netns string
+	// TLS, if set, secures the connections with TLS
+	TLS *tls.Config
+	// Wrap, if set, is passed every connection, e.g. to secure it
+	Wrap func(net.Conn) net.Conn
+	// PrivateKey, if set, returns the current key of the client, with which
+	// registrations are signed for the server with ServerKey
+	PrivateKey func() wgtypes.Key
+	ServerKey  wgtypes.Key
+	// PageSize, if set, has full peer lists fetched this many peers at a
+	// time, each page with its own timeout
+	PageSize int
+}
+
+// NewHTTP returns the transport to the peer API at server
+func NewHTTP(server net.TCPAddr, options HTTPOptions) *HTTP {
+	t := &HTTP{server: server, scheme: "http", options: options}
+	if options.Netns == "" && options.TLS == nil && options.Wrap == nil {
+		return t
+	}
+	transport := &http.Transport{TLSClientConfig: options.TLS}
+	if options.TLS != nil {
+		t.scheme = "https"
+	}
+	dial := (&net.Dialer{}).DialContext
+	if netns := options.Netns; netns != "" {
+		dial = func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+			err = wg.InNetns(netns, func() error {
+				var d net.Dialer
+				conn, err = d.DialContext(ctx, network, addr)
+				return err
+			})
+			return conn, err
+		}
+	}
+	transport.DialContext = dial
+	if wrap := options.Wrap; wrap != nil {
+		// Connections are not reused, so that each request is secured with the
+		// keys of the moment, which change on key rotation
+		transport.DisableKeepAlives = true
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return wrap(conn), nil
+		}
+	}
+	t.transport = transport
+	return t
+}
+
+func (t *HTTP) url(path string) url.URL {
+	return url.URL{Scheme: t.scheme, Host: t.server.String(), Path: path}
+}
+
+// get decodes the response to a GET of path into out
+func (t *HTTP) get(path string, out interface{}) error {
+	return t.getURL(context.Background(), t.url(path), out)
+}
+
+func (t *HTTP) getURL(ctx context.Context, url url.URL, out interface{}) error {
+	res, err := t.fetch(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return gob.NewDecoder(res.Body).Decode(out)
+}
+
+// fetch returns the successful response to a GET of url
+func (t *HTTP) fetch(ctx context.Context, url url.URL) (*http.Response, error) {
+	client := &http.Client{Timeout: requestTimeout, Transport: t.transport}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Header)
+	protocol.SetVersion(req.Header)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.negotiate(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res, nil
+}
+
+// post sends the body, if any, gob encoded to path
+func (t *HTTP) post(path string, timeout time.Duration, body interface{}) error {
+	data, err := encode(body)
+	if err != nil {
+		return err
+	}
+	return t.send(path, timeout, data, make(http.Header))
+}
+
+// send posts data to path with the header
+func (t *HTTP) send(path string, timeout time.Duration, data []byte, header http.Header) error {
+	client := &http.Client{Timeout: timeout, Transport: t.transport}
+	url := t.url(path)
+	req, err := http.NewRequest(http.MethodPost, url.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/octet-stream")
+	protocol.SetVersion(req.Header)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := t.negotiate(res); err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("Server responded %s", res.Status)
+	}
+	return nil
+}
+
+// negotiate records the version and capabilities the server announced, and
+// fails if the server is too old or turned the client away as too old
+func (t *HTTP) negotiate(res *http.Response) error {
+	if res.StatusCode == http.StatusUpgradeRequired {
+		return errors.Errorf("Server version %s requires a newer client", res.Header.Get(protocol.VersionHeader))
+	}
+	peer, err := protocol.GetVersion(res.Header)
+	if err != nil {
+		return errors.Wrap(err, "Unsupported server")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peer, t.known = peer, true
+	if date, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		t.clockOffset, t.clocked = date.Sub(time.Now().Truncate(time.Second)), true
+	}
+	return nil
+}
+
+// ClockOffset returns how far the clock of the server was ahead of ours at
+// its last response, to the second, and whether it told its time at all
+func (t *HTTP) ClockOffset() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clockOffset, t.clocked
+}
+
+// supports reports whether the server has the capability. Until it answers,
+// it is assumed to.
+func (t *HTTP) supports(capability string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.known || t.peer.Supports(capability)
+}
+
+func encode(body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Register signs the registration, if the options have the keys, so that the
+// server can tell it from a replayed one
+func (t *HTTP) Register(registration protocol.Registration) error {
+	if t.options.PrivateKey == nil {
+		return t.post(protocol.RegisterPath, requestTimeout, registration)
+	}
+	data, err := encode(registration)
+	if err != nil {
+		return err
+	}
+	header, err := protocol.SignRegistration(t.options.PrivateKey(), t.options.ServerKey, data, time.Now())
+	if err != nil {
+		return err
+	}
+	return t.send(protocol.RegisterPath, requestTimeout, data, header)
+}
+
+func (t *HTTP) Deregister() error {
+	return t.post(protocol.DeregisterPath, 5*time.Second, nil)
+}
+
+// FetchPeers asks for the changes since the last list, if the server
+// announced its generation, and applies them
+func (t *HTTP) FetchPeers(ctx context.Context) (peers []wg.Peer, err error) {
+	t.fetching.Lock()
+	defer t.fetching.Unlock()
+	ctx, span := tracing.Start(ctx, "fetch peers")
+	defer func() {
+		span.SetAttributes(attribute.Int("peers", len(peers)))
+		tracing.End(span, err)
+	}()
+	if t.partial != nil {
+		peers, err := t.resume(ctx)
+		if err == nil {
+			return append([]wg.Peer(nil), peers...), nil
+		}
+		if !gone(err) {
+			return nil, err
+		}
+		// The server moved on, so start over with its current list
+	}
+	url := t.url(protocol.PeersPath)
+	query := url.Query()
+	if t.generation != 0 && time.Since(t.lastFull) < fullResyncInterval {
+		query.Set("since", strconv.FormatUint(t.generation, 10))
+	}
+	if t.options.PageSize > 0 {
+		query.Set("limit", strconv.Itoa(t.options.PageSize))
+	}
+	url.RawQuery = query.Encode()
+	res, err := t.fetch(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	sentDelta := res.Header.Get(protocol.DeltaHeader) != ""
+	span.SetAttributes(attribute.Bool("delta", sentDelta))
+	// The body is decoded as it arrives
+	_, decoding := tracing.Start(ctx, "decode")
+	if sentDelta {
+		var delta protocol.PeerDelta
+		err := gob.NewDecoder(res.Body).Decode(&delta)
+		tracing.End(decoding, err)
+		if err != nil {
+			return nil, err
+		}
+		if delta.Since != t.generation {
+			err := errors.Errorf("Server sent changes since generation %d instead of %d", delta.Since, t.generation)
+			t.generation = 0
+			return nil, err
+		}
+		peers = delta.Apply(t.peers)
+	} else {
+		err := gob.NewDecoder(res.Body).Decode(&peers)
+		tracing.End(decoding, err)
+		if err != nil {
+			return nil, err
+		}
+		if total := res.Header.Get(protocol.TotalHeader); total != "" {
+			if peers, err = t.fetchPages(ctx, peers, res.Header.Get(protocol.GenerationHeader), total); err != nil {
+				return nil, err
+			}
+		}
+		t.lastFull = time.Now()
+	}
+	// Servers that do not send deltas announce no generation
+	t.generation, _ = strconv.ParseUint(res.Header.Get(protocol.GenerationHeader), 10, 64)
+	t.peers = peers
+	t.mu.Lock()
+	t.replicas = protocol.GetReplicas(res.Header)
+	t.mu.Unlock()
+	// The caller adjusts the peers it is given
+	return append([]wg.Peer(nil), peers...), nil
+}
+
+// resume continues the paged list the last fetch did not complete
+func (t *HTTP) resume(ctx context.Context) ([]wg.Peer, error) {
+	generation := t.partialGeneration
+	peers, err := t.fetchPages(ctx, t.partial, generation, t.partialTotal)
+	if err != nil {
+		return nil, err
+	}
+	t.generation, _ = strconv.ParseUint(generation, 10, 64)
+	t.peers = peers
+	t.lastFull = time.Now()
+	return peers, nil
+}
+
+// fetchPages fetches the rest of the list of the generation after its first
+// pages. Failed pages are tried again; if one keeps failing, the pages
+// fetched so far are kept for the next fetch to continue from.
+func (t *HTTP) fetchPages(ctx context.Context, peers []wg.Peer, generation, total string) ([]wg.Peer, error) {
+	t.partial = nil
+	n, err := strconv.Atoi(total)
+	if err != nil {
+		return nil, errors.Errorf("Invalid peer count %q", total)
+	}
+	for len(peers) < n {
+		next := t.url(protocol.PeersPath)
+		query := next.Query()
+		query.Set("generation", generation)
+		query.Set("offset", strconv.Itoa(len(peers)))
+		query.Set("limit", strconv.Itoa(t.options.PageSize))
+		next.RawQuery = query.Encode()
+		page, err := t.fetchPage(ctx, next)
+		if err != nil {
+			if !gone(err) {
+				t.partial, t.partialGeneration, t.partialTotal = peers, generation, total
+			}
+			return nil, errors.Wrapf(err, "Could not fetch peers from %d of %d", len(peers), n)
+		}
+		if len(page) == 0 {
+			return nil, errors.Errorf("Server sent no peers from %d of %d", len(peers), n)
+		}
+		peers = append(peers, page...)
+	}
+	return peers, nil
+}
+
+// fetchPage tries the page up to pageAttempts times, unless the server no
+// longer has the list, e.g. while the link drops requests or the rate limit of
+// the server is hit
+func (t *HTTP) fetchPage(ctx context.Context, url url.URL) ([]wg.Peer, error) {
+	delay := pageRetryDelay
+	for attempt := 1; ; attempt++ {
+		var page []wg.Peer
+		err := t.getURL(ctx, url, &page)
+		if err == nil || attempt == pageAttempts || gone(err) {
+			return page, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// gone reports whether the server no longer has the list of a generation
+func gone(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.code == http.StatusGone
+}
+
+func (t *HTTP) Replicas() []protocol.Replica {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.replicas
+}
+
+func (t *HTTP) Watch(since uint64) (uint64, error) {
+	client := &http.Client{Timeout: watchTimeout + 10*time.Second, Transport: t.transport}
+	url := t.url(protocol.WatchPath)
+	if since != 0 {
+		url.RawQuery = "since=" + strconv.FormatUint(since, 10)
+	}
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	protocol.SetVersion(req.Header)
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if err := t.negotiate(res); err != nil {
+		return 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("Server responded %s", res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 32))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(body)), 10, 64)
+}
+
+func (t *HTTP) FetchPunches() ([]protocol.Punch, error) {
+	var punches []protocol.Punch
+	if err := t.get(protocol.PunchPath, &punches); err != nil {
+		return nil, err
+	}
+	return punches, nil
+}
+
+func (t *HTTP) FetchRestart() (bool, error) {
+	var restart protocol.Restart
+	if err := t.get(protocol.RestartPath, &restart); err != nil {
+		return false, err
+	}
+	return restart.Restart, nil
+}
+
+func (t *HTTP) FetchACL() (protocol.ACL, error) {
+	var acl protocol.ACL
+	err := t.get(protocol.ACLPath, &acl)
+	return acl, err
+}
+
+func (t *HTTP) FetchRevocations() (protocol.Revocations, error) {
+	var revocations protocol.Revocations
+	// Servers from before revocations answer any path with the peer list
+	if !t.supports(protocol.CapRevocations) {
+		return revocations, nil
+	}
+	err := t.get(protocol.RevokedPath, &revocations)
+	return revocations, err
+}
+
+func (t *HTTP) ReportFailure(diag protocol.Diagnostic) error {
+	return t.post(protocol.DiagnosticsPath, requestTimeout, diag)
+}
+
+func (t *HTTP) AnnounceRotation(rotation protocol.Rotation) error {
+	return t.post(protocol.RotatePath, requestTimeout, rotation)
+}
+
+func (t *HTTP) VerifyEndpoint(verification protocol.Verification) error {
+	return t.post(protocol.VerifyPath, requestTimeout, verification)
+}
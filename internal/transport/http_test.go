@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerServer answers peer list requests with the full list of generation 1,
+// or with the delta it is given to those that ask for changes since then
+type peerServer struct {
+	peers []wg.Peer
+	delta protocol.PeerDelta
+	since []string
+}
+
+func (s *peerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	protocol.SetVersion(w.Header())
+	since := r.URL.Query().Get("since")
+	s.since = append(s.since, since)
+	if since == "" {
+		w.Header().Set(protocol.GenerationHeader, "1")
+		gob.NewEncoder(w).Encode(s.peers)
+		return
+	}
+	w.Header().Set(protocol.GenerationHeader, strconv.FormatUint(s.delta.Generation, 10))
+	w.Header().Set(protocol.DeltaHeader, "1")
+	gob.NewEncoder(w).Encode(s.delta)
+}
+
+func newPeerTransport(t *testing.T, s *peerServer) *HTTP {
+	t.Helper()
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	return NewHTTP(*addr, HTTPOptions{})
+}
+
+func TestFetchPeersDelta(t *testing.T) {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := wg.Peer{IP: "192.0.2.2", Port: 51820, PublicKey: k.PublicKey()}
+	s := &peerServer{
+		peers: []wg.Peer{{IP: "192.0.2.1", Port: 51820}},
+		delta: protocol.PeerDelta{Since: 1, Generation: 2, Changed: []wg.Peer{added}},
+	}
+	tr := newPeerTransport(t, s)
+	if peers, err := tr.FetchPeers(context.Background()); err != nil || len(peers) != 1 {
+		t.Fatalf("Full fetch got %d peers (%v), want 1", len(peers), err)
+	}
+	peers, err := tr.FetchPeers(context.Background())
+	if err != nil || len(peers) != 2 || peers[1].PublicKey != added.PublicKey {
+		t.Fatalf("Delta fetch got %v (%v), want the added peer", peers, err)
+	}
+	if tr.generation != 2 {
+		t.Errorf("Generation after the delta is %d, want 2", tr.generation)
+	}
+	if len(s.since) != 2 || s.since[1] != "1" {
+		t.Errorf("Asked for changes since %q, want since 1 last", s.since)
+	}
+}
+
+func TestFetchPeersDeltaMismatch(t *testing.T) {
+	s := &peerServer{
+		peers: []wg.Peer{{IP: "192.0.2.1", Port: 51820}},
+		// Changes since a list the client never had
+		delta: protocol.PeerDelta{Since: 7, Generation: 8},
+	}
+	tr := newPeerTransport(t, s)
+	if _, err := tr.FetchPeers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.FetchPeers(context.Background()); err == nil {
+		t.Error("Delta against another generation was applied")
+	}
+	if tr.generation != 0 {
+		t.Errorf("Generation after the mismatch is %d, want 0", tr.generation)
+	}
+	// Which has the next fetch ask for the full list
+	if peers, err := tr.FetchPeers(context.Background()); err != nil || len(peers) != 1 {
+		t.Errorf("Fetch after the mismatch got %d peers (%v), want the full list", len(peers), err)
+	}
+	if n := len(s.since); n != 3 || s.since[2] != "" {
+		t.Errorf("Asked for changes since %q, want the full list last", s.since)
+	}
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Server is the server side of a transport: it answers the clients that
+// connect on the listeners it serves until it is closed, after which Serve
+// returns http.ErrServerClosed
+type Server interface {
+	Serve(net.Listener) error
+	Close() error
+}
+
+// ServerOptions are what the server side of a transport is set up with
+type ServerOptions struct {
+	// API answers the requests of the peer API as the HTTP transport sends
+	// them; other transports translate their requests into these
+	API http.Handler
+	// ConnContext, if set, derives the context of the requests on a
+	// connection
+	ConnContext func(context.Context, net.Conn) context.Context
+	// MaxHeaderBytes limits the headers of a request
+	MaxHeaderBytes int
+	// WatchTimeout is how long a watch request is held at most
+	WatchTimeout time.Duration
+}
+
+// ServerFactory sets up the server side of a transport of one kind
+type ServerFactory func(options ServerOptions) (Server, error)
+
+var serverFactories = map[string]ServerFactory{
+	KindHTTP: func(options ServerOptions) (Server, error) {
+		return NewHTTPServer(options), nil
+	},
+}
+
+// RegisterServer adds the server side of a kind of transport for the
+// transport option of the server to select. Like Register, it is meant to be
+// called from an init function and panics if the kind is taken.
+func RegisterServer(kind string, factory ServerFactory) {
+	if _, ok := serverFactories[kind]; ok {
+		panic("server transport " + kind + " is registered twice")
+	}
+	serverFactories[kind] = factory
+}
+
+// ServerKinds returns the kinds of transport a server can answer in order
+func ServerKinds() []string {
+	kinds := make([]string, 0, len(serverFactories))
+	for k := range serverFactories {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// NewServer returns the server side of the transport of the kind
+func NewServer(kind string, options ServerOptions) (Server, error) {
+	factory, ok := serverFactories[kind]
+	if !ok {
+		return nil, errors.Errorf("Unknown server transport %s (%s)", kind, strings.Join(ServerKinds(), "/"))
+	}
+	return factory(options)
+}
+
+// NewHTTPServer returns the server side of the HTTP transport, which serves
+// the peer API as it is
+func NewHTTPServer(options ServerOptions) *http.Server {
+	return &http.Server{
+		ReadTimeout: 3 * time.Second,
+		// Leaves room for watch requests
+		WriteTimeout:   options.WatchTimeout + 10*time.Second,
+		IdleTimeout:    120 * time.Second,
+		MaxHeaderBytes: options.MaxHeaderBytes,
+		Handler:        options.API,
+		ConnContext:    options.ConnContext,
+	}
+}
@@ -0,0 +1,118 @@
+// Package transport carries the exchange between a client and the server:
+// registering, fetching peers, waiting for changes and the other requests of
+// the sync. The sync only sees the Transport interface, so that transports can
+// be added and tested without it.
+package transport
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/protocol"
+	"github.com/jimzhong/wireguard-overlay/internal/wg"
+	"github.com/pkg/errors"
+)
+
+// Kinds of transport
+const (
+	// KindHTTP talks to the peer API of the server over the overlay
+	KindHTTP = "http"
+	// KindFile reads the peers from a file, without any server
+	KindFile = "file"
+)
+
+// Transport exchanges the sync with the server
+type Transport interface {
+	// Register tells the server about the client
+	Register(protocol.Registration) error
+	// Deregister tells the server that the client shuts down
+	Deregister() error
+	// FetchPeers returns the peers the client is to configure, tracing the
+	// fetch as part of the span in the context
+	FetchPeers(context.Context) ([]wg.Peer, error)
+	// Replicas returns the replicas of the server announced with the last
+	// peer list
+	Replicas() []protocol.Replica
+	// Watch blocks until the peers have a generation other than since, or
+	// until the transport gives up waiting, and returns the current generation
+	Watch(since uint64) (uint64, error)
+	// FetchPunches returns the hole punches the server scheduled for the
+	// client with peers behind NAT
+	FetchPunches() ([]protocol.Punch, error)
+	// FetchRestart reports whether the client is to restart as part of a
+	// rolling restart
+	FetchRestart() (bool, error)
+	// FetchACL returns the ACL the client is to enforce
+	FetchACL() (protocol.ACL, error)
+	// FetchRevocations returns the keys the client must not configure
+	FetchRevocations() (protocol.Revocations, error)
+	// ReportFailure tells the server about a peer the client keeps failing
+	// to reach
+	ReportFailure(protocol.Diagnostic) error
+	// AnnounceRotation tells the server the key the client is rotating to,
+	// which takes over from the current one at the cutover the server sets
+	AnnounceRotation(protocol.Rotation) error
+	// VerifyEndpoint returns a cookie the server sent to a claimed endpoint
+	VerifyEndpoint(protocol.Verification) error
+}
+
+// Watching gives up after this long, so that the caller notices lost servers
+const watchTimeout = 30 * time.Second
+
+// Options are what a transport is set up with. Each kind takes the settings
+// that apply to it and ignores the others.
+type Options struct {
+	// Server is the address of the server's peer API on the overlay
+	Server net.TCPAddr
+	// Path is the file the file transport reads the peers from
+	Path string
+	// HTTP are the settings of the HTTP transport
+	HTTP HTTPOptions
+}
+
+// Factory sets up a transport of one kind
+type Factory func(options Options) (Transport, error)
+
+var factories = map[string]Factory{
+	KindHTTP: func(options Options) (Transport, error) {
+		return NewHTTP(options.Server, options.HTTP), nil
+	},
+	KindFile: func(options Options) (Transport, error) {
+		if options.Path == "" {
+			return nil, errors.New("The file transport requires a file")
+		}
+		return NewFile(options.Path), nil
+	},
+}
+
+// Register adds a kind of transport for the transport option of the client to
+// select. It is meant to be called from an init function of the file that
+// implements the transport, and panics if the kind is taken.
+func Register(kind string, factory Factory) {
+	if _, ok := factories[kind]; ok {
+		panic("transport " + kind + " is registered twice")
+	}
+	factories[kind] = factory
+}
+
+// Kinds returns the registered kinds of transport in order
+func Kinds() []string {
+	kinds := make([]string, 0, len(factories))
+	for k := range factories {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// New returns the transport of the kind
+func New(kind string, options Options) (Transport, error) {
+	factory, ok := factories[kind]
+	if !ok {
+		return nil, errors.Errorf("Unknown transport %s (%s)", kind, strings.Join(Kinds(), "/"))
+	}
+	return factory(options)
+}
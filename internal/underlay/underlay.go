@@ -0,0 +1,119 @@
+package underlay
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// Well-known IPv4 addresses of ipv4only.arpa (RFC 7050)
+var ipv4OnlyAddrs = []net.IP{
+	net.IPv4(192, 0, 0, 170),
+	net.IPv4(192, 0, 0, 171),
+}
+
+// WellKnownPrefix is the NAT64 prefix of RFC 6052
+var WellKnownPrefix = net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// HasIPv4 reports whether the host has a default IPv4 route
+func HasIPv4() (bool, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return false, errors.Wrap(err, "Could not list routes")
+	}
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.Equal(net.IPv4zero) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DiscoverNAT64Prefix finds the /96 prefix the DNS64 resolver synthesizes
+// addresses with by looking up ipv4only.arpa (RFC 7050)
+func DiscoverNAT64Prefix() (*net.IPNet, error) {
+	ips, err := net.LookupIP("ipv4only.arpa")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not look up ipv4only.arpa")
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue
+		}
+		for _, known := range ipv4OnlyAddrs {
+			if net.IP(ip[12:]).Equal(known) {
+				prefix := make(net.IP, net.IPv6len)
+				copy(prefix, ip[:12])
+				return &net.IPNet{IP: prefix, Mask: net.CIDRMask(96, 128)}, nil
+			}
+		}
+	}
+	return nil, errors.New("No NAT64 prefix found; the resolver does not do DNS64")
+}
+
+// ParseNAT64Prefix parses a /96 NAT64 prefix
+func ParseNAT64Prefix(s string) (*net.IPNet, error) {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid NAT64 prefix %q", s)
+	}
+	if ones, bits := prefix.Mask.Size(); ones != 96 || bits != 128 {
+		return nil, errors.Errorf("NAT64 prefix %s must be an IPv6 /96", s)
+	}
+	return prefix, nil
+}
+
+// Synthesize embeds the IPv4 address into the NAT64 prefix. Other addresses
+// are returned as they are.
+func Synthesize(prefix *net.IPNet, ip net.IP) net.IP {
+	v4 := ip.To4()
+	if v4 == nil || prefix == nil {
+		return ip
+	}
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized, prefix.IP.To16()[:12])
+	copy(synthesized[12:], v4)
+	return synthesized
+}
+
+// ResolveHost resolves an IP address literal or hostname. IPv6 addresses are
+// preferred when the host has no IPv4 connectivity.
+func ResolveHost(host string, hasIPv4 bool) (net.IP, error) {
+	ips, err := ResolveHostAll(host, hasIPv4)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// ResolveHostAll resolves an IP address literal or hostname to all of its
+// addresses, the preferred ones first
+func ResolveHostAll(host string, hasIPv4 bool) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not resolve %s", host)
+	}
+	if len(ips) == 0 {
+		return nil, errors.Errorf("%s has no addresses", host)
+	}
+	return prefer(ips, hasIPv4), nil
+}
+
+// prefer moves IPv4 addresses behind the IPv6 ones when the host has no IPv4
+// connectivity, keeping the order within each family
+func prefer(ips []net.IP, hasIPv4 bool) []net.IP {
+	preferred := make([]net.IP, 0, len(ips))
+	var others []net.IP
+	for _, ip := range ips {
+		if hasIPv4 || ip.To4() == nil {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	return append(preferred, others...)
+}
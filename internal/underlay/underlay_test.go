@@ -0,0 +1,92 @@
+package underlay
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseNAT64Prefix(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"64:ff9b::/96", "64:ff9b::/96", true},
+		{"2001:db8:64::/96", "2001:db8:64::/96", true},
+		{"2001:db8:64::1/96", "2001:db8:64::/96", true},
+		{"64:ff9b::/64", "", false},
+		{"10.0.0.0/8", "", false},
+		{"64:ff9b::", "", false},
+		{"garbage", "", false},
+	}
+	for _, tt := range tests {
+		prefix, err := ParseNAT64Prefix(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseNAT64Prefix(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && prefix.String() != tt.want {
+			t.Errorf("ParseNAT64Prefix(%q) = %s, want %s", tt.in, prefix, tt.want)
+		}
+	}
+}
+
+func TestSynthesize(t *testing.T) {
+	custom, err := ParseNAT64Prefix("2001:db8:64::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		prefix *net.IPNet
+		ip     net.IP
+		want   string
+	}{
+		{"well-known prefix", &WellKnownPrefix, net.ParseIP("192.0.2.33").To4(), "64:ff9b::c000:221"},
+		{"custom prefix", custom, net.ParseIP("192.0.2.33").To4(), "2001:db8:64::c000:221"},
+		{"v4-mapped input", &WellKnownPrefix, net.ParseIP("::ffff:192.0.2.33"), "64:ff9b::c000:221"},
+		{"IPv6 unchanged", &WellKnownPrefix, net.ParseIP("2001:db8::1"), "2001:db8::1"},
+		{"no prefix", nil, net.ParseIP("192.0.2.33"), "192.0.2.33"},
+	}
+	for _, tt := range tests {
+		if got := Synthesize(tt.prefix, tt.ip); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: Synthesize = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrefer(t *testing.T) {
+	v4a, v4b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		hasIPv4 bool
+		want    []net.IP
+	}{
+		{"dual-stack host keeps order", []net.IP{v4a, v6a, v4b, v6b}, true, []net.IP{v4a, v6a, v4b, v6b}},
+		{"v6-only host prefers AAAA", []net.IP{v4a, v6a, v4b, v6b}, false, []net.IP{v6a, v6b, v4a, v4b}},
+		{"v6-only host with only A", []net.IP{v4a, v4b}, false, []net.IP{v4a, v4b}},
+		{"v6-only host with only AAAA", []net.IP{v6b, v6a}, false, []net.IP{v6b, v6a}},
+	}
+	for _, tt := range tests {
+		if got := prefer(tt.ips, tt.hasIPv4); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: prefer = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveHostLiteral(t *testing.T) {
+	for _, host := range []string{"192.0.2.1", "2001:db8::1"} {
+		for _, hasIPv4 := range []bool{true, false} {
+			ip, err := ResolveHost(host, hasIPv4)
+			if err != nil {
+				t.Fatalf("ResolveHost(%q, %v): %v", host, hasIPv4, err)
+			}
+			if !ip.Equal(net.ParseIP(host)) {
+				t.Errorf("ResolveHost(%q, %v) = %s", host, hasIPv4, ip)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package wg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Peers applied per run, as in a large mesh
+const benchmarkPeerCount = 2000
+
+// BenchmarkAddPeers times applying peers with random keys and endpoints to a
+// throwaway interface in batches of several sizes, to choose peer-apply-batch
+// for the host. A batch size of 0 applies all peers in one call. The
+// interface is kernel wireguard if available and userspace otherwise.
+func BenchmarkAddPeers(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("Creating interfaces requires root")
+	}
+	peers, err := benchmarkPeers(benchmarkPeerCount)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, batch := range []int{0, 16, 64, 256, 1024} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			var applying time.Duration
+			for i := 0; i < b.N; i++ {
+				// Every run gets a new interface, since removed peers linger
+				// in the userspace implementation
+				b.StopTimer()
+				s := benchmarkState(b)
+				s.SetBatchSize(batch)
+				b.StartTimer()
+				started := time.Now()
+				err := s.AddPeers(peers)
+				applying += time.Since(started)
+				b.StopTimer()
+				if err := s.DownInterface(); err != nil {
+					b.Errorf("Could not remove %s: %v", s.Interface(), err)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(b.N*len(peers))/applying.Seconds(), "peers/s")
+		})
+	}
+}
+
+// benchmarkState sets up a throwaway interface on a random overlay network
+func benchmarkState(b *testing.B) *State {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		b.Fatal(err)
+	}
+	overlay := net.IPNet{IP: make(net.IP, net.IPv6len), Mask: net.CIDRMask(48, 128)}
+	overlay.IP[0] = 0xfd
+	copy(overlay.IP[1:6], random)
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	s, err := New("wgbn"+hex.EncodeToString(random[5:]), 0, overlay, random, key.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := s.SetUpInterface(); err != nil {
+		b.Skip("Could not set up interface: ", err)
+	}
+	return s
+}
+
+// benchmarkPeers returns peers like those of an overlay, with an endpoint
+// each. Without keepalives, nothing is sent to them.
+func benchmarkPeers(n int) ([]Peer, error) {
+	peers := make([]Peer, n)
+	for i := range peers {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		peers[i] = Peer{
+			IP:        net.IPv4(192, 0, 2, byte(i)).String(),
+			Port:      51820 + i%1000,
+			PublicKey: key.PublicKey(),
+		}
+	}
+	return peers, nil
+}
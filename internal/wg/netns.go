@@ -0,0 +1,114 @@
+package wg
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// openNetns opens the network namespace with the name, as created by ip netns
+// add, or at the path, e.g. /proc/<pid>/ns/net of a container
+func openNetns(name string) (netns.NsHandle, error) {
+	var ns netns.NsHandle
+	var err error
+	if strings.Contains(name, "/") {
+		ns, err = netns.GetFromPath(name)
+	} else {
+		ns, err = netns.GetFromName(name)
+	}
+	return ns, errors.Wrapf(err, "Could not open network namespace %s", name)
+}
+
+// InNetns runs f on a thread in the named network namespace, so that the
+// sockets f opens, e.g. for netlink, wgctrl or TCP, belong to it. An empty
+// name runs f in the current namespace.
+func InNetns(name string, f func() error) error {
+	if name == "" {
+		return f()
+	}
+	ns, err := openNetns(name)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	done := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// instead of being reused in the namespace
+		runtime.LockOSThread()
+		if err := netns.Set(ns); err != nil {
+			done <- errors.Wrapf(err, "Could not enter network namespace %s", name)
+			return
+		}
+		done <- f()
+	}()
+	return <-done
+}
+
+// SetNetns places the interface in the named network namespace instead of the
+// current one. Wireguard keeps its socket in the namespace the interface is
+// created in, so the encrypted traffic still uses the network of the daemon.
+// It has to be called before DryRun and SetUpInterface.
+func (s *State) SetNetns(name string) error {
+	ns, err := openNetns(name)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return errors.Wrap(err, "Could not open netlink handle")
+	}
+	var client *wgctrl.Client
+	if err := InNetns(name, func() (err error) {
+		client, err = wgctrl.New()
+		return err
+	}); err != nil {
+		handle.Delete()
+		return errors.Wrap(err, "Could not instantiate wireguard client")
+	}
+	s.client.Close()
+	s.client, s.nl, s.netns = client, handle, name
+	return nil
+}
+
+// moveIntoNetns creates the interface in the current namespace, unless it
+// exists there already, and moves it into the namespace of the state. An
+// interface already in that namespace is used as it is. It reports whether
+// the interface was created.
+func (s *State) moveIntoNetns() (bool, error) {
+	if _, err := s.nl.LinkByName(s.iface); err == nil {
+		return false, nil
+	}
+	created := false
+	link, err := netlink.LinkByName(s.iface)
+	if err != nil {
+		if err := retry(func() error {
+			return netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: s.iface}})
+		}); err != nil {
+			return false, errors.Wrapf(err, "Could not create interface %s", s.iface)
+		}
+		created = true
+		if link, err = netlink.LinkByName(s.iface); err != nil {
+			return created, errors.Wrapf(err, "Could not get link information for %s", s.iface)
+		}
+	} else if link.Type() != "wireguard" {
+		return false, errors.Errorf("Interface %s exists and is no wireguard interface", s.iface)
+	}
+	ns, err := openNetns(s.netns)
+	if err != nil {
+		return created, err
+	}
+	defer ns.Close()
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		if created {
+			netlink.LinkDel(link)
+		}
+		return false, errors.Wrapf(err, "Could not move %s to network namespace %s", s.iface, s.netns)
+	}
+	return created, nil
+}
@@ -0,0 +1,191 @@
+package wg
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// plan records the changes of a dry run instead of applying them
+type plan struct {
+	w io.Writer
+	// peers is the device as it would be configured
+	peers map[wgtypes.Key]Peer
+	// existing are the peers of the running device that were not touched
+	existing map[wgtypes.Key]bool
+}
+
+// DryRun makes the state print the changes it would apply to w instead of
+// applying them. Changes are compared with the running interface, if any. It
+// has to be called before the state is used by several goroutines.
+func (s *State) DryRun(w io.Writer) {
+	s.plan = &plan{w: w, peers: make(map[wgtypes.Key]Peer), existing: make(map[wgtypes.Key]bool)}
+	device, err := s.client.Device(s.iface)
+	if err != nil {
+		s.planf("interface %s is not running", s.iface)
+		return
+	}
+	s.planf("interface %s is running, comparing with its configuration", s.iface)
+	for i := range device.Peers {
+		p := fromWgtypesPeer(&device.Peers[i], s.Networks())
+		s.plan.peers[p.PublicKey] = p
+		s.plan.existing[p.PublicKey] = true
+	}
+}
+
+// FinishDryRun prints the peers of the running device that the new
+// configuration would not have
+func (s *State) FinishDryRun() {
+	if s.plan == nil {
+		return
+	}
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	keys := make([]string, 0, len(s.plan.existing))
+	for k := range s.plan.existing {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.planf("peer %s would be dropped", k)
+	}
+}
+
+func (s *State) planf(format string, args ...interface{}) {
+	fmt.Fprintf(s.plan.w, format+"\n", args...)
+}
+
+func (s *State) planUpInterface() {
+	port := "random"
+	if s.port != 0 {
+		port = fmt.Sprint(s.port)
+	}
+	fwmark := "off"
+	if s.fwmark != 0 {
+		fwmark = fmt.Sprintf("%#x", s.fwmark)
+	}
+	s.planf("interface %s create, listen-port %s, public key %s, mtu %d, fwmark %s", s.iface, port, s.publicKey, mtu, fwmark)
+	if s.netns != "" {
+		s.planf("link set %s netns %s", s.iface, s.netns)
+	}
+	s.planf("address add %s dev %s", &s.OverlayAddr, s.iface)
+	for i := range s.extraAddrs {
+		s.planf("address add %s dev %s", &s.extraAddrs[i], s.iface)
+	}
+	s.planf("link set %s up", s.iface)
+	s.planRoute(netlink.Route{Dst: &s.OverlayNetwork})
+	for i := range s.extraNets {
+		s.planRoute(netlink.Route{Dst: &s.extraNets[i], Src: s.extraAddrs[i].IP})
+	}
+}
+
+func (s *State) planAssignAddresses(wanted []net.IPNet) {
+	for i := range wanted {
+		s.planf("address add %s dev %s", &wanted[i], s.iface)
+	}
+	for _, old := range append([]net.IPNet{s.assignedAddr}, s.previousAddrs...) {
+		if old.IP == nil || old.IP.Equal(s.OverlayAddr.IP) || containsAddr(wanted, old.IP) {
+			continue
+		}
+		s.planf("address del %s dev %s", &old, s.iface)
+	}
+	s.planRoute(netlink.Route{Dst: &s.OverlayNetwork, Src: wanted[0].IP})
+	s.setAssignedAddr(wanted[0])
+	s.previousAddrs = wanted[1:]
+}
+
+func (s *State) planRoute(route netlink.Route) {
+	route = s.markRoute(route)
+	line := fmt.Sprintf("route replace %s dev %s", route.Dst, s.iface)
+	if route.Src != nil {
+		line += " src " + route.Src.String()
+	}
+	if route.Table != 0 {
+		line += fmt.Sprintf(" table %d", route.Table)
+	}
+	if route.Priority != 0 {
+		line += fmt.Sprintf(" metric %d", route.Priority)
+	}
+	line += fmt.Sprintf(" proto %d", route.Protocol)
+	s.planf("%s", line)
+}
+
+// planPeers prints and records the peer changes
+func (s *State) planPeers(configs []wgtypes.PeerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range configs {
+		delete(s.plan.existing, c.PublicKey)
+		if c.Remove {
+			if _, ok := s.plan.peers[c.PublicKey]; ok {
+				s.planf("peer remove %s", c.PublicKey)
+				delete(s.plan.peers, c.PublicKey)
+			}
+			continue
+		}
+		old, ok := s.plan.peers[c.PublicKey]
+		if !ok && c.UpdateOnly {
+			continue
+		}
+		p := applyPeerConfig(old, c)
+		s.plan.peers[c.PublicKey] = p
+		if !ok {
+			s.planf("peer add %s %s", c.PublicKey, describePeer(p))
+		} else {
+			s.planf("peer update %s %s (was %s)", c.PublicKey, describePeer(p), describePeer(old))
+		}
+	}
+}
+
+// applyPeerConfig returns the peer after wireguard applied the config
+func applyPeerConfig(p Peer, c wgtypes.PeerConfig) Peer {
+	p.PublicKey = c.PublicKey
+	if c.PresharedKey != nil {
+		p.PresharedKey = *c.PresharedKey
+	}
+	if c.Endpoint != nil {
+		p.IP = c.Endpoint.IP.String()
+		p.Port = c.Endpoint.Port
+	}
+	if c.PersistentKeepaliveInterval != nil {
+		p.KeepaliveInterval = *c.PersistentKeepaliveInterval
+	}
+	if c.ReplaceAllowedIPs {
+		p.Addresses = nil
+	}
+	for _, a := range c.AllowedIPs {
+		found := false
+		for _, have := range p.Addresses {
+			found = found || have.Equal(a.IP)
+		}
+		if !found {
+			p.Addresses = append(p.Addresses, a.IP)
+		}
+	}
+	return p
+}
+
+func describePeer(p Peer) string {
+	endpoint := "none"
+	if p.IP != "" {
+		endpoint = (&net.UDPAddr{IP: net.ParseIP(p.IP), Port: p.Port}).String()
+	}
+	addrs := make([]string, 0, len(p.Addresses))
+	for _, a := range p.Addresses {
+		n := hostNet(a)
+		addrs = append(addrs, n.String())
+	}
+	for _, n := range p.AllowedIPs {
+		addrs = append(addrs, n.String())
+	}
+	allowed := strings.Join(addrs, ",")
+	if allowed == "" {
+		allowed = "none"
+	}
+	return fmt.Sprintf("endpoint %s allowed-ips %s keepalive %s", endpoint, allowed, p.KeepaliveInterval)
+}
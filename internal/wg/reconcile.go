@@ -0,0 +1,79 @@
+package wg
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reconcile compares the device with its configuration through the state and
+// repairs what was changed by other means, e.g. by an operator running wg: the
+// private key, the listen port, the firewall mark, and peers that were removed or whose allowed
+// IPs, preshared key or keepalive differ. Endpoints are left as they are, since
+// wireguard moves them when peers roam, and so are peers added by other means.
+func (s *State) Reconcile() error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	if s.plan != nil || s.down {
+		return nil
+	}
+	device, err := s.client.Device(s.iface)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get device %s", s.iface)
+	}
+	var config wgtypes.Config
+	if device.PrivateKey != s.privateKey {
+		wgLog.Warnf("Private key of %s was changed; restoring it", s.iface)
+		config.PrivateKey = &s.privateKey
+	}
+	if s.port != 0 && device.ListenPort != s.port {
+		wgLog.Warnf("Listen port of %s was changed to %d; restoring %d", s.iface, device.ListenPort, s.port)
+		config.ListenPort = &s.port
+	}
+	if s.fwmark != 0 && device.FirewallMark != s.fwmark {
+		wgLog.Warnf("Firewall mark of %s was changed to %#x; restoring %#x", s.iface, device.FirewallMark, s.fwmark)
+		config.FirewallMark = &s.fwmark
+	}
+	configured := make(map[wgtypes.Key]*Peer, len(device.Peers))
+	for i := range device.Peers {
+		p := fromWgtypesPeer(&device.Peers[i], s.Networks())
+		configured[p.PublicKey] = &p
+	}
+	for k, p := range s.desired {
+		p := p
+		log := wgLog.WithField("peer", k.String())
+		want := p
+		want.Addresses = s.PeerAddresses(p)
+		c, ok := configured[k]
+		if !ok {
+			log.Warnf("Peer was removed from %s; adding it again with %s", s.iface, describePeer(want))
+		} else if !p.sameSettings(c, s.overlay()) {
+			log.Warnf("Peer was changed on %s to %s; restoring %s", s.iface, describePeer(*c), describePeer(want))
+		} else {
+			continue
+		}
+		pc := p.toPeerConfig(s.overlay())
+		pc.ReplaceAllowedIPs = true
+		if ok {
+			// Keep the endpoint the peer roamed to
+			pc.Endpoint = nil
+		}
+		config.Peers = append(config.Peers, pc)
+	}
+	if config.PrivateKey == nil && config.ListenPort == nil && config.FirewallMark == nil && len(config.Peers) == 0 {
+		return nil
+	}
+	return errors.Wrapf(s.client.ConfigureDevice(s.iface, config), "Could not repair %s", s.iface)
+}
+
+// RunReconcile repairs the device every interval
+func (s *State) RunReconcile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.Reconcile(); err != nil {
+			wgLog.WithError(err).Warn("Could not reconcile device")
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package wg
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+)
+
+// Transient netlink errors are retried for this long
+const netlinkRetryTime = 5 * time.Second
+
+// transient reports whether a netlink error may go away by itself, e.g. when
+// the kernel is short of buffers or the link is changed concurrently
+func transient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EINTR)
+}
+
+// retry runs f until it succeeds, fails with an error that is not transient,
+// or has kept failing for netlinkRetryTime
+func retry(f func() error) error {
+	bf := backoff.NewExponentialBackOff()
+	bf.InitialInterval = 50 * time.Millisecond
+	bf.MaxElapsedTime = netlinkRetryTime
+	return backoff.Retry(func() error {
+		err := f()
+		if err != nil && !transient(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, bf)
+}
@@ -0,0 +1,172 @@
+package wg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// How long the self-test waits for the handshake
+const selfTestWait = 2 * time.Second
+
+// SelfTest checks kernel wireguard end to end: it creates two interfaces,
+// moves them to throwaway namespaces, lets them handshake over loopback and
+// removes them again. Production interfaces are not touched.
+func SelfTest() error {
+	// Namespaces are switched per thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		return errors.Wrap(err, "Could not get network namespace")
+	}
+	defer origin.Close()
+	var namespaces [2]netns.NsHandle
+	for i := range namespaces {
+		ns, err := netns.New()
+		if err != nil {
+			netns.Set(origin)
+			return errors.Wrap(err, "Could not create network namespace")
+		}
+		defer ns.Close()
+		namespaces[i] = ns
+		if err := netns.Set(origin); err != nil {
+			return errors.Wrap(err, "Could not return to network namespace")
+		}
+	}
+
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	names := [2]string{"wgst" + hex.EncodeToString(suffix) + "a", "wgst" + hex.EncodeToString(suffix) + "b"}
+	var keys [2]wgtypes.Key
+	var ports [2]int
+	for i, name := range names {
+		if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			if errors.Is(err, syscall.EOPNOTSUPP) {
+				return errors.New("Kernel wireguard is not available")
+			}
+			return errors.Wrapf(err, "Could not create interface %s", name)
+		}
+		defer removeTestLink(name, namespaces[i])
+		if keys[i], err = wgtypes.GeneratePrivateKey(); err != nil {
+			return err
+		}
+		if ports[i], err = freeUDPPort(); err != nil {
+			return err
+		}
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return errors.Wrap(err, "Could not create wireguard client")
+	}
+	defer client.Close()
+	keepalive := time.Second
+	for i, name := range names {
+		other := 1 - i
+		if err := client.ConfigureDevice(name, wgtypes.Config{
+			PrivateKey: &keys[i],
+			ListenPort: &ports[i],
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:                   keys[other].PublicKey(),
+				Endpoint:                    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ports[other]},
+				PersistentKeepaliveInterval: &keepalive,
+			}},
+		}); err != nil {
+			return errors.Wrapf(err, "Could not configure %s", name)
+		}
+	}
+
+	// The sockets stay in this namespace, so the interfaces talk over its
+	// loopback. Coming up, they send a keepalive and thus handshake.
+	for i, name := range names {
+		if err := moveTestLink(name, origin, namespaces[i], true); err != nil {
+			return err
+		}
+	}
+	time.Sleep(selfTestWait)
+	for i, name := range names {
+		if err := moveTestLink(name, namespaces[i], origin, false); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		device, err := client.Device(name)
+		if err != nil {
+			return errors.Wrapf(err, "Could not get device %s", name)
+		}
+		if len(device.Peers) != 1 || device.Peers[0].LastHandshakeTime.IsZero() || device.Peers[0].ReceiveBytes == 0 {
+			return errors.Errorf("Interface %s did not complete a handshake", name)
+		}
+	}
+	return nil
+}
+
+// moveTestLink moves the link between namespaces, setting it up in the new one
+// if asked to
+func moveTestLink(name string, from, to netns.NsHandle, up bool) error {
+	h, err := netlink.NewHandleAt(from)
+	if err != nil {
+		return errors.Wrap(err, "Could not open netlink handle")
+	}
+	defer h.Delete()
+	link, err := h.LinkByName(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get link information for %s", name)
+	}
+	if err := h.LinkSetNsFd(link, int(to)); err != nil {
+		return errors.Wrapf(err, "Could not move %s to namespace", name)
+	}
+	if !up {
+		return nil
+	}
+	in, err := netlink.NewHandleAt(to)
+	if err != nil {
+		return errors.Wrap(err, "Could not open netlink handle")
+	}
+	defer in.Delete()
+	if link, err = in.LinkByName(name); err != nil {
+		return errors.Wrapf(err, "Could not get link information for %s", name)
+	}
+	return errors.Wrapf(in.LinkSetUp(link), "Could not enable interface %s", name)
+}
+
+// removeTestLink deletes the link, wherever the self-test left it
+func removeTestLink(name string, ns netns.NsHandle) {
+	if link, err := netlink.LinkByName(name); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			wgLog.WithError(err).Warn("Could not remove self-test interface ", name)
+		}
+		return
+	}
+	// Removing the namespace also removes links left behind in it
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return
+	}
+	defer h.Delete()
+	if link, err := h.LinkByName(name); err == nil {
+		h.LinkDel(link)
+	}
+}
+
+func freeUDPPort() (int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
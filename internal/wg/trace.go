@@ -0,0 +1,60 @@
+package wg
+
+import (
+	"time"
+
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+)
+
+// How often the debugged peer is sampled
+const traceInterval = time.Second
+
+// TraceDebuggedPeer logs the handshakes, endpoint changes and traffic of the
+// peer being debugged, see logging.DebugPeer. It does not return.
+func (s *State) TraceDebuggedPeer() {
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+	var last *PeerStats
+	lastPeer := ""
+	for range ticker.C {
+		peer, ok := logging.Debugged()
+		if !ok {
+			last, lastPeer = nil, ""
+			continue
+		}
+		if peer != lastPeer {
+			last, lastPeer = nil, peer
+		}
+		stats, err := s.GetPeerStats()
+		if err != nil {
+			continue
+		}
+		log := wgLog.WithField("peer", peer)
+		var current *PeerStats
+		for i := range stats {
+			if stats[i].PublicKey.String() == peer {
+				current = &stats[i]
+			}
+		}
+		switch {
+		case current == nil:
+			if last != nil || peer != lastPeer {
+				log.Debug("Peer is not configured")
+			}
+		case last == nil:
+			log.Debugf("Endpoint %s, last handshake %s, received %d bytes, sent %d bytes",
+				current.Endpoint, current.LastHandshake.Format(time.RFC3339), current.RxBytes, current.TxBytes)
+		default:
+			if !current.LastHandshake.Equal(last.LastHandshake) {
+				log.Debugf("Handshake at %s", current.LastHandshake.Format(time.RFC3339))
+			}
+			if current.Endpoint.String() != last.Endpoint.String() {
+				log.Debugf("Endpoint changed from %s to %s", last.Endpoint, current.Endpoint)
+			}
+			if current.RxBytes != last.RxBytes || current.TxBytes != last.TxBytes {
+				log.Debugf("Received %d bytes, sent %d bytes", current.RxBytes-last.RxBytes, current.TxBytes-last.TxBytes)
+			}
+		}
+		last = current
+	}
+}
@@ -0,0 +1,58 @@
+package wg
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// userspaceDevice is an embedded wireguard-go device used when the kernel
+// has no wireguard support. It exposes the same UAPI socket as the wg tool
+// uses, so wgctrl configures it like a kernel device.
+type userspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+}
+
+func newUserspaceDevice(iface string, mtu int) (*userspaceDevice, error) {
+	tunDevice, err := tun.CreateTUN(iface, mtu)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not create TUN device %s", iface)
+	}
+	log := wgLog.WithField("iface", iface)
+	dev := device.NewDevice(tunDevice, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: log.Debugf,
+		Errorf:   log.Errorf,
+	})
+	uapiFile, err := ipc.UAPIOpen(iface)
+	if err != nil {
+		dev.Close()
+		return nil, errors.Wrapf(err, "Could not open UAPI socket for %s", iface)
+	}
+	uapi, err := ipc.UAPIListen(iface, uapiFile)
+	if err != nil {
+		uapiFile.Close()
+		dev.Close()
+		return nil, errors.Wrapf(err, "Could not listen on UAPI socket for %s", iface)
+	}
+	go func() {
+		for {
+			c, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(c)
+		}
+	}()
+	return &userspaceDevice{device: dev, uapi: uapi}, nil
+}
+
+// Close tears down the device, which also removes the TUN interface
+func (u *userspaceDevice) Close() {
+	u.uapi.Close()
+	u.device.Close()
+}
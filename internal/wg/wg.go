@@ -1,26 +1,111 @@
 package wg
 
 import (
+	"context"
 	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/jimzhong/wireguard-overlay/internal/derive"
+	"github.com/jimzhong/wireguard-overlay/internal/logging"
+	"github.com/jimzhong/wireguard-overlay/internal/tracing"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// State holds the configured state of a Wesher Wireguard interface
+var wgLog = logging.For("wg")
+
+// TODO: make MTU configurable?
+const mtu = 1280
+
+// Applying many peers is logged this often
+const applyProgressInterval = 5 * time.Second
+
+// DefaultRouteMarker is the protocol number of the routes the state adds,
+// unless SetRouteAttributes sets another one. It is unassigned, so that the
+// routes of other daemons do not carry it.
+const DefaultRouteMarker = 78
+
+// State holds the configured state of a Wesher Wireguard interface.
+//
+// A State is safe for concurrent use. Changes to the device are applied one
+// at a time, each seeing the effects of the previous ones, so that e.g. a
+// peer refresh paced by SetUpdateRate is not interleaved with an endpoint
+// change from another goroutine. Reading the device does not wait for
+// changes in progress. OverlayNetwork and OverlayAddr never change; the
+// public key and the assigned address are read through their methods.
+// Further overlay networks, e.g. an IPv4 one besides an IPv6 one, are set with
+// SetExtraNetworks.
 type State struct {
-	iface          string
-	client         *wgctrl.Client
+	iface  string
+	client *wgctrl.Client
+	// nl configures links, addresses and routes in netns, the namespace of
+	// the interface if not the current one
+	nl             *netlink.Handle
+	netns          string
 	OverlayNetwork net.IPNet
 	OverlayAddr    net.IPNet
-	port           int
-	privateKey     wgtypes.Key
-	PublicKey      wgtypes.Key
+	// extraNets are the further overlay networks, and extraAddrs the
+	// addresses derived in them
+	extraNets  []net.IPNet
+	extraAddrs []net.IPNet
+	// salt is mixed into the derivation of addresses
+	salt []byte
+	port int
+	// apply is held while changing the device, and guards the fields below
+	// that are only used while doing so
+	apply     sync.Mutex
+	userspace *userspaceDevice
+	limiter   *rate.Limiter
+	// batch is the most peers applied per call, if positive
+	batch int
+	// stopped is done once peers are no longer to be applied
+	stopped context.Context
+	stop    context.CancelFunc
+	// previousAddrs are kept configured while the node is renumbered
+	previousAddrs []net.IPNet
+	// routes are the routes added through the interface, removed on teardown
+	routes []netlink.Route
+	// fwmark marks the packets wireguard sends, and table is the routing
+	// table of the routes, if not main
+	fwmark int
+	table  int
+	// metric is the priority of the routes, if set, and routeMarker the
+	// protocol by which they are found on teardown
+	metric      int
+	routeMarker int
+	// routeProto is the protocol of the routes of peer networks, for routing
+	// daemons to redistribute them, and exportRoutes, if set, takes those
+	// routes instead of the kernel
+	routeProto   int
+	exportRoutes func([]Route)
+	// desired are the peers as configured through the state, restored by
+	// Reconcile when they are changed by other means; down is set once the
+	// interface is taken down
+	desired map[wgtypes.Key]Peer
+	down    bool
+	// peerNets are the routed allowed IPs of peers, by network
+	peerNets map[string]bool
+	// plan is set during a dry run, before the state is shared
+	plan       *plan
+	privateKey wgtypes.Key
+	// mu guards the fields below and the peers of the plan; they are only
+	// written while apply is held as well
+	mu        sync.RWMutex
+	publicKey wgtypes.Key
+	// assignedAddr is the address allocated by the server, if any
+	assignedAddr net.IPNet
 }
 
 type Peer struct {
@@ -29,15 +114,97 @@ type Peer struct {
 	PublicKey         wgtypes.Key
 	PresharedKey      wgtypes.Key
 	KeepaliveInterval time.Duration
+	// Addresses are the overlay addresses of the peer. If empty, the address
+	// derived from the public key is used.
+	Addresses []net.IP
+	// AddressVersion is the derivation algorithm of the peer's address
+	AddressVersion derive.Version
+	// NextKey is the key the peer is rotating to. The new key takes over the
+	// addresses of the peer at Cutover, or once the server sets it.
+	NextKey wgtypes.Key
+	Cutover time.Time
+	// Candidates are the endpoints under which the peer may be reachable, if
+	// there is a choice. IP and Port are the one the server observes.
+	Candidates []*net.UDPAddr
+	// Standby peers are configured without addresses so that they can
+	// handshake before taking over the addresses of a rotated key
+	Standby bool
+	// AllowedIPs are networks routed to the peer besides its overlay
+	// addresses, e.g. the routes a gateway advertises. Those outside the
+	// overlay network are routed through the interface.
+	AllowedIPs []net.IPNet
+	// Metadata are the labels the peer registered with. They are not
+	// configured on the device.
+	Metadata map[string]string
+	// ThroughServer peers are not configured directly; their addresses are
+	// routed through the server, as the topology of the overlay says
+	ThroughServer bool
+	// Hub is the region of a peer that forwards overlay traffic between
+	// regions
+	Hub string
+	// Via is the hub through which the peer is reached, if not directly. Its
+	// addresses are routed to the hub.
+	Via wgtypes.Key
+	// Expires, if set, is when the record lapses. Clients remove the peer
+	// then unless the server renewed the record.
+	Expires time.Time
+}
+
+// allowedIPs returns the overlay addresses and the other allowed IPs of the peer
+func (p *Peer) allowedIPs(o overlay) []net.IPNet {
+	if p.Standby {
+		return nil
+	}
+	return append(p.overlayAddrs(o), p.AllowedIPs...)
+}
+
+// overlayAddrs returns the overlay addresses of the peer as host networks. In
+// the overlay networks, the main one first, in which the peer has none of its
+// addresses, the address derived from its public key is used; in the main one
+// only if it has no addresses at all.
+func (p *Peer) overlayAddrs(o overlay) []net.IPNet {
+	if p.Standby {
+		return nil
+	}
+	addrs := make([]net.IPNet, 0, len(p.Addresses)+len(o.nets))
+	for _, ip := range p.Addresses {
+		addrs = append(addrs, hostNet(ip))
+	}
+	for i, n := range o.nets {
+		if i == 0 && len(p.Addresses) != 0 || containsIP(n, p.Addresses) {
+			continue
+		}
+		if addr, err := derive.Address(p.AddressVersion, n, p.PublicKey, o.salt); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func containsIP(n net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *Peer) toPeerConfig(overlayNet net.IPNet) wgtypes.PeerConfig {
+func hostNet(ip net.IP) net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func (p *Peer) toPeerConfig(o overlay) wgtypes.PeerConfig {
 	config := wgtypes.PeerConfig{
-		PublicKey: p.PublicKey,
-		AllowedIPs: []net.IPNet{
-			getOverlayAddr(overlayNet, p.PublicKey),
-		},
+		PublicKey:    p.PublicKey,
+		AllowedIPs:   p.allowedIPs(o),
 		PresharedKey: &p.PresharedKey,
+		// Leased addresses and routes can move, so do not keep stale ones
+		// around, and neither the addresses of other derivation versions
+		ReplaceAllowedIPs: len(p.Addresses) != 0 || len(p.AllowedIPs) != 0 || p.Standby || p.AddressVersion.Normalize() != derive.Current,
 	}
 	if p.Port != 0 && p.IP != "" {
 		config.Endpoint = &net.UDPAddr{IP: net.ParseIP(p.IP), Port: p.Port}
@@ -48,26 +215,17 @@ func (p *Peer) toPeerConfig(overlayNet net.IPNet) wgtypes.PeerConfig {
 	return config
 }
 
-// GetOverlayAddr synthesizes an address by hashing the pubkey
-func getOverlayAddr(ipnet net.IPNet, pubkey wgtypes.Key) net.IPNet {
-	// TODO: handle all zero and all one host addresses.
-	bits, size := ipnet.Mask.Size()
-	ip := make([]byte, len(ipnet.IP))
-	copy(ip, []byte(ipnet.IP))
-	hb := sha256.Sum256(pubkey[:])
-	for i := 1; i <= (size-bits)/8; i++ {
-		ip[len(ip)-i] = hb[len(hb)-i]
-	}
-	return net.IPNet{
-		IP:   net.IP(ip),
-		Mask: net.CIDRMask(size, size), // either /32 or /128, depending if ipv4 or ipv6
-	}
+// getOverlayAddr synthesizes an address by hashing the pubkey
+func getOverlayAddr(ipnet net.IPNet, pubkey wgtypes.Key, salt []byte) net.IPNet {
+	addr, _ := derive.Address(derive.Current, ipnet, pubkey, salt)
+	return addr
 }
 
 // New creates a new Wesher Wireguard state
 // The Wireguard keys are generated for every new interface
 // The interface must later be setup using SetUpInterface
-func New(iface string, port int, overlayNet net.IPNet, privKey string) (*State, error) {
+// The salt, if any, is mixed into the derivation of overlay addresses
+func New(iface string, port int, overlayNet net.IPNet, salt []byte, privKey string) (*State, error) {
 	client, err := wgctrl.New()
 	if err != nil {
 		return nil, errors.Wrap(err, "Could not instantiate wireguard client")
@@ -78,96 +236,922 @@ func New(iface string, port int, overlayNet net.IPNet, privKey string) (*State,
 		return nil, errors.Wrap(err, "Could not parse private key")
 	}
 	pubKey := privateKey.PublicKey()
+	stopped, stop := context.WithCancel(context.Background())
 	state := State{
 		iface:          iface,
 		client:         client,
+		nl:             &netlink.Handle{},
 		privateKey:     privateKey,
-		PublicKey:      pubKey,
+		publicKey:      pubKey,
 		OverlayNetwork: overlayNet,
-		OverlayAddr:    getOverlayAddr(overlayNet, pubKey),
+		OverlayAddr:    getOverlayAddr(overlayNet, pubKey, salt),
+		salt:           salt,
 		port:           port,
+		routeMarker:    DefaultRouteMarker,
+		desired:        make(map[wgtypes.Key]Peer),
+		peerNets:       make(map[string]bool),
+		stopped:        stopped,
+		stop:           stop,
 	}
 	return &state, nil
 }
 
+// Interface returns the name of the wireguard interface
+func (s *State) Interface() string {
+	return s.iface
+}
+
+// PublicKey returns the public key of the device
+func (s *State) PublicKey() wgtypes.Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.publicKey
+}
+
+// PrivateKey returns the private key of the device
+func (s *State) PrivateKey() wgtypes.Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.privateKey
+}
+
+// AssignedAddress returns the address allocated by the server, if any
+func (s *State) AssignedAddress() net.IPNet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.assignedAddr
+}
+
 func (s *State) GetOverlayAddress(pubkey wgtypes.Key) net.IPNet {
-	return getOverlayAddr(s.OverlayNetwork, pubkey)
+	return getOverlayAddr(s.OverlayNetwork, pubkey, s.salt)
+}
+
+// SaltDigest returns the SHA-256 of the address salt, nil without salt
+func (s *State) SaltDigest() []byte {
+	if len(s.salt) == 0 {
+		return nil
+	}
+	digest := sha256.Sum256(s.salt)
+	return digest[:]
+}
+
+// DeriveAddress derives the address of the key in OverlayNetwork with the
+// version
+func (s *State) DeriveAddress(v derive.Version, pubkey wgtypes.Key) (net.IPNet, error) {
+	return derive.Address(v, s.OverlayNetwork, pubkey, s.salt)
 }
 
-// DownInterface shuts down the associated network interface
+// SetExtraNetworks sets the overlay networks besides OverlayNetwork, in each of
+// which the node and its peers have an address as well. It has to be called
+// before the interface is set up.
+func (s *State) SetExtraNetworks(nets []net.IPNet) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	s.extraNets = nets
+	s.extraAddrs = make([]net.IPNet, 0, len(nets))
+	for _, n := range nets {
+		s.extraAddrs = append(s.extraAddrs, getOverlayAddr(n, s.publicKey, s.salt))
+	}
+}
+
+// overlay is what the overlay addresses of peers are derived from
+type overlay struct {
+	nets []net.IPNet
+	salt []byte
+}
+
+func (s *State) overlay() overlay {
+	return overlay{nets: s.Networks(), salt: s.salt}
+}
+
+// Networks returns the overlay networks, OverlayNetwork first
+func (s *State) Networks() []net.IPNet {
+	return append([]net.IPNet{s.OverlayNetwork}, s.extraNets...)
+}
+
+// OnOverlay reports whether the address lies in one of the overlay networks
+func (s *State) OnOverlay(ip net.IP) bool {
+	return inNetworks(s.Networks(), ip)
+}
+
+func inNetworks(nets []net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerAddresses returns the overlay addresses the peer would be configured with
+func (s *State) PeerAddresses(p Peer) []net.IP {
+	var ips []net.IP
+	for _, a := range p.overlayAddrs(s.overlay()) {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
+
+// SetPrivateKey switches the device to a new private key. The overlay address
+// is kept.
+func (s *State) SetPrivateKey(key wgtypes.Key) error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	if s.plan != nil {
+		s.planf("private key replace, public key %s", key.PublicKey())
+	} else if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
+		PrivateKey: &key,
+	}); err != nil {
+		return errors.Wrapf(err, "Could not set private key for %s", s.iface)
+	}
+	s.mu.Lock()
+	s.privateKey = key
+	s.publicKey = key.PublicKey()
+	s.mu.Unlock()
+	return nil
+}
+
+// DownInterface removes the routes and addresses added to the associated
+// network interface and shuts it down
 func (s *State) DownInterface() error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	if s.plan != nil {
+		// Nothing was changed
+		return nil
+	}
+	s.down = true
+	s.removeRoutesAndAddresses()
+	if s.userspace != nil {
+		s.userspace.Close()
+		s.userspace = nil
+		return nil
+	}
 	if _, err := s.client.Device(s.iface); err != nil {
 		if os.IsNotExist(err) {
 			return nil // device already gone; noop
 		}
 		return err
 	}
-	link, err := netlink.LinkByName(s.iface)
+	link, err := s.nl.LinkByName(s.iface)
 	if err != nil {
 		return err
 	}
-	return netlink.LinkDel(link)
+	return s.nl.LinkDel(link)
 }
 
-// SetUpInterface creates and sets up the associated network interface
-func (s *State) SetUpInterface() error {
-	if err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: s.iface}}); err != nil {
-		return errors.Wrapf(err, "Could not create interface %s", s.iface)
+// removeRoutesAndAddresses undoes what was configured on the interface. Removing
+// the link would do so as well, but a link that cannot be removed, or the tun
+// device of the userspace implementation, would leave them behind.
+func (s *State) removeRoutesAndAddresses() {
+	link, err := s.nl.LinkByName(s.iface)
+	if err != nil {
+		return
 	}
+	for i := len(s.routes) - 1; i >= 0; i-- {
+		if err := s.nl.RouteDel(&s.routes[i]); err != nil && !errors.Is(err, syscall.ESRCH) {
+			wgLog.WithError(err).Warnf("Could not remove route to %s", s.routes[i].Dst)
+		}
+	}
+	s.routes = nil
+	s.removeMarkedRoutes(link)
+	addrs := append(append([]net.IPNet{s.OverlayAddr, s.AssignedAddress()}, s.previousAddrs...), s.extraAddrs...)
+	for i := range addrs {
+		if addrs[i].IP == nil {
+			continue
+		}
+		if err := s.nl.AddrDel(link, &netlink.Addr{IPNet: &addrs[i]}); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			wgLog.WithError(err).Warnf("Could not remove address %s", &addrs[i])
+		}
+	}
+}
 
-	if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
-		PrivateKey: &s.privateKey,
-		ListenPort: func() *int {
-			if s.port == 0 {
-				return nil
+// removeMarkedRoutes removes the routes through the link that carry the
+// protocol of the state, including those it lost track of
+func (s *State) removeMarkedRoutes(link netlink.Link) {
+	table := s.table
+	if table == 0 {
+		table = syscall.RT_TABLE_MAIN
+	}
+	for _, proto := range []int{s.routeMarker, s.routeProto} {
+		if proto == 0 {
+			continue
+		}
+		filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: table, Protocol: proto}
+		routes, err := s.nl.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			wgLog.WithError(err).Warnf("Could not list routes of %s", s.iface)
+			continue
+		}
+		for i := range routes {
+			if err := s.nl.RouteDel(&routes[i]); err != nil && !errors.Is(err, syscall.ESRCH) {
+				wgLog.WithError(err).Warnf("Could not remove route to %s", routes[i].Dst)
 			}
-			return &s.port
-		}(),
+		}
+	}
+}
+
+// SetUpInterface creates and sets up the associated network interface. An
+// interface left over from a previous run is taken over, so that starting
+// again is clean. Transient netlink errors are retried; if a step still fails,
+// what was set up is rolled back: a link created here is removed, and the
+// addresses and routes added to an existing one are.
+func (s *State) SetUpInterface() error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	if s.plan != nil {
+		s.planUpInterface()
+		return nil
+	}
+	created, err := s.createLink()
+	if err != nil {
+		return err
+	}
+	if !created {
+		// Routes of a previous run that did not exit cleanly
+		if link, err := s.nl.LinkByName(s.iface); err == nil {
+			s.removeMarkedRoutes(link)
+		}
+	}
+	if err := s.configureLink(); err != nil {
+		s.rollBack(created)
+		return err
+	}
+	return nil
+}
+
+// createLink creates the interface unless it exists, and reports whether it
+// did
+func (s *State) createLink() (bool, error) {
+	if s.netns != "" {
+		created, err := s.moveIntoNetns()
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			return false, errors.New("Kernel wireguard is not available, and the userspace fallback does not support netns")
+		}
+		return created, err
+	}
+	err := retry(func() error {
+		return netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: s.iface}})
+	})
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, syscall.EEXIST):
+		link, err := s.nl.LinkByName(s.iface)
+		if err != nil {
+			return false, errors.Wrapf(err, "Could not get link information for %s", s.iface)
+		}
+		if link.Type() != "wireguard" {
+			return false, errors.Errorf("Interface %s exists and is no wireguard interface", s.iface)
+		}
+		wgLog.Infof("Taking over existing interface %s", s.iface)
+		return false, nil
+	case !errors.Is(err, syscall.EOPNOTSUPP):
+		return false, errors.Wrapf(err, "Could not create interface %s", s.iface)
+	}
+	// The kernel does not know the wireguard link type
+	wgLog.Warnf("Kernel wireguard is not available, falling back to userspace for %s", s.iface)
+	userspace, err := newUserspaceDevice(s.iface, mtu)
+	if err != nil {
+		return false, err
+	}
+	s.userspace = userspace
+	return true, nil
+}
+
+// configureLink configures wireguard, the addresses, MTU and overlay routes
+// of the interface
+func (s *State) configureLink() error {
+	if err := retry(func() error {
+		return s.client.ConfigureDevice(s.iface, wgtypes.Config{
+			PrivateKey: &s.privateKey,
+			ListenPort: func() *int {
+				if s.port == 0 {
+					return nil
+				}
+				return &s.port
+			}(),
+			FirewallMark: func() *int {
+				if s.fwmark == 0 {
+					return nil
+				}
+				return &s.fwmark
+			}(),
+		})
 	}); err != nil {
 		return errors.Wrapf(err, "Could not set wireguard configuration for %s", s.iface)
 	}
+	if s.port == 0 {
+		// Keep the port the kernel picked, so that Reconcile restores it like
+		// a configured one
+		device, err := s.client.Device(s.iface)
+		if err != nil {
+			return errors.Wrapf(err, "Could not read wireguard port of %s", s.iface)
+		}
+		s.port = device.ListenPort
+	}
 
-	link, err := netlink.LinkByName(s.iface)
+	link, err := s.nl.LinkByName(s.iface)
 	if err != nil {
 		return errors.Wrapf(err, "Could not get link information for %s", s.iface)
 	}
-	if err := netlink.AddrReplace(link, &netlink.Addr{
-		IPNet: &s.OverlayAddr,
-	}); err != nil {
-		return errors.Wrapf(err, "Could not set address for %s", s.iface)
+	addrs := append([]net.IPNet{s.OverlayAddr}, s.extraAddrs...)
+	for i := range addrs {
+		if err := retry(func() error {
+			return s.nl.AddrReplace(link, &netlink.Addr{IPNet: &addrs[i]})
+		}); err != nil {
+			return errors.Wrapf(err, "Could not set address %s for %s", &addrs[i], s.iface)
+		}
 	}
-	// TODO: make MTU configurable?
-	if err := netlink.LinkSetMTU(link, 1280); err != nil {
+	if err := retry(func() error { return s.nl.LinkSetMTU(link, mtu) }); err != nil {
 		return errors.Wrapf(err, "Could not set MTU for %s", s.iface)
 	}
-	if err := netlink.LinkSetUp(link); err != nil {
+	if err := retry(func() error { return s.nl.LinkSetUp(link) }); err != nil {
 		return errors.Wrapf(err, "Could not enable interface %s", s.iface)
 	}
 
-	netlink.RouteAdd(&netlink.Route{
+	if err := s.addRoute(netlink.Route{
 		LinkIndex: link.Attrs().Index,
 		Dst:       &s.OverlayNetwork,
 		Scope:     netlink.SCOPE_LINK,
+	}); err != nil {
+		return err
+	}
+	for i := range s.extraNets {
+		if err := s.addRoute(netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &s.extraNets[i],
+			Scope:     netlink.SCOPE_LINK,
+			Src:       s.extraAddrs[i].IP,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollBack undoes a failed SetUpInterface, removing the link if created
+func (s *State) rollBack(created bool) {
+	wgLog.Warnf("Rolling back the setup of %s", s.iface)
+	s.removeRoutesAndAddresses()
+	if s.userspace != nil {
+		s.userspace.Close()
+		s.userspace = nil
+		return
+	}
+	if !created {
+		return
+	}
+	link, err := s.nl.LinkByName(s.iface)
+	if err == nil {
+		err = s.nl.LinkDel(link)
+	}
+	if err != nil {
+		wgLog.WithError(err).Warnf("Could not remove interface %s", s.iface)
+	}
+}
+
+// markRoute sets the table, metric and protocol of a route the state adds.
+// Routes of peer networks may carry another protocol, for routing daemons.
+func (s *State) markRoute(route netlink.Route) netlink.Route {
+	if s.table != 0 {
+		route.Table = s.table
+	}
+	if s.metric != 0 {
+		route.Priority = s.metric
+	}
+	if route.Protocol == 0 {
+		route.Protocol = s.routeMarker
+	}
+	return route
+}
+
+// addRoute adds or replaces the route and remembers it for the teardown
+func (s *State) addRoute(route netlink.Route) error {
+	route = s.markRoute(route)
+	if s.plan != nil {
+		s.planRoute(route)
+	} else if err := retry(func() error { return s.nl.RouteReplace(&route) }); err != nil {
+		return errors.Wrapf(err, "Could not set route to %s for %s", route.Dst, s.iface)
+	}
+	for i, r := range s.routes {
+		if r.Dst.String() == route.Dst.String() {
+			s.routes[i] = route
+			return nil
+		}
+	}
+	s.routes = append(s.routes, route)
+	return nil
+}
+
+// routePeerNetworks routes the allowed IPs of the peers that lie outside the
+// overlay network through the interface, and removes the routes of networks
+// that no peer has anymore
+func (s *State) routePeerNetworks() {
+	wanted := make(map[string]net.IPNet)
+	var exported []Route
+	for _, p := range s.desired {
+		if p.Standby {
+			continue
+		}
+		addrs := p.overlayAddrs(s.overlay())
+		for _, n := range p.AllowedIPs {
+			if !s.OnOverlay(n.IP) {
+				wanted[n.String()] = n
+				if len(addrs) != 0 {
+					exported = append(exported, Route{Dst: n, Via: addrs[0].IP})
+				}
+			}
+		}
+	}
+	if s.exportRoutes != nil {
+		s.exportPeerNetworks(exported)
+		// Drop the routes added before, e.g. from the peer cache
+		wanted = nil
+	}
+	index := 0
+	if link, err := s.nl.LinkByName(s.iface); err == nil {
+		index = link.Attrs().Index
+	} else if s.plan == nil {
+		wgLog.WithError(err).Warnf("Could not route peer networks through %s", s.iface)
+		return
+	}
+	for i := 0; i < len(s.routes); i++ {
+		dst := s.routes[i].Dst.String()
+		if _, ok := wanted[dst]; ok || !s.peerNets[dst] {
+			continue
+		}
+		if s.plan != nil {
+			s.planf("route del %s dev %s", dst, s.iface)
+		} else if err := s.nl.RouteDel(&s.routes[i]); err != nil && !errors.Is(err, syscall.ESRCH) {
+			wgLog.WithError(err).Warnf("Could not remove route to %s", dst)
+			continue
+		}
+		delete(s.peerNets, dst)
+		s.routes = append(s.routes[:i], s.routes[i+1:]...)
+		i--
+	}
+	for dst, n := range wanted {
+		if s.peerNets[dst] {
+			continue
+		}
+		n := n
+		if err := s.addRoute(netlink.Route{LinkIndex: index, Dst: &n, Scope: netlink.SCOPE_LINK, Protocol: s.routeProto}); err != nil {
+			wgLog.WithError(err).Warn("Could not route peer network")
+			continue
+		}
+		s.peerNets[dst] = true
+	}
+}
+
+// exportPeerNetworks passes the routes on, ordered by destination
+func (s *State) exportPeerNetworks(routes []Route) {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Dst.String() < routes[j].Dst.String() })
+	if s.plan != nil {
+		for _, r := range routes {
+			s.planf("route export %s via %s", r.Dst.String(), r.Via)
+		}
+		return
+	}
+	s.exportRoutes(routes)
+}
+
+// EnableForwarding lets the kernel forward traffic between peers of the
+// interface, so that the node can relay for peers that cannot reach each
+// other directly
+func (s *State) EnableForwarding() error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	families := make(map[string]bool)
+	for _, n := range s.Networks() {
+		if n.IP.To4() != nil {
+			families["ipv4"] = true
+		} else {
+			families["ipv6"] = true
+		}
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if families[family] {
+			if err := s.enableForwarding(family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *State) enableForwarding(family string) error {
+	path := fmt.Sprintf("/proc/sys/net/%s/conf/%s/forwarding", family, s.iface)
+	if s.plan != nil {
+		s.planf("write 1 to %s", path)
+		return nil
+	}
+	// The settings of the namespace of the interface apply
+	return InNetns(s.netns, func() error {
+		if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
+			return errors.Wrapf(err, "Could not enable forwarding on %s", s.iface)
+		}
+		if family == "ipv6" {
+			// IPv6 forwarding also depends on the global switch, which affects
+			// router advertisements on all interfaces, so it is left to the admin
+			if data, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/all/forwarding"); err == nil && strings.TrimSpace(string(data)) == "0" {
+				wgLog.Warn("net.ipv6.conf.all.forwarding is disabled; relaying will not work until it is enabled")
+			}
+		}
+		return nil
 	})
+}
+
+// SetUpdateRate paces how many new or changed peers are applied to the device
+// per second. Adding a peer with an endpoint makes wireguard initiate a
+// handshake, so pacing avoids handshake storms when many peers change at
+// once. A non-positive rate disables pacing.
+func (s *State) SetUpdateRate(perSecond float64, burst int) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	if perSecond <= 0 {
+		s.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	s.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// SetBatchSize limits how many peers are applied to the device per call, so
+// that thousands of changed peers do not make one huge request. Applying is
+// logged as it progresses and can be stopped between batches. A non-positive
+// size applies all peers at once.
+func (s *State) SetBatchSize(peers int) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	s.batch = peers
+}
+
+// Stop stops applying peers, at the next batch of the application in
+// progress, so that shutting down does not wait for it
+func (s *State) Stop() {
+	s.stop()
+}
+
+// SetPolicyRouting makes wireguard mark the packets it sends with fwmark and
+// adds the routes to the routing table instead of main, for policy routing,
+// e.g. so that the encrypted packets to an endpoint reachable through the
+// overlay do not loop back into it. Zero leaves either unset. It has to be
+// called before the interface is set up.
+func (s *State) SetPolicyRouting(fwmark, table int) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	s.fwmark, s.table = fwmark, table
+}
+
+// SetRouteAttributes sets the metric of the routes the state adds, 0 for the
+// kernel default, and the protocol number that marks them, by which they are
+// removed on teardown, along with those of a previous run. It has to be
+// called before the interface is set up.
+func (s *State) SetRouteAttributes(metric, marker int) error {
+	if metric < 0 {
+		return errors.Errorf("Invalid route metric %d", metric)
+	}
+	// Protocols up to static are used by the kernel and by hand
+	if marker <= syscall.RTPROT_STATIC || marker > 255 {
+		return errors.Errorf("Invalid route marker %d", marker)
+	}
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	s.metric, s.routeMarker = metric, marker
+	return nil
+}
+
+// Route is a network routed to a peer, through its overlay address
+type Route struct {
+	Dst net.IPNet
+	Via net.IP
+}
+
+// SetRouteProtocol sets the protocol number of the routes of peer networks,
+// e.g. for babeld to redistribute them. It has to be called before the
+// interface is set up.
+func (s *State) SetRouteProtocol(proto int) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	s.routeProto = proto
+}
+
+// ExportRoutes hands the routes of peer networks to export, e.g. to announce
+// them to a routing daemon, instead of adding them to the kernel. Export is
+// called with all routes whenever they change, and must not block. It has to
+// be called before the interface is set up.
+func (s *State) ExportRoutes(export func([]Route)) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	s.exportRoutes = export
+}
+
+// unchanged reports whether applying p would not modify the configured peer
+func (p *Peer) unchanged(configured *Peer, o overlay) bool {
+	if !p.sameSettings(configured, o) {
+		return false
+	}
+	if p.Port == 0 || p.IP == "" {
+		// No endpoint to set
+		return true
+	}
+	return p.Port == configured.Port && net.ParseIP(p.IP).Equal(net.ParseIP(configured.IP))
+}
+
+// sameSettings reports whether the configured peer has the preshared key,
+// keepalive and allowed IPs of p
+func (p *Peer) sameSettings(configured *Peer, o overlay) bool {
+	if p.PresharedKey != configured.PresharedKey || p.KeepaliveInterval != configured.KeepaliveInterval {
+		return false
+	}
+	want := p.allowedIPs(o)
+	have := append([]net.IPNet(nil), configured.AllowedIPs...)
+	for _, a := range configured.Addresses {
+		have = append(have, hostNet(a))
+	}
+	if len(want) != len(have) {
+		return false
+	}
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			found = found || w.String() == h.String()
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// AssignAddresses configures the addresses allocated by the server and makes
+// the first one the source address of overlay traffic. The others are previous
+// addresses that stay valid while the node is renumbered. The derived address
+// stays configured so that the server remains reachable with it.
+func (s *State) AssignAddresses(ips []net.IP) error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	wanted := make([]net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		wanted = append(wanted, hostNet(ip))
+	}
+	if len(wanted) == 0 || (wanted[0].IP.Equal(s.assignedAddr.IP) && sameAddrs(wanted[1:], s.previousAddrs)) {
+		return nil
+	}
+	if s.plan != nil {
+		s.planAssignAddresses(wanted)
+		return nil
+	}
+	link, err := s.nl.LinkByName(s.iface)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get link information for %s", s.iface)
+	}
+	for i := range wanted {
+		if err := s.nl.AddrReplace(link, &netlink.Addr{IPNet: &wanted[i]}); err != nil {
+			return errors.Wrapf(err, "Could not set address for %s", s.iface)
+		}
+	}
+	for _, old := range append([]net.IPNet{s.assignedAddr}, s.previousAddrs...) {
+		if old.IP == nil || old.IP.Equal(s.OverlayAddr.IP) || containsAddr(wanted, old.IP) {
+			continue
+		}
+		old := old
+		if err := s.nl.AddrDel(link, &netlink.Addr{IPNet: &old}); err != nil {
+			wgLog.WithError(err).Warnf("Could not remove previous address %s", &old)
+		}
+	}
+	if err := s.addRoute(netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &s.OverlayNetwork,
+		Scope:     netlink.SCOPE_LINK,
+		Src:       wanted[0].IP,
+	}); err != nil {
+		return err
+	}
+	s.setAssignedAddr(wanted[0])
+	s.previousAddrs = wanted[1:]
+	return nil
+}
+
+func (s *State) setAssignedAddr(addr net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assignedAddr = addr
+}
+
+func containsAddr(addrs []net.IPNet, ip net.IP) bool {
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameAddrs(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		if !containsAddr(b, x.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate reports why the peer cannot be configured, if it cannot
+func (p *Peer) Validate() error {
+	if len(p.Addresses) == 0 && !p.Standby && !p.AddressVersion.Supported() {
+		return errors.Errorf("Unsupported address version %d", p.AddressVersion)
+	}
 	return nil
 }
 
 func (s *State) AddPeers(peers []Peer) error {
+	return s.AddPeersContext(context.Background(), peers)
+}
+
+// AddPeersContext adds the peers as AddPeers does, tracing the steps as part
+// of the span in the context
+func (s *State) AddPeersContext(ctx context.Context, peers []Peer) (err error) {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	ctx, span := tracing.Start(ctx, "apply peers", attribute.Int("peers", len(peers)))
+	defer func() { tracing.End(span, err) }()
+	_, diff := tracing.Start(ctx, "diff")
+	current, err := s.GetPeers()
+	if err != nil {
+		tracing.End(diff, err)
+		return errors.Wrapf(err, "Could not get peers of %s", s.iface)
+	}
+	configured := make(map[wgtypes.Key]*Peer, len(current))
+	for i := range current {
+		configured[current[i].PublicKey] = &current[i]
+	}
+	failed := make(PeerErrors)
 	config := make([]wgtypes.PeerConfig, 0, len(peers))
+	valid := make([]Peer, 0, len(peers))
 	for _, p := range peers {
-		if p.PublicKey != s.PublicKey {
-			config = append(config, p.toPeerConfig(s.OverlayNetwork))
+		if p.PublicKey == s.publicKey {
+			continue
+		}
+		if err := p.Validate(); err != nil {
+			failed[p.PublicKey] = err
+			continue
+		}
+		valid = append(valid, p)
+		if c, ok := configured[p.PublicKey]; ok && p.unchanged(c, s.overlay()) {
+			continue
+		}
+		wgLog.WithField("peer", p.PublicKey.String()).Debugf("Configuring peer with %s", describePeer(p))
+		pc := p.toPeerConfig(s.overlay())
+		if c, ok := configured[p.PublicKey]; ok && len(c.AllowedIPs) != 0 {
+			// Drop the routes the peer no longer has
+			pc.ReplaceAllowedIPs = true
+		}
+		config = append(config, pc)
+	}
+	diff.SetAttributes(attribute.Int("changed", len(config)))
+	diff.End()
+	total, started := len(config), time.Now()
+	logged := started
+	var stopped error
+	for len(config) > 0 {
+		if stopped = s.stopped.Err(); stopped != nil {
+			break
+		}
+		n := len(config)
+		if s.batch > 0 && n > s.batch {
+			n = s.batch
+		}
+		if s.limiter != nil && s.plan == nil {
+			if n > s.limiter.Burst() {
+				n = s.limiter.Burst()
+			}
+			if stopped = s.limiter.WaitN(s.stopped, n); stopped != nil {
+				break
+			}
+		}
+		_, configure := tracing.Start(ctx, "configure device", attribute.Int("peers", n))
+		if s.plan != nil {
+			s.planPeers(config[:n])
+		} else if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
+			Peers: config[:n],
+		}); err != nil {
+			configure.RecordError(err)
+			// Apply the peers one by one to find those the device refuses
+			for _, c := range config[:n] {
+				if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
+					Peers: []wgtypes.PeerConfig{c},
+				}); err != nil {
+					failed[c.PublicKey] = errors.Wrapf(err, "Could not set peer for %s", s.iface)
+				}
+			}
+		}
+		configure.End()
+		config = config[n:]
+		if len(config) != 0 && time.Since(logged) >= applyProgressInterval {
+			wgLog.Infof("Applied %d of %d peers to %s", total-len(config), total, s.iface)
+			logged = time.Now()
+		}
+	}
+	if logged != started {
+		wgLog.Infof("Applied %d peers to %s in %s", total-len(config), s.iface, time.Since(started).Round(time.Millisecond))
+	}
+	// Peers left over when stopped are not desired
+	pending := make(map[wgtypes.Key]bool, len(config))
+	for _, c := range config {
+		pending[c.PublicKey] = true
+	}
+	for _, p := range valid {
+		if _, ok := failed[p.PublicKey]; !ok && !pending[p.PublicKey] {
+			s.desired[p.PublicKey] = p
 		}
 	}
-	if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
+	s.routePeerNetworks()
+	if stopped != nil {
+		return errors.Wrapf(stopped, "Stopped applying peers to %s", s.iface)
+	}
+	if len(failed) != 0 {
+		return failed
+	}
+	return nil
+}
+
+// PeerErrors is returned by AddPeers when some peers could not be configured.
+// The other peers were configured.
+type PeerErrors map[wgtypes.Key]error
+
+func (e PeerErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for k, err := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", k, err))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("Could not configure %d peers: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// SetPeerEndpoint points an existing peer at the endpoint, if not nil, and sets
+// its keepalive. Setting a keepalive makes wireguard send one right away.
+func (s *State) SetPeerEndpoint(key wgtypes.Key, endpoint *net.UDPAddr, keepalive time.Duration) error {
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	config := []wgtypes.PeerConfig{{
+		PublicKey:                   key,
+		UpdateOnly:                  true,
+		Endpoint:                    endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+	}}
+	if s.plan != nil {
+		s.planPeers(config)
+	} else if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
+		Peers: config,
+	}); err != nil {
+		return errors.Wrapf(err, "Could not update peer %s", key)
+	}
+	if p, ok := s.desired[key]; ok {
+		if endpoint != nil {
+			p.IP, p.Port = endpoint.IP.String(), endpoint.Port
+		}
+		p.KeepaliveInterval = keepalive
+		s.desired[key] = p
+	}
+	return nil
+}
+
+// RemovePeers removes the peers from the device
+func (s *State) RemovePeers(keys []wgtypes.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	s.apply.Lock()
+	defer s.apply.Unlock()
+	config := make([]wgtypes.PeerConfig, 0, len(keys))
+	for _, k := range keys {
+		wgLog.WithField("peer", k.String()).Debug("Removing peer")
+		config = append(config, wgtypes.PeerConfig{PublicKey: k, Remove: true})
+	}
+	if s.plan != nil {
+		s.planPeers(config)
+	} else if err := s.client.ConfigureDevice(s.iface, wgtypes.Config{
 		Peers: config,
 	}); err != nil {
-		return errors.Wrapf(err, "Could not set peers for %s", s.iface)
+		return errors.Wrapf(err, "Could not remove peers from %s", s.iface)
+	}
+	for _, k := range keys {
+		delete(s.desired, k)
 	}
+	s.routePeerNetworks()
 	return nil
 }
 
-func fromWgtypesPeer(p *wgtypes.Peer) Peer {
+// fromWgtypesPeer converts a device peer. Host entries on the overlay networks
+// are its addresses, the other allowed IPs are kept as such.
+func fromWgtypesPeer(p *wgtypes.Peer, nets []net.IPNet) Peer {
 	peer := Peer{
 		PublicKey:         p.PublicKey,
 		PresharedKey:      p.PresharedKey,
@@ -177,17 +1161,85 @@ func fromWgtypesPeer(p *wgtypes.Peer) Peer {
 		peer.IP = p.Endpoint.IP.String()
 		peer.Port = p.Endpoint.Port
 	}
+	for _, a := range p.AllowedIPs {
+		if ones, bits := a.Mask.Size(); ones == bits && inNetworks(nets, a.IP) {
+			peer.Addresses = append(peer.Addresses, a.IP)
+		} else {
+			peer.AllowedIPs = append(peer.AllowedIPs, a)
+		}
+	}
 	return peer
 }
 
 func (s *State) GetPeers() ([]Peer, error) {
+	if s.plan != nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		peers := make([]Peer, 0, len(s.plan.peers))
+		for _, p := range s.plan.peers {
+			peers = append(peers, p)
+		}
+		return peers, nil
+	}
 	device, err := s.client.Device(s.iface)
 	if err != nil {
 		return nil, err
 	}
 	peers := make([]Peer, 0, len(device.Peers))
 	for _, p := range device.Peers {
-		peers = append(peers, fromWgtypesPeer(&p))
+		peers = append(peers, fromWgtypesPeer(&p, s.Networks()))
 	}
 	return peers, nil
 }
+
+// PeerStats is a configured peer with its endpoint as the device last saw it,
+// its last handshake and its traffic counters
+type PeerStats struct {
+	Peer
+	Endpoint      *net.UDPAddr
+	LastHandshake time.Time
+	RxBytes       int64
+	TxBytes       int64
+}
+
+// GetPeerStats returns the configured peers with their statistics, for the
+// status, the metrics and the health checks alike. During a dry run they have
+// none.
+func (s *State) GetPeerStats() ([]PeerStats, error) {
+	if s.plan != nil {
+		peers, err := s.GetPeers()
+		stats := make([]PeerStats, 0, len(peers))
+		for _, p := range peers {
+			stats = append(stats, PeerStats{Peer: p})
+		}
+		return stats, err
+	}
+	device, err := s.client.Device(s.iface)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]PeerStats, 0, len(device.Peers))
+	for i := range device.Peers {
+		p := &device.Peers[i]
+		stats = append(stats, PeerStats{
+			Peer:          fromWgtypesPeer(p, s.Networks()),
+			Endpoint:      p.Endpoint,
+			LastHandshake: p.LastHandshakeTime,
+			RxBytes:       p.ReceiveBytes,
+			TxBytes:       p.TransmitBytes,
+		})
+	}
+	return stats, nil
+}
+
+// ListenPort returns the UDP port the wireguard device is listening on
+func (s *State) ListenPort() (int, error) {
+	if s.plan != nil {
+		return s.port, nil
+	}
+	device, err := s.client.Device(s.iface)
+	if err != nil {
+		return 0, err
+	}
+	return device.ListenPort, nil
+}
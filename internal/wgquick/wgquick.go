@@ -0,0 +1,272 @@
+// Package wgquick reads and writes the configuration files of wg-quick
+package wgquick
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Config is an interface as wg-quick configures it
+type Config struct {
+	PrivateKey wgtypes.Key
+	ListenPort int
+	Addresses  []net.IPNet
+	MTU        int
+	FwMark     int
+	Peers      []Peer
+}
+
+// Peer is a [Peer] section
+type Peer struct {
+	PublicKey           wgtypes.Key
+	PresharedKey        wgtypes.Key
+	Endpoint            *net.UDPAddr
+	AllowedIPs          []net.IPNet
+	PersistentKeepalive time.Duration
+}
+
+// Keys that only wg-quick itself acts on
+var ignored = map[string]bool{
+	"dns": true, "table": true, "saveconfig": true,
+	"preup": true, "postup": true, "predown": true, "postdown": true,
+}
+
+// Parse reads a configuration. Keys that only concern wg-quick, such as DNS
+// and the hooks, are skipped.
+func Parse(r io.Reader) (*Config, error) {
+	var config Config
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				config.Peers = append(config.Peers, Peer{})
+			default:
+				return nil, errors.Errorf("Line %d: unknown section %s", n, line)
+			}
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, errors.Errorf("Line %d: expected key = value", n)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		var err error
+		switch section {
+		case "interface":
+			err = config.set(key, value)
+		case "peer":
+			err = config.Peers[len(config.Peers)-1].set(key, value)
+		default:
+			err = errors.New("key outside of a section")
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Line %d", n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if config.PrivateKey == (wgtypes.Key{}) {
+		return nil, errors.New("No private key in [Interface]")
+	}
+	for i, p := range config.Peers {
+		if p.PublicKey == (wgtypes.Key{}) {
+			return nil, errors.Errorf("No public key in peer %d", i+1)
+		}
+	}
+	return &config, nil
+}
+
+func (c *Config) set(key, value string) error {
+	var err error
+	switch key {
+	case "privatekey":
+		c.PrivateKey, err = wgtypes.ParseKey(value)
+	case "listenport":
+		c.ListenPort, err = strconv.Atoi(value)
+	case "address":
+		var nets []net.IPNet
+		nets, err = parseNetworks(value, false)
+		c.Addresses = append(c.Addresses, nets...)
+	case "mtu":
+		c.MTU, err = strconv.Atoi(value)
+	case "fwmark":
+		if value != "off" {
+			var mark uint64
+			mark, err = strconv.ParseUint(value, 0, 32)
+			c.FwMark = int(mark)
+		}
+	default:
+		if !ignored[key] {
+			return errors.Errorf("unknown key %s", key)
+		}
+	}
+	return err
+}
+
+func (p *Peer) set(key, value string) error {
+	var err error
+	switch key {
+	case "publickey":
+		p.PublicKey, err = wgtypes.ParseKey(value)
+	case "presharedkey":
+		p.PresharedKey, err = wgtypes.ParseKey(value)
+	case "endpoint":
+		p.Endpoint, err = net.ResolveUDPAddr("udp", value)
+	case "allowedips":
+		var nets []net.IPNet
+		nets, err = parseNetworks(value, true)
+		p.AllowedIPs = append(p.AllowedIPs, nets...)
+	case "persistentkeepalive":
+		if value != "off" {
+			var secs int
+			secs, err = strconv.Atoi(value)
+			p.PersistentKeepalive = time.Duration(secs) * time.Second
+		}
+	default:
+		return errors.Errorf("unknown key %s", key)
+	}
+	return err
+}
+
+// parseNetworks parses a comma separated list of addresses with optional
+// prefix lengths, which default to a single host. Allowed IPs are masked to
+// their network, interface addresses are not.
+func parseNetworks(value string, mask bool) ([]net.IPNet, error) {
+	var nets []net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %s", s)
+			}
+			if v4 := ip.To4(); v4 != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		ip, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		if !mask {
+			network.IP = ip
+		}
+		nets = append(nets, *network)
+	}
+	return nets, nil
+}
+
+// Write writes the configuration in the format Parse reads
+func Write(w io.Writer, c *Config) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[Interface]\nPrivateKey = %s\n", c.PrivateKey)
+	if c.ListenPort != 0 {
+		fmt.Fprintf(b, "ListenPort = %d\n", c.ListenPort)
+	}
+	if len(c.Addresses) != 0 {
+		fmt.Fprintf(b, "Address = %s\n", joinNetworks(c.Addresses))
+	}
+	if c.MTU != 0 {
+		fmt.Fprintf(b, "MTU = %d\n", c.MTU)
+	}
+	if c.FwMark != 0 {
+		fmt.Fprintf(b, "FwMark = %#x\n", c.FwMark)
+	}
+	for _, p := range c.Peers {
+		fmt.Fprintf(b, "\n[Peer]\nPublicKey = %s\n", p.PublicKey)
+		if p.PresharedKey != (wgtypes.Key{}) {
+			fmt.Fprintf(b, "PresharedKey = %s\n", p.PresharedKey)
+		}
+		if len(p.AllowedIPs) != 0 {
+			fmt.Fprintf(b, "AllowedIPs = %s\n", joinNetworks(p.AllowedIPs))
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(b, "Endpoint = %s\n", p.Endpoint)
+		}
+		if p.PersistentKeepalive != 0 {
+			fmt.Fprintf(b, "PersistentKeepalive = %d\n", int(p.PersistentKeepalive/time.Second))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func joinNetworks(nets []net.IPNet) string {
+	s := make([]string, len(nets))
+	for i := range nets {
+		s[i] = nets[i].String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Export reads the configuration of the interface from the device, with its
+// addresses and MTU
+func Export(iface string) (*Config, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not instantiate wireguard client")
+	}
+	defer client.Close()
+	device, err := client.Device(iface)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read interface %s", iface)
+	}
+	config := &Config{
+		PrivateKey: device.PrivateKey,
+		ListenPort: device.ListenPort,
+		FwMark:     device.FirewallMark,
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not find link %s", iface)
+	}
+	config.MTU = link.Attrs().MTU
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list addresses")
+	}
+	for _, a := range addrs {
+		if !a.IP.IsLinkLocalUnicast() {
+			config.Addresses = append(config.Addresses, *a.IPNet)
+		}
+	}
+	for _, p := range device.Peers {
+		config.Peers = append(config.Peers, Peer{
+			PublicKey:           p.PublicKey,
+			PresharedKey:        p.PresharedKey,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          p.AllowedIPs,
+			PersistentKeepalive: p.PersistentKeepaliveInterval,
+		})
+	}
+	return config, nil
+}
@@ -0,0 +1,72 @@
+package wgquick
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820
+Address = 10.0.0.1/24, fd00::1/64
+Address = 10.1.0.1/16 # a second line adds to the first
+MTU = 1280
+FwMark = 0xca6c0000
+DNS = 10.0.0.53
+PostUp = true
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.2/32, 192.168.1.7/24
+AllowedIPs = fd00::2
+Endpoint = 192.0.2.1:51820
+PersistentKeepalive = 25
+`
+
+func TestParseRoundTrip(t *testing.T) {
+	config, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := joinNetworks(config.Addresses), "10.0.0.1/24, fd00::1/64, 10.1.0.1/16"; got != want {
+		t.Errorf("Addresses = %s, want %s", got, want)
+	}
+	if config.FwMark != 0xca6c0000 {
+		t.Errorf("FwMark = %#x, want 0xca6c0000", config.FwMark)
+	}
+	if len(config.Peers) != 1 {
+		t.Fatalf("Got %d peers, want 1", len(config.Peers))
+	}
+	// Allowed IPs are masked to their network
+	if got, want := joinNetworks(config.Peers[0].AllowedIPs), "10.0.0.2/32, 192.168.1.0/24, fd00::2/128"; got != want {
+		t.Errorf("AllowedIPs = %s, want %s", got, want)
+	}
+
+	b := &strings.Builder{}
+	if err := Write(b, config); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("Could not parse written config: %v\n%s", err, b)
+	}
+	if !reflect.DeepEqual(config, again) {
+		t.Errorf("Config changed in a round trip:\n%+v\n%+v", config, again)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, config := range []string{
+		"[Interface]\nListenPort = 1\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nFwMark = 0x100000000\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.0.0.300\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n[Peer]\nAllowedIPs = 10.0.0.0/8\n",
+		"[Wireguard]\n",
+		"PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n",
+	} {
+		if _, err := Parse(strings.NewReader(config)); err == nil {
+			t.Errorf("Parsed invalid config:\n%s", config)
+		}
+	}
+}